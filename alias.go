@@ -0,0 +1,104 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Aliases, short names for targets given on the command line, declared with
+// 'alias name: target ...'.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// An alias for targets.
+type alias struct {
+	targets []string // targets the alias stands for
+	file    string   // file where the alias is declared
+	line    int      // line number on which it is declared
+	doc     string   // documentation given in ## comments before it
+}
+
+// Where the alias is declared, as file:line.
+func (a *alias) location() string {
+	return fmt.Sprintf("%s:%d", a.file, a.line)
+}
+
+// Declare an alias, given the tokens of its name and of its targets, which
+// are expanded as they are read.
+func (p *parser) alias(directive token, name token, targets []token) {
+	names, err := p.rules.expand(name.val, true)
+	if err != nil {
+		p.basicErrorAtToken(err.what, name)
+	}
+	if len(names) != 1 {
+		p.basicErrorAtToken("expected a single name after alias", name)
+	}
+	if old, ok := p.rules.aliases[names[0]]; ok {
+		p.basicErrorAtToken(fmt.Sprintf("alias %s is already declared at %s", names[0], old.location()), name)
+	}
+
+	a := alias{targets: make([]string, 0), file: p.name, line: directive.line, doc: directive.doc}
+	for _, t := range targets {
+		p.checkUnset(t.val, t.line, false)
+		parts, err := p.rules.expand(t.val, true)
+		if err != nil {
+			p.basicErrorAtToken(err.what, t)
+		}
+		for _, part := range parts {
+			a.targets = append(a.targets, mountedPath(p.rules.dir, unescapeName(part, false)))
+		}
+	}
+	if len(a.targets) == 0 {
+		p.basicErrorAtToken(fmt.Sprintf("expected targets for alias %s", names[0]), name)
+	}
+	p.rules.aliases[names[0]] = a
+}
+
+// Replace the aliases among the targets with the targets they stand for, and
+// those with theirs in turn, if they are aliases too.
+func (rs *ruleSet) resolveAliases(targets []string) []string {
+	resolved := make([]string, 0, len(targets))
+	var resolve func(name string, seen map[string]bool)
+	resolve = func(name string, seen map[string]bool) {
+		a, ok := rs.aliases[name]
+		if !ok || seen[name] {
+			resolved = append(resolved, name)
+			return
+		}
+		seen[name] = true
+		for _, t := range a.targets {
+			resolve(t, seen)
+		}
+		delete(seen, name)
+	}
+	for _, t := range targets {
+		resolve(t, make(map[string]bool))
+	}
+	return resolved
+}
+
+// The names of the aliases, sorted.
+func (rs *ruleSet) aliasNames() []string {
+	names := make([]string, 0, len(rs.aliases))
+	for name := range rs.aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,165 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// How a target gets its recipe when its rules give it different ones.
+type ambiguityPolicy int
+
+const (
+	ambiguousUnset    ambiguityPolicy = iota // as -ambiguous has it, or concrete
+	ambiguousConcrete                        // a rule that isn't a meta-rule beats those that are
+	ambiguousRecent                          // the rule defined last
+	ambiguousSpecific                        // the rule whose target pattern has the most literal text
+	ambiguousError                           // no recipe is picked
+)
+
+func (p *ambiguityPolicy) String() string {
+	switch *p {
+	case ambiguousRecent:
+		return "recent"
+	case ambiguousSpecific:
+		return "specific"
+	case ambiguousError:
+		return "error"
+	}
+	return "concrete"
+}
+
+func (p *ambiguityPolicy) Set(value string) error {
+	switch value {
+	case "concrete":
+		*p = ambiguousConcrete
+	case "recent":
+		*p = ambiguousRecent
+	case "specific":
+		*p = ambiguousSpecific
+	case "error":
+		*p = ambiguousError
+	default:
+		return fmt.Errorf("unknown policy %q, expected concrete, recent, specific or error", value)
+	}
+	return nil
+}
+
+// Pick the recipe of the rule's targets by a policy if their rules differ.
+func (r *rule) setAmbiguity(name string, value string) *attribError {
+	if err := r.ambiguity.Set(value); err != nil {
+		return &attribError{'a', err.Error()}
+	}
+	return nil
+}
+
+// The policy for a node whose rules give it different recipes: the first one
+// set with ambiguous= by a rule for its name, such as 'a.o:ambiguous=recent:',
+// or else by any of the meta-rules giving it a recipe, or that of -ambiguous.
+func (g *graph) ambiguityPolicy(u *node) ambiguityPolicy {
+	for _, k := range g.rs.targetRules[u.name] {
+		if r := &g.rs.rules[k]; r.ambiguity != ambiguousUnset {
+			return r.ambiguity
+		}
+	}
+	for _, e := range u.prereqs {
+		if e.r.ambiguity != ambiguousUnset {
+			return e.r.ambiguity
+		}
+	}
+	return g.opts.ambiguity
+}
+
+// Pick the edge whose rule a node's recipe comes from, among edges whose
+// rules give it different recipes, as the policy has it. Returns nil if none
+// is preferred, and otherwise why the one returned is.
+func (g *graph) resolveAmbiguity(u *node, recipes []*edge, policy ambiguityPolicy) (*edge, string) {
+	var best []*edge
+	var why string
+	switch policy {
+	case ambiguousError:
+		return nil, ""
+
+	case ambiguousRecent:
+		best = recipes[:1]
+		for _, e := range recipes[1:] {
+			if g.ruleIndex(e.r) > g.ruleIndex(best[0].r) {
+				best = []*edge{e}
+			}
+		}
+		why = "defined last"
+
+	case ambiguousSpecific:
+		most := -1
+		for _, e := range recipes {
+			if n := specificity(u.name, e.r); n > most {
+				best, most = []*edge{e}, n
+			} else if n == most {
+				best = append(best, e)
+			}
+		}
+		why = "with the most specific target"
+
+	default:
+		for _, e := range recipes {
+			if !e.r.isMeta {
+				best = append(best, e)
+			}
+		}
+		if len(best) == 0 {
+			best = recipes
+		}
+		why = "not of a meta-rule"
+	}
+
+	for _, e := range best[1:] {
+		if !e.r.equivRecipe(best[0].r) {
+			return nil, ""
+		}
+	}
+	return best[0], why
+}
+
+// The index of the rule in the rule set the graph is built from, which is
+// greater the later it's defined.
+func (g *graph) ruleIndex(r *rule) int {
+	for k := range g.rs.rules {
+		if &g.rs.rules[k] == r {
+			return k
+		}
+	}
+	return -1
+}
+
+// How specific the rule's targets are about the name: that of the most
+// specific of its patterns matching it. A rule that isn't a meta-rule is more
+// specific than any that is.
+func specificity(name string, r *rule) int {
+	if !r.isMeta {
+		return math.MaxInt32
+	}
+	n := 0
+	for i := range r.targets {
+		if s := r.targets[i].specificity(); s > n && r.targets[i].match(name) != nil {
+			n = s
+		}
+	}
+	return n
+}
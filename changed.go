@@ -0,0 +1,71 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Building just what a list of changed files affects, as a continuous
+// integration build might, given the output of git diff --name-only.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Read the names of changed files, one per line, from a file, or from the
+// standard input if the name is "-".
+func readChangedFiles(name string) ([]string, error) {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	changed := make([]string, 0)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			changed = append(changed, filepath.Clean(line))
+		}
+	}
+	return changed, scanner.Err()
+}
+
+// The targets in the graph that depend on any of the changed files, directly
+// or not, sorted.
+func (g *graph) affectedBy(changed []string) []string {
+	s := make(nodeSet)
+	for _, name := range changed {
+		if u, ok := g.nodes[name]; ok && u != g.root {
+			s[u] = true
+		}
+	}
+	names := make([]string, 0)
+	for u := range s.reach(g.dependents(), true) {
+		names = append(names, u.name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAffectedBy(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		for _, name := range []string{"a.c", "b.c", "c.c", "config.h"} {
+			writeFile(t, name, "")
+		}
+		writeFile(t, "changed", "./b.c\n\nunknown.c\n")
+		changed, err := readChangedFiles("changed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"b.c", "unknown.c"}; !reflect.DeepEqual(changed, want) {
+			t.Errorf("read changed files %q, want %q", changed, want)
+		}
+
+		rs := parse("all:V: p q\np: a.o b.o\n\tcc\nq: c.o\n\tcc\n%.o: %.c config.h\n\tcc\n",
+			"mkfile", dir+"/mkfile", make(map[string][]string))
+		rs.addRoot([]string{"all"})
+		g := buildgraph(rs, "", defaultBuildOptions())
+		if got, want := g.affectedBy(changed), []string{"all", "b.o", "p"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("affected %q, want %q", got, want)
+		}
+		if got := g.affectedBy([]string{"mkfile"}); len(got) > 0 {
+			t.Errorf("a file outside the graph affected %q", got)
+		}
+	})
+}
@@ -0,0 +1,193 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Probing for compilers and other tools, and writing what's found to
+// config.mk for mkfiles to include.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The file an include of which is configured automatically.
+const configureFile = "config.mk"
+
+// The first line of a file written by mk configure. Only files beginning with
+// it are configured again once stale, so that hand-written ones are left be.
+const configureHeader = "# written by mk configure, and again once stale"
+
+// Set by -n: configuring on inclusion doesn't write config.mk.
+var configureDryRun bool
+
+// Tools to probe for: the variable each is assigned to, and the programs that
+// may provide it, in order of preference. A variable set in the environment is
+// used as it is.
+var configureTools = []struct {
+	name       string
+	candidates []string
+}{
+	{"CC", []string{"cc", "gcc", "clang"}},
+	{"CXX", []string{"c++", "g++", "clang++"}},
+	{"AR", []string{"ar", "llvm-ar"}},
+	{"RANLIB", []string{"ranlib", "llvm-ranlib"}},
+	{"YACC", []string{"yacc", "byacc"}},
+	{"LEX", []string{"lex", "flex"}},
+	{"PKG_CONFIG", []string{"pkg-config", "pkgconf"}},
+}
+
+// Flags passed on from the environment, if set.
+var configureFlags = []string{"CFLAGS", "CXXFLAGS", "LDFLAGS"}
+
+// The variables whose values in the environment configuring depends on.
+func configureEnv() []string {
+	names := make([]string, 0, len(configureTools)+len(configureFlags))
+	for _, tool := range configureTools {
+		names = append(names, tool.name)
+	}
+	return append(names, configureFlags...)
+}
+
+// Probe for the tools, returning the assignments of config.mk.
+func probeTools() [][2]string {
+	assignments := make([][2]string, 0)
+	for _, tool := range configureTools {
+		if value := os.Getenv(tool.name); value != "" {
+			assignments = append(assignments, [2]string{tool.name, value})
+			continue
+		}
+		for _, candidate := range tool.candidates {
+			if path, err := exec.LookPath(candidate); err == nil {
+				assignments = append(assignments, [2]string{tool.name, path})
+				break
+			}
+		}
+	}
+	for _, name := range configureFlags {
+		if value := os.Getenv(name); value != "" {
+			assignments = append(assignments, [2]string{name, value})
+		}
+	}
+	return assignments
+}
+
+// Probe for the tools, returning what's found along with the content of
+// config.mk, which records the environment it was found in, making it stale
+// once changed.
+func configuration() ([][2]string, string) {
+	assignments := probeTools()
+	var b strings.Builder
+	fmt.Fprintln(&b, configureHeader)
+	for _, env := range configureEnv() {
+		fmt.Fprintf(&b, "# env %s=%s\n", env, os.Getenv(env))
+	}
+	for _, a := range assignments {
+		fmt.Fprintf(&b, "%s=%s\n", a[0], a[1])
+	}
+	return assignments, b.String()
+}
+
+// Probe for the tools and write what's found to the file.
+func configure(name string) ([][2]string, error) {
+	assignments, content := configuration()
+	return assignments, ioutil.WriteFile(name, []byte(content), 0644)
+}
+
+// True if the file is missing, or was written by mk configure and either
+// configured in a different environment or names a tool that's no longer
+// there.
+func configureStale(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	tools := make(map[string]bool)
+	for _, tool := range configureTools {
+		tools[tool.name] = true
+	}
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != configureHeader {
+		return false
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# env ") {
+			fields := strings.SplitN(strings.TrimPrefix(line, "# env "), "=", 2)
+			if len(fields) == 2 && os.Getenv(fields[0]) != fields[1] {
+				return true
+			}
+		} else if k := strings.IndexByte(line, '='); k > 0 && tools[line[:k]] {
+			if path := line[k+1:]; filepath.IsAbs(path) {
+				if _, err := os.Stat(path); err != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Configure config.mk before it's included, if it's missing or stale, unless
+// commands aren't being run while parsing. In a dry run the file isn't
+// written: its content is returned, along with true, to be parsed in its
+// place.
+func autoConfigure(filename string) (string, bool) {
+	if filepath.Base(filename) != configureFile || !configureStale(filename) {
+		return "", false
+	}
+	if _, reporting := parseExecutor.(parseReporter); reporting {
+		mkPrintError(fmt.Sprintf("mk: not configuring %s while parsing", filename))
+		return "", false
+	}
+	if configureDryRun {
+		mkPrintMessage(fmt.Sprintf("mk: configuring %s, without writing it in a dry run", filename))
+		_, content := configuration()
+		return content, true
+	}
+	mkPrintMessage(fmt.Sprintf("mk: configuring %s", filename))
+	if _, err := configure(filename); err != nil {
+		mkError(fmt.Sprintf("unable to write %s: %s", filename, err))
+	}
+	return "", false
+}
+
+// mk configure [-o file]: probe for tools and write config.mk.
+func configureCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk configure", flag.ExitOnError)
+	var output string
+	flags.StringVar(&output, "o", configureFile, "write the configuration to the given file")
+	flags.Parse(args)
+
+	assignments, err := configure(output)
+	if err != nil {
+		mkError(fmt.Sprintf("mk configure: %s", err))
+	}
+	for _, a := range assignments {
+		fmt.Printf("%s=%s\n", a[0], a[1])
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigure(t *testing.T) {
+	bin := t.TempDir()
+	for _, name := range []string{"gcc", "ar"} {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+	for _, name := range configureEnv() {
+		t.Setenv(name, "")
+	}
+	t.Setenv("CFLAGS", "-O2")
+
+	inDir(t, t.TempDir(), func() {
+		if !configureStale("config.mk") {
+			t.Error("a missing config.mk isn't stale")
+		}
+		autoConfigure("config.mk")
+		content, err := ioutil.ReadFile("config.mk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"\nCC=" + filepath.Join(bin, "gcc") + "\n", "\nAR=" + filepath.Join(bin, "ar") + "\n", "\nCFLAGS=-O2\n"} {
+			if !strings.Contains(string(content), want) {
+				t.Errorf("config.mk doesn't contain %q:\n%s", want, content)
+			}
+		}
+		if strings.Contains(string(content), "\nCXX=") {
+			t.Errorf("config.mk assigns CXX, which wasn't found:\n%s", content)
+		}
+		if configureStale("config.mk") {
+			t.Error("config.mk is stale right after configuring")
+		}
+
+		t.Setenv("CC", "clang")
+		if !configureStale("config.mk") {
+			t.Error("config.mk isn't stale once $CC changed")
+		}
+		t.Setenv("CC", "")
+		os.Remove(filepath.Join(bin, "ar"))
+		if !configureStale("config.mk") {
+			t.Error("config.mk isn't stale once ar is gone")
+		}
+
+		// a dry run parses the configuration without writing it
+		configureDryRun = true
+		defer func() { configureDryRun = false }()
+		rs := parse("<config.mk\n", "mkfile", "mkfile", make(map[string][]string))
+		if cc, _ := lookupVar(rs.vars, "CC"); len(cc) != 1 || cc[0] != filepath.Join(bin, "gcc") {
+			t.Errorf("CC = %q in a dry run, want %s", cc, filepath.Join(bin, "gcc"))
+		}
+		if after, _ := ioutil.ReadFile("config.mk"); string(after) != string(content) {
+			t.Errorf("config.mk was written in a dry run:\n%s", after)
+		}
+		configureDryRun = false
+
+		// hand-written configurations are never stale
+		handWritten := "PREFIX=/usr/local\nCC=/opt/cross/bin/cc\n"
+		writeFile(t, "config.mk", handWritten)
+		if configureStale("config.mk") {
+			t.Error("a hand-written config.mk is stale")
+		}
+		autoConfigure("config.mk")
+		if after, _ := ioutil.ReadFile("config.mk"); string(after) != handWritten {
+			t.Errorf("a hand-written config.mk was overwritten:\n%s", after)
+		}
+	})
+}
@@ -0,0 +1,367 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// A long-lived mk that builds on request, driven over HTTP with JSON, so that
+// editors and CI agents needn't start mk over for every build.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A build server for the mkfiles in the current directory.
+type daemon struct {
+	mkfiles      []string
+	includeDirs  []string
+	envOverrides bool
+	parses       parseCache    // the mkfile as it was last read
+	opts         *buildOptions // options every build starts from
+	metrics      *buildMetrics // counts of the builds done so far
+
+	building sync.Mutex    // held during a build, so there's one at a time
+	mutex    sync.Mutex    // exclusivity for the fields below
+	active   bool          // a build is under way
+	targets  []string      // targets of the current or last build
+	graph    *graph        // graph of the current or last build
+	stop     func()        // cancels the build under way
+	summary  *buildSummary // summary of the last build to finish
+}
+
+// Something reported as a build goes: a target finishing, and lastly the
+// build itself finishing.
+type buildEvent struct {
+	Target  string        `json:"target,omitempty"`
+	Status  string        `json:"status"`
+	Summary *buildSummary `json:"summary,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// A fatal error during a build, which stops the build but not the daemon.
+type daemonAbort struct{}
+
+func newDaemon(mkfiles []string, includeDirs []string, envOverrides bool, opts *buildOptions) *daemon {
+	d := &daemon{
+		mkfiles:      mkfiles,
+		includeDirs:  includeDirs,
+		envOverrides: envOverrides,
+		opts:         opts,
+		metrics:      &buildMetrics{},
+	}
+	opts.metrics = d.metrics
+	return d
+}
+
+// Build the targets, or the default ones if none are given, reading the
+// mkfile afresh if it has changed. Files stat'ed are remembered from one build
+// to the next, until invalidated.
+func (d *daemon) build(targets []string, progress progressFunc) (summary buildSummary, err error) {
+	d.building.Lock()
+	defer d.building.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(daemonAbort); !ok {
+				panic(r)
+			}
+			err = errors.New("the build stopped on an error; see the daemon's output")
+		}
+		d.mutex.Lock()
+		d.active = false
+		d.mutex.Unlock()
+	}()
+
+	rs, targets := d.parses.read(d.mkfiles, d.includeDirs, targets, d.envOverrides)
+	targets = rs.resolveAliases(targets)
+	if len(targets) == 0 {
+		targets = defaultTargets(rs, false)
+	}
+	if len(targets) == 0 {
+		return summary, errors.New("nothing to mk")
+	}
+	rs.addRoot(targets)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	opts := *d.opts
+	opts.ctx = ctx
+	opts.progress = progress
+	if opts.equalTime == equalTimeHash {
+		opts.hashes = loadHashStore(statePath(".mkhashes"))
+	}
+	opts.outputs = loadOutputStore(statePath(".mkoutputs"))
+	opts.tests = loadTestStore(statePath(".mktests"))
+	opts.inputs = loadInputStore(statePath(".mkinputs"))
+	opts.statuses = loadStatusStore(statePath(".mkstatus"))
+	g := buildgraph(rs, "", &opts)
+
+	d.mutex.Lock()
+	d.active, d.targets, d.graph, d.stop = true, targets, g, stop
+	d.mutex.Unlock()
+
+	start := time.Now()
+	mkRoot(g, &opts)
+	if !opts.dryRun {
+		g.removeIntermediates()
+	}
+	summary = g.summarize(start)
+	d.metrics.build(start, g.root.status != nodeStatusFailed)
+	if opts.hashes != nil {
+		if err := opts.hashes.save(); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to save hashes: %s", err))
+		}
+	}
+	if err := opts.outputs.save(); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to save outputs: %s", err))
+	}
+	if err := opts.inputs.save(); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to save inputs: %s", err))
+	}
+	if !opts.dryRun {
+		opts.statuses.recordGraph(g)
+		if err := opts.statuses.save(); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to save statuses: %s", err))
+		}
+	}
+	if opts.tests.ran() {
+		if err := opts.tests.save(); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to save test results: %s", err))
+		}
+	}
+
+	d.mutex.Lock()
+	d.summary = &summary
+	d.mutex.Unlock()
+	if g.root.status == nodeStatusFailed {
+		return summary, errors.New("the build failed")
+	}
+	return summary, nil
+}
+
+// Cancel the build under way, killing its recipes. It returns false if
+// there's no build to cancel.
+func (d *daemon) cancel() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.active {
+		return false
+	}
+	d.stop()
+	return true
+}
+
+// A target in the graph of the current or last build.
+type graphNode struct {
+	Target  string   `json:"target"`
+	Status  string   `json:"status"`
+	Rule    string   `json:"rule,omitempty"`
+	Prereqs []string `json:"prereqs"`
+}
+
+// The graph of the current or last build, ordered by target.
+func (d *daemon) nodes() []graphNode {
+	d.mutex.Lock()
+	g := d.graph
+	d.mutex.Unlock()
+	nodes := make([]graphNode, 0)
+	if g == nil {
+		return nodes
+	}
+	for _, u := range g.nodes {
+		if u == g.root {
+			continue
+		}
+		n := graphNode{Target: u.name, Prereqs: make([]string, 0)}
+		u.mutex.Lock()
+		n.Status = u.status.String()
+		u.mutex.Unlock()
+		for _, e := range u.prereqs {
+			if e.r != nil && n.Rule == "" {
+				n.Rule = e.r.location()
+			}
+			if e.v != nil {
+				n.Prereqs = append(n.Prereqs, e.v.name)
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Target < nodes[j].Target })
+	return nodes
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Decode a POST request's JSON body into v, replying with an error and
+// returning false if that can't be done. An empty body leaves v as it is.
+// Requests must be JSON, and not come from a web page elsewhere, which can only
+// make a browser send a POST of another type or with its own Origin.
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if media, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || media != "application/json" {
+		http.Error(w, "use Content-Type: application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "requests from other origins aren't accepted", http.StatusForbidden)
+			return false
+		}
+	}
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// The daemon's API:
+//
+//	POST /build       {"targets": [...]}: build, streaming events as JSON lines
+//	GET  /status      whether a build is under way, its targets and the last summary
+//	GET  /graph       the targets of the current or last build
+//	POST /cancel      cancel the build under way, killing its recipes
+//	POST /invalidate  {"paths": [...]}: files changed since they were stat'ed
+//	GET  /metrics     counters in the Prometheus text format
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Targets []string `json:"targets"`
+		}
+		if !readRequest(w, r, &req) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		var mutex sync.Mutex
+		enc := json.NewEncoder(w)
+		send := func(ev buildEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			enc.Encode(ev)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		// targets up to date may be looked at more than once
+		sent := make(map[string]nodeStatus)
+		summary, err := d.build(req.Targets, func(target string, status nodeStatus) {
+			mutex.Lock()
+			last, ok := sent[target]
+			sent[target] = status
+			mutex.Unlock()
+			if !ok || last != status {
+				send(buildEvent{Target: target, Status: status.String()})
+			}
+		})
+		if err != nil {
+			send(buildEvent{Status: "failed", Summary: &summary, Error: err.Error()})
+		} else {
+			send(buildEvent{Status: "done", Summary: &summary})
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		d.mutex.Lock()
+		status := struct {
+			Building bool          `json:"building"`
+			Targets  []string      `json:"targets"`
+			Summary  *buildSummary `json:"summary"`
+		}{d.active, d.targets, d.summary}
+		d.mutex.Unlock()
+		writeJSON(w, status)
+	})
+	mux.HandleFunc("/graph", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.nodes())
+	})
+	mux.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if readRequest(w, r, &struct{}{}) {
+			writeJSON(w, map[string]bool{"cancelled": d.cancel()})
+		}
+	})
+	mux.HandleFunc("/invalidate", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Paths []string `json:"paths"`
+		}
+		if readRequest(w, r, &req) {
+			d.opts.stats.invalidate(req.Paths)
+			writeJSON(w, map[string]int{"invalidated": len(req.Paths)})
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.metrics.write(w)
+	})
+	return mux
+}
+
+// mk daemon [-listen address] [-f mkfile] [options]: serve builds of the
+// mkfile until killed.
+func daemonCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk daemon", flag.ExitOnError)
+	var address string
+	opts := defaultBuildOptions()
+	mkfile := mkfileFlags(flags)
+	flags.StringVar(&address, "listen", "localhost:7380", "serve requests at the given address")
+	flags.IntVar(&opts.jobs, "p", 1, "maximum number of jobs to execute in parallel")
+	flags.IntVar(&opts.nice, "nice", 0, "run recipes at the given niceness, from 1 to 19")
+	flags.StringVar(&opts.cpus, "cpus", "", "run recipes on the listed CPUs, such as 0-3,8")
+	flags.BoolVar(&opts.keepGoing, "k", false, "keep building after a recipe fails")
+	flags.Parse(args)
+	checkSchedule(opts)
+	mkfiles := []string(mkfile.mkfiles)
+	if len(mkfiles) == 0 {
+		mkfiles = []string{defaultMkfile()}
+	}
+	for _, path := range mkfiles {
+		if path == "-" {
+			mkError("mk daemon: the mkfile can't be read from the standard input")
+		} else if _, err := os.Stat(path); err != nil {
+			mkError("no mkfile found")
+		}
+	}
+
+	// errors end the build they happen in, rather than the daemon
+	mkExit = func(int) { panic(daemonAbort{}) }
+
+	d := newDaemon(mkfiles, mkfile.includeDirs, mkfile.envOverrides, opts)
+	mkPrintMessage(fmt.Sprintf("mk: serving builds of %s at %s", strings.Join(mkfiles, " "), address))
+	if err := http.ListenAndServe(address, d.handler()); err != nil {
+		mkExit = os.Exit
+		mkError(fmt.Sprintf("mk daemon: %s", err))
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDaemon(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "b", "")
+		writeFile(t, "mkfile", "all:V: a\na: b\n\ttouch a\n")
+		opts := defaultBuildOptions()
+		opts.executor = &stubExecutor{}
+		server := httptest.NewServer(newDaemon([]string{"mkfile"}, nil, false, opts).handler())
+		defer server.Close()
+
+		resp, err := http.Post(server.URL+"/build", "application/json", strings.NewReader(`{"targets": ["all"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []buildEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var ev buildEvent
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, ev)
+		}
+		resp.Body.Close()
+		if len(events) != 3 {
+			t.Fatalf("got events %+v, want a, all and the build's end", events)
+		}
+		if events[0].Target != "a" || events[0].Status != "done" || events[1].Target != "all" {
+			t.Errorf("got events %+v, want a done, then all", events)
+		}
+		if end := events[2]; end.Status != "done" || end.Summary == nil || end.Summary.Rebuilt != 1 {
+			t.Errorf("build ended with %+v, want it done with a rebuilt", end)
+		}
+
+		var nodes []graphNode
+		resp, err = http.Get(server.URL + "/graph")
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&nodes)
+		resp.Body.Close()
+		want := []graphNode{
+			{"a", "done", "mkfile:2", []string{"b"}},
+			{"all", "uptodate", "mkfile:1", []string{"a"}},
+			{"b", "uptodate", "", []string{}},
+		}
+		if !reflect.DeepEqual(nodes, want) {
+			t.Errorf("got graph %+v, want %+v", nodes, want)
+		}
+
+		resp, err = http.Post(server.URL+"/cancel", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cancelled map[string]bool
+		json.NewDecoder(resp.Body).Decode(&cancelled)
+		resp.Body.Close()
+		if cancelled["cancelled"] {
+			t.Error("cancelled a build that had finished")
+		}
+
+		resp, err = http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, _ := readMetrics(resp.Body)
+		resp.Body.Close()
+		if metrics.builds != 1 || metrics.recipes != 1 {
+			t.Errorf("got %v builds and %v recipes, want 1 of each", metrics.builds, metrics.recipes)
+		}
+	})
+}
+
+func TestDaemonErrors(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "all:V: a c\na: b\n\ttouch a\nc:\n\ttouch c\n")
+		opts := defaultBuildOptions()
+		opts.executor = &stubExecutor{}
+		opts.keepGoing = true
+		server := httptest.NewServer(newDaemon([]string{"mkfile"}, nil, false, opts).handler())
+		defer server.Close()
+		oldExit := mkExit
+		mkExit = func(int) { panic(daemonAbort{}) }
+		defer func() { mkExit = oldExit }()
+
+		// b is missing, which fails a in the goroutine building it
+		resp, err := http.Post(server.URL+"/build", "application/json", strings.NewReader(`{"targets": ["all"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var end buildEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			json.Unmarshal(scanner.Bytes(), &end)
+		}
+		resp.Body.Close()
+		if end.Status == "done" {
+			t.Errorf("build ended with %+v, want it to fail", end)
+		}
+		resp, err = http.Get(server.URL + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		for _, req := range []struct {
+			contentType, origin string
+			want                int
+		}{
+			{"text/plain", "", http.StatusUnsupportedMediaType},
+			{"application/json", "https://example.com", http.StatusForbidden},
+			{"application/json", server.URL, http.StatusOK},
+		} {
+			r, _ := http.NewRequest(http.MethodPost, server.URL+"/cancel", nil)
+			r.Header.Set("Content-Type", req.contentType)
+			if req.origin != "" {
+				r.Header.Set("Origin", req.origin)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != req.want {
+				t.Errorf("POST with Content-Type %s and Origin %q: status %d, want %d",
+					req.contentType, req.origin, resp.StatusCode, req.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,135 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Formats mk env can print variables in.
+const (
+	envFormatShell = iota
+	envFormatJSON
+)
+
+// Quote a value so that sh reads it back as a single word.
+func shellValue(value string) string {
+	if value != "" && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=./,:@%") == "" {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// Print the named variables, or all of those not from the environment, in the
+// given format. Returns false if any of the named variables isn't set.
+func printEnv(out io.Writer, rs *ruleSet, names []string, format int) bool {
+	ok := true
+	if len(names) == 0 {
+		for name := range rs.vars {
+			if rs.origins[name] != originEnvironment {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	values := make(map[string][]string)
+	set := make([]string, 0, len(names))
+	for _, name := range names {
+		value, found := lookupVar(rs.vars, name)
+		if !found {
+			mkPrintError(fmt.Sprintf("mk: %s is not set", name))
+			ok = false
+			continue
+		}
+		values[name] = value
+		set = append(set, name)
+	}
+
+	switch format {
+	case envFormatJSON:
+		encoded, _ := json.MarshalIndent(values, "", "\t")
+		fmt.Fprintf(out, "%s\n", encoded)
+	default:
+		for _, name := range set {
+			fmt.Fprintf(out, "%s=%s\n", name, shellValue(strings.Join(values[name], " ")))
+		}
+	}
+	return ok
+}
+
+// Run 'mk env [options] [var=value] [VAR...]', printing the variables the
+// mkfile sets.
+func envCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk env", flag.ExitOnError)
+	var asJSON, asShell bool
+	mkfile := mkfileFlags(flags)
+	flags.BoolVar(&asJSON, "json", false, "print variables as a JSON object of lists of words")
+	flags.BoolVar(&asShell, "sh", false, "print variables as sh assignments (the default)")
+	flags.Parse(args)
+
+	if asJSON && asShell {
+		mkError("mk env: -json and -sh are mutually exclusive")
+	}
+	format := envFormatShell
+	if asJSON {
+		format = envFormatJSON
+	}
+
+	rs, names := mkfile.read(flags.Args())
+	if !printEnv(os.Stdout, rs, names, format) {
+		mkExit(1)
+	}
+	return true
+}
+
+// Print the words each expression expands to with the mkfile's variables, one
+// to a line.
+func printEval(out io.Writer, rs *ruleSet, exprs []string) {
+	for _, expr := range exprs {
+		words, err := expand(expr, rs.vars, true)
+		if err != nil {
+			mkError(fmt.Sprintf("mk eval: %s", err.what))
+		}
+		for _, word := range words {
+			fmt.Fprintln(out, word)
+		}
+	}
+}
+
+// Run 'mk eval [options] [var=value] expression...', printing what the
+// expressions expand to.
+func evalCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk eval", flag.ExitOnError)
+	mkfile := mkfileFlags(flags)
+	flags.Parse(args)
+
+	rs, exprs := mkfile.read(flags.Args())
+	if len(exprs) == 0 {
+		mkError("mk eval: no expression given")
+	}
+	printEval(os.Stdout, rs, exprs)
+	return true
+}
@@ -0,0 +1,401 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Snapshots of the environment and tools each build ran with, and comparing
+// them with 'mk envdiff'.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of builds whose snapshots are kept.
+const maxEnvSnapshots = 20
+
+// How long a tool gets to print its version.
+const toolVersionTimeout = 2 * time.Second
+
+// The environment and tools a build ran with. A log written with -log
+// begins with one, without the tools.
+type envSnapshot struct {
+	Version string                 `json:"mk"`
+	Started string                 `json:"started"`
+	Env     []string               `json:"env"`
+	Tools   map[string]toolVersion `json:"tools,omitempty"`
+}
+
+// Which program a tool is, and the first line it prints given --version, if
+// it can.
+type toolVersion struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	ModTime string `json:"modtime"`
+}
+
+// Read the snapshots in a file, oldest first, skipping lines that aren't
+// snapshots, such as the recipes of a log. A missing file holds none.
+func readEnvSnapshots(path string) ([]envSnapshot, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []envSnapshot{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	snapshots := make([]envSnapshot, 0)
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var snapshot envSnapshot
+		if err := dec.Decode(&snapshot); err == io.EOF {
+			return snapshots, nil
+		} else if err != nil {
+			return snapshots, err
+		}
+		if snapshot.Env != nil {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+}
+
+// The programs the rules' recipes run: their shells, and the tools mk
+// configure probes for, as the mkfile sets them.
+func ruleTools(rs *ruleSet) []string {
+	seen := make(map[string]bool)
+	tools := make([]string, 0)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			tools = append(tools, name)
+		}
+	}
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.recipe == "" {
+			continue
+		}
+		if len(r.shell) > 0 {
+			add(r.shell[0])
+		} else {
+			add("sh")
+		}
+	}
+	for _, tool := range configureTools {
+		if value, ok := rs.vars[tool.name]; ok && len(value) > 0 {
+			add(value[0])
+		}
+	}
+	sort.Strings(tools)
+	return tools
+}
+
+// Find the tool and its version. A tool unchanged since the previous
+// snapshot keeps the version found then, rather than being run again.
+func probeToolVersion(name string, previous map[string]toolVersion) (toolVersion, bool) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return toolVersion{}, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return toolVersion{}, false
+	}
+	tv := toolVersion{Path: path, ModTime: info.ModTime().UTC().Format(time.RFC3339)}
+	if old, ok := previous[name]; ok && old.Path == tv.Path && old.ModTime == tv.ModTime {
+		tv.Version = old.Version
+		return tv, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), toolVersionTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				tv.Version = line
+				break
+			}
+		}
+	}
+	return tv, true
+}
+
+// Record the environment, hashed, and the tools of the rules as those of a
+// build, in the given file, keeping the snapshots of the last few builds.
+func recordEnv(path string, rs *ruleSet, start time.Time) error {
+	snapshots, err := readEnvSnapshots(path)
+	if err != nil {
+		snapshots = []envSnapshot{}
+	}
+	var previous map[string]toolVersion
+	if len(snapshots) > 0 {
+		previous = snapshots[len(snapshots)-1].Tools
+	}
+
+	env := hashEnv(os.Environ())
+	snapshot := envSnapshot{
+		Version: version(),
+		Started: start.UTC().Format(time.RFC3339),
+		Env:     env,
+		Tools:   make(map[string]toolVersion),
+	}
+	for _, name := range ruleTools(rs) {
+		if tv, ok := probeToolVersion(name, previous); ok {
+			snapshot.Tools[name] = tv
+		}
+	}
+	snapshots = append(snapshots, snapshot)
+	if len(snapshots) > maxEnvSnapshots {
+		snapshots = snapshots[len(snapshots)-maxEnvSnapshots:]
+	}
+
+	return writeStateFile(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, snapshot := range snapshots {
+			if err := enc.Encode(snapshot); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Parts of the names of variables whose values are kept out of snapshots.
+var secretEnvNames = []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL"}
+
+// The prefix of the value a secret is replaced with in a snapshot.
+const redactedPrefix = "<redacted "
+
+// A value replaced by a hash, which still shows when it changes. Values
+// already replaced are left as they are.
+func redactValue(value string) string {
+	if strings.HasPrefix(value, redactedPrefix) {
+		return value
+	}
+	h := sha256.Sum256([]byte(value))
+	return redactedPrefix + hex.EncodeToString(h[:4]) + ">"
+}
+
+// The environment entries, sorted, with the values of those that look like
+// secrets replaced by a hash.
+func redactEnv(env []string) []string {
+	redacted := make([]string, len(env))
+	for i, elem := range env {
+		redacted[i] = elem
+		k := strings.IndexByte(elem, '=')
+		if k <= 0 {
+			continue
+		}
+		name := strings.ToUpper(elem[:k])
+		for _, secret := range secretEnvNames {
+			if strings.Contains(name, secret) {
+				redacted[i] = elem[:k+1] + redactValue(elem[k+1:])
+				break
+			}
+		}
+	}
+	sort.Strings(redacted)
+	return redacted
+}
+
+// The environment entries, sorted, with every value replaced by a hash, as
+// they're recorded in .mkenvs.
+func hashEnv(env []string) []string {
+	hashed := make([]string, 0, len(env))
+	for _, elem := range env {
+		if k := strings.IndexByte(elem, '='); k > 0 {
+			hashed = append(hashed, elem[:k+1]+redactValue(elem[k+1:]))
+		}
+	}
+	sort.Strings(hashed)
+	return hashed
+}
+
+// Split environment entries into a map of their values.
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, elem := range env {
+		if k := strings.IndexByte(elem, '='); k > 0 {
+			m[elem[:k]] = elem[k+1:]
+		}
+	}
+	return m
+}
+
+func (tv toolVersion) String() string {
+	if tv.Version == "" {
+		return tv.Path
+	}
+	return tv.Path + " " + tv.Version
+}
+
+// Print how the newer snapshot differs from the older, as lines removed and
+// added, returning false if they differ.
+func diffEnvSnapshots(out io.Writer, older, newer *envSnapshot) bool {
+	lines := make([]string, 0)
+	if older.Version != newer.Version {
+		lines = append(lines, "- mk "+older.Version, "+ mk "+newer.Version)
+	}
+
+	oldEnv, newEnv := envMap(older.Env), envMap(newer.Env)
+	names := make([]string, 0, len(oldEnv)+len(newEnv))
+	for name := range oldEnv {
+		names = append(names, name)
+	}
+	for name := range newEnv {
+		if _, ok := oldEnv[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldValue, inOld := oldEnv[name]
+		newValue, inNew := newEnv[name]
+		// a log records values that .mkenvs only has hashes of
+		if inOld && inNew && redactValue(oldValue) == redactValue(newValue) {
+			continue
+		}
+		if inOld {
+			lines = append(lines, "- "+name+"="+oldValue)
+		}
+		if inNew {
+			lines = append(lines, "+ "+name+"="+newValue)
+		}
+	}
+
+	tools := make([]string, 0, len(older.Tools)+len(newer.Tools))
+	for name := range older.Tools {
+		tools = append(tools, name)
+	}
+	for name := range newer.Tools {
+		if _, ok := older.Tools[name]; !ok {
+			tools = append(tools, name)
+		}
+	}
+	sort.Strings(tools)
+	for _, name := range tools {
+		oldTool, inOld := older.Tools[name]
+		newTool, inNew := newer.Tools[name]
+		if inOld && inNew && oldTool.Path == newTool.Path && oldTool.Version == newTool.Version {
+			continue
+		}
+		if inOld {
+			lines = append(lines, "- tool "+name+": "+oldTool.String())
+		}
+		if inNew {
+			lines = append(lines, "+ tool "+name+": "+newTool.String())
+		}
+	}
+
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return len(lines) == 0
+}
+
+// The snapshot an argument of mk envdiff names: "now" for the current
+// environment and the tools of the last build as they are now, n for the nth
+// last build, or a file, whose last snapshot is taken.
+func envSnapshotArg(arg string, snapshots []envSnapshot) (*envSnapshot, error) {
+	if arg == "now" {
+		env := hashEnv(os.Environ())
+		now := &envSnapshot{Version: version(), Env: env, Tools: make(map[string]toolVersion)}
+		if len(snapshots) > 0 {
+			for name := range snapshots[len(snapshots)-1].Tools {
+				if tv, ok := probeToolVersion(name, nil); ok {
+					now.Tools[name] = tv
+				}
+			}
+		}
+		return now, nil
+	}
+	if n, err := strconv.Atoi(arg); err == nil {
+		if n < 1 || n > len(snapshots) {
+			return nil, fmt.Errorf("%d builds are recorded, not %s", len(snapshots), arg)
+		}
+		return &snapshots[len(snapshots)-n], nil
+	}
+	fromFile, err := readEnvSnapshots(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(fromFile) == 0 {
+		return nil, fmt.Errorf("%s has no environment recorded", arg)
+	}
+	return &fromFile[len(fromFile)-1], nil
+}
+
+// Run 'mk envdiff [old [new]]', comparing the environments two builds ran
+// with.
+func envdiffCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk envdiff", flag.ExitOnError)
+	var toolsOnly bool
+	flags.BoolVar(&toolsOnly, "tools", false, "compare just the tools and the version of mk")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: mk envdiff [options] [old [new]]\n")
+		fmt.Fprintf(flags.Output(), "each of old and new is n for the nth last build, now, or a file\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 2 {
+		flags.Usage()
+		mkExit(2)
+	}
+
+	path := statePath(".mkenvs")
+	snapshots, err := readEnvSnapshots(path)
+	if err != nil {
+		mkError(fmt.Sprintf("mk envdiff: unable to read %s: %s", path, err))
+	}
+	operands := []string{"2", "1"}
+	if flags.NArg() == 1 {
+		operands = []string{flags.Arg(0), "1"}
+	} else if flags.NArg() == 2 {
+		operands = flags.Args()
+	}
+	older, err := envSnapshotArg(operands[0], snapshots)
+	if err != nil {
+		mkError(fmt.Sprintf("mk envdiff: %s", err))
+	}
+	newer, err := envSnapshotArg(operands[1], snapshots)
+	if err != nil {
+		mkError(fmt.Sprintf("mk envdiff: %s", err))
+	}
+	if toolsOnly {
+		older.Env, newer.Env = nil, nil
+	}
+	if !diffEnvSnapshots(os.Stdout, older, newer) {
+		mkExit(1)
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactEnv(t *testing.T) {
+	got := redactEnv([]string{"PATH=/bin", "GITHUB_TOKEN=abc", "aws_secret_access_key=x", "EMPTY="})
+	want := []string{"EMPTY=", "GITHUB_TOKEN=<redacted ba7816bf>", "PATH=/bin", "aws_secret_access_key=<redacted 2d711642>"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("redactEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestDiffEnvSnapshots(t *testing.T) {
+	older := &envSnapshot{
+		Version: "1.0",
+		Env:     []string{"A=1", "B=2", "C=3"},
+		Tools: map[string]toolVersion{
+			"cc": {Path: "/usr/bin/cc", Version: "cc 12"},
+			"sh": {Path: "/bin/sh"},
+		},
+	}
+	newer := &envSnapshot{
+		Version: "1.0",
+		Env:     []string{"A=1", "B=4", "D=5"},
+		Tools: map[string]toolVersion{
+			"cc": {Path: "/usr/bin/cc", Version: "cc 13"},
+			"sh": {Path: "/bin/sh", ModTime: "2024-01-01T00:00:00Z"},
+		},
+	}
+	var out strings.Builder
+	if diffEnvSnapshots(&out, older, newer) {
+		t.Errorf("diffEnvSnapshots() = true, want false")
+	}
+	want := "- B=2\n+ B=4\n- C=3\n+ D=5\n- tool cc: /usr/bin/cc cc 12\n+ tool cc: /usr/bin/cc cc 13\n"
+	if out.String() != want {
+		t.Errorf("diffEnvSnapshots() printed %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if !diffEnvSnapshots(&out, older, older) || out.String() != "" {
+		t.Errorf("diffEnvSnapshots() of a snapshot with itself printed %q", out.String())
+	}
+
+	// values logged in full are compared with the hashes of .mkenvs
+	hashed := &envSnapshot{Version: "1.0", Env: hashEnv([]string{"A=1", "B=4", "C=3"}), Tools: older.Tools}
+	out.Reset()
+	diffEnvSnapshots(&out, older, hashed)
+	if want := "- B=2\n+ B=" + redactValue("4") + "\n"; out.String() != want {
+		t.Errorf("diffEnvSnapshots() printed %q, want %q", out.String(), want)
+	}
+}
+
+func TestRecordEnv(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		rs := parse("CC=nosuchcc\nall:V:\n\techo all\n", "mkfile", "/mkfile", make(map[string][]string))
+		if got, want := ruleTools(rs), []string{"nosuchcc", "sh"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ruleTools() = %q, want %q", got, want)
+		}
+
+		// the snapshots of just the last few builds are kept
+		for i := 0; i < maxEnvSnapshots+2; i++ {
+			t.Setenv("MKENVTEST", fmt.Sprint(i))
+			if err := recordEnv(".mkenvs", rs, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		snapshots, err := readEnvSnapshots(".mkenvs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) != maxEnvSnapshots {
+			t.Fatalf("%d snapshots kept, want %d", len(snapshots), maxEnvSnapshots)
+		}
+		last := envMap(snapshots[len(snapshots)-1].Env)
+		if want := redactValue(fmt.Sprint(maxEnvSnapshots + 1)); last["MKENVTEST"] != want {
+			t.Errorf("last snapshot has MKENVTEST=%s, want %s", last["MKENVTEST"], want)
+		}
+		if info, err := os.Stat(".mkenvs"); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf(".mkenvs has mode %v, want it readable only by its owner", info.Mode())
+		}
+		if _, ok := snapshots[0].Tools["sh"]; !ok {
+			t.Errorf("snapshot lacks the shell: %v", snapshots[0].Tools)
+		}
+	})
+}
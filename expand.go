@@ -47,14 +47,92 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
+// Error expanding a word.
+type expandError struct {
+	what string
+}
+
+// The values of a deferred variable begin with this marker, followed by the
+// unexpanded words assigned to it.
+const deferredMarker = "\x00deferred"
+
+// Expansion with a set of variables. While deferred variables are being
+// expanded, each is expanded by an expander of its own, which knows what it's
+// nested within.
+type expander struct {
+	vars      map[string][]string
+	expanding []string // deferred variables being expanded, outermost first
+	depth     int      // how deeply the references being expanded are nested
+	dir       string   // directory backticks are run in, if not the current one
+}
+
+// Look up a variable, expanding it if its assignment was deferred. A deferred
+// variable whose expansion refers back to itself is a fatal error.
+func lookupVar(vars map[string][]string, name string) ([]string, bool) {
+	return (&expander{vars: vars}).lookup(name)
+}
+
+// Look up a variable, expanding it if its assignment was deferred.
+func (x *expander) lookup(name string) ([]string, bool) {
+	values, ok := x.vars[name]
+	if !ok || len(values) == 0 || values[0] != deferredMarker {
+		return values, ok
+	}
+
+	for i := range x.expanding {
+		if x.expanding[i] == name {
+			chain := append(append([]string{}, x.expanding[i:]...), name)
+			mkError(fmt.Sprintf("variable recursion: %s", strings.Join(chain, " -> ")))
+		}
+	}
+	inner := &expander{vars: x.vars, expanding: append(x.expanding[:len(x.expanding):len(x.expanding)], name),
+		depth: x.depth, dir: x.dir}
+
+	expanded := make([]string, 0)
+	for _, word := range values[1:] {
+		parts, err := inner.expand(word, true)
+		if err != nil {
+			continue
+		}
+		expanded = append(expanded, parts...)
+	}
+	return expanded, true
+}
+
+// The shell used to run commands while parsing: the value of $MKSHELL if set,
+// or sh.
+func mkShell(vars map[string][]string) (string, []string) {
+	return (&expander{vars: vars}).shell()
+}
+
+// The shell used to run commands. An untrusted mkfile's $MKSHELL is ignored,
+// since it could run anything.
+func (x *expander) shell() (string, []string) {
+	if restricted != nil {
+		return "sh", []string{}
+	}
+	shell, ok := x.lookup("MKSHELL")
+	if ok && len(shell) > 0 {
+		return shell[0], shell[1:]
+	}
+	return "sh", []string{}
+}
+
 // Expand a word. This includes substituting variables and handling quotes.
-func expand(input string, vars map[string][]string, expandBackticks bool) []string {
+func expand(input string, vars map[string][]string, expandBackticks bool) ([]string, *expandError) {
+	return (&expander{vars: vars}).expand(input, expandBackticks)
+}
+
+// Expand a word.
+func (x *expander) expand(input string, expandBackticks bool) ([]string, *expandError) {
 	parts := make([]string, 0)
 	expanded := ""
 	var i, j int
@@ -79,7 +157,11 @@ func expand(input string, vars map[string][]string, expandBackticks bool) []stri
 			expanded += out
 
 		case '"':
-			out, off = expandDoubleQuoted(input[i:], vars, expandBackticks)
+			var err *expandError
+			out, off, err = x.doubleQuoted(input[i:], expandBackticks)
+			if err != nil {
+				return nil, err
+			}
 			expanded += out
 
 		case '\'':
@@ -89,21 +171,25 @@ func expand(input string, vars map[string][]string, expandBackticks bool) []stri
 		case '`':
 			if expandBackticks {
 				var outParts []string
-				outParts, off = expandBackQuoted(input[i:], vars)
+				var err *expandError
+				outParts, off, err = x.backQuoted(input[i:])
+				if err != nil {
+					return nil, err
+				}
 				if len(outParts) > 0 {
 					outParts[0] = expanded + outParts[0]
 					expanded = outParts[len(outParts)-1]
 					parts = append(parts, outParts[:len(outParts)-1]...)
 				}
 			} else {
-				out = input
-				off = len(input)
+				out = "`" + input[i:]
+				off = len(input) - i
 				expanded += out
 			}
 
 		case '$':
 			var outParts []string
-			outParts, off = expandSigil(input[i:], vars)
+			outParts, off, _ = x.sigil(input[i:])
 			if len(outParts) > 0 {
 				firstPart := expanded + outParts[0]
 				if len(outParts) > 1 {
@@ -125,47 +211,56 @@ func expand(input string, vars map[string][]string, expandBackticks bool) []stri
 		parts = append(parts, expanded)
 	}
 
-	return parts
+	return parts, nil
 }
 
-// Expand following a '\\'
-func expandEscape(input string) (string, int) {
+// The character input begins with, along with its bytes as they are, so that
+// invalid UTF-8 is passed on unchanged rather than replaced. The bytes are
+// empty at the end of the input.
+func firstRune(input string) (rune, string) {
 	c, w := utf8.DecodeRuneInString(input)
+	return c, input[:w]
+}
+
+// Expand following a '\\'. A line continued within double quotes is joined
+// to the next, as in sh.
+func expandEscape(input string) (string, int) {
+	c, s := firstRune(input)
 	if c == '\t' || c == ' ' {
-		return string(c), w
+		return s, len(s)
+	} else if strings.HasPrefix(input, "\n") || strings.HasPrefix(input, "\r\n") {
+		return "", strings.IndexByte(input, '\n') + 1
 	}
-	return "\\" + string(c), w
+	return "\\" + s, len(s)
 }
 
 // Expand a double quoted string starting after a '\"'
-func expandDoubleQuoted(input string, vars map[string][]string, expandBackticks bool) (string, int) {
+func (x *expander) doubleQuoted(input string, expandBackticks bool) (string, int, *expandError) {
 	// find the first non-escaped "
 	j := 0
 	for {
-		j = strings.IndexAny(input[j:], "\"\\")
-		if j < 0 {
+		k := strings.IndexAny(input[j:], "\"\\")
+		if k < 0 {
 			break
 		}
+		j += k
 
 		c, w := utf8.DecodeRuneInString(input[j:])
-		j += w
-
 		if c == '"' {
-			return strings.Join(expand(input[:j], vars, expandBackticks), " "), (j + w)
+			parts, err := x.expand(input[:j], expandBackticks)
+			return strings.Join(parts, " "), (j + w), err
 		}
 
-		if c == '\\' {
-			if j+w < len(input) {
-				j += w
-				_, w := utf8.DecodeRuneInString(input[j:])
-				j += w
-			} else {
-				break
-			}
+		// skip the backslash and the character it escapes
+		j += w
+		if j >= len(input) {
+			break
 		}
+		_, w = utf8.DecodeRuneInString(input[j:])
+		j += w
 	}
 
-	return input, len(input)
+	return input, len(input), nil
 }
 
 // Expand a single quoted string starting after a '\''
@@ -177,48 +272,64 @@ func expandSingleQuoted(input string) (string, int) {
 	return input[:j], j + 1
 }
 
-// Expand something starting with at '$'.
-func expandSigil(input string, vars map[string][]string) ([]string, int) {
+// How deeply variable references may be nested within each other.
+const maxRefDepth = 16
+
+// Find the '}' closing a bracketed expansion, returning its index in input,
+// which follows the opening '{'. Returns -1 if there is no closing brace.
+func matchingBrace(input string) int {
+	depth := 1
+	for i, c := range input {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Expand something starting with at '$'. Returns false if it's left as it is,
+// not naming a variable that's set.
+func (x *expander) sigil(input string) ([]string, int, bool) {
 	c, w := utf8.DecodeRuneInString(input)
 	var offset int
 	var varname string
-	var namelist_pattern = regexp.MustCompile(`^\s*([^:]+)\s*:\s*([^%]*)%([^=]*)\s*=\s*([^%]*)%([^%]*)\s*`)
 
 	// escaping of "$" with "$$"
 	if c == '$' {
-		return []string{"$"}, 2
-		// match bracketed expansions: ${foo}, or ${foo:a%b=c%d}
+		return []string{"$"}, w, false
+		// match bracketed expansions: ${foo}, or ${foo:a%b=c%d:t}
 	} else if c == '{' {
-		j := strings.IndexRune(input[w:], '}')
-		if j < 0 {
-			return []string{"$" + input}, len(input)
+		j := matchingBrace(input[w:])
+		if j < 0 || x.depth >= maxRefDepth {
+			return []string{"$"}, 0, false
 		}
 		varname = input[w : w+j]
 		offset = w + j + 1
 
-		// is this a namelist?
-		mat := namelist_pattern.FindStringSubmatch(varname)
-		if mat != nil && isValidVarName(mat[1]) {
-			// ${varname:a%b=c%d}
-			varname = mat[1]
-			a, b, c, d := mat[2], mat[3], mat[4], mat[5]
-			values, ok := vars[varname]
-			if !ok {
-				return []string{}, offset
-			}
+		// computed names and patterns: ${${name}}, ${foo:%=$dir/%}
+		if strings.ContainsRune(varname, '$') {
+			inner := &expander{vars: x.vars, expanding: x.expanding, depth: x.depth + 1, dir: x.dir}
+			varname = inner.plainSigils(varname)
+		}
 
-			pat := regexp.MustCompile(strings.Join([]string{`^\Q`, a, `\E(.*)\Q`, b, `\E$`}, ""))
-			expanded_values := make([]string, len(values))
-			for i, value := range values {
-				value_match := pat.FindStringSubmatch(value)
-				if value_match != nil {
-					expanded_values[i] = strings.Join([]string{c, value_match[1], d}, "")
-				} else {
-					expanded_values[i] = value
+		// are there modifiers?
+		if k := strings.IndexRune(varname, ':'); k >= 0 {
+			name := strings.TrimSpace(varname[:k])
+			if name != "" && isValidVarName(name) {
+				values, ok := x.lookup(name)
+				if !ok {
+					return []string{}, offset, true
+				}
+				if values, ok = modify(values, strings.Split(varname[k+1:], ":")); ok {
+					return values, offset, true
 				}
 			}
-
-			return expanded_values, offset
 		}
 		// bare variables: $foo
 	} else {
@@ -237,54 +348,193 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 			varname = input[i:j]
 			offset = j
 		} else {
-			return []string{"$" + input}, len(input)
+			return []string{"$"}, 0, false
 		}
 	}
 
 	if isValidVarName(varname) {
-		varvals, ok := vars[varname]
+		varvals, ok := x.lookup(varname)
 		if ok {
-			return varvals, offset
+			return varvals, offset, true
 		} else {
-			return []string{"$" + input[:offset]}, offset
+			return []string{"$" + input[:offset]}, offset, false
 		}
 	}
 
-	return []string{"$" + input}, len(input)
+	return []string{"$" + input[:offset]}, offset, false
 }
 
-// Find and expand all sigils.
-func expandSigils(input string, vars map[string][]string) []string {
-	parts := make([]string, 0)
-	expanded := ""
-	for i := 0; i < len(input); {
-		j := strings.IndexRune(input[i:], '$')
-		if j < 0 {
-			expanded += input[i:]
-			break
+// Substitution modifier: a%b=c%d
+var namelistPattern = regexp.MustCompile(`^\s*([^%]*)%([^=]*)\s*=\s*([^%]*)%([^%]*)\s*$`)
+
+// Apply a chain of expansion modifiers to the values of a variable, returning
+// false if a modifier isn't recognized. Modifiers are:
+//
+//	a%b=c%d  replace values matching a%b with c%d
+//	h        directory part
+//	t        last path element
+//	r        everything but the extension
+//	e        extension, without the dot
+//	u, l     upper and lower case
+func modify(values []string, modifiers []string) ([]string, bool) {
+	for _, m := range modifiers {
+		var f func(string) string
+		switch strings.TrimSpace(m) {
+		case "h":
+			f = filepath.Dir
+		case "t":
+			f = filepath.Base
+		case "r":
+			f = func(v string) string { return strings.TrimSuffix(v, filepath.Ext(v)) }
+		case "e":
+			f = func(v string) string { return strings.TrimPrefix(filepath.Ext(v), ".") }
+		case "u":
+			f = strings.ToUpper
+		case "l":
+			f = strings.ToLower
+		default:
+			mat := namelistPattern.FindStringSubmatch(m)
+			if mat == nil {
+				return nil, false
+			}
+			a, b, c, d := mat[1], mat[2], mat[3], mat[4]
+			f = func(v string) string {
+				if len(v) >= len(a)+len(b) &&
+					strings.HasPrefix(v, a) && strings.HasSuffix(v, b) {
+					return c + v[len(a):len(v)-len(b)] + d
+				}
+				return v
+			}
 		}
 
-		ex, k := expandSigil(input[j+1:], vars)
-		if len(ex) > 0 {
-			ex[0] = expanded + ex[0]
-			expanded = ex[len(ex)-1]
-			parts = append(parts, ex[:len(ex)-1]...)
+		modified := make([]string, len(values))
+		for i := range values {
+			modified[i] = f(values[i])
 		}
-		i = k
+		values = modified
 	}
+	return values, true
+}
 
-	if len(expanded) > 0 {
-		parts = append(parts, expanded)
+// Find and expand all sigils in a recipe run by the shell, producing a flat
+// string. For sh and its kin, elements of list variables are quoted where they
+// would otherwise be split, so file names containing spaces survive. Within
+// quotes, as in "$prereq", they're joined with spaces, since they're already
+// one word, and so are they for other shells. Words spanning several lines,
+// such as those assigned by define, are fragments of script and are left
+// alone.
+func expandRecipeSigils(input string, vars map[string][]string, shell []string) string {
+	return (&expander{vars: vars}).recipeSigils(input, shell)
+}
+
+// Find and expand all sigils in a recipe run by the shell.
+func (x *expander) recipeSigils(input string, shell []string) string {
+	quote := isShLike(shell)
+	return x.flatSigils(input, func(words []string, quoted bool) string {
+		if quoted || !quote {
+			return strings.Join(words, " ")
+		}
+		joined := make([]string, len(words))
+		for i, word := range words {
+			if strings.ContainsRune(word, '\n') {
+				joined[i] = word
+			} else {
+				joined[i] = shellQuote(word)
+			}
+		}
+		return strings.Join(joined, " ")
+	})
+}
+
+// True if the shell quotes as sh does. No shell at all is sh.
+func isShLike(shell []string) bool {
+	if len(shell) == 0 {
+		return true
+	}
+	switch strings.TrimSuffix(filepath.Base(shell[0]), ".exe") {
+	case "sh", "ash", "bash", "dash", "ksh", "mksh", "zsh", "busybox":
+		return true
+	}
+	return false
+}
+
+// Find and expand all sigils, joining the elements of list variables with
+// spaces.
+func expandPlainSigils(input string, vars map[string][]string) string {
+	return (&expander{vars: vars}).plainSigils(input)
+}
+
+// Find and expand all sigils, joining list variables with spaces.
+func (x *expander) plainSigils(input string) string {
+	return x.flatSigils(input, func(words []string, quoted bool) string {
+		return strings.Join(words, " ")
+	})
+}
+
+// Split a value into words at spaces and tabs outside quotes, removing the
+// quotes and escapes as expand does, so that "a b" c is two words. Variables
+// aren't substituted.
+func splitWords(input string) []string {
+	words := make([]string, 0)
+	start, quote := -1, byte(0)
+	for i := 0; i <= len(input); i++ {
+		if i == len(input) || quote == 0 && (input[i] == ' ' || input[i] == '\t') {
+			if start >= 0 {
+				parts, _ := expand(input[start:i], nil, false)
+				words = append(words, parts...)
+				start = -1
+			}
+			continue
+		}
+
+		if start < 0 {
+			start = i
+		}
+		switch c := input[i]; {
+		case c == '\\' && quote != '\'' && i+1 < len(input):
+			i++
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
+		}
 	}
+	return words
+}
 
-	return parts
+// Quote a word for sh unless it consists only of characters sh takes
+// literally.
+func shellQuote(word string) string {
+	safe := word != ""
+	for _, c := range word {
+		if !(c < utf8.RuneSelf && (unicode.IsLetter(c) || unicode.IsDigit(c)) || strings.ContainsRune("_@%+=:,./-", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
 }
 
-// Find and expand all sigils in a recipe, producing a flat string.
-func expandRecipeSigils(input string, vars map[string][]string) string {
+// Join words into a string that sh will split back into the same words.
+func shellJoin(words []string) string {
+	quoted := make([]string, len(words))
+	for i := range words {
+		quoted[i] = shellQuote(words[i])
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Find and expand all sigils, flattening list variables with join, which is
+// told whether the sigil is within quotes. Quotes are taken to end with the
+// line, so that an apostrophe in a comment or here-document affects only it.
+func (x *expander) flatSigils(input string, join func(words []string, quoted bool) string) string {
 	expanded := ""
+	var quote rune // the quote the input is within, if any
 	for i := 0; i < len(input); {
-		off := strings.IndexAny(input[i:], "$\\")
+		off := strings.IndexAny(input[i:], "$\\'\"\n")
 		if off < 0 {
 			expanded += input[i:]
 			break
@@ -293,20 +543,32 @@ func expandRecipeSigils(input string, vars map[string][]string) string {
 		i += off
 
 		c, w := utf8.DecodeRuneInString(input[i:])
-		if c == '$' {
+		if c == '\'' || c == '"' || c == '\n' {
+			if c == '\n' || c == quote {
+				quote = 0
+			} else if quote == 0 {
+				quote = c
+			}
+			expanded += string(c)
 			i += w
-			ex, k := expandSigil(input[i:], vars)
-			expanded += strings.Join(ex, " ")
+		} else if c == '$' {
+			i += w
+			ex, k, ok := x.sigil(input[i:])
+			if ok {
+				expanded += join(ex, quote != 0)
+			} else {
+				expanded += strings.Join(ex, " ")
+			}
 			i += k
 		} else if c == '\\' {
 			i += w
-			c, w := utf8.DecodeRuneInString(input[i:])
+			c, s := firstRune(input[i:])
 			if c == '$' {
 				expanded += "$"
 			} else {
-				expanded += "\\" + string(c)
+				expanded += "\\" + s
 			}
-			i += w
+			i += len(s)
 		}
 	}
 
@@ -322,19 +584,19 @@ func expandSuffixes(input string, stem string) string {
 			expanded = append(expanded, input[i:]...)
 			break
 		}
+		j += i
 
-		c, w := utf8.DecodeRuneInString(input[j:])
+		// both are single bytes, which can't be part of a multibyte character
 		expanded = append(expanded, input[i:j]...)
-		if c == '%' {
+		if input[j] == '%' {
 			expanded = append(expanded, stem...)
-			i = j + w
+			i = j + 1
+		} else if strings.HasPrefix(input[j+1:], "%") {
+			expanded = append(expanded, '%')
+			i = j + 2
 		} else {
-			j += w
-			c, w := utf8.DecodeRuneInString(input[j:])
-			if c == '%' {
-				expanded = append(expanded, '%')
-				i = j + w
-			}
+			expanded = append(expanded, '\\')
+			i = j + 1
 		}
 	}
 
@@ -342,21 +604,24 @@ func expandSuffixes(input string, stem string) string {
 }
 
 // Expand a backtick quoted string, by executing the contents.
-func expandBackQuoted(input string, vars map[string][]string) ([]string, int) {
-	// TODO: expand sigils?
+func (x *expander) backQuoted(input string) ([]string, int, *expandError) {
 	j := strings.Index(input, "`")
 	if j < 0 {
-		return []string{input}, len(input)
+		return []string{input}, len(input), nil
 	}
 
-	// TODO: handle errors
-	output, _ := subprocess("sh", nil, input[:j], true)
+	sh, args := x.shell()
+	command := x.recipeSigils(input[:j], append([]string{sh}, args...))
+	output, err := runParseCommand(sh, args, x.dir, command)
+	if err != nil {
+		return nil, j + 1, &expandError{fmt.Sprintf("backtick command failed (%s): `%s`", err, command)}
+	}
 
 	parts := make([]string, 0)
-	_, tokens := lexWords(output)
-	for t := range tokens {
+	l := lexWords(output)
+	for t, ok := l.nextToken(); ok; t, ok = l.nextToken() {
 		parts = append(parts, t.val)
 	}
 
-	return parts, j + 1
+	return parts, j + 1, nil
 }
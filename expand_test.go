@@ -0,0 +1,247 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	vars := map[string][]string{
+		"a":     {"x", "y"},
+		"b":     {"z"},
+		"π":     {"pi"},
+		"src":   {"lib/a.c", "lib/sub/b.C"},
+		"which": {"b"},
+		"b_b":   {"nested"},
+		"meta":  {"a.(c)", "ab.c", `a\E*`},
+	}
+
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"plain", []string{"plain"}},
+		{"$a", []string{"x", "y"}},
+		{"pre$b.o", []string{"prez.o"}},
+		{"${a}", []string{"x", "y"}},
+		{"${a:%=%.o}", []string{"x.o", "y.o"}},
+		{"'$a'", []string{"$a"}},
+		{"\"$a\"", []string{"x y"}},
+		{"$$", []string{"$"}},
+		{"$undefined", []string{"$undefined"}},
+		{"$$b", []string{"$b"}},
+		{"${src:t}", []string{"a.c", "b.C"}},
+		{"${src:h}", []string{"lib", "lib/sub"}},
+		{"${src:e}", []string{"c", "C"}},
+		{"${src:r:t}", []string{"a", "b"}},
+		{"${src:t:%.c=%.o:u}", []string{"A.O", "B.C"}},
+		{"${src:l:%.c=%.o}", []string{"lib/a.o", "lib/sub/b.o"}},
+		{"${src:z}", []string{"${src:z}"}},
+		{"${${which}}", []string{"z"}},
+		{"${b_${which}}", []string{"nested"}},
+		{"${src:t:%.c=$b/%.o}", []string{"z/a.o", "b.C"}},
+		{"${${${${${${${${${${${${${${${${${b}}}}}}}}}}}}}}}}}", []string{"${${${${${${${${${${${${${${${${${b}}}}}}}}}}}}}}}}}"}},
+		{"${b:%=%{{{{{{{{{{{{{{{{{}}}}}}}}}}}}}}}}}}", []string{"z{{{{{{{{{{{{{{{{{}}}}}}}}}}}}}}}}}"}},
+		{"$(b)$b", []string{"$(b)z"}},
+		{"$π", []string{"pi"}},
+		{"ü$b.ö", []string{"üz.ö"}},
+		{"${π:%=%ü}", []string{"piü"}},
+		{"'é $a' \"ß$b\"", []string{"é $a ßz"}},
+		{"a\\ b", []string{"a b"}},
+		{"日\\本", []string{"日\\本"}},
+		{"trailing\\", []string{"trailing\\"}},
+		{"bad\\\xff$b", []string{"bad\\\xffz"}},
+		{"\xfe$b\xff", []string{"\xfez\xff"}},
+		{"\"unterminated $b", []string{"unterminated $b"}},
+		{"'unterminated $b", []string{"unterminated $b"}},
+		{"x`ls $b`", []string{"x`ls $b`"}},
+		{"$", []string{"$"}},
+		{"a$", []string{"a$"}},
+		{"${b", []string{"${b"}},
+		{"${}", []string{"${}"}},
+		{"$1", []string{"$1"}},
+		{"\"a\\\" $b\"", []string{"a\\\" z"}},
+		{"\"a\\\\\"$b", []string{"a\\\\z"}},
+		{"${meta:a.%=b%}", []string{"b(c)", "ab.c", `a\E*`}},
+		{"${meta:a\\E%=%}", []string{"a.(c)", "ab.c", "*"}},
+	}
+
+	for _, test := range tests {
+		got, _ := expand(test.input, vars, false)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expand(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestExpandBackticks(t *testing.T) {
+	oldExecutor := parseExecutor
+	defer func() { parseExecutor = oldExecutor }()
+	x := &stubExecutor{output: "a b\n"}
+	parseExecutor = x
+
+	vars := map[string][]string{"dir": {"src"}}
+	got, err := expand("pre`ls $dir`", vars, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.what)
+	}
+	if !reflect.DeepEqual(got, []string{"prea", "b"}) {
+		t.Errorf("expanded to %q, want [prea b]", got)
+	}
+	if !reflect.DeepEqual(x.inputs, []string{"ls src"}) {
+		t.Errorf("executed %q, want [ls src]", x.inputs)
+	}
+
+	x.fail = true
+	if _, err := expand("`false`", vars, true); err == nil {
+		t.Errorf("failing backtick command expanded without error")
+	}
+}
+
+func TestExpandRecipeSigils(t *testing.T) {
+	vars := map[string][]string{
+		"target": {"a.o"},
+		"prereq": {"a.c", "a.h"},
+		"files":  {"my file.c", "it's"},
+		"list":   {"a b", "c"},
+		"odd":    {"$HOME", "*.c", "a;b", "", "x\ny"},
+	}
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"cc -o $target $prereq", "cc -o a.o a.c a.h"},
+		{"echo \\$target", "echo $target"},
+		{"echo ${target}", "echo a.o"},
+		{"ls $files", `ls 'my file.c' 'it'\''s'`},
+		{"echo $(pwd) $target", "echo $(pwd) a.o"},
+		{"echo ü$target日 ü${target}日", "echo ü$target日 üa.o日"},
+		{"echo \\\xff$target \\", "echo \\\xffa.o \\"},
+		{"echo \\ü\\", "echo \\ü\\"},
+		{"printf '%s\\n' ${prereq:%.c=%.ö}", "printf '%s\\n' 'a.ö' a.h"},
+		{"echo $odd $$x", "echo '$HOME' '*.c' 'a;b' '' x\ny $x"},
+		{"ls $list \"$list\" '$list'", "ls 'a b' c \"a b c\" 'a b c'"},
+		{"echo \"x $list\" $list", "echo \"x a b c\" 'a b' c"},
+		{"echo \\\"$list\\\"", "echo \\\"'a b' c\\\""},
+		{"# don't\necho $list", "# don't\necho 'a b' c"},
+		{"echo \"it's $list\"", "echo \"it's a b c\""},
+	}
+
+	for _, test := range tests {
+		got := expandRecipeSigils(test.input, vars, nil)
+		if got != test.want {
+			t.Errorf("expandRecipeSigils(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+
+	// only sh and its kin get the words quoted
+	if got := expandRecipeSigils("ls $files", vars, []string{"/bin/bash", "-e"}); got != `ls 'my file.c' 'it'\''s'` {
+		t.Errorf("expanded for bash to %q", got)
+	}
+	if got := expandRecipeSigils("print $files", vars, []string{"python3", "-"}); got != "print my file.c it's" {
+		t.Errorf("expanded for python3 to %q", got)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", []string{}},
+		{"a  b\tc", []string{"a", "b", "c"}},
+		{"\"a b\" c", []string{"a b", "c"}},
+		{"'x \"y' z\\ w", []string{"x \"y", "z w"}},
+		{"-DX=\"1 2\" $HOME", []string{"-DX=1 2", "$HOME"}},
+		{"C:\\src 'ü ö'", []string{"C:\\src", "ü ö"}},
+	}
+
+	for _, test := range tests {
+		if got := splitWords(test.input); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitWords(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestExpandSuffixes(t *testing.T) {
+	tests := []struct {
+		input string
+		stem  string
+		want  string
+	}{
+		{"%.c", "foo", "foo.c"},
+		{"src/%.c", "foo", "src/foo.c"},
+		{"none", "foo", "none"},
+		{"\\%.%", "foo", "%.foo"},
+		{"a\\b/%", "foo", "a\\b/foo"},
+		{"ü/%.ö", "日本", "ü/日本.ö"},
+		{"\xff%\xfe", "x", "\xffx\xfe"},
+		{"%\\", "x", "x\\"},
+		{"\\\\%", "x", "\\%"},
+	}
+
+	for _, test := range tests {
+		got := expandSuffixes(test.input, test.stem)
+		if got != test.want {
+			t.Errorf("expandSuffixes(%q, %q) = %q, want %q", test.input, test.stem, got, test.want)
+		}
+	}
+}
+
+func BenchmarkExpand(b *testing.B) {
+	vars := map[string][]string{
+		"CFLAGS": {"-O2", "-Wall", "-Wextra"},
+		"objs":   {"a.o", "b.o", "c.o", "d.o"},
+	}
+	for i := 0; i < b.N; i++ {
+		expand("\"$CFLAGS\" ${objs:%.o=%.c} pre$objs", vars, false)
+	}
+}
+
+func BenchmarkExpandRecipeSigils(b *testing.B) {
+	vars := map[string][]string{
+		"target": {"prog"},
+		"prereq": {"a.o", "b.o", "c.o", "d.o"},
+		"CC":     {"cc"},
+	}
+	for i := 0; i < b.N; i++ {
+		expandRecipeSigils("$CC -o $target $prereq\n\\$HOME ${target}.map\n", vars, nil)
+	}
+}
+
+func FuzzExpand(f *testing.F) {
+	f.Add("$a")
+	f.Add("pre${a:%=%.o}post")
+	f.Add("\"$a\" '$b' `c` \\$")
+	f.Add("${")
+	f.Fuzz(func(t *testing.T, input string) {
+		vars := map[string][]string{
+			"a": {"x", "y"},
+			"b": {"z"},
+		}
+		sandboxed(func() {
+			expand(input, vars, true)
+			expandRecipeSigils(input, vars, nil)
+			expandSuffixes(input, "stem")
+		})
+	})
+}
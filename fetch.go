@@ -0,0 +1,244 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Fetching prerequisites named by URLs into a cache directory.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache directory used when $MKCACHE isn't set.
+const defaultCacheDir = ".mkcache"
+
+// True if a prerequisite is a URL to be fetched rather than a file.
+func isURL(name string) bool {
+	for _, scheme := range []string{"http://", "https://", "git://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// The file a URL is fetched into, within the cache directory, along with the
+// SHA-256 the URL's #sha256= fragment, if any, says it should have.
+func fetchPath(cache string, rawurl string) (string, string) {
+	checksum := ""
+	if k := strings.Index(rawurl, "#sha256="); k >= 0 {
+		checksum = strings.ToLower(rawurl[k+len("#sha256="):])
+		rawurl = rawurl[:k]
+	}
+
+	key := sha256.Sum256([]byte(rawurl))
+	base := "download"
+	if u, err := url.Parse(rawurl); err == nil {
+		if b := path.Base(u.Path); b != "." && b != "/" {
+			base = b
+		}
+		if u.Scheme == "git" {
+			base = strings.TrimSuffix(base, ".git")
+		}
+	}
+	return filepath.Join(cache, "fetch", hex.EncodeToString(key[:8]), base), checksum
+}
+
+// Replace a rule's URL prerequisites with the files they are fetched into,
+// adding a rule to fetch each file unless there already is one.
+func (p *parser) addFetchRules(r *rule) {
+	cache := defaultCacheDir
+	if dir, ok := lookupVar(p.rules.vars, "MKCACHE"); ok && len(dir) > 0 {
+		cache = dir[0]
+	}
+	if restricted != nil && !restricted.inWorkspace(cache) {
+		p.basicErrorAtLine(fmt.Sprintf("restricted: the cache %s is outside the workspace", cache), r.line)
+	}
+
+	for i, prereq := range r.prereqs {
+		if !isURL(prereq) {
+			continue
+		}
+		target, checksum := fetchPath(cache, prereq)
+		r.prereqs[i] = target
+		if _, ok := p.rules.targetRules[target]; ok {
+			continue
+		}
+		if checksum != "" && (!isChecksum(checksum) || strings.HasPrefix(prereq, "git://")) {
+			p.basicErrorAtLine(fmt.Sprintf("expected a SHA-256 in hex after #sha256= in %s", prereq), r.line)
+		}
+
+		f := rule{file: r.file, path: r.path, line: r.line, checksum: checksum}
+		f.targets = []pattern{{spat: target}}
+		f.url = strings.SplitN(prereq, "#sha256=", 2)[0]
+		p.rules.add(f)
+	}
+}
+
+// Fetch the target of a rule with a URL, revalidating what was fetched before.
+// Returns whether the target changed and whether fetching succeeded.
+func fetch(target string, r *rule, opts *buildOptions) (bool, bool) {
+	mkPrintMessage(fmt.Sprintf("fetch %s", r.url))
+	if opts.dryRun {
+		return true, true
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		mkPrintError(fmt.Sprintf("mk: %s", err))
+		return false, false
+	}
+	if strings.HasPrefix(r.url, "git://") {
+		return fetchGit(target, r, opts)
+	}
+	return fetchHTTP(opts.ctx, target, r)
+}
+
+// Download a file over HTTP, asking the server to send it only if it changed
+// since the last download. It's installed only once it's complete and matches
+// the rule's checksum, if any. If the server can't be reached, or fails, what
+// was downloaded before is used, with a warning.
+func fetchHTTP(ctx context.Context, target string, r *rule) (bool, bool) {
+	req, err := http.NewRequestWithContext(ctx, "GET", r.url, nil)
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: %s", err))
+		return false, false
+	}
+
+	// validators of the last download are kept beside it
+	validators := filepath.Join(filepath.Dir(target), ".validators")
+	_, err = os.Stat(target)
+	cached := err == nil
+	if cached {
+		if content, err := ioutil.ReadFile(validators); err == nil {
+			for _, line := range strings.Split(string(content), "\n") {
+				if fields := strings.SplitN(line, ": ", 2); len(fields) == 2 {
+					req.Header.Set(fields[0], fields[1])
+				}
+			}
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if cached && ctx.Err() == nil {
+			return fetchedBefore(target, r, err.Error())
+		}
+		mkPrintError(fmt.Sprintf("mk: %s", err))
+		return false, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return fetchedBefore(target, r, "")
+	}
+	if cached && resp.StatusCode >= 500 {
+		return fetchedBefore(target, r, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		mkPrintError(fmt.Sprintf("mk: fetching %s: %s", r.url, resp.Status))
+		return false, false
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".fetch")
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: %s", err))
+		return false, false
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: fetching %s: %s", r.url, err))
+		return false, false
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); r.checksum != "" && got != r.checksum {
+		mkPrintError(fmt.Sprintf("mk: checksum mismatch for %s: expected %s, got %s", r.url, r.checksum, got))
+		return false, false
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		mkPrintError(fmt.Sprintf("mk: %s", err))
+		return false, false
+	}
+
+	saved := ""
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		saved += "If-None-Match: " + etag + "\n"
+	}
+	if modified := resp.Header.Get("Last-Modified"); modified != "" {
+		saved += "If-Modified-Since: " + modified + "\n"
+	}
+	ioutil.WriteFile(validators, []byte(saved), 0644)
+	return true, true
+}
+
+// Use what was downloaded before, if it still matches the rule's checksum, with
+// a warning about why it wasn't downloaded again, if anything went wrong.
+func fetchedBefore(target string, r *rule, failure string) (bool, bool) {
+	if r.checksum != "" {
+		if got := hashFile(target); got != r.checksum {
+			mkPrintError(fmt.Sprintf("mk: checksum mismatch for %s: expected %s, got %s", target, r.checksum, got))
+			os.Remove(target)
+			return false, false
+		}
+	}
+	if failure != "" {
+		mkPrintError(fmt.Sprintf("warning: fetching %s: %s; using the copy fetched before", r.url, failure))
+	}
+	return false, true
+}
+
+// Clone a git repository, or pull it if it was cloned before. Its directory is
+// touched if that changed the checked out commit. A clone that can't be pulled
+// is used as it is, with a warning.
+func fetchGit(target string, r *rule, opts *buildOptions) (bool, bool) {
+	if _, err := os.Stat(target); err != nil {
+		_, err := opts.executor.run(opts.ctx, "git", []string{"clone", "--quiet", r.url, target}, "", "", captureNone)
+		return err == nil, err == nil
+	}
+
+	head := func() string {
+		out, _ := opts.executor.run(opts.ctx, "git", []string{"-C", target, "rev-parse", "HEAD"}, "", "", captureStdout)
+		return strings.TrimSpace(out)
+	}
+	before := head()
+	if _, err := opts.executor.run(opts.ctx, "git", []string{"-C", target, "pull", "--quiet", "--ff-only"}, "", "", captureNone); err != nil {
+		if opts.ctx.Err() != nil {
+			return false, false
+		}
+		return fetchedBefore(target, r, err.Error())
+	}
+	if head() == before {
+		return false, true
+	}
+	now := time.Now()
+	os.Chtimes(target, now, now)
+	return true, true
+}
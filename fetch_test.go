@@ -0,0 +1,97 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	content, etag, status := "a", `"1"`, http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "out: "+server.URL+"/lib.txt\n\tcp $prereq out; echo $target >> log\n")
+
+		run := func() []string {
+			writeFile(t, "log", "")
+			runMk(t, nil, defaultBuildOptions())
+			return readWords(t, "log")
+		}
+
+		if got := run(); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("first run: executed %q, want [out]", got)
+		}
+		if got := run(); len(got) != 0 {
+			t.Errorf("unchanged: executed %q, want nothing", got)
+		}
+		content, etag = "b", `"2"`
+		if got := run(); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("changed: executed %q, want [out]", got)
+		}
+		if got := readWords(t, "out"); !reflect.DeepEqual(got, []string{"b"}) {
+			t.Errorf("out is %q, want [b]", got)
+		}
+
+		// what was fetched before is used when the server fails
+		status = http.StatusServiceUnavailable
+		writeFile(t, "log", "")
+		g := runMk(t, nil, defaultBuildOptions())
+		if got := readWords(t, "log"); g.root.status == nodeStatusFailed || len(got) != 0 {
+			t.Errorf("server down: build %s, executed %q, want out up to date", g.root.status, got)
+		}
+		status = http.StatusOK
+
+		// and what was fetched is checked against its checksum when unchanged
+		writeFile(t, "mkfile", "sum: "+server.URL+"/lib.txt#sha256="+fmt.Sprintf("%x", sha256.Sum256([]byte("b")))+"\n\tcp $prereq sum\n")
+		runMk(t, nil, defaultBuildOptions())
+		target, _ := fetchPath(defaultCacheDir, server.URL+"/lib.txt")
+		writeFile(t, target, "corrupt")
+		opts := defaultBuildOptions()
+		opts.rebuildAll = true
+		if g := runMk(t, nil, opts); g.root.status != nodeStatusFailed {
+			t.Errorf("corrupt cache: sum built, want a checksum mismatch")
+		}
+
+		sum := strings.Repeat("0", 64)
+		writeFile(t, "mkfile", "bad: "+server.URL+"/other.txt#sha256="+sum+"\n\ttouch bad\n")
+		g = runMk(t, nil, defaultBuildOptions())
+		if g.nodes["bad"].status != nodeStatusFailed {
+			t.Errorf("checksum mismatch: bad has status %d, want failed", g.nodes["bad"].status)
+		}
+	})
+}
@@ -45,17 +45,30 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // A dependency graph
 type graph struct {
-	root  *node            // the intial target's node
-	nodes map[string]*node // map targets to their nodes
+	root      *node               // the intial target's node
+	nodes     map[string]*node    // map targets to their nodes
+	rs        *ruleSet            // rules the graph is built from
+	opts      *buildOptions       // options the graph is built with
+	jobs      *jobPool            // slots for executing recipes
+	fetches   *jobPool            // slots for fetching URLs
+	resources map[string]*jobPool // amounts of each resource class
+	mutex     sync.Mutex          // exclusivity for the failed flag and cacheHits
+	failed    bool                // a recipe failed during the build
+	cacheHits int                 // fetched URLs that hadn't changed
 }
 
 // An edge in the graph.
@@ -78,13 +91,30 @@ const (
 	nodeStatusFailed
 )
 
+func (s nodeStatus) String() string {
+	switch s {
+	case nodeStatusStarted:
+		return "started"
+	case nodeStatusNop:
+		return "uptodate"
+	case nodeStatusDone:
+		return "done"
+	case nodeStatusFailed:
+		return "failed"
+	}
+	return "ready"
+}
+
 type nodeFlag int
 
 const (
-	nodeFlagCycle    nodeFlag = 0x0002
-	nodeFlagReady             = 0x0004
-	nodeFlagProbable          = 0x0100
-	nodeFlagVacuous           = 0x0200
+	nodeFlagCycle        nodeFlag = 0x0002
+	nodeFlagReady                 = 0x0004
+	nodeFlagProbable              = 0x0100
+	nodeFlagVacuous               = 0x0200
+	nodeFlagStat                  = 0x0400
+	nodeFlagIntermediate          = 0x0800
+	nodeFlagFuture                = 0x1000
 )
 
 // A node in the dependency graph
@@ -99,45 +129,192 @@ type node struct {
 	mutex     sync.Mutex        // exclusivity for the status variable
 	listeners []chan nodeStatus // channels to notify of completion
 	flags     nodeFlag          // bitwise combination of node flags
+	refs      int               // number of edges directed to this node
+	statErr   error             // why the file couldn't be stat'ed, if it couldn't
 }
 
-// Update a node's timestamp and 'exists' flag.
-func (u *node) updateTimestamp() {
-	info, err := os.Stat(u.name)
+// How long a stat failing transiently is first waited for before it's tried
+// again, which doubles with each try.
+const statRetryDelay = 50 * time.Millisecond
+
+// Result of a stat call on a file.
+type statResult struct {
+	t      time.Time // file modification time
+	exists bool      // does the file exist
+	err    error     // why it couldn't be stat'ed, if not because it's missing
+}
+
+// Stat results shared by every graph built with the same options.
+type statCache struct {
+	sync.Mutex
+	results map[string]statResult
+	retries int // times a stat failing transiently is tried again
+}
+
+func newStatCache() *statCache {
+	return &statCache{results: make(map[string]statResult)}
+}
+
+// Stat a file, updating the cache. If dirNewest is true, the timestamp of a
+// directory is that of the newest file within it, since a directory's own
+// modification time doesn't change when the files in it do.
+func (c *statCache) stat(name string, dirNewest bool) statResult {
+	var res statResult
+	info, err := os.Stat(name)
+	for i := 0; err != nil && i < c.retries && isTransientStatError(err); i++ {
+		time.Sleep(statRetryDelay << uint(i))
+		info, err = os.Stat(name)
+	}
 	if err == nil {
-		u.t = info.ModTime()
-		u.exists = true
-		u.flags |= nodeFlagProbable
+		res = statResult{info.ModTime(), true, nil}
+		if dirNewest && info.IsDir() {
+			res.t = newestInDir(name, res.t)
+		}
+	} else if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		res = statResult{time.Unix(0, 0), false, nil}
 	} else {
-		_, ok := err.(*os.PathError)
-		if ok {
-			u.t = time.Unix(0, 0)
-			u.exists = false
-		} else {
-			mkError(err.Error())
+		// the file may not be needed, as when it's a candidate prerequisite
+		// of a meta-rule, so the error is only reported if it is
+		if pathErr, ok := err.(*os.PathError); ok {
+			err = pathErr.Err
 		}
+		res = statResult{time.Unix(0, 0), false, err}
+	}
+
+	c.Lock()
+	c.results[name] = res
+	c.Unlock()
+	return res
+}
+
+// Forget what was stat'ed of the given files, or of every file if none are
+// given, since they may have changed.
+func (c *statCache) invalidate(names []string) {
+	c.Lock()
+	defer c.Unlock()
+	if len(names) == 0 {
+		c.results = make(map[string]statResult)
+	}
+	for _, name := range names {
+		delete(c.results, name)
 	}
+}
+
+// Stat a file, using the cached result if there is one.
+func (c *statCache) cached(name string, dirNewest bool) statResult {
+	c.Lock()
+	res, ok := c.results[name]
+	c.Unlock()
+	if ok {
+		return res
+	}
+	return c.stat(name, dirNewest)
+}
+
+// Find the newest modification time of anything within a directory, or t if
+// nothing is newer.
+func newestInDir(dir string, t time.Time) time.Time {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+		return nil
+	})
+	return t
+}
 
-	if rebuildAll {
+// Set a node's timestamp and 'exists' flag from a stat result.
+func (u *node) setTimestamp(res statResult) {
+	u.t = res.t
+	u.exists = res.exists
+	u.statErr = res.err
+	if u.exists {
 		u.flags |= nodeFlagProbable
 	}
 }
 
-// Create a new node
+// Update a node's timestamp and 'exists' flag.
+func (u *node) updateTimestamp(opts *buildOptions) {
+	u.setTimestamp(opts.stats.stat(u.name, opts.dirNewest))
+}
+
+// True if the node is only produced by virtual rules.
+func (u *node) isVirtual() bool {
+	if len(u.prereqs) == 0 {
+		return false
+	}
+	for i := range u.prereqs {
+		if !u.prereqs[i].r.attributes.virtual {
+			return false
+		}
+	}
+	return true
+}
+
+// Create a new node. Its timestamp is filled in later by statNodes.
 func (g *graph) newnode(name string) *node {
 	u := &node{name: name}
-	u.updateTimestamp()
 	g.nodes[name] = u
 	return u
 }
 
-// Print a graph in graphviz format.
+// Stat every node in the graph that hasn't been stat'ed yet, using a bounded
+// pool of workers.
+func (g *graph) statNodes() {
+	workers := g.opts.statWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	nodes := make(chan *node)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for u := range nodes {
+				u.setTimestamp(g.opts.stats.cached(u.name, g.opts.dirNewest))
+			}
+			wg.Done()
+		}()
+	}
+
+	stated := make([]*node, 0)
+	for _, u := range g.nodes {
+		if u.flags&nodeFlagStat != 0 {
+			continue
+		}
+		u.flags |= nodeFlagStat
+		stated = append(stated, u)
+		if g.opts.rebuildAll {
+			u.flags |= nodeFlagProbable
+		}
+		if g.opts.skipVirtualStat && u.isVirtual() {
+			u.setTimestamp(statResult{time.Unix(0, 0), false, nil})
+			continue
+		}
+		nodes <- u
+	}
+	close(nodes)
+	wg.Wait()
+	g.checkFuture(stated)
+}
+
+// Print a graph in graphviz format, leaving out the root.
 func (g *graph) visualize(w io.Writer) {
-	fmt.Fprintln(w, "digraph mk {")
+	names := make([]string, 0, len(g.nodes))
 	for t, u := range g.nodes {
+		if u != g.root {
+			names = append(names, t)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "digraph mk {")
+	for _, t := range names {
+		u := g.nodes[t]
 		for i := range u.prereqs {
 			if u.prereqs[i].v != nil {
-				fmt.Fprintf(w, "    \"%s\" -> \"%s\";\n", t, u.prereqs[i].v.name)
+				fmt.Fprintf(w, "    %q -> %q;\n", t, u.prereqs[i].v.name)
 			}
 		}
 	}
@@ -148,32 +325,313 @@ func (g *graph) visualize(w io.Writer) {
 func (u *node) newedge(v *node, r *rule) *edge {
 	e := &edge{v: v, r: r}
 	u.prereqs = append(u.prereqs, e)
+	if v != nil {
+		v.refs++
+	}
 	return e
 }
 
 // Create a dependency graph for the given target.
-func buildgraph(rs *ruleSet, target string) *graph {
-	g := &graph{nil, make(map[string]*node)}
+func buildgraph(rs *ruleSet, target string, opts *buildOptions) *graph {
+	g := &graph{root: nil, nodes: make(map[string]*node), rs: rs, opts: opts}
+	g.jobs = newJobPool(int64(opts.jobs))
+	g.fetches = newJobPool(int64(opts.fetchJobs))
+	g.newResourcePools()
+	g.reroot(target)
+	return g
+}
 
+// Root the graph at a different target, reusing the nodes that have already
+// been built and adding any that are missing.
+func (g *graph) reroot(target string) {
 	// keep track of how many times each rule is visited, to avoid cycles.
-	rulecnt := make([]int, len(rs.rules))
-	g.root = applyrules(rs, g, target, rulecnt)
+	rulecnt := make([]int, len(g.rs.rules))
+	g.root = applyrules(g.rs, g, target, rulecnt)
+	g.statNodes()
 	g.cyclecheck(g.root)
 	g.root.flags |= nodeFlagProbable
 	g.vacuous(g.root)
 	g.ambiguous(g.root)
+	g.markIntermediates()
+	if g.opts.why {
+		g.explainInferences()
+	}
+}
 
-	return g
+// Flag the missing files that are intermediate: those produced by rules with
+// the I attribute, and with -intermediates, those produced only by meta-rules,
+// for other meta-rules, such as the .c file in a chain from .y to .c to .o.
+// Files named by a concrete rule, or on the command line, aren't intermediate
+// unless marked so.
+func (g *graph) markIntermediates() {
+	explicit := make(map[*node]bool)
+	for _, u := range g.nodes {
+		for _, e := range u.prereqs {
+			if e.r != nil && !e.r.isMeta && e.v != nil {
+				explicit[e.v] = true
+			}
+		}
+	}
+
+	for _, u := range g.nodes {
+		if u.exists || u == g.root || u.flags&nodeFlagIntermediate != 0 {
+			continue
+		}
+		marked, meta, keep := false, true, false
+		for _, e := range u.prereqs {
+			if e.r == nil {
+				continue
+			}
+			marked = marked || e.r.attributes.intermediate
+			meta = meta && e.r.isMeta
+			keep = keep || e.r.attributes.virtual || e.r.attributes.precious
+		}
+		if keep || len(u.prereqs) == 0 {
+			continue
+		}
+		if marked || (g.opts.intermediates && meta && !explicit[u]) {
+			u.flags |= nodeFlagIntermediate
+		}
+	}
 }
 
-// Recursively match the given target to a rule in the rule set to construct the
-// full graph.
-func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
-	u, ok := g.nodes[target]
-	if ok {
-		return u
+// Print each chain of two or more meta-rules the graph was inferred through,
+// from a file named by a concrete rule or on the command line to the file the
+// chain ends at, with the rule applied at each step.
+func (g *graph) explainInferences() {
+	// the files only meta-rules lead to
+	inferred := make(map[*node]bool)
+	explicit := make(map[*node]bool)
+	for _, u := range g.nodes {
+		for _, e := range u.prereqs {
+			if e.v == nil || e.r == nil {
+				continue
+			}
+			if e.r.isMeta {
+				inferred[e.v] = true
+			} else {
+				explicit[e.v] = true
+			}
+		}
 	}
-	u = g.newnode(target)
+
+	names := make([]string, 0)
+	for name, u := range g.nodes {
+		if u != g.root && (explicit[u] || !inferred[u]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var follow func(u *node, path string, steps int)
+	follow = func(u *node, path string, steps int) {
+		for _, e := range u.prereqs {
+			if e.v == nil || e.r == nil || !e.r.isMeta {
+				continue
+			}
+			p := fmt.Sprintf("%s -(%s at %s)-> %s", path, strings.Join(e.r.targetNames(), " "), e.r.location(), e.v.name)
+			if e.v.flags&nodeFlagIntermediate != 0 {
+				p += " [intermediate]"
+			}
+			if inferred[e.v] && !explicit[e.v] && len(e.v.prereqs) > 0 {
+				follow(e.v, p, steps+1)
+			} else if steps > 0 {
+				mkPrintError("mk: why: inferred " + p)
+			}
+		}
+	}
+	for _, name := range names {
+		follow(g.nodes[name], name, 0)
+	}
+}
+
+// True if the node is an intermediate file that doesn't exist.
+func (u *node) isMissingIntermediate() bool {
+	return u.flags&nodeFlagIntermediate != 0 && !u.exists
+}
+
+// The time a target would have if it were rebuilt: its own, unless it's a
+// missing intermediate, which takes the time of its newest prerequisite.
+func (u *node) sourceTime() time.Time {
+	if !u.isMissingIntermediate() {
+		return u.t
+	}
+	var t time.Time
+	for _, e := range u.prereqs {
+		if e.v != nil {
+			if vt := e.v.sourceTime(); vt.After(t) {
+				t = vt
+			}
+		}
+	}
+	return t
+}
+
+// Remove the intermediate files built by the last build, printing each one.
+func (g *graph) removeIntermediates() {
+	names := make([]string, 0)
+	for name, u := range g.nodes {
+		if u.flags&nodeFlagIntermediate != 0 && u.status == nodeStatusDone {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mkPrintMessage(fmt.Sprintf("rm %s", shellQuote(name)))
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			mkPrintError(fmt.Sprintf("mk: %s", err))
+		}
+	}
+}
+
+// Refresh the timestamps of the named nodes, e.g. after the files changed.
+// Nodes not in the graph are ignored.
+func (g *graph) refresh(names []string) {
+	for _, name := range names {
+		u, ok := g.nodes[name]
+		if ok {
+			u.updateTimestamp(g.opts)
+		}
+	}
+}
+
+// Refresh the timestamps of every node in the graph.
+func (g *graph) refreshAll() {
+	for _, u := range g.nodes {
+		u.updateTimestamp(g.opts)
+	}
+}
+
+// True if building the node executed no recipes, for it or any of its
+// prerequisites.
+func (g *graph) upToDate(u *node) bool {
+	seen := map[*node]bool{u: true}
+	stack := []*node{u}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if v.status == nodeStatusDone || v.status == nodeStatusFailed {
+			return false
+		}
+		for _, e := range v.prereqs {
+			if e.v != nil && !seen[e.v] {
+				seen[e.v] = true
+				stack = append(stack, e.v)
+			}
+		}
+	}
+	return true
+}
+
+// Record that a recipe failed.
+func (g *graph) setFailed() {
+	g.mutex.Lock()
+	g.failed = true
+	g.mutex.Unlock()
+
+	// recipes waiting for their turn needn't start, unless asked to keep going
+	if !g.opts.keepGoing {
+		g.cancel()
+	}
+}
+
+// True if a recipe has failed.
+func (g *graph) hasFailed() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.failed
+}
+
+// Remove what a failed recipe left of the node's target: all of it, if the rule
+// has the D attribute, or whatever the recipe changed if it was cancelled,
+// unless the rule is virtual or precious. before is what the target was like
+// before the recipe was executed.
+func (u *node) removeFailed(r *rule, before statResult, opts *buildOptions) {
+	if r.attributes.virtual {
+		return
+	}
+	after := opts.stats.stat(u.name, false)
+	if !after.exists {
+		return
+	}
+	changed := !before.exists || !after.t.Equal(before.t)
+	cancelled := opts.ctx.Err() != nil && changed && !r.attributes.precious
+	if !r.attributes.delFailed && !cancelled {
+		return
+	}
+	mkPrintMessage(fmt.Sprintf("mk: deleting %s", u.name))
+	if err := os.Remove(u.name); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to delete %s: %s", u.name, err))
+	}
+}
+
+// Make every node ready to be built again.
+func (g *graph) reset() {
+	g.mutex.Lock()
+	g.failed = false
+	g.mutex.Unlock()
+
+	g.jobs.uncancel()
+	g.fetches.uncancel()
+	for _, pool := range g.resources {
+		pool.uncancel()
+	}
+
+	for _, u := range g.nodes {
+		u.mutex.Lock()
+		u.status = nodeStatusReady
+		u.listeners = u.listeners[:0]
+		u.mutex.Unlock()
+	}
+}
+
+// A prerequisite edge to be created by applying a rule to a target.
+type pendingEdge struct {
+	k       int      // index of the rule being applied
+	prereq  string   // name of the prerequisite
+	hasNode bool     // false if the rule has no prerequisites
+	stem    string   // stem matched for meta-rule applications
+	matches []string // regular expression matches
+}
+
+// Replace prerequisites containing glob patterns with the files matching them,
+// in sorted order. A pattern matching no files is kept as it is, naming a
+// prerequisite that may yet be built or else reported missing.
+func expandGlobs(prereqs []string) []string {
+	expanded := make([]string, 0, len(prereqs))
+	for _, prereq := range prereqs {
+		if !isGlobPattern(prereq) {
+			expanded = append(expanded, prereq)
+			continue
+		}
+		matches, _ := filepath.Glob(prereq)
+		if len(matches) == 0 {
+			expanded = append(expanded, prereq)
+			continue
+		}
+		sort.Strings(matches)
+		expanded = append(expanded, matches...)
+	}
+	return expanded
+}
+
+// Match the given target to the rules in the rule set, returning the edges
+// that applying them would create: those of rules that aren't meta-rules
+// first, then those of meta-rules from the most specific match to the least,
+// and in the order the rules are defined otherwise.
+//
+// A rule is applied at most chain times in one chain of inference, or as many
+// as its chain attribute allows, and a concrete rule once more.
+func matchrules(rs *ruleSet, u *node, rulecnt []int, chain int) []pendingEdge {
+	target := u.name
+	pending := make([]pendingEdge, 0)
+
+	// edges of meta-rules, grouped by the pattern matched
+	type metaMatch struct {
+		specificity int
+		pending     []pendingEdge
+	}
+	metaMatches := make([]metaMatch, 0)
 
 	// does the target match a concrete rule?
 
@@ -181,44 +639,38 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 	if ok {
 		for ki := range ks {
 			k := ks[ki]
-			if rulecnt[k] > maxRuleCnt {
+			r := &rs.rules[k]
+			if rulecnt[k] > r.chainLimit(chain) {
 				continue
 			}
 
-			r := &rs.rules[k]
-
 			// skip meta-rules
 			if r.isMeta {
 				continue
 			}
 
 			// skip rules that have no effect
-			if r.recipe == "" && len(r.prereqs) == 0 {
+			if r.recipe == "" && len(r.prereqs) == 0 && r.url == "" {
 				continue
 			}
 
 			u.flags |= nodeFlagProbable
-			rulecnt[k] += 1
-			if len(r.prereqs) == 0 {
-				u.newedge(nil, r)
+			prereqs := expandGlobs(r.prereqs)
+			if len(prereqs) == 0 {
+				pending = append(pending, pendingEdge{k: k})
 			} else {
-				for i := range r.prereqs {
-					u.newedge(applyrules(rs, g, r.prereqs[i], rulecnt), r)
+				for i := range prereqs {
+					pending = append(pending,
+						pendingEdge{k: k, prereq: prereqs[i], hasNode: true})
 				}
 			}
-			rulecnt[k] -= 1
 		}
 	}
 
 	// find applicable metarules
 	for k := range rs.rules {
-		if rulecnt[k] >= maxRuleCnt {
-			continue
-		}
-
 		r := &rs.rules[k]
-
-		if !r.isMeta {
+		if !r.isMeta || rulecnt[k] >= r.chainLimit(chain) {
 			continue
 		}
 
@@ -247,32 +699,187 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 				stem = mat[1]
 			}
 
-			rulecnt[k] += 1
-			if len(r.prereqs) == 0 {
-				e := u.newedge(nil, r)
-				e.stem = stem
-				e.matches = matches
-			} else {
-				for i := range r.prereqs {
-					var prereq string
-					if r.attributes.regex {
-						prereq = expandRecipeSigils(r.prereqs[i], match_vars)
-					} else {
-						prereq = expandSuffixes(r.prereqs[i], stem)
-					}
+			prereqs := make([]string, len(r.prereqs))
+			for i := range r.prereqs {
+				if r.attributes.regex {
+					prereqs[i] = expandPlainSigils(r.prereqs[i], match_vars)
+				} else {
+					prereqs[i] = expandSuffixes(r.prereqs[i], stem)
+				}
+			}
+			prereqs = expandGlobs(prereqs)
 
-					e := u.newedge(applyrules(rs, g, prereq, rulecnt), r)
-					e.stem = stem
-					e.matches = matches
+			m := metaMatch{specificity: r.targets[j].specificity()}
+			if len(prereqs) == 0 {
+				m.pending = append(m.pending,
+					pendingEdge{k: k, stem: stem, matches: matches})
+			} else {
+				for i := range prereqs {
+					m.pending = append(m.pending, pendingEdge{k, prereqs[i], true, stem, matches})
 				}
 			}
-			rulecnt[k] -= 1
+			metaMatches = append(metaMatches, m)
+		}
+	}
+
+	sort.SliceStable(metaMatches, func(i, j int) bool {
+		return metaMatches[i].specificity > metaMatches[j].specificity
+	})
+	for _, m := range metaMatches {
+		pending = append(pending, m.pending...)
+	}
+	return pending
+}
+
+// Match the given target to a rule in the rule set, and its prerequisites in
+// turn, to construct the full graph.
+//
+// The graph is explored depth first using an explicit stack, so that very deep
+// dependency chains don't exhaust the goroutine stack.
+func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
+	u, ok := g.nodes[target]
+	if ok {
+		return u
+	}
+	u = g.newnode(target)
+
+	// a node under construction, the next of its edges to create, and how
+	// many meta-rules in a row led to it from a file that exists or has a
+	// concrete rule
+	type frame struct {
+		u       *node
+		pending []pendingEdge
+		i       int
+		depth   int
+	}
+
+	// create an edge from the frame's node, moving on to the next one
+	link := func(f *frame, v *node) {
+		p := &f.pending[f.i]
+		e := f.u.newedge(v, &rs.rules[p.k])
+		e.stem = p.stem
+		e.matches = p.matches
+		f.i++
+	}
+
+	// the nodes on the stack, which a meta-rule mustn't lead back to
+	onStack := map[*node]bool{u: true}
+
+	pending := matchrules(rs, u, rulecnt, g.opts.chain)
+	g.prestat(pending)
+	stack := []frame{{u, pending, 0, 0}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.i >= len(f.pending) {
+			v := f.u
+			delete(onStack, v)
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				parent := &stack[len(stack)-1]
+				rulecnt[parent.pending[parent.i].k] -= 1
+				link(parent, v)
+			}
+			continue
+		}
+
+		p := &f.pending[f.i]
+		if !p.hasNode {
+			link(f, nil)
+			continue
+		}
+
+		v, ok := g.nodes[p.prereq]
+		if ok && onStack[v] && rs.rules[p.k].isMeta {
+			// skip an inference that would make a cycle
+			f.i++
+			continue
+		} else if ok {
+			link(f, v)
+			continue
+		}
+
+		// descend into a new prerequisite while its rule is being applied
+		rulecnt[p.k] += 1
+		v = g.newnode(p.prereq)
+		depth := 0
+		if rs.rules[p.k].isMeta {
+			depth = g.speculate(v, f.depth+1)
+		}
+		onStack[v] = true
+		if depth < 0 {
+			stack = append(stack, frame{v, nil, 0, 0})
+		} else {
+			pending := matchrules(rs, v, rulecnt, g.opts.chain)
+			g.prestat(pending)
+			stack = append(stack, frame{v, pending, 0, depth})
 		}
 	}
 
 	return u
 }
 
+// With -metadepth, stat the files meta-rules imply as a node's prerequisites
+// all at once, with the pool of workers, so that speculate finds them in the
+// stat cache.
+func (g *graph) prestat(pending []pendingEdge) {
+	if g.opts.metaDepth <= 0 {
+		return
+	}
+	names := make([]string, 0, len(pending))
+	for _, p := range pending {
+		if _, ok := g.nodes[p.prereq]; p.hasNode && !ok && g.rs.rules[p.k].isMeta {
+			names = append(names, p.prereq)
+		}
+	}
+	if len(names) < 2 {
+		return
+	}
+
+	workers := g.opts.statWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	files := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			for name := range files {
+				g.opts.stats.cached(name, g.opts.dirNewest)
+			}
+			wg.Done()
+		}()
+	}
+	for _, name := range names {
+		files <- name
+	}
+	close(files)
+	wg.Wait()
+}
+
+// Given a node a meta-rule implies, at the given depth of meta-rules in a row,
+// return its depth: 0 if the file exists or has a concrete rule, or -1 if it's
+// too deep to match rules to. The node is stat'ed now to find out, rather than
+// with the others, though prestat has usually stat'ed it already.
+func (g *graph) speculate(v *node, depth int) int {
+	if g.opts.metaDepth <= 0 {
+		return depth
+	}
+	v.flags |= nodeFlagStat
+	if g.opts.rebuildAll {
+		v.flags |= nodeFlagProbable
+	}
+	v.setTimestamp(g.opts.stats.cached(v.name, g.opts.dirNewest))
+	g.checkFuture([]*node{v})
+	if v.exists || len(g.rs.targetRules[v.name]) > 0 {
+		return 0
+	}
+	if depth >= g.opts.metaDepth {
+		return -1
+	}
+	return depth
+}
+
 // Remove edges marked as togo.
 func (g *graph) togo(u *node) {
 	n := 0
@@ -287,129 +894,251 @@ func (g *graph) togo(u *node) {
 		if !u.prereqs[i].togo {
 			prereqs[j] = u.prereqs[i]
 			j++
+		} else if u.prereqs[i].v != nil {
+			g.unref(u.prereqs[i].v)
 		}
 	}
 
-	// TODO: We may have to delete nodes from g.nodes, right?
-
 	u.prereqs = prereqs
 }
 
+// Drop a reference to a node. Once nothing refers to it, the node is removed
+// from the graph along with its edges, possibly orphaning its prerequisites in
+// turn.
+func (g *graph) unref(v *node) {
+	stack := []*node{v}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		v.refs--
+		if v.refs > 0 || v == g.root {
+			continue
+		}
+
+		delete(g.nodes, v.name)
+		for i := range v.prereqs {
+			if v.prereqs[i].v != nil {
+				stack = append(stack, v.prereqs[i].v)
+			}
+		}
+		v.prereqs = nil
+	}
+}
+
 // Remove vacous children of n.
-func (g *graph) vacuous(u *node) bool {
-	vac := u.flags&nodeFlagProbable == 0
-	if u.flags&nodeFlagReady != 0 {
-		return vac
+func (g *graph) vacuous(root *node) bool {
+	// a node being examined, the next edge to look at, and whether it is
+	// vacuous so far
+	type frame struct {
+		u   *node
+		i   int
+		vac bool
 	}
-	u.flags |= nodeFlagReady
 
-	for i := range u.prereqs {
-		e := u.prereqs[i]
-		if e.v != nil && g.vacuous(e.v) && e.r.isMeta {
+	// Start examining a node. Nodes that have been seen before report
+	// whether they were probable when first seen.
+	var stack []frame
+	visit := func(u *node) (bool, bool) {
+		vac := u.flags&nodeFlagProbable == 0
+		if u.flags&nodeFlagReady != 0 {
+			return vac, true
+		}
+		u.flags |= nodeFlagReady
+		stack = append(stack, frame{u, 0, vac})
+		return false, false
+	}
+
+	// account for the result of examining the frame's current edge
+	result := func(f *frame, vac bool) {
+		e := f.u.prereqs[f.i]
+		if e.v != nil && vac && e.r.isMeta {
 			e.togo = true
 		} else {
-			vac = false
+			f.vac = false
 		}
+		f.i++
 	}
 
-	// if a rule generated edges that are not togo, keep all of its edges
-	for i := range u.prereqs {
-		e := u.prereqs[i]
-		if !e.togo {
-			for j := range u.prereqs {
-				f := u.prereqs[j]
-				if e.r == f.r {
-					f.togo = false
+	if vac, seen := visit(root); seen {
+		return vac
+	}
+
+	var vac bool
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		u := f.u
+		if f.i < len(u.prereqs) {
+			e := u.prereqs[f.i]
+			if e.v == nil {
+				result(f, false)
+			} else if v, seen := visit(e.v); seen {
+				result(f, v)
+			}
+			continue
+		}
+
+		// if a rule generated edges that are not togo, keep all of its edges
+		for i := range u.prereqs {
+			e := u.prereqs[i]
+			if !e.togo {
+				for j := range u.prereqs {
+					f := u.prereqs[j]
+					if e.r == f.r {
+						f.togo = false
+					}
 				}
 			}
 		}
-	}
 
-	g.togo(u)
-	if vac {
-		u.flags |= nodeFlagVacuous
+		g.togo(u)
+		if f.vac {
+			u.flags |= nodeFlagVacuous
+		}
+
+		vac = f.vac
+		stack = stack[:len(stack)-1]
+		if len(stack) > 0 {
+			result(&stack[len(stack)-1], vac)
+		}
 	}
 
 	return vac
 }
 
-// Check for cycles
-func (g *graph) cyclecheck(u *node) {
-	if u.flags&nodeFlagCycle != 0 && len(u.prereqs) > 0 {
-		mkError(fmt.Sprintf("cycle in the graph detected at target %s", u.name))
+// Check for cycles, reporting the full path of the first one found.
+func (g *graph) cyclecheck(root *node) {
+	// a frame of the depth-first search: a node and the next edge to follow
+	type frame struct {
+		u *node
+		i int
 	}
-	u.flags |= nodeFlagCycle
-	for i := range u.prereqs {
-		if u.prereqs[i].v != nil {
-			g.cyclecheck(u.prereqs[i].v)
+
+	done := make(map[*node]bool)
+	stack := []frame{{root, 0}}
+	root.flags |= nodeFlagCycle
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.i >= len(f.u.prereqs) {
+			f.u.flags &= ^nodeFlagCycle
+			done[f.u] = true
+			stack = stack[:len(stack)-1]
+			continue
 		}
-	}
-	u.flags &= ^nodeFlagCycle
 
+		e := f.u.prereqs[f.i]
+		f.i++
+		v := e.v
+		if v == nil || done[v] {
+			continue
+		}
+
+		if v.flags&nodeFlagCycle != 0 && len(v.prereqs) > 0 {
+			// the cycle consists of the stack from v's frame upwards
+			k := len(stack) - 1
+			for stack[k].u != v {
+				k--
+			}
+			path := ""
+			for ; k < len(stack); k++ {
+				pe := stack[k].u.prereqs[stack[k].i-1]
+				path += fmt.Sprintf("%s -(%s)-> ", stack[k].u.name, pe.r.location())
+			}
+			path += v.name
+			mkError(fmt.Sprintf("cycle in the graph detected: %s", path))
+		}
+
+		v.flags |= nodeFlagCycle
+		stack = append(stack, frame{v, 0})
+	}
 }
 
-// Deal with ambiguous rules.
-func (g *graph) ambiguous(u *node) {
-	bad := 0
-	var le *edge
-	for i := range u.prereqs {
-		e := u.prereqs[i]
+// Deal with ambiguous rules, visiting every node reachable from root after
+// its prerequisites.
+func (g *graph) ambiguous(root *node) {
+	type frame struct {
+		u *node
+		i int
+	}
 
-		if e.v != nil {
-			g.ambiguous(e.v)
+	seen := map[*node]bool{root: true}
+	stack := []frame{{root, 0}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.i < len(f.u.prereqs) {
+			v := f.u.prereqs[f.i].v
+			f.i++
+			if v != nil && !seen[v] {
+				seen[v] = true
+				stack = append(stack, frame{v, 0})
+			}
+			continue
 		}
+
+		g.ambiguousNode(f.u)
+		stack = stack[:len(stack)-1]
+	}
+}
+
+// Deal with ambiguous rules for a single node: when its rules give it
+// different recipes, pick one as the policy for it has it, pruning the others,
+// or fail.
+func (g *graph) ambiguousNode(u *node) {
+	recipes := make([]*edge, 0)
+	conflict := false
+	for _, e := range u.prereqs {
 		if e.r.recipe == "" {
 			continue
 		}
-		if le == nil || le.r == nil {
-			le = e
-		} else {
-			if !le.r.equivRecipe(e.r) {
-				if le.r.isMeta && !e.r.isMeta {
-					mkPrintRecipe(u.name, le.r.recipe, false)
-					le.togo = true
-					le = e
-				} else if !le.r.isMeta && e.r.isMeta {
-					mkPrintRecipe(u.name, e.r.recipe, false)
-					e.togo = true
-					continue
-				}
-			}
-			if !le.r.equivRecipe(e.r) {
-				if bad == 0 {
-					mkPrintError(fmt.Sprintf("mk: ambiguous recipes for %s\n", u.name))
-					bad = 1
-					g.trace(u.name, le)
-				}
+		if len(recipes) > 0 && !recipes[0].r.equivRecipe(e.r) {
+			conflict = true
+		}
+		recipes = append(recipes, e)
+	}
+
+	if conflict {
+		policy := g.ambiguityPolicy(u)
+		pick, why := g.resolveAmbiguity(u, recipes, policy)
+		if pick == nil {
+			mkPrintError(fmt.Sprintf("mk: ambiguous recipes for %s", u.name))
+			for _, e := range recipes {
 				g.trace(u.name, e)
 			}
+			mkError("")
+		}
+
+		pruned := make([]string, 0)
+		for _, e := range recipes {
+			if !e.r.equivRecipe(pick.r) {
+				e.togo = true
+				pruned = append(pruned, e.r.location())
+			}
+		}
+		if g.opts.why {
+			mkPrintError(fmt.Sprintf("mk: why: %s gets the recipe at %s, %s, rather than at %s (policy %s)",
+				u.name, pick.r.location(), why, strings.Join(pruned, ", "), &policy))
 		}
-	}
-	if bad > 0 {
-		mkError("")
 	}
 	g.togo(u)
 }
 
-// Print a trace of rules, k
+// Print a trace of rules, from the one with edge e for the named node down
+// through the first prerequisite of each with a recipe, on a line of its own.
 func (g *graph) trace(name string, e *edge) {
-	fmt.Fprintf(os.Stderr, "\t%s", name)
-	for true {
-		prereqname := ""
-		if e.v != nil {
-			prereqname = e.v.name
-		}
-		fmt.Fprintf(os.Stderr, " <-(%s:%d)- %s", e.r.file, e.r.line, prereqname)
-		if e.v != nil {
-			for i := range e.v.prereqs {
-				if e.v.prereqs[i].r.recipe != "" {
-					e = e.v.prereqs[i]
-					continue
-				}
+	fmt.Fprintf(os.Stderr, "\t%s <-(%s)-", name, e.r.location())
+	for e != nil && e.v != nil {
+		fmt.Fprintf(os.Stderr, " %s", e.v.name)
+		next := (*edge)(nil)
+		for i := range e.v.prereqs {
+			if e.v.prereqs[i].r.recipe != "" {
+				next = e.v.prereqs[i]
+				break
 			}
-			break
-		} else {
-			break
 		}
+		if next != nil {
+			fmt.Fprintf(os.Stderr, " <-(%s)-", next.r.location())
+		}
+		e = next
 	}
+	fmt.Fprintln(os.Stderr)
 }
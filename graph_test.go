@@ -0,0 +1,414 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A mkfile with a chain of n virtual rules, f0 depending on f1 and so on.
+func chainMkfile(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "f%d:V: f%d\n\ttrue\n", i, i+1)
+	}
+	fmt.Fprintf(&b, "f%d:V:\n\ttrue\n", n)
+	return b.String()
+}
+
+func TestDeepChain(t *testing.T) {
+	const n = 10000
+	rs := parse(chainMkfile(n), "mkfile", "/mkfile", make(map[string][]string))
+	g := buildgraph(rs, "f0", defaultBuildOptions())
+
+	if len(g.nodes) != n+1 {
+		t.Fatalf("graph has %d nodes, want %d", len(g.nodes), n+1)
+	}
+
+	depth := 0
+	for u := g.root; len(u.prereqs) > 0 && u.prereqs[0].v != nil; u = u.prereqs[0].v {
+		depth++
+	}
+	if depth != n {
+		t.Errorf("chain depth is %d, want %d", depth, n)
+	}
+}
+
+func TestVacuousPruning(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "a.c", "")
+		rs := parse("%.o: %.c\n\tcc $stem.c\n%.c: %.y\n\tyacc $stem.y\n",
+			"mkfile", dir+"/mkfile", make(map[string][]string))
+		g := buildgraph(rs, "a.o", defaultBuildOptions())
+
+		if _, ok := g.nodes["a.c"]; !ok {
+			t.Errorf("a.c missing from the graph")
+		}
+		if _, ok := g.nodes["a.y"]; ok {
+			t.Errorf("vacuous node a.y was not removed from the graph")
+		}
+	})
+}
+
+// A mkfile with a chain of n meta-rules, %.s0 depending on %.s1 and so on.
+func metaChainMkfile(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%%.s%d: %%.s%d\n\ttrue\n", i, i+1)
+	}
+	return b.String()
+}
+
+func TestDeepMetaChain(t *testing.T) {
+	const n = 1000
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		rs := parse(metaChainMkfile(n), "mkfile", dir+"/mkfile", make(map[string][]string))
+
+		// nothing at the end of the chain exists, so all of it is vacuous
+		g := buildgraph(rs, "a.s0", defaultBuildOptions())
+		if len(g.nodes) != 1 {
+			t.Errorf("graph has %d nodes, want the vacuous chain pruned", len(g.nodes))
+		}
+
+		writeFile(t, fmt.Sprintf("a.s%d", n), "")
+		g = buildgraph(rs, "a.s0", defaultBuildOptions())
+		depth := 0
+		for u := g.root; len(u.prereqs) > 0 && u.prereqs[0].v != nil; u = u.prereqs[0].v {
+			depth++
+		}
+		if depth != n {
+			t.Errorf("chain depth is %d, want %d", depth, n)
+		}
+	})
+}
+
+func TestMetaDepth(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "a.w", "")
+		mkfile := "%.o: %.c\n\tcc\n%.c: %.x\n\tx\n%.x: %.y\n\ty\n%.y: %.z\n\tz\n%.z: %.w\n\tw\n"
+		for _, test := range []struct {
+			depth int
+			want  bool // whether a.o can be built from a.w
+		}{{0, true}, {5, true}, {4, false}, {2, false}} {
+			rs := parse(mkfile, "mkfile", "/mkfile", make(map[string][]string))
+			opts := defaultBuildOptions()
+			opts.metaDepth = test.depth
+			g := buildgraph(rs, "a.o", opts)
+			if _, ok := g.nodes["a.w"]; ok != test.want {
+				t.Errorf("a.w in the graph is %v with -metadepth %d, want %v", ok, test.depth, test.want)
+			}
+		}
+
+		// the files meta-rules imply are stat'ed together, ahead of speculate
+		rs := parse("%.o: %.c\n\tcc\n%.o: %.s\n\tas\n", "mkfile", "/mkfile", make(map[string][]string))
+		opts := defaultBuildOptions()
+		opts.metaDepth = 2
+		g := buildgraph(rs, "a.o", opts)
+		opts.stats.invalidate(nil)
+		g.prestat(matchrules(rs, &node{name: "b.o"}, make([]int, len(rs.rules)), opts.chain))
+		if len(opts.stats.results) != 2 {
+			t.Errorf("stat'ed %v ahead, want b.c and b.s", opts.stats.results)
+		}
+	})
+}
+
+func TestChain(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "t", "")
+		writeFile(t, "x.b", "")
+		for _, test := range []struct {
+			mkfile string
+			chain  int
+			target string
+			want   string // the deepest file in the chain
+		}{
+			{"%.gz: %\n\tgzip\n", 1, "t.gz.gz", "t.gz.gz"},
+			{"%.gz: %\n\tgzip\n", 2, "t.gz.gz", "t"},
+			{"%.gz:chain=2: %\n\tgzip\n", 1, "t.gz.gz", "t"},
+			{"%.gz:chain=3: %\n\tgzip\n", 1, "t.gz.gz", "t"},
+			{"%.a: %.b\n\tcp\n%.b: %.a\n\tcp\n", 3, "x.a", "x.b"},
+		} {
+			rs := parse(test.mkfile, "mkfile", "/mkfile", make(map[string][]string))
+			opts := defaultBuildOptions()
+			opts.chain = test.chain
+			got := ""
+			sandboxed(func() {
+				u := buildgraph(rs, test.target, opts).root
+				for len(u.prereqs) > 0 && u.prereqs[0].v != nil {
+					u = u.prereqs[0].v
+				}
+				got = u.name
+			})
+			if got != test.want {
+				t.Errorf("%q with -chain %d infers %s from %s, want %s", test.mkfile, test.chain, test.target, got, test.want)
+			}
+		}
+	})
+}
+
+func TestExplainInferences(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "a.y", "")
+		writeFile(t, "b.c", "")
+		rs := parse("all:V: a.o b.o\n%.o: %.c\n\tcc\n%.c: %.y\n\tyacc\n",
+			"mkfile", "/mkfile", make(map[string][]string))
+		rs.addRoot([]string{"all"})
+		opts := defaultBuildOptions()
+		opts.why = true
+		opts.intermediates = true
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stderr := os.Stderr
+		os.Stderr = w
+		buildgraph(rs, "", opts)
+		os.Stderr = stderr
+		w.Close()
+		got, _ := ioutil.ReadAll(r)
+
+		// b.o is inferred in a single step, which isn't worth explaining
+		want := "mk: why: inferred a.o -(%.o at mkfile:2)-> a.c [intermediate] -(%.c at mkfile:4)-> a.y\n"
+		if string(got) != want {
+			t.Errorf("printed %q, want %q", got, want)
+		}
+	})
+}
+
+func TestAmbiguityPolicies(t *testing.T) {
+	mkfile := "%.o:V:\n\techo any\nlib%.o:V:\n\techo lib\nliba.o:V:\n\techo a\n" +
+		"%.x:V:\n\techo x1\n%.x:V:\n\techo x2\nb.x:ambiguous=recent:\n"
+	tests := []struct {
+		target string
+		policy ambiguityPolicy
+		want   string // the recipe picked, or "" if none is
+	}{
+		{"liba.o", ambiguousUnset, "echo a\n"},
+		{"liba.o", ambiguousRecent, "echo a\n"},
+		{"liba.o", ambiguousError, ""},
+		{"libb.o", ambiguousConcrete, ""},
+		{"libb.o", ambiguousRecent, "echo lib\n"},
+		{"libb.o", ambiguousSpecific, "echo lib\n"},
+		{"a.x", ambiguousSpecific, ""},
+		{"b.x", ambiguousError, "echo x2\n"},
+	}
+
+	for _, test := range tests {
+		rs := parse(mkfile, "mkfile", "/mkfile", make(map[string][]string))
+		opts := defaultBuildOptions()
+		opts.ambiguity = test.policy
+		got := ""
+		sandboxed(func() {
+			g := buildgraph(rs, test.target, opts)
+			for _, e := range g.root.prereqs {
+				got += e.r.recipe
+			}
+		})
+		if got != test.want {
+			t.Errorf("%s got recipe %q with -ambiguous %s, want %q", test.target, got, &test.policy, test.want)
+		}
+	}
+}
+
+func TestPatternSpecificity(t *testing.T) {
+	rs := parse("a.o lib%.o %.o lib\\%%.o:\n\techo\nlib(.*)o:R:\n\techo\n", "mkfile", "/mkfile",
+		make(map[string][]string))
+	want := []int{math.MaxInt32, 5, 2, 6, 0}
+	got := make([]int, 0)
+	for _, r := range rs.rules {
+		for i := range r.targets {
+			got = append(got, r.targets[i].specificity())
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("specificities are %v, want %v", got, want)
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "b.md", "")
+		writeFile(t, "a.md", "")
+		got := expandGlobs([]string{"*.md", "*.txt", "c"})
+		if want := []string{"a.md", "b.md", "*.txt", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expanded to %q, want %q", got, want)
+		}
+	})
+}
+
+func BenchmarkBuildgraph(b *testing.B) {
+	rs := parse(chainMkfile(1000), "mkfile", "/mkfile", make(map[string][]string))
+	for i := 0; i < b.N; i++ {
+		buildgraph(rs, "f0", defaultBuildOptions())
+	}
+}
+
+func TestGraphStats(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		for _, name := range []string{"a.c", "b.c", "c.c", "config.h"} {
+			writeFile(t, name, "")
+		}
+		rs := parse("all:V: p q\np: a.o b.o\n\tcc\nq: c.o\n\tcc\n%.o: %.c config.h\n\tcc\n",
+			"mkfile", dir+"/mkfile", make(map[string][]string))
+		rs.addRoot([]string{"all"})
+		s := buildgraph(rs, "", defaultBuildOptions()).stats()
+
+		if s.nodes != 10 || s.edges != 11 || s.maxDepth != 3 {
+			t.Errorf("got %d nodes, %d edges and depth %d, want 10, 11 and 3", s.nodes, s.edges, s.maxDepth)
+		}
+		if s.widestLevel != 3 || s.widestCount != 4 {
+			t.Errorf("widest level is %d with %d nodes, want 3 with 4", s.widestLevel, s.widestCount)
+		}
+		if want := []namedCount{{"%.o at mkfile:6", 3}}; !reflect.DeepEqual(s.metaRules, want) {
+			t.Errorf("meta-rule applications are %v, want %v", s.metaRules, want)
+		}
+		if want := (namedCount{"config.h", 3}); s.mostDepended[0] != want {
+			t.Errorf("most depended upon is %v, want %v", s.mostDepended[0], want)
+		}
+	})
+}
+
+func TestExportGraph(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "a.c", "")
+		rs := parse("all:V: p\np: a.o\n\tcc\n%.o: %.c\n\tcc\n",
+			"mkfile", dir+"/mkfile", make(map[string][]string))
+		rs.addRoot([]string{"all"})
+		g := buildgraph(rs, "", defaultBuildOptions())
+
+		var dot strings.Builder
+		if err := g.export(&dot, "dot"); err != nil {
+			t.Fatal(err)
+		}
+		if want := "digraph mk {\n    \"a.o\" -> \"a.c\";\n    \"all\" -> \"p\";\n    \"p\" -> \"a.o\";\n}\n"; dot.String() != want {
+			t.Errorf("dot graph is %q, want %q", dot.String(), want)
+		}
+
+		var out strings.Builder
+		if err := g.export(&out, "json"); err != nil {
+			t.Fatal(err)
+		}
+		var gj graphJSON
+		if err := json.Unmarshal([]byte(out.String()), &gj); err != nil {
+			t.Fatal(err)
+		}
+		if gj.Schema != graphSchemaVersion || !reflect.DeepEqual(gj.Targets, []string{"all"}) {
+			t.Errorf("schema %d and targets %q, want %d and [all]", gj.Schema, gj.Targets, graphSchemaVersion)
+		}
+		names := make([]string, 0)
+		for _, nj := range gj.Nodes {
+			names = append(names, nj.Name)
+		}
+		if want := []string{"a.c", "a.o", "all", "p"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("nodes are %q, want %q", names, want)
+		}
+		if a := gj.Nodes[0]; !a.Exists || a.ModTime == "" || a.Recipe != nil {
+			t.Errorf("a.c is %+v", a)
+		}
+		ao := gj.Nodes[1]
+		if ao.Recipe == nil || len(ao.Rules) != 1 || *ao.Recipe != ao.Rules[0] {
+			t.Fatalf("a.o is %+v", ao)
+		}
+		if r := gj.Rules[*ao.Recipe]; !r.Meta || r.Line != 4 || !reflect.DeepEqual(r.Targets, []string{"%.o"}) {
+			t.Errorf("a.o's rule is %+v", r)
+		}
+		want := edgeJSON{From: "a.o", To: "a.c", Rule: *ao.Recipe, Stem: "a"}
+		if !reflect.DeepEqual(gj.Edges[0], want) {
+			t.Errorf("first edge is %+v, want %+v", gj.Edges[0], want)
+		}
+
+		if err := g.export(&out, "svg"); err == nil {
+			t.Errorf("export in an unknown format succeeded")
+		}
+	})
+}
+
+func TestGraphHTML(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "mkfile", "all:V: a b\na:V:\n\ttrue\nb:V:\n\tfalse\n")
+		opts := defaultBuildOptions()
+		opts.keepGoing = true
+		opts.statuses = loadStatusStore(".mkstatus")
+		g := runMk(t, nil, opts)
+		opts.statuses.recordGraph(g)
+		if err := opts.statuses.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the statuses are those of the last build
+		opts = defaultBuildOptions()
+		opts.statuses = loadStatusStore(".mkstatus")
+		rs := parse("all:V: a b '</x>'\na:V:\n\ttrue\nb:V:\n\tfalse\n'</x>':V:\n\ttrue\n",
+			"mkfile", dir+"/mkfile", make(map[string][]string))
+		rs.addRoot([]string{"all"})
+		var out strings.Builder
+		if err := buildgraph(rs, "", opts).export(&out, "html"); err != nil {
+			t.Fatal(err)
+		}
+		page := out.String()
+		for _, want := range []string{
+			`"name":"a","exists":false,"virtual":true,"intermediate":false,"probable":true,"vacuous":false,"cycle":false,"status":"ready","last_status":"done"`,
+			`"name":"b","exists":false,"virtual":true,"intermediate":false,"probable":true,"vacuous":false,"cycle":false,"status":"ready","last_status":"failed"`,
+			"\\u003c/x\\u003e",
+		} {
+			if !strings.Contains(page, want) {
+				t.Errorf("page lacks %s", want)
+			}
+		}
+		if strings.Contains(page, "/*GRAPH*/") || strings.Contains(page, "</x>") {
+			t.Errorf("graph isn't substituted into the page safely")
+		}
+	})
+}
+
+func TestStatErrors(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		if err := os.Symlink("x.s", "x.s"); err != nil {
+			t.Skip(err)
+		}
+		writeFile(t, "x.c", "")
+		writeFile(t, "mkfile", "%.o: %.c\n\tcp $stem.c $target\n%.o: %.s\n\tcp $stem.s $target\nout: x.s\n\tcp x.s out\n")
+
+		// x.s can't be stat'ed, but isn't needed to build x.o
+		if g := runMk(t, []string{"x.o"}, defaultBuildOptions()); g.root.status == nodeStatusFailed {
+			t.Errorf("building x.o failed")
+		}
+		if _, err := os.Stat("x.o"); err != nil {
+			t.Error(err)
+		}
+
+		g := runMk(t, []string{"out"}, defaultBuildOptions())
+		if u := g.nodes["x.s"]; u.statErr == nil || g.root.status != nodeStatusFailed {
+			t.Errorf("x.s has stat error %v, and building out ended %s", u.statErr, g.root.status)
+		}
+	})
+}
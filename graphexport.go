@@ -0,0 +1,198 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Exporting the graph for other tools to read, as printed by -graph.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// The version of the schema of the graph as JSON. Fields may be added without
+// changing it, but not removed or changed in meaning.
+const graphSchemaVersion = 1
+
+// The graph as JSON.
+type graphJSON struct {
+	Schema  int        `json:"schema"`
+	Targets []string   `json:"targets"`
+	Nodes   []nodeJSON `json:"nodes"`
+	Edges   []edgeJSON `json:"edges"`
+	Rules   []ruleJSON `json:"rules"`
+}
+
+// A target or file in the graph as JSON.
+type nodeJSON struct {
+	Name         string `json:"name"`
+	Exists       bool   `json:"exists"`
+	ModTime      string `json:"mtime,omitempty"`
+	Virtual      bool   `json:"virtual"`
+	Intermediate bool   `json:"intermediate"`
+	Probable     bool   `json:"probable"`
+	Vacuous      bool   `json:"vacuous"`
+	Cycle        bool   `json:"cycle"`
+	Status       string `json:"status"`
+	LastStatus   string `json:"last_status,omitempty"`
+	Rules        []int  `json:"rules"`
+	Recipe       *int   `json:"recipe"`
+}
+
+// A prerequisite edge as JSON: the target it's from needs the one it's to, by
+// the rule given as its index in the rules.
+type edgeJSON struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Rule    int      `json:"rule"`
+	Stem    string   `json:"stem,omitempty"`
+	Matches []string `json:"matches,omitempty"`
+}
+
+// A rule applied in the graph as JSON.
+type ruleJSON struct {
+	File       string   `json:"file"`
+	Line       int      `json:"line"`
+	Targets    []string `json:"targets"`
+	Prereqs    []string `json:"prereqs"`
+	Attributes string   `json:"attributes"`
+	Meta       bool     `json:"meta"`
+	Recipe     bool     `json:"recipe"`
+	URL        string   `json:"url,omitempty"`
+	Doc        string   `json:"doc,omitempty"`
+}
+
+// The graph as JSON, its nodes sorted by name and its rules in the order the
+// nodes first use them.
+func (g *graph) toJSON() *graphJSON {
+	gj := &graphJSON{
+		Schema:  graphSchemaVersion,
+		Targets: make([]string, 0),
+		Nodes:   make([]nodeJSON, 0, len(g.nodes)),
+		Edges:   make([]edgeJSON, 0),
+		Rules:   make([]ruleJSON, 0),
+	}
+	for _, e := range g.root.prereqs {
+		if e.v != nil {
+			gj.Targets = append(gj.Targets, e.v.name)
+		}
+	}
+
+	ruleIDs := make(map[*rule]int)
+	ruleID := func(r *rule) int {
+		if id, ok := ruleIDs[r]; ok {
+			return id
+		}
+		id := len(gj.Rules)
+		ruleIDs[r] = id
+		prereqs := r.prereqs
+		if prereqs == nil {
+			prereqs = []string{}
+		}
+		gj.Rules = append(gj.Rules, ruleJSON{
+			File:       r.file,
+			Line:       r.line,
+			Targets:    r.targetNames(),
+			Prereqs:    prereqs,
+			Attributes: r.attribString(),
+			Meta:       r.isMeta,
+			Recipe:     r.recipe != "",
+			URL:        r.url,
+			Doc:        r.doc,
+		})
+		return id
+	}
+
+	names := make([]string, 0, len(g.nodes))
+	for name, u := range g.nodes {
+		if u != g.root {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := g.nodes[name]
+		nj := nodeJSON{
+			Name:         name,
+			Exists:       u.exists,
+			Virtual:      u.isVirtual(),
+			Intermediate: u.flags&nodeFlagIntermediate != 0,
+			Probable:     u.flags&nodeFlagProbable != 0,
+			Vacuous:      u.flags&nodeFlagVacuous != 0,
+			Cycle:        u.flags&nodeFlagCycle != 0,
+			Status:       u.status.String(),
+			Rules:        make([]int, 0),
+		}
+		if g.opts.statuses != nil {
+			if status, ok := g.opts.statuses.last(name); ok {
+				nj.LastStatus = status.String()
+			}
+		}
+		if u.exists {
+			nj.ModTime = u.t.UTC().Format(time.RFC3339Nano)
+		}
+		seen := make(map[int]bool)
+		for _, e := range u.prereqs {
+			if e.r == nil {
+				continue
+			}
+			id := ruleID(e.r)
+			if !seen[id] {
+				seen[id] = true
+				nj.Rules = append(nj.Rules, id)
+			}
+			// the target is built by the first rule with a recipe or URL
+			if builds := e.r.recipe != "" || e.r.url != ""; builds && nj.Recipe == nil {
+				nj.Recipe = &id
+			}
+			if e.v != nil {
+				gj.Edges = append(gj.Edges, edgeJSON{
+					From:    name,
+					To:      e.v.name,
+					Rule:    id,
+					Stem:    e.stem,
+					Matches: e.matches,
+				})
+			}
+		}
+		gj.Nodes = append(gj.Nodes, nj)
+	}
+	return gj
+}
+
+// Print the graph in the given format, dot, json or html.
+func (g *graph) export(w io.Writer, format string) error {
+	switch format {
+	case "dot":
+		g.visualize(w)
+		return nil
+	case "json":
+		encoded, err := json.MarshalIndent(g.toJSON(), "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", encoded)
+		return err
+	case "html":
+		return g.writeHTML(w)
+	}
+	return fmt.Errorf("unknown graph format %s: want dot, json or html", format)
+}
@@ -0,0 +1,159 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Statistics about the shape of the graph, for finding accidental fan-out,
+// such as everything depending on a configuration header.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// How many files the most depended upon files are listed for.
+const graphStatsTop = 10
+
+// A count of something, such as the targets depending on a file.
+type namedCount struct {
+	name  string
+	count int
+}
+
+// Statistics about a graph.
+type graphStats struct {
+	nodes        int          // targets and files, not counting the root
+	edges        int          // prerequisite edges between them
+	maxDepth     int          // longest chain of prerequisites
+	widestLevel  int          // level with the most nodes, by distance from the root
+	widestCount  int          // nodes on that level
+	metaRules    []namedCount // times each meta-rule was applied
+	mostDepended []namedCount // files with the most targets depending on them
+}
+
+func sortCounts(counts map[string]int) []namedCount {
+	sorted := make([]namedCount, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, namedCount{name, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	return sorted
+}
+
+// Gather statistics about the graph.
+func (g *graph) stats() graphStats {
+	var s graphStats
+	dependents := make(map[string]int)
+	metaRules := make(map[string]int)
+	for _, u := range g.nodes {
+		if u != g.root {
+			s.nodes++
+		}
+		seenRules := make(map[*rule]bool)
+		seenPrereqs := make(map[*node]bool)
+		for _, e := range u.prereqs {
+			if e.r != nil && e.r.isMeta && !seenRules[e.r] {
+				seenRules[e.r] = true
+				metaRules[strings.Join(e.r.targetNames(), " ")+" at "+e.r.location()]++
+			}
+			if e.v == nil {
+				continue
+			}
+			if u != g.root {
+				s.edges++
+			}
+			if u != g.root && !seenPrereqs[e.v] {
+				seenPrereqs[e.v] = true
+				dependents[e.v.name]++
+			}
+		}
+	}
+
+	// the depth of a node is its longest chain of prerequisites
+	depths := make(map[*node]int)
+	var depth func(u *node) int
+	depth = func(u *node) int {
+		if d, ok := depths[u]; ok {
+			return d
+		}
+		d := 0
+		for _, e := range u.prereqs {
+			if e.v != nil {
+				if dv := depth(e.v) + 1; dv > d {
+					d = dv
+				}
+			}
+		}
+		depths[u] = d
+		return d
+	}
+	if s.maxDepth = depth(g.root) - 1; s.maxDepth < 0 {
+		s.maxDepth = 0
+	}
+
+	// levels are by distance from the root, the targets being level 0
+	level := map[*node]int{g.root: -1}
+	queue := []*node{g.root}
+	width := make(map[int]int)
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for _, e := range u.prereqs {
+			if _, ok := level[e.v]; e.v != nil && !ok {
+				level[e.v] = level[u] + 1
+				width[level[e.v]]++
+				queue = append(queue, e.v)
+			}
+		}
+	}
+	for l, count := range width {
+		if count > s.widestCount || (count == s.widestCount && l < s.widestLevel) {
+			s.widestLevel, s.widestCount = l, count
+		}
+	}
+
+	s.metaRules = sortCounts(metaRules)
+	s.mostDepended = sortCounts(dependents)
+	if len(s.mostDepended) > graphStatsTop {
+		s.mostDepended = s.mostDepended[:graphStatsTop]
+	}
+	return s
+}
+
+// Print the statistics.
+func (s graphStats) print(out io.Writer) {
+	fmt.Fprintf(out, "nodes: %d\n", s.nodes)
+	fmt.Fprintf(out, "edges: %d\n", s.edges)
+	fmt.Fprintf(out, "max depth: %d\n", s.maxDepth)
+	fmt.Fprintf(out, "widest level: %d, with %d nodes\n", s.widestLevel, s.widestCount)
+	fmt.Fprintln(out, "meta-rule applications:")
+	for _, c := range s.metaRules {
+		fmt.Fprintf(out, "\t%d\t%s\n", c.count, c.name)
+	}
+	fmt.Fprintln(out, "most depended upon:")
+	for _, c := range s.mostDepended {
+		fmt.Fprintf(out, "\t%d\t%s\n", c.count, c.name)
+	}
+}
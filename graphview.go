@@ -0,0 +1,54 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Viewing the graph in a web browser, as printed by -graph html.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A page viewing the graph, which it's substituted into as JSON.
+//
+//go:embed graphview.html
+var graphViewer string
+
+// Write a page viewing the graph, which needs nothing else to be shown and
+// colors each target by how it fared in its last build.
+func (g *graph) writeHTML(w io.Writer) error {
+	// marshalled JSON escapes <, so it can't end the script it's in
+	data, err := json.Marshal(g.toJSON())
+	if err != nil {
+		return err
+	}
+	title := "mk graph"
+	if dir, err := os.Getwd(); err == nil {
+		title += " of " + filepath.Base(dir)
+	}
+	page := strings.Replace(graphViewer, "/*GRAPH*/null", string(data), 1)
+	page = strings.Replace(page, "<title>mk graph</title>", "<title>"+html.EscapeString(title)+"</title>", 1)
+	_, err = io.WriteString(w, page)
+	return err
+}
@@ -0,0 +1,120 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Help assembled from the documentation in the mkfile, as printed by
+// 'mk help'.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A documented name and its documentation, as listed by mk help.
+type helpEntry struct {
+	name string
+	doc  []string
+}
+
+// Print the entries under a heading, their documentation lined up.
+func printHelpSection(out io.Writer, heading string, entries []helpEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	width := 0
+	for _, e := range entries {
+		if len(e.name) > width {
+			width = len(e.name)
+		}
+	}
+	fmt.Fprintf(out, "\n%s:\n", heading)
+	for _, e := range entries {
+		for i, line := range e.doc {
+			name := ""
+			if i == 0 {
+				name = e.name
+			}
+			fmt.Fprintf(out, "  %-*s  %s\n", width, name, line)
+		}
+	}
+}
+
+// Print the documented targets, every alias, the documented variables and
+// what's built by default.
+func printHelp(out io.Writer, rs *ruleSet) {
+	fmt.Fprintln(out, "usage: mk [options] [var=value] [target ...]")
+
+	targets := make([]helpEntry, 0)
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.doc != "" && !r.isMeta && !r.isRoot() {
+			targets = append(targets, helpEntry{strings.Join(r.targetNames(), " "), strings.Split(r.doc, "\n")})
+		}
+	}
+	for _, name := range rs.aliasNames() {
+		a := rs.aliases[name]
+		doc := []string{"builds " + strings.Join(a.targets, " ")}
+		if a.doc != "" {
+			doc = append(strings.Split(a.doc, "\n"), doc...)
+		}
+		targets = append(targets, helpEntry{name, doc})
+	}
+	printHelpSection(out, "Targets", targets)
+
+	names := make([]string, 0, len(rs.varDocs))
+	for name := range rs.varDocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vars := make([]helpEntry, 0, len(names))
+	for _, name := range names {
+		value, _ := lookupVar(rs.vars, name)
+		vars = append(vars, helpEntry{name + "=" + shellJoin(value), strings.Split(rs.varDocs[name], "\n")})
+	}
+	printHelpSection(out, "Variables", vars)
+
+	fmt.Fprintln(out)
+	if value, ok := lookupVar(rs.vars, "MKDEFAULT"); ok && len(value) > 0 {
+		fmt.Fprintf(out, "By default, mk builds %s, as set by MKDEFAULT.\n", strings.Join(value, " "))
+	} else if r := defaultRule(rs, false); r != nil && (r.recipe != "" || len(r.prereqs) > 0) {
+		fmt.Fprintf(out, "By default, mk builds %s, the first rule's targets, at %s.\n",
+			strings.Join(r.targetNames(), " "), r.location())
+	} else {
+		fmt.Fprintln(out, "There is no default target; set MKDEFAULT to pick one.")
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(out, "No targets are documented; mk -list lists them all.")
+	}
+}
+
+// Run 'mk help [options] [var=value]', printing help assembled from the
+// documentation in the mkfile.
+func helpCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk help", flag.ExitOnError)
+	mkfile := mkfileFlags(flags)
+	flags.Parse(args)
+
+	rs, _ := mkfile.read(flags.Args())
+	printHelp(os.Stdout, rs)
+	return true
+}
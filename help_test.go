@@ -0,0 +1,61 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintHelp(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"## the compiler\nCC=cc -O2\nMKDEFAULT=fe\n## builds\n## the bundle\ndist/b.js:\n\tnpm run build\nx:V:\n\ttrue\nalias fe: dist/b.js\n",
+			"usage: mk [options] [var=value] [target ...]\n\n" +
+				"Targets:\n  dist/b.js  builds\n             the bundle\n  fe         builds dist/b.js\n\n" +
+				"Variables:\n  CC=cc -O2  the compiler\n\n" +
+				"By default, mk builds fe, as set by MKDEFAULT.\n"},
+		{"%.o: %.c\n\tcc -c $stem.c\nall:V: a.o\n",
+			"usage: mk [options] [var=value] [target ...]\n\n" +
+				"By default, mk builds all, the first rule's targets, at mkfile:3.\n" +
+				"No targets are documented; mk -list lists them all.\n"},
+		{"## nothing\nx:\n",
+			"usage: mk [options] [var=value] [target ...]\n\n" +
+				"Targets:\n  x  nothing\n\n" +
+				"There is no default target; set MKDEFAULT to pick one.\n"},
+	}
+
+	for _, test := range tests {
+		rs := parse(test.input, "mkfile", "/mkfile", make(map[string][]string))
+		var out strings.Builder
+		printHelp(&out, rs)
+		if out.String() != test.want {
+			t.Errorf("printHelp(%q) printed %q, want %q", test.input, out.String(), test.want)
+		}
+	}
+}
+
+func TestDefaultAlias(t *testing.T) {
+	rs := parse("MKDEFAULT=fe b\nalias fe: dist/b.js\na:\n\ttrue\n", "mkfile", "/mkfile", make(map[string][]string))
+	if got := strings.Join(defaultTargets(rs, false), " "); got != "dist/b.js b" {
+		t.Errorf("defaultTargets() = %s, want dist/b.js b", got)
+	}
+}
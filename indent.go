@@ -0,0 +1,109 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Checks of how recipes are indented: with tabs, spaces or either, and the
+// same way throughout each recipe.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How recipes may be indented.
+type indentPolicy int
+
+const (
+	indentAny    indentPolicy = iota // tabs or spaces
+	indentTabs                       // tabs only
+	indentSpaces                     // spaces only
+)
+
+// How recipes must be indented, as set by -indent.
+var recipeIndent = indentAny
+
+var indentPolicyNames = []string{"any", "tabs", "spaces"}
+
+func (policy indentPolicy) String() string {
+	return indentPolicyNames[policy]
+}
+
+// Parse the argument of -indent.
+func parseIndentPolicy(s string) (indentPolicy, error) {
+	for i, name := range indentPolicyNames {
+		if s == name {
+			return indentPolicy(i), nil
+		}
+	}
+	return indentAny, fmt.Errorf("unknown indentation %q: expected any, tabs or spaces", s)
+}
+
+// Describe indentation, such as "a tab and 2 spaces".
+func describeIndent(indent string) string {
+	tabs := strings.Count(indent, "\t")
+	parts := make([]string, 0, 2)
+	if tabs == 1 {
+		parts = append(parts, "a tab")
+	} else if tabs > 1 {
+		parts = append(parts, fmt.Sprintf("%d tabs", tabs))
+	}
+	if spaces := len(indent) - tabs; spaces == 1 {
+		parts = append(parts, "a space")
+	} else if spaces > 1 {
+		parts = append(parts, fmt.Sprintf("%d spaces", spaces))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Check the indentation of a recipe beginning on the given line. What's
+// removed from each line is as much as its first line is indented, which must
+// be indented as recipeIndent allows. A line indented differently as far as
+// that goes is warned about, as unindenting it gives confusing results.
+func (p *parser) checkIndentation(t token, first int) {
+	lines := strings.SplitAfter(t.indent+t.val, "\n")
+	for k, kind := range recipeLineKinds(lines) {
+		line := lines[k]
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		// here-documents' lines may be unindented
+		if kind != lineIndented || indent == "" || strings.TrimSpace(line) == "" {
+			continue
+		}
+		removed := indent
+		if len(removed) > len(t.indent) {
+			removed = removed[:len(t.indent)]
+		}
+
+		if recipeIndent == indentTabs && strings.ContainsRune(removed, ' ') ||
+			recipeIndent == indentSpaces && strings.ContainsRune(removed, '\t') {
+			p.basicErrorAtLine(fmt.Sprintf("recipe line indented with %s, but -indent is %s",
+				describeIndent(indent), recipeIndent), first+k)
+		}
+		if removed != t.indent {
+			mkPrintError(fmt.Sprintf("warning: %s:%d: recipe line indented with %s, but its first line with %s",
+				p.name, first+k, describeIndent(indent), describeIndent(t.indent)))
+		}
+	}
+}
+
+// Warn about indented lines following something other than a rule, which
+// are ignored.
+func (p *parser) strayRecipe(t token) {
+	mkPrintError(fmt.Sprintf("warning: %s:%d: ignoring indented lines, which follow no rule",
+		p.name, t.line-strings.Count(t.val, "\n")))
+}
@@ -0,0 +1,101 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDescribeIndent(t *testing.T) {
+	tests := map[string]string{
+		"\t":     "a tab",
+		"\t\t":   "2 tabs",
+		" ":      "a space",
+		"\t    ": "a tab and 4 spaces",
+	}
+	for indent, want := range tests {
+		if got := describeIndent(indent); got != want {
+			t.Errorf("describeIndent(%q) = %q, want %q", indent, got, want)
+		}
+	}
+}
+
+// Parse the mkfile with recipes indented as policy requires, returning what
+// was printed to stderr and whether parsing failed.
+func parseIndented(t *testing.T, input string, policy indentPolicy) (string, bool) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+	recipeIndent = policy
+	defer func() { recipeIndent = indentAny }()
+
+	failed := true
+	sandboxed(func() {
+		parse(input, "mkfile", "/mkfile", make(map[string][]string))
+		failed = false
+	})
+	w.Close()
+	printed, _ := ioutil.ReadAll(r)
+	return string(printed), failed
+}
+
+func TestIndentPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		policy  indentPolicy
+		printed string
+		failed  bool
+	}{
+		{"a:\n\tone\n\t  two\n", indentAny, "", false},
+		{"a:\n  one\n    two\n", indentAny, "", false},
+		{"a:\n\tone\n  two\n", indentAny, "mkfile:3: recipe line indented with 2 spaces, but its first line with a tab", false},
+		{"a:\n\t\tone\n\ttwo\n", indentAny, "mkfile:3: recipe line indented with a tab, but its first line with 2 tabs", false},
+		{"a:\n\tone\n\t    two\n", indentTabs, "", false},
+		{"a:\n  one\n", indentTabs, "mkfile:2: syntax error: recipe line indented with 2 spaces, but -indent is tabs", true},
+		{"a:\n  one\n\ttwo\n", indentSpaces, "mkfile:3: syntax error: recipe line indented with a tab, but -indent is spaces", true},
+		{"a:\n\tcat <<EOF\nx\n\tEOF\n\techo \\\n  y\n", indentTabs, "", false},
+		{"x=1\n\techo x\na:\n", indentAny, "mkfile:2: ignoring indented lines, which follow no rule", false},
+	}
+
+	for _, test := range tests {
+		printed, failed := parseIndented(t, test.input, test.policy)
+		if !strings.Contains(printed, test.printed) || test.printed == "" && printed != "" || failed != test.failed {
+			t.Errorf("parsing %q with -indent %s printed %q and failed %v, want %q and %v",
+				test.input, test.policy, printed, failed, test.printed, test.failed)
+		}
+	}
+}
+
+func TestParseIndentPolicy(t *testing.T) {
+	for _, name := range []string{"any", "tabs", "spaces"} {
+		if policy, err := parseIndentPolicy(name); err != nil || policy.String() != name {
+			t.Errorf("parseIndentPolicy(%q) = %v, %v", name, policy, err)
+		}
+	}
+	if _, err := parseIndentPolicy("both"); err == nil {
+		t.Errorf("parseIndentPolicy(%q) succeeded", "both")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Writing a starter mkfile for a new project with 'mk init'.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A starter mkfile, in which NAME stands for the name of the project, and
+// the outputs of building it, to be listed in .gitignore.
+type initTemplate struct {
+	mkfile  string
+	outputs []string
+}
+
+var initTemplates = map[string]initTemplate{
+	"c": {`CC=cc
+CFLAGS=-O2 -Wall
+LDFLAGS=
+TARG=NAME
+OFILES=main.o
+
+## builds NAME
+all:V: $TARG
+
+<mk:cc
+`, []string{"*.o", "*.d", "/NAME"}},
+
+	"go": {`GO=go
+GOFLAGS=
+TARG=NAME
+
+## builds NAME
+all:V: $TARG
+
+<mk:go
+`, []string{"/NAME"}},
+
+	"generic": {`# A rule is its targets, a colon, and what they're made from, followed by
+# the recipe making them, indented. 'mk -list' lists the targets.
+
+## builds everything
+all:V: hello.txt
+
+hello.txt:
+	echo hello from NAME >$target
+
+## removes what was built
+clean:V:
+	rm -f hello.txt
+`, []string{"hello.txt"}},
+}
+
+// Files mk keeps its own state in, which .gitignore lists as well.
+var stateFiles = []string{".mkoutputs", ".mkhashes", ".mktests", ".mkinputs", ".mkenvs", ".mkstatus", defaultCacheDir + "/", "/out/"}
+
+// The template suiting the project in the current directory: go if there's a
+// go.mod, c if there are C files, and generic otherwise.
+func guessTemplate() string {
+	if _, err := os.Stat("go.mod"); err == nil {
+		return "go"
+	}
+	if files, _ := filepath.Glob("*.c"); len(files) > 0 {
+		return "c"
+	}
+	return "generic"
+}
+
+// The names of the templates, in sorted order.
+func initTemplateNames() []string {
+	names := make([]string, 0, len(initTemplates))
+	for name := range initTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write the named template to mkfile in the current directory, and add the
+// outputs of building it to .gitignore, keeping what's there already.
+func initProject(name string, project string) error {
+	t, ok := initTemplates[name]
+	if !ok {
+		return fmt.Errorf("unknown template %q, expected one of %s", name, strings.Join(initTemplateNames(), ", "))
+	}
+	if _, err := os.Stat("mkfile"); err == nil {
+		return fmt.Errorf("mkfile already exists")
+	}
+	mkfile := strings.Replace(t.mkfile, "NAME", project, -1)
+	if err := ioutil.WriteFile("mkfile", []byte(mkfile), 0644); err != nil {
+		return err
+	}
+
+	ignore, err := ioutil.ReadFile(".gitignore")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(string(ignore), "\n") {
+		listed[strings.TrimSpace(line)] = true
+	}
+	if len(ignore) > 0 && ignore[len(ignore)-1] != '\n' {
+		ignore = append(ignore, '\n')
+	}
+	for _, pattern := range append(t.outputs, stateFiles...) {
+		pattern = strings.Replace(pattern, "NAME", project, -1)
+		if !listed[pattern] {
+			ignore = append(ignore, pattern+"\n"...)
+			listed[pattern] = true
+		}
+	}
+	return ioutil.WriteFile(".gitignore", ignore, 0644)
+}
+
+func initCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk init", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: mk init [%s]\n", strings.Join(initTemplateNames(), " | "))
+	}
+
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		mkExit(2)
+	}
+
+	name := guessTemplate()
+	if flags.NArg() == 1 {
+		name = flags.Arg(0)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		mkError(fmt.Sprintf("mk init: %s", err))
+	}
+	if err := initProject(name, filepath.Base(cwd)); err != nil {
+		mkError(fmt.Sprintf("mk init: %s", err))
+	}
+	mkPrintMessage(fmt.Sprintf("mk: wrote a %s mkfile and .gitignore", name))
+	return true
+}
@@ -0,0 +1,72 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestInitProject(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		if got := guessTemplate(); got != "generic" {
+			t.Errorf("guessed template %s in an empty directory, want generic", got)
+		}
+		writeFile(t, "go.mod", "module example.com/proj\n")
+		if got := guessTemplate(); got != "go" {
+			t.Errorf("guessed template %s with a go.mod, want go", got)
+		}
+
+		writeFile(t, ".gitignore", "node_modules\n.mkoutputs")
+		if err := initProject("cobol", "proj"); err == nil {
+			t.Errorf("initialized with an unknown template")
+		}
+		if err := initProject("go", "proj"); err != nil {
+			t.Fatal(err)
+		}
+		ignore, _ := ioutil.ReadFile(".gitignore")
+		want := "node_modules\n.mkoutputs\n/proj\n.mkhashes\n.mktests\n.mkinputs\n.mkenvs\n.mkstatus\n.mkcache/\n/out/\n"
+		if string(ignore) != want {
+			t.Errorf(".gitignore is %q, want %q", ignore, want)
+		}
+		if err := initProject("go", "proj"); err == nil {
+			t.Errorf("initialized over an existing mkfile")
+		}
+	})
+}
+
+func TestInitTemplates(t *testing.T) {
+	oldExecutor := parseExecutor
+	defer func() { parseExecutor = oldExecutor }()
+	parseExecutor = &stubExecutor{}
+
+	for _, name := range initTemplateNames() {
+		inDir(t, t.TempDir(), func() {
+			if err := initProject(name, "proj"); err != nil {
+				t.Fatal(err)
+			}
+			input, _ := ioutil.ReadFile("mkfile")
+			rs := parse(string(input), "mkfile", "/mkfile", make(map[string][]string))
+			if got := defaultTargets(rs, false); !reflect.DeepEqual(got, []string{"all"}) {
+				t.Errorf("the %s template's default targets are %q, want [all]", name, got)
+			}
+		})
+	}
+}
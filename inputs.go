@@ -0,0 +1,67 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Keeping track of what besides files targets depend on, declared with
+// inputs=..., such as the compiler and flags a rule uses, so that changing
+// them rebuilds the targets.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Declare what besides its prerequisites the rule's targets depend on. It
+// takes the rest of the attributes.
+func (r *rule) setInputs(name string, value string) *attribError {
+	r.inputs = value
+	return nil
+}
+
+// Hashes of the inputs targets were last built with.
+type inputStore struct {
+	state *stateStore // each target with the hash of its inputs
+}
+
+// Load the hashes kept in the given file. A missing file holds none.
+func loadInputStore(path string) *inputStore {
+	return &inputStore{loadStateStore(path, 1)}
+}
+
+// Write the hashes back to their file, if any were recorded.
+func (s *inputStore) save() error {
+	return s.state.save()
+}
+
+func hashInputs(inputs string) string {
+	h := sha256.Sum256([]byte(inputs))
+	return hex.EncodeToString(h[:])
+}
+
+// True if the target was last built with other inputs than the rule's, or if
+// that isn't known.
+func (s *inputStore) changedFor(target string, r *rule) bool {
+	recorded, ok := s.state.get(target)
+	return !ok || recorded[0] != hashInputs(r.inputs)
+}
+
+// Record the inputs the target was built with.
+func (s *inputStore) record(target string, r *rule) {
+	s.state.set(target, hashInputs(r.inputs))
+}
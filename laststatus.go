@@ -0,0 +1,65 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Keeping track of how each target fared in the last build that considered
+// it, for viewing the graph.
+
+package main
+
+// Statuses targets ended the builds that last considered them with.
+type statusStore struct {
+	state *stateStore // each target with its last status
+}
+
+// Load the statuses kept in the given file. A missing file holds none.
+func loadStatusStore(path string) *statusStore {
+	return &statusStore{loadStateStore(path, 1)}
+}
+
+// Record how the targets with rules in the graph fared, leaving those the
+// build didn't get to as they were.
+func (s *statusStore) recordGraph(g *graph) {
+	for name, u := range g.nodes {
+		if u == g.root || len(u.prereqs) == 0 {
+			continue
+		}
+		switch u.status {
+		case nodeStatusDone, nodeStatusFailed, nodeStatusNop:
+			s.state.set(name, u.status.String())
+		}
+	}
+}
+
+// The status the target ended its last build with, if it's known.
+func (s *statusStore) last(target string) (nodeStatus, bool) {
+	fields, ok := s.state.get(target)
+	if !ok {
+		return 0, false
+	}
+	for _, status := range []nodeStatus{nodeStatusDone, nodeStatusFailed, nodeStatusNop} {
+		if fields[0] == status.String() {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+// Write the statuses back to their file, if any were recorded.
+func (s *statusStore) save() error {
+	return s.state.save()
+}
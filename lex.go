@@ -45,7 +45,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strings"
 	"unicode/utf8"
 )
@@ -71,6 +73,8 @@ const (
 	tokenColon
 	tokenAssign
 	tokenRecipe
+	tokenDefine
+	tokenFor
 )
 
 func (typ tokenType) String() string {
@@ -91,15 +95,21 @@ func (typ tokenType) String() string {
 		return "[Assign]"
 	case tokenRecipe:
 		return "[Recipe]"
+	case tokenDefine:
+		return "[Define]"
+	case tokenFor:
+		return "[For]"
 	}
 	return "[MysteryToken]"
 }
 
 type token struct {
-	typ  tokenType // token type
-	val  string    // token string
-	line int       // line where it was found
-	col  int       // column on which the token began
+	typ    tokenType // token type
+	val    string    // token string
+	line   int       // line where it was found
+	col    int       // column on which the token began
+	indent string    // the indentation of a recipe's first line
+	doc    string    // '## ' comment lines just above the line the token begins
 }
 
 func (t *token) String() string {
@@ -112,17 +122,121 @@ func (t *token) String() string {
 	return t.val
 }
 
+// The lexer reads its input as it goes, keeping only what the token being
+// lexed needs, so that large generated mkfiles aren't read whole. Positions
+// are offsets within the whole input.
 type lexer struct {
-	input     string     // input string to be lexed
-	output    chan token // channel on which tokens are sent
-	start     int        // token beginning
-	startCol  int        // column on which the token begins
-	pos       int        // position within input
-	line      int        // line within input
-	col       int        // column within input
-	errMsg    string     // set to an appropriate error message when necessary
-	indented  bool       // true if the only whitespace so far on this line
-	bareWords bool       // lex only a sequence of words
+	reader    *bufio.Reader // where more input is read from, if any
+	buf       []byte        // what's read from it
+	input     string        // input read and not yet discarded
+	base      int           // the position of input[0]
+	done      bool          // all of the input has been read
+	held      string        // a '\r' read that may begin a Windows line ending
+	tokens    []token       // tokens lexed but not yet taken by nextToken
+	state     lexerStateFun // what to lex next, or nil at the end
+	start     int           // token beginning
+	startCol  int           // column on which the token begins
+	pos       int           // position within input
+	lineStart int           // position of the beginning of the current line
+	line      int           // line within input
+	col       int           // column within input
+	errMsg    string        // set to an appropriate error message when necessary
+	indented  bool          // true if the only whitespace so far on this line
+	bareWords bool          // lex only a sequence of words
+	indent    string        // the indentation of the current recipe's first line
+	doc       string        // '## ' comment lines not yet given to a token
+	docLine   int           // the line of the last of them
+}
+
+// How much input is read at a time, at least.
+const lexChunk = 64 << 10
+
+// Read more of the input, discarding what neither the token nor the line
+// being lexed needs any more. Returns false once there's no more.
+func (l *lexer) fill() bool {
+	for !l.done {
+		keep := l.start
+		if l.lineStart < keep {
+			keep = l.lineStart
+		}
+		// read as much again as is kept, so that long tokens are read in
+		// linear time
+		size := len(l.input) - (keep - l.base)
+		if size < lexChunk {
+			size = lexChunk
+		}
+		if len(l.buf) < size {
+			l.buf = make([]byte, size)
+		}
+		n, err := l.reader.Read(l.buf[:size])
+		if err != nil {
+			l.done = true
+			if err != io.EOF {
+				l.lexError(fmt.Sprintf("error reading input: %s", err))
+			}
+		}
+
+		chunk := l.held + string(l.buf[:n])
+		l.held = ""
+		if !l.done && strings.HasSuffix(chunk, "\r") {
+			chunk, l.held = chunk[:len(chunk)-1], "\r"
+		}
+		if chunk == "" {
+			continue
+		}
+		l.input = l.input[keep-l.base:] + strings.Replace(chunk, "\r\n", "\n", -1)
+		l.base = keep
+		return true
+	}
+	return false
+}
+
+// Read input until n bytes from pos are buffered, or there's no more input.
+// Returns false if there's no input at pos.
+func (l *lexer) buffered(pos int, n int) bool {
+	for pos+n > l.base+len(l.input) && l.fill() {
+	}
+	return pos < l.base+len(l.input)
+}
+
+// The input from the position a up to b, which must still be buffered.
+func (l *lexer) text(a int, b int) string {
+	return l.input[a-l.base : b-l.base]
+}
+
+// The input from off bytes past the current position, to at least the end of
+// the line there.
+func (l *lexer) aheadLine(off int) string {
+	for strings.IndexByte(l.input[l.pos+off-l.base:], '\n') < 0 && l.fill() {
+	}
+	return l.input[l.pos+off-l.base:]
+}
+
+// Lex the next token, returning false at the end of the input or after an
+// error.
+func (l *lexer) nextToken() (token, bool) {
+	for len(l.tokens) == 0 {
+		if l.state == nil {
+			return token{}, false
+		}
+		l.state = l.state(l)
+	}
+	t := l.tokens[0]
+	l.tokens = l.tokens[1:]
+	if t.typ == tokenError {
+		// nothing after an error is lexed reliably
+		l.state, l.tokens = nil, nil
+	}
+	return t, true
+}
+
+// Lex ahead until n tokens are waiting to be taken by nextToken, or there are
+// no more, returning those waiting.
+func (l *lexer) peekTokens(n int) []token {
+	for len(l.tokens) < n && l.state != nil {
+		l.state = l.state(l)
+	}
+	return l.tokens
 }
 
 // A lexerStateFun is simultaneously the state of the lexer and the next
@@ -140,16 +254,14 @@ func (l *lexer) lexError(what string) {
 func (l *lexer) peekN(n int) (c rune) {
 	pos := l.pos
 	var width int
-	i := 0
-	for ; i <= n && pos < len(l.input); i++ {
-		c, width = utf8.DecodeRuneInString(l.input[pos:])
+	for i := 0; i <= n; i++ {
+		if !l.buffered(pos, utf8.UTFMax) {
+			return eof
+		}
+		c, width = utf8.DecodeRuneInString(l.input[pos-l.base:])
 		pos += width
 	}
 
-	if i <= n {
-		return eof
-	}
-
 	return
 }
 
@@ -160,13 +272,14 @@ func (l *lexer) peek() rune {
 
 // Consume and return the next character in the lexer input.
 func (l *lexer) next() rune {
-	if l.pos >= len(l.input) {
+	if !l.buffered(l.pos, utf8.UTFMax) {
 		return eof
 	}
-	c, width := utf8.DecodeRuneInString(l.input[l.pos:])
+	c, width := utf8.DecodeRuneInString(l.input[l.pos-l.base:])
 	l.pos += width
 
 	if c == '\n' {
+		l.lineStart = l.pos
 		l.col = 0
 		l.line += 1
 		l.indented = true
@@ -188,7 +301,17 @@ func (l *lexer) skip() {
 }
 
 func (l *lexer) emit(typ tokenType) {
-	l.output <- token{typ, l.input[l.start:l.pos], l.line, l.startCol}
+	t := token{typ: typ, val: l.text(l.start, l.pos), line: l.line, col: l.startCol}
+	if typ == tokenRecipe {
+		t.indent = l.indent
+	}
+	if l.doc != "" && typ != tokenNewline {
+		if t.line == l.docLine+1 {
+			t.doc = l.doc
+		}
+		l.doc = ""
+	}
+	l.tokens = append(l.tokens, t)
 	l.start = l.pos
 	l.startCol = 0
 }
@@ -223,7 +346,7 @@ func (l *lexer) acceptRun(valid string) int {
 
 // Accept until something from the given string is encountered.
 func (l *lexer) acceptUntil(invalid string) {
-	for l.pos < len(l.input) && strings.IndexRune(invalid, l.peek()) < 0 {
+	for l.buffered(l.pos, 1) && strings.IndexRune(invalid, l.peek()) < 0 {
 		l.next()
 	}
 
@@ -235,7 +358,7 @@ func (l *lexer) acceptUntil(invalid string) {
 // Accept until something from the given string is encountered, or the end of th
 // file
 func (l *lexer) acceptUntilOrEof(invalid string) {
-	for l.pos < len(l.input) && strings.IndexRune(invalid, l.peek()) < 0 {
+	for l.buffered(l.pos, 1) && strings.IndexRune(invalid, l.peek()) < 0 {
 		l.next()
 	}
 }
@@ -251,7 +374,7 @@ func (l *lexer) skipRun(valid string) int {
 
 // Skip until something from the given string is encountered.
 func (l *lexer) skipUntil(invalid string) {
-	for l.pos < len(l.input) && strings.IndexRune(invalid, l.peek()) < 0 {
+	for l.buffered(l.pos, 1) && strings.IndexRune(invalid, l.peek()) < 0 {
 		l.skip()
 	}
 
@@ -260,24 +383,23 @@ func (l *lexer) skipUntil(invalid string) {
 	}
 }
 
-// Start a new lexer to lex the given input.
-func lex(input string) (*lexer, chan token) {
-	l := &lexer{input: input, output: make(chan token), line: 1, col: 0, indented: true}
-	go l.run()
-	return l, l.output
+// Start a new lexer to lex the given input. Windows line endings are taken
+// as newlines, so no stray '\r' ends up in words or recipes.
+func lex(input string) *lexer {
+	input = strings.Replace(input, "\r\n", "\n", -1)
+	return &lexer{input: input, done: true, state: lexTopLevel, line: 1, col: 0, indented: true}
 }
 
-func lexWords(input string) (*lexer, chan token) {
-	l := &lexer{input: input, output: make(chan token), line: 1, col: 0, indented: true, bareWords: true}
-	go l.run()
-	return l, l.output
+// Start a new lexer to lex the input read from r, as it's needed.
+func lexReader(r io.Reader) *lexer {
+	return &lexer{reader: bufio.NewReader(r), state: lexTopLevel, line: 1, col: 0, indented: true}
 }
 
-func (l *lexer) run() {
-	for state := lexTopLevel; state != nil; {
-		state = state(l)
-	}
-	close(l.output)
+// Start a new lexer to lex only a sequence of words.
+func lexWords(input string) *lexer {
+	l := lex(input)
+	l.bareWords = true
+	return l
 }
 
 func lexTopLevel(l *lexer) lexerStateFun {
@@ -294,19 +416,29 @@ func lexTopLevel(l *lexer) lexerStateFun {
 		}
 		l.skipRun(" \t\r\n")
 
-		if l.peek() == '\\' && l.peekN(1) == '\n' {
-			l.next()
-			l.next()
+		if l.peek() == '\\' && (l.peekN(1) == '\n' || l.peekN(1) == '\r' && l.peekN(2) == '\n') {
+			l.skip()
+			l.skipRun("\r")
+			l.skip()
 			l.indented = false
 		} else {
 			break
 		}
 	}
 
-	if l.indented && l.col > 0 {
+	if l.indented && l.col > 0 && l.peek() != eof {
+		l.indent = l.text(l.lineStart, l.pos)
 		return lexRecipe
 	}
 
+	if l.col == 0 && !l.bareWords {
+		if isBlock(l.aheadLine(0), "define", 2) {
+			return lexBlock(tokenDefine, nil, "endef")
+		} else if isLoop(l.aheadLine(0)) {
+			return lexBlock(tokenFor, isLoop, "end")
+		}
+	}
+
 	c := l.peek()
 	switch c {
 	case eof:
@@ -343,7 +475,20 @@ func lexAssign(l *lexer) lexerStateFun {
 }
 
 func lexComment(l *lexer) lexerStateFun {
+	// '## ' lines in column 0 document the line following them
+	doc := l.pos == l.lineStart && l.peekN(1) == '#' && l.peekN(2) != '#'
 	l.skip() // '#'
+	if doc {
+		l.skip() // '#'
+		l.ignore(" ")
+		l.acceptUntilOrEof("\n")
+		text := strings.TrimSpace(l.text(l.start, l.pos))
+		if l.doc != "" && l.docLine == l.line-1 {
+			text = l.doc + "\n" + text
+		}
+		l.doc, l.docLine = text, l.line
+		l.start, l.startCol = l.pos, l.col
+	}
 	l.skipUntil("\n")
 	return lexTopLevel
 }
@@ -391,19 +536,126 @@ func lexSingleQuotedWord(l *lexer) lexerStateFun {
 
 func lexRecipe(l *lexer) lexerStateFun {
 	for {
+		start := l.pos
 		l.acceptUntilOrEof("\n")
+		// continued lines may go on unindented
+		for continuedLine(l.text(start, l.pos)) && l.peek() != eof {
+			l.next() // '\n'
+			start = l.pos
+			l.acceptUntilOrEof("\n")
+		}
+		// here-documents may go on unindented, if they end
+		for _, delim := range heredocDelimiters(l.text(start, l.pos)) {
+			n := l.heredocEnd(delim)
+			if n < 0 {
+				break
+			}
+			for end := l.pos + n; l.pos < end; {
+				l.next()
+			}
+		}
 		l.acceptRun(" \t\n\r")
-		if !l.indented || l.col == 0 {
+		// comments in column 0 don't end a recipe going on after them
+		for l.col == 0 && l.peek() == '#' && l.continuesAfterComments() {
+			l.acceptUntilOrEof("\n")
+			l.acceptRun(" \t\n\r")
+		}
+		if !l.indented || l.col == 0 || l.peek() == eof {
 			break
 		}
 	}
 
-	if !onlyWhitespace(l.input[l.start:l.pos]) {
+	if !onlyWhitespace(l.text(l.start, l.pos)) {
 		l.emit(tokenRecipe)
 	}
 	return lexTopLevel
 }
 
+// How far past the current position, the end of a line, the line ending a
+// here-document with the given delimiter ends, or -1 if no line does.
+func (l *lexer) heredocEnd(delim string) int {
+	for off := 0; l.buffered(l.pos+off, 1); {
+		line := firstLine(l.aheadLine(off + 1))
+		if endsHeredoc(line, delim) {
+			return off + 1 + len(line)
+		}
+		off += 1 + len(line)
+	}
+	return -1
+}
+
+// True if the input, beginning with comment lines, goes on with an indented
+// line once they and any blank lines are skipped.
+func (l *lexer) continuesAfterComments() bool {
+	for off := 0; ; {
+		input := l.aheadLine(off)
+		if !strings.HasPrefix(input, "#") && strings.TrimSpace(firstLine(input)) != "" {
+			return strings.IndexAny(input, " \t") == 0
+		}
+		k := strings.IndexByte(input, '\n')
+		if k < 0 {
+			return false
+		}
+		off += k + 1
+	}
+}
+
+// The first line of the input.
+func firstLine(input string) string {
+	if k := strings.IndexByte(input, '\n'); k >= 0 {
+		return input[:k]
+	}
+	return input
+}
+
+// True if the first line of input begins with the given keyword, followed by
+// at least minFields-1 more words.
+func isBlock(input string, keyword string, minFields int) bool {
+	fields := strings.Fields(firstLine(input))
+	return len(fields) >= minFields && fields[0] == keyword
+}
+
+// True if the input begins 'for name in'.
+func isLoop(input string) bool {
+	return isBlock(input, "for", 3) && strings.Fields(firstLine(input))[2] == "in"
+}
+
+// Lex a block such as 'define name' up to the line holding only the closing
+// keyword, which is emitted as a single token, less the closing line. If opens
+// is non-nil, blocks begun by lines for which it is true may be nested. Only
+// unindented lines open or close blocks, as indented ones belong to recipes.
+func lexBlock(typ tokenType, opens func(string) bool, close string) lexerStateFun {
+	return func(l *lexer) lexerStateFun {
+		line := l.line
+		depth := 1
+		for {
+			l.acceptUntilOrEof("\n")
+			if l.next() == eof {
+				l.lexError(fmt.Sprintf("end of file encountered while looking for %s", close))
+				return nil
+			}
+
+			next := firstLine(l.aheadLine(0))
+			if strings.IndexAny(next, " \t") == 0 {
+				continue
+			} else if opens != nil && opens(next) {
+				depth++
+			} else if strings.TrimRight(next, " \t\r") == close {
+				depth--
+			}
+
+			if depth == 0 {
+				l.tokens = append(l.tokens, token{typ: typ, val: l.text(l.start, l.pos), line: line, col: l.startCol})
+				l.start = l.pos
+				for range next {
+					l.skip()
+				}
+				return lexTopLevel
+			}
+		}
+	}
+}
+
 func lexBareWord(l *lexer) lexerStateFun {
 	l.acceptUntil(nonBareRunes)
 	c := l.peek()
@@ -415,12 +667,10 @@ func lexBareWord(l *lexer) lexerStateFun {
 		return lexBackQuotedWord
 	} else if c == '\\' {
 		c1 := l.peekN(1)
-		if c1 == '\n' || c1 == '\r' {
+		if c1 == '\n' || c1 == '\r' && l.peekN(2) == '\n' {
 			if l.start < l.pos {
 				l.emit(tokenWord)
 			}
-			l.skip()
-			l.skip()
 			return lexTopLevel
 		} else {
 			l.next()
@@ -435,6 +685,11 @@ func lexBareWord(l *lexer) lexerStateFun {
 			l.next()
 			return lexBareWord
 		}
+	} else if c == ':' && l.peekN(1) == '/' && l.peekN(2) == '/' && isURL(l.text(l.start, l.pos)+"://") {
+		// a URL runs to the next space, colons and fragments included
+		l.acceptUntil(" \t\n\r")
+		l.emit(tokenWord)
+		return lexTopLevel
 	}
 
 	if l.start < l.pos {
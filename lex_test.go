@@ -0,0 +1,137 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLex(t *testing.T) {
+	type tok struct {
+		typ tokenType
+		val string
+	}
+
+	tests := []struct {
+		input string
+		want  []tok
+	}{
+		{"a: b c\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "b"},
+			{tokenWord, "c"}, {tokenNewline, "\n"}}},
+		{"x = 1 2\n", []tok{
+			{tokenWord, "x"}, {tokenAssign, "="}, {tokenWord, "1"},
+			{tokenWord, "2"}, {tokenNewline, "\n"}}},
+		{"a:V: b\n\techo $target\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "V"},
+			{tokenColon, ":"}, {tokenWord, "b"}, {tokenNewline, "\n"},
+			{tokenRecipe, "echo $target\n"}}},
+		{"<foo.mk\n", []tok{
+			{tokenRedirInclude, "<"}, {tokenWord, "foo.mk"}, {tokenNewline, "\n"}}},
+		{"<|cat x\n", []tok{
+			{tokenPipeInclude, "<|"}, {tokenWord, "cat"}, {tokenWord, "x"},
+			{tokenNewline, "\n"}}},
+		{"a: \"b c\" 'd'\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "\"b c\""},
+			{tokenWord, "'d'"}, {tokenNewline, "\n"}}},
+		{"a: b \\\n c\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "b"},
+			{tokenWord, "c"}, {tokenNewline, "\n"}}},
+		{"a: ${x}y\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "${x}y"},
+			{tokenNewline, "\n"}}},
+		{"x = 1\r\na: b\r\n\techo $target\r\n\tcat <<EOF\r\nEOF\r\n", []tok{
+			{tokenWord, "x"}, {tokenAssign, "="}, {tokenWord, "1"}, {tokenNewline, "\n"},
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "b"}, {tokenNewline, "\n"},
+			{tokenRecipe, "echo $target\n\tcat <<EOF\nEOF\n"}}},
+		{"define x\na b\nendef\ny=1\n", []tok{
+			{tokenDefine, "define x\na b\n"}, {tokenNewline, "\n"},
+			{tokenWord, "y"}, {tokenAssign, "="}, {tokenWord, "1"}, {tokenNewline, "\n"}}},
+		{"a:\n\tx\n# c\n\n\ty\n#d\nb:\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenNewline, "\n"},
+			{tokenRecipe, "x\n# c\n\n\ty\n"}, {tokenNewline, "\n"},
+			{tokenWord, "b"}, {tokenColon, ":"}, {tokenNewline, "\n"}}},
+		{"a: b \\\r\n c\r\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenWord, "b"},
+			{tokenWord, "c"}, {tokenNewline, "\n"}}},
+		{" ", []tok{}},
+		{"a:\n\tx\n ", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenNewline, "\n"},
+			{tokenRecipe, "x\n "}}},
+		{"a: `b\nc: d\n", []tok{
+			{tokenWord, "a"}, {tokenColon, ":"}, {tokenError, "`b\nc: d\n"}}},
+		{"for x in 1 2\n$x:\n\tfor f in a b; do echo $f; done\nend\n", []tok{
+			{tokenFor, "for x in 1 2\n$x:\n\tfor f in a b; do echo $f; done\n"}, {tokenNewline, "\n"}}},
+		{"for x in 1 2\n$x:\n\tend\ny=$x\nend\n", []tok{
+			{tokenFor, "for x in 1 2\n$x:\n\tend\ny=$x\n"}, {tokenNewline, "\n"}}},
+		{"for x in 1 2\nfor y in a b\n$x$y:\nend\nend \n", []tok{
+			{tokenFor, "for x in 1 2\nfor y in a b\n$x$y:\nend\n"}, {tokenNewline, "\n"}}},
+	}
+
+	for _, test := range tests {
+		l := lex(test.input)
+		got := make([]tok, 0)
+		for tk, ok := l.nextToken(); ok; tk, ok = l.nextToken() {
+			got = append(got, tok{tk.typ, tk.val})
+		}
+
+		// read a byte at a time, the same tokens are lexed
+		l = lexReader(iotest.OneByteReader(strings.NewReader(test.input)))
+		for i := 0; ; i++ {
+			tk, ok := l.nextToken()
+			if !ok {
+				if i != len(got) {
+					t.Errorf("lexReader(%q) lexed %d tokens, want %d", test.input, i, len(got))
+				}
+				break
+			}
+			if i >= len(got) || (tok{tk.typ, tk.val}) != got[i] {
+				t.Errorf("lexReader(%q) token %d = %v", test.input, i, tk)
+			}
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("lex(%q) = %v, want %v", test.input, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("lex(%q) token %d = %v, want %v", test.input, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func FuzzLex(f *testing.F) {
+	f.Add("a: b c\n\techo $target\n")
+	f.Add("x = 'a b' \"c\" `d`\n")
+	f.Add("<|cat x\n<foo.mk\n")
+	f.Add("a: ${x}y \\\n z\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		l := lex(input)
+		r := lexReader(iotest.HalfReader(strings.NewReader(input)))
+		for want, ok := l.nextToken(); ok; want, ok = l.nextToken() {
+			if got, _ := r.nextToken(); got != want {
+				t.Fatalf("lexReader(%q) token = %v, want %v", input, got, want)
+			}
+		}
+	})
+}
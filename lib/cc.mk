@@ -0,0 +1,28 @@
+# C and C++ compilation with dependency scanning.
+#
+# Set these before including:
+#
+#   CC, CXX     the C and C++ compilers (e.g. cc and c++)
+#   CFLAGS      flags passed when compiling C
+#   CXXFLAGS    flags passed when compiling C++
+#   LDFLAGS     flags passed when linking
+#   TARG        the program to build
+#   OFILES      the object files it is linked from
+
+$TARG: $OFILES
+	$CC $LDFLAGS -o $target $prereq
+
+%.o: %.c
+	$CC $CFLAGS -MMD -MF $stem.d -c -o $target $stem.c
+
+%.o: %.cc
+	$CXX $CXXFLAGS -MMD -MF $stem.d -c -o $target $stem.cc
+
+%.o: %.cpp
+	$CXX $CXXFLAGS -MMD -MF $stem.d -c -o $target $stem.cpp
+
+clean:V:
+	rm -f $TARG $OFILES ${OFILES:%.o=%.d}
+
+# header dependencies found by the compiler on previous builds
+<|'cat *.d 2>/dev/null || true'
@@ -0,0 +1,19 @@
+# Go builds.
+#
+# Set these before including:
+#
+#   GO          the go command (e.g. go)
+#   GOFLAGS     flags passed to go build
+#   TARG        the binary to build
+
+$TARG: `find . -name '*.go' ! -name '*_test.go'` go.mod
+	$GO build $GOFLAGS -o $target
+
+test:V:
+	$GO test ./...
+
+vet:V:
+	$GO vet ./...
+
+clean:V:
+	rm -f $TARG
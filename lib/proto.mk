@@ -0,0 +1,12 @@
+# Protocol buffer code generation.
+#
+# Set these before including:
+#
+#   PROTOC      the protocol buffer compiler (e.g. protoc)
+#   PROTOFLAGS  flags passed to it, e.g. --go_out=. for Go code
+
+%.pb.go: %.proto
+	$PROTOC $PROTOFLAGS $stem.proto
+
+%.pb.cc %.pb.h: %.proto
+	$PROTOC $PROTOFLAGS $stem.proto
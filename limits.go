@@ -0,0 +1,58 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Resource limits on recipes, so that a runaway one can't take down the
+// machine building.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Limit the recipe with one of the settings maxmem, maxfiles and maxcore: the
+// most memory it may map, files it may have open at once, and bytes of core it
+// may dump.
+func (r *rule) setLimit(name string, value string) *attribError {
+	n, ok := parseAmount(value)
+	if !ok {
+		return &attribError{'m', fmt.Sprintf("expected a limit for %s but found %q", name, value)}
+	}
+	if r.limits == nil {
+		r.limits = make(map[string]int64)
+	}
+	r.limits[name] = n
+	return nil
+}
+
+// The hidden first argument by which mk runs a recipe under resource limits,
+// as 'mk -_rlimit name=value ... -- program [arg ...]'. It can't be mistaken
+// for a target or a flag.
+const rlimitArg = "-_rlimit"
+
+// The limits of a rule's recipe as name=value arguments of rlimitArg, in
+// sorted order.
+func (r *rule) limitArgs() []string {
+	args := make([]string, 0, len(r.limits))
+	for name, value := range r.limits {
+		args = append(args, fmt.Sprintf("%s=%d", name, value))
+	}
+	sort.Strings(args)
+	return args
+}
@@ -0,0 +1,52 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	rs := parse("gen:V maxmem=2G maxfiles=256 maxcore=0 mem=1G:\n\t./gen\n", "mkfile", "/mkfile", make(map[string][]string))
+	r := &rs.rules[0]
+	if want := []string{"maxcore=0", "maxfiles=256", "maxmem=2147483648"}; !reflect.DeepEqual(r.limitArgs(), want) {
+		t.Errorf("limits are %q, want %q", r.limitArgs(), want)
+	}
+	if r.resources["mem"] != 1<<30 || len(r.resources) != 1 {
+		t.Errorf("resources are %v, want just mem", r.resources)
+	}
+	if got, want := r.attribString(), "V maxcore=0 maxfiles=256 maxmem=2147483648 mem=1G"; got != want {
+		t.Errorf("attributes are %q, want %q", got, want)
+	}
+
+	program, args := limitCommand(r.limitArgs(), "sh", []string{"-e"})
+	if want := []string{rlimitArg, "maxcore=0", "maxfiles=256", "maxmem=2147483648", "--", "sh", "-e"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("ran %s %q, want mk %q", program, args, want)
+	}
+	if program, _ := limitCommand(nil, "sh", nil); program != "sh" {
+		t.Errorf("without limits, ran %s", program)
+	}
+
+	for _, args := range [][]string{{}, {"x"}, {"maxmem=1", "--"}, {"nofile=1", "--", "sh"}, {"maxmem=a", "--", "sh"}} {
+		if rlimitCommand(args) {
+			t.Errorf("mk -_rlimit %q was taken as well-formed", args)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Counting builds and recipes for monitoring, in the Prometheus text format.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters for builds and the recipes they execute.
+type buildMetrics struct {
+	mutex          sync.Mutex
+	builds         float64
+	buildFailures  float64
+	buildSeconds   float64
+	recipes        float64
+	recipeFailures float64
+	recipeSeconds  float64
+}
+
+// The metrics, in the order they're written, with their help text.
+var metricNames = []struct {
+	name string
+	help string
+}{
+	{"mk_builds_total", "Builds run."},
+	{"mk_build_failures_total", "Builds that failed."},
+	{"mk_build_seconds_total", "Time spent building."},
+	{"mk_recipes_total", "Recipes executed."},
+	{"mk_recipe_failures_total", "Recipes that failed."},
+	{"mk_recipe_seconds_total", "Time spent executing recipes."},
+}
+
+// The counter with the given name.
+func (m *buildMetrics) counter(name string) *float64 {
+	switch name {
+	case "mk_builds_total":
+		return &m.builds
+	case "mk_build_failures_total":
+		return &m.buildFailures
+	case "mk_build_seconds_total":
+		return &m.buildSeconds
+	case "mk_recipes_total":
+		return &m.recipes
+	case "mk_recipe_failures_total":
+		return &m.recipeFailures
+	case "mk_recipe_seconds_total":
+		return &m.recipeSeconds
+	}
+	return nil
+}
+
+// Count a recipe that started at the given time and has just finished.
+func (m *buildMetrics) recipe(start time.Time, ok bool) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.recipes++
+	m.recipeSeconds += time.Since(start).Seconds()
+	if !ok {
+		m.recipeFailures++
+	}
+}
+
+// Count a build that started at the given time and has just finished.
+func (m *buildMetrics) build(start time.Time, ok bool) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.builds++
+	m.buildSeconds += time.Since(start).Seconds()
+	if !ok {
+		m.buildFailures++
+	}
+}
+
+// Write the metrics in the Prometheus text exposition format.
+func (m *buildMetrics) write(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, metric := range metricNames {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n",
+			metric.name, metric.help, metric.name, metric.name,
+			strconv.FormatFloat(*m.counter(metric.name), 'g', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load metrics written by an earlier run, so the counters keep counting up
+// across runs. A missing file means nothing has been counted yet.
+func loadMetrics(name string) (*buildMetrics, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return &buildMetrics{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m, err := readMetrics(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return m, nil
+}
+
+// Read metrics in the Prometheus text format, ignoring any but mk's own.
+func readMetrics(r io.Reader) (*buildMetrics, error) {
+	m := &buildMetrics{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if counter := m.counter(fields[0]); counter != nil {
+			var err error
+			if *counter, err = strconv.ParseFloat(fields[1], 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, scanner.Err()
+}
+
+// Write the metrics to a file, such as one read by node_exporter's textfile
+// collector. The file is replaced at once, so it's never read half written.
+func (m *buildMetrics) save(name string) error {
+	file, err := ioutil.TempFile(filepath.Dir(name), ".mkmetrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := m.write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
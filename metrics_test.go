@@ -0,0 +1,66 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "all:V: a b\na b:\n\ttouch $target\n")
+		for i := 0; i < 2; i++ {
+			metrics, err := loadMetrics("metrics.prom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := defaultBuildOptions()
+			opts.executor = &stubExecutor{}
+			opts.metrics = metrics
+			start := time.Now()
+			g := runMk(t, nil, opts)
+			metrics.build(start, g.root.status != nodeStatusFailed)
+			if err := metrics.save("metrics.prom"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		metrics, err := loadMetrics("metrics.prom")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := metrics.write(&out); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"# TYPE mk_builds_total counter\nmk_builds_total 2\n",
+			"mk_build_failures_total 0\n",
+			"mk_recipes_total 4\n",
+			"mk_recipe_failures_total 0\n",
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("metrics don't contain %q:\n%s", want, out.String())
+			}
+		}
+	})
+}
@@ -45,83 +45,136 @@
 package main
 
 import (
+	"context"
 	"bufio"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
-// True if we are ignoring timestamps and rebuilding everything.
-var rebuildAll bool = false
+// Called with each target with rules as it finishes building.
+type progressFunc func(target string, status nodeStatus)
 
-// Set of targets for which we are forcing rebuild
-var rebuildTargets map[string]bool = make(map[string]bool)
-
-// Lock on standard out, messages don't get interleaved too much.
-var mkMsgMutex sync.Mutex
-
-// The maximum number of times an rule may be applied.
-const maxRuleCnt = 1
-
-// Limit the number of recipes executed simultaneously.
-var subprocsAllowed int
-
-// Current subprocesses being executed
-var subprocsRunning int
-
-// Wakeup on a free subprocess slot.
-var subprocsRunningCond *sync.Cond = sync.NewCond(&sync.Mutex{})
-
-// Prevent more than one recipe at a time from trying to take over
-var exclusiveSubproc = sync.Mutex{}
+// Options controlling a build.
+type buildOptions struct {
+	ctx             context.Context // cancelled to stop the build
+	dryRun          bool            // print recipes without executing them
+	rebuildAll      bool            // ignore timestamps and rebuild everything
+	rebuildTargets  map[string]bool // targets for which we are forcing rebuild
+	rebuildPatterns []string        // glob patterns of targets to force rebuild
+	jobs            int             // maximum number of recipes executed at once
+	fetchJobs       int             // maximum number of URLs fetched at once
+	failTail        int             // lines of a failed quiet recipe's output to show
+	lineByLine      bool            // execute each line of every recipe on its own
+	markStderr      bool            // mark each line recipes write to stderr
+	nice            int             // niceness to run recipes at, if any
+	cpus            string          // CPUs to run recipes on, if not all of them
+	tracer          *tracer         // spans of recipes executed, if traced
+	metrics         *buildMetrics   // counts of builds and recipes, if kept
+	progress        progressFunc    // told of each target as it finishes
+	atFile          int             // length of $prereq beyond which it's @$prereqfile
+	keepGoing       bool            // keep building after a recipe fails
+	statWorkers     int             // maximum number of files stat'ed at once
+	skipVirtualStat bool            // don't stat targets of virtual rules
+	executor        executor        // runs recipes
+	equalTime       equalTimePolicy // treatment of targets as old as a prerequisite
+	skew            time.Duration   // timestamps this close together are taken as equal
+	metaDepth       int             // meta-rules in a row applied to missing files, if limited
+	chain           int             // times a rule may be applied in one chain of inference
+	future          futurePolicy    // treatment of files modified in the future
+	ambiguity       ambiguityPolicy // which of several different recipes a target gets
+	why             bool            // explain how the graph is built
+	intermediates   bool            // infer intermediate files from chains of meta-rules
+	hashes          *hashStore      // prerequisite hashes for equalTimeHash
+	outputs         *outputStore    // targets produced by recipes, if recorded
+	tests           *testStore      // results of tests, if kept
+	inputs          *inputStore     // inputs targets were built with, if kept
+	statuses        *statusStore    // how targets fared in their last build, if kept
+	prompts         *promptBroker   // asks before each recipe, if set
+	provenance      *provenanceWriter // records how targets were built, if set
+	log             *buildLog       // recipes executed, if logged
+	dirNewest       bool            // date directories by the newest file within
+	stats           *statCache      // files stat'ed so far
+}
 
-// Wait until there is an available subprocess slot.
-func reserveSubproc() {
-	subprocsRunningCond.L.Lock()
-	for subprocsRunning >= subprocsAllowed {
-		subprocsRunningCond.Wait()
+// Build options with their default values.
+func defaultBuildOptions() *buildOptions {
+	return &buildOptions{
+		ctx:            context.Background(),
+		rebuildTargets: make(map[string]bool),
+		jobs:           1,
+		fetchJobs:      4,
+		statWorkers:    16,
+		metaDepth:      defaultMetaDepth,
+		chain:          maxRuleCnt,
+		executor:       processExecutor{},
+		stats:          newStatCache(),
 	}
-	subprocsRunning++
-	subprocsRunningCond.L.Unlock()
 }
 
-// Free up another subprocess to run.
-func finishSubproc() {
-	subprocsRunningCond.L.Lock()
-	subprocsRunning--
-	subprocsRunningCond.Signal()
-	subprocsRunningCond.L.Unlock()
+// True if the target's rebuild is forced, either by name or by matching one
+// of the rebuild patterns.
+func (opts *buildOptions) forcesRebuild(target string) bool {
+	if opts.rebuildAll || opts.rebuildTargets[target] {
+		return true
+	}
+	for _, pat := range opts.rebuildPatterns {
+		if matched, _ := filepath.Match(pat, target); matched {
+			return true
+		}
+	}
+	return false
 }
 
-// Make everyone wait while we
-func reserveExclusiveSubproc() {
-	exclusiveSubproc.Lock()
-	// Wait until everything is done running
-	stolenSubprocs := 0
-	subprocsRunningCond.L.Lock()
-	stolenSubprocs = subprocsAllowed - subprocsRunning
-	subprocsRunning = subprocsAllowed
-	for stolenSubprocs < subprocsAllowed {
-		subprocsRunningCond.Wait()
-		stolenSubprocs += subprocsAllowed - subprocsRunning
-		subprocsRunning = subprocsAllowed
+// Force rebuilding the targets named with -r. Glob patterns among them force
+// rebuilding of the matching targets rather than naming targets themselves.
+// Returns the targets that aren't patterns.
+func (opts *buildOptions) forceRebuild(targets []string) []string {
+	explicit := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if isGlobPattern(target) {
+			opts.rebuildPatterns = append(opts.rebuildPatterns, target)
+		} else {
+			opts.rebuildTargets[target] = true
+			explicit = append(explicit, target)
+		}
 	}
+	return explicit
 }
 
-func finishExclusiveSubproc() {
-	subprocsRunning = 0
-	subprocsRunningCond.Broadcast()
-	subprocsRunningCond.L.Unlock()
-	exclusiveSubproc.Unlock()
+// True if the string contains glob metacharacters.
+func isGlobPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
 }
 
+// Lock on standard out, messages don't get interleaved too much.
+var mkMsgMutex sync.Mutex
+
+// The maximum number of times an rule may be applied in one chain of
+// inference, by default.
+const maxRuleCnt = 1
+
+// The most times a rule may be applied in one chain of inference, as each
+// application can multiply the files mk looks for.
+const maxChain = 16
+
+// How many meta-rules in a row are applied to missing files by default: as
+// many as the chain of inference allows.
+const defaultMetaDepth = 0
+
 // Build a node's prereqs. Block until completed.
-func mkNodePrereqs(g *graph, u *node, e *edge, prereqs []*node, dryrun bool,
-	required bool) nodeStatus {
+func mkNodePrereqs(g *graph, u *node, e *edge, prereqs []*node,
+	opts *buildOptions, required bool) nodeStatus {
 	prereqStat := make(chan nodeStatus)
 	pending := 0
 
@@ -130,7 +183,7 @@ func mkNodePrereqs(g *graph, u *node, e *edge, prereqs []*node, dryrun bool,
 		prereqs[i].mutex.Lock()
 		switch prereqs[i].status {
 		case nodeStatusReady, nodeStatusNop:
-			go mkNode(g, prereqs[i], dryrun, required)
+			go mkNode(g, prereqs[i], opts, required)
 			fallthrough
 		case nodeStatusStarted:
 			prereqs[i].listeners = append(prereqs[i].listeners, prereqStat)
@@ -159,10 +212,11 @@ func mkNodePrereqs(g *graph, u *node, e *edge, prereqs []*node, dryrun bool,
 // Args:
 //  g: Graph in which the node lives.
 //  u: Node to (possibly) build.
-//  dryrun: Don't actually build anything, just pretend.
-//  required: Avoid building this node, unless its prereqs are out of date.
+//  opts: Options controlling the build.
+//  required: Avoid building this node if it's a missing intermediate file,
+//            unless its prereqs are out of date.
 //
-func mkNode(g *graph, u *node, dryRun bool, required bool) {
+func mkNode(g *graph, u *node, opts *buildOptions, required bool) {
 	// try to claim on this node
 	u.mutex.Lock()
 	if u.status != nodeStatusReady && u.status != nodeStatusNop {
@@ -176,6 +230,15 @@ func mkNode(g *graph, u *node, dryRun bool, required bool) {
 	// when finished, notify the listeners
 	finalStatus := nodeStatusDone
 	defer func() {
+		// an error ending a daemon's build fails the target, since nothing
+		// would recover it in the goroutine building a prerequisite
+		if r := recover(); r != nil {
+			if _, ok := r.(daemonAbort); !ok {
+				panic(r)
+			}
+			finalStatus = nodeStatusFailed
+		}
+
 		u.mutex.Lock()
 		u.status = finalStatus
 		for i := range u.listeners {
@@ -183,8 +246,18 @@ func mkNode(g *graph, u *node, dryRun bool, required bool) {
 		}
 		u.listeners = u.listeners[0:0]
 		u.mutex.Unlock()
+		if opts.progress != nil && u != g.root && len(u.prereqs) > 0 {
+			opts.progress(u.name, finalStatus)
+		}
 	}()
 
+	// a file that couldn't be stat'ed fails once it's needed
+	if u.statErr != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to stat %s: %s", u.name, u.statErr))
+		finalStatus = nodeStatusFailed
+		return
+	}
+
 	// there aren't any tules
 	if len(u.prereqs) == 0 {
 		if !(u.r != nil && u.r.attributes.virtual) && !u.exists {
@@ -195,11 +268,14 @@ func mkNode(g *graph, u *node, dryRun bool, required bool) {
 		return
 	}
 
-	// there should otherwise be exactly one edge with an associated rule
+	// the target is built by the first rule with a recipe or URL, if any,
+	// which are all alike once ambiguous recipes have been pruned
 	prereqs := make([]*node, 0)
 	var e *edge = nil
 	for i := range u.prereqs {
-		if u.prereqs[i].r != nil {
+		r := u.prereqs[i].r
+		builds := r != nil && (r.recipe != "" || r.url != "")
+		if r != nil && (e == nil || builds && e.r.recipe == "" && e.r.url == "") {
 			e = u.prereqs[i]
 		}
 		if u.prereqs[i].v != nil {
@@ -214,16 +290,18 @@ func mkNode(g *graph, u *node, dryRun bool, required bool) {
 	}
 
 	prereqsRequired := required && (e.r.attributes.virtual || !u.exists)
-	mkNodePrereqs(g, u, e, prereqs, dryRun, prereqsRequired)
+	if mkNodePrereqs(g, u, e, prereqs, opts, prereqsRequired) == nodeStatusFailed {
+		finalStatus = nodeStatusFailed
+	}
 
 	upToDate := true
 	if !e.r.attributes.virtual {
-		u.updateTimestamp()
-		if !u.exists && required {
+		u.updateTimestamp(opts)
+		if !u.exists && (required || !u.isMissingIntermediate()) {
 			upToDate = false
 		} else if u.exists || required {
 			for i := range prereqs {
-				if u.t.Before(prereqs[i].t) || prereqs[i].status == nodeStatusDone {
+				if opts.olderThan(u, prereqs[i]) || prereqs[i].status == nodeStatusDone {
 					upToDate = false
 				}
 			}
@@ -234,42 +312,159 @@ func mkNode(g *graph, u *node, dryRun bool, required bool) {
 		upToDate = false
 	}
 
-	_, isRebuildTarget := rebuildTargets[u.name]
-	if isRebuildTarget || rebuildAll {
+	if opts.forcesRebuild(u.name) {
+		upToDate = false
+	}
+
+	// as is a target whose rule's inputs changed since it was built
+	if upToDate && e.r.inputs != "" && opts.inputs != nil && opts.inputs.changedFor(u.name, e.r) {
+		upToDate = false
+	}
+
+	// a target that doesn't match its checksum is rebuilt, say, redownloaded
+	if upToDate && e.r.checksum != "" && u.exists && hashFile(u.name) != e.r.checksum {
+		upToDate = false
+	}
+
+	// what was fetched is revalidated, unless its checksum pins it down
+	if e.r.url != "" && e.r.checksum == "" {
 		upToDate = false
 	}
 
 	// make another pass on the prereqs, since we know we need them now
-	if !upToDate {
-		mkNodePrereqs(g, u, e, prereqs, dryRun, true)
+	if !upToDate && finalStatus != nodeStatusFailed {
+		if mkNodePrereqs(g, u, e, prereqs, opts, true) == nodeStatusFailed {
+			finalStatus = nodeStatusFailed
+		}
 	}
 
-	// execute the recipe, unless the prereqs failed
-	if !upToDate && finalStatus != nodeStatusFailed && len(e.r.recipe) > 0 {
-		if e.r.attributes.exclusive {
-			reserveExclusiveSubproc()
-		} else {
-			reserveSubproc()
+	// don't start anything new once a recipe has failed, unless asked to, or
+	// once the build is cancelled
+	if (!opts.keepGoing && g.hasFailed()) || opts.ctx.Err() != nil {
+		finalStatus = nodeStatusFailed
+	}
+
+	// a test whose inputs haven't changed since it passed needn't run again
+	key := ""
+	if !upToDate && finalStatus != nodeStatusFailed && e.r.attributes.test && opts.tests != nil && !opts.dryRun {
+		key = testKey(u.name, u, e, prereqs)
+		if !opts.forcesRebuild(u.name) && opts.tests.cachedPass(u.name, key) {
+			upToDate = true
 		}
+	}
 
-		if !dorecipe(u.name, u, e, dryRun) {
+	// fetch the target, or execute the recipe, unless the prereqs failed
+	if !upToDate && finalStatus != nodeStatusFailed && (e.r.url != "" || len(e.r.recipe) > 0) && restricted != nil {
+		if err := restricted.checkRecipe(u.name, e, prereqs); err != nil {
+			mkPrintError(fmt.Sprintf("mk: restricted: not building %s: %s", u.name, err))
+			finalStatus = nodeStatusFailed
+			g.setFailed()
+			return
+		}
+	}
+	if !upToDate && finalStatus != nodeStatusFailed && e.r.url != "" {
+		if !g.fetches.reserve(1) {
+			finalStatus = nodeStatusFailed
+			return
+		}
+		start := time.Now()
+		changed, ok := fetch(u.name, e.r, opts)
+		g.fetches.finish(1)
+		cache := "miss"
+		if ok && !changed {
+			cache = "hit"
+		}
+		opts.tracer.record(u.name, e.r, start, ok, cache)
+		if !ok {
 			finalStatus = nodeStatusFailed
+			g.setFailed()
+		} else if !changed {
+			finalStatus = nodeStatusNop
+			g.mutex.Lock()
+			g.cacheHits++
+			g.mutex.Unlock()
+		}
+		u.updateTimestamp(opts)
+	} else if !upToDate && finalStatus != nodeStatusFailed && len(e.r.recipe) > 0 {
+		if opts.prompts != nil && !opts.dryRun {
+			switch opts.prompts.confirm(u.name, e.r.recipe) {
+			case answerNo:
+				finalStatus = nodeStatusNop
+				return
+			case answerQuit:
+				finalStatus = nodeStatusFailed
+				return
+			}
+		}
+		if !g.reserve(e.r) {
+			// the build was cancelled while waiting
+			finalStatus = nodeStatusFailed
+			return
 		}
-		u.updateTimestamp()
 
-		if e.r.attributes.exclusive {
-			finishExclusiveSubproc()
-		} else {
-			finishSubproc()
+		start := time.Now()
+		before := statResult{u.t, u.exists, u.statErr}
+		ok := dorecipe(u.name, u, e, opts) && verifyChecksum(u.name, e.r, opts)
+		opts.tracer.record(u.name, e.r, start, ok, "miss")
+		opts.metrics.recipe(start, ok)
+		if key != "" && opts.tests.record(u.name, key, ok) {
+			ok = true
 		}
+		if !ok {
+			finalStatus = nodeStatusFailed
+			g.setFailed()
+			if !opts.dryRun {
+				u.removeFailed(e.r, before, opts)
+			}
+		} else if !opts.dryRun {
+			if opts.equalTime == equalTimeHash {
+				opts.hashes.record(u.name, prereqs)
+			}
+			if opts.outputs != nil && !e.r.attributes.virtual && !e.r.attributes.precious {
+				opts.outputs.record(u.name)
+			}
+			if opts.inputs != nil && e.r.inputs != "" {
+				opts.inputs.record(u.name, e.r)
+			}
+			if opts.provenance != nil && !e.r.attributes.virtual {
+				if err := opts.provenance.write(u.name, e.r, prereqs, start); err != nil {
+					mkPrintError(fmt.Sprintf("mk: unable to write the provenance of %s: %s", u.name, err))
+				}
+			}
+		}
+		u.updateTimestamp(opts)
+
+		g.finish(e.r)
 	} else if finalStatus != nodeStatusFailed {
 		finalStatus = nodeStatusNop
 	}
 }
 
+// Build the graph's root. Once opts.ctx is cancelled, recipes waiting for their
+// turn don't start, and those executing are killed.
+func mkRoot(g *graph, opts *buildOptions) {
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-opts.ctx.Done():
+			g.cancel()
+		case <-finished:
+		}
+	}()
+	mkNode(g, g.root, opts, true)
+}
+
+// How deeply mk may be run within itself.
+const maxMkLevel = 64
+
+// Terminate mk after a fatal error. Fuzz tests replace this so that errors
+// can be recovered from.
+var mkExit = os.Exit
+
 func mkError(msg string) {
 	mkPrintError(msg)
-	os.Exit(1)
+	mkExit(1)
 }
 
 func mkPrintError(msg string) {
@@ -301,59 +496,529 @@ func mkPrintRecipe(target string, recipe string, quiet bool) {
 	mkMsgMutex.Unlock()
 }
 
+// Print a recipe's captured output.
+func mkPrintOutput(output string) {
+	mkMsgMutex.Lock()
+	os.Stdout.WriteString(output)
+	mkMsgMutex.Unlock()
+}
+
+// Print a recipe that failed along with the last lines of its output.
+func mkPrintFailure(target string, recipe string, output string, err error, lines int) {
+	mkMsgMutex.Lock()
+	defer mkMsgMutex.Unlock()
+
+	fmt.Fprintf(os.Stderr, "mk: recipe for %s failed (%s):\n", target, err)
+	for _, line := range strings.Split(strings.TrimSuffix(recipe, "\n"), "\n") {
+		fmt.Fprintf(os.Stderr, "\t%s\n", line)
+	}
+	tail := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if output == "" {
+		return
+	} else if len(tail) > lines {
+		tail = tail[len(tail)-lines:]
+		fmt.Fprintf(os.Stderr, "mk: last %d lines of output:\n", lines)
+	} else {
+		fmt.Fprintf(os.Stderr, "mk: output:\n")
+	}
+	for _, line := range tail {
+		fmt.Fprintf(os.Stderr, "\t%s\n", line)
+	}
+}
+
+// A flag that may be given more than once, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Print the targets of each rule that isn't a meta-rule, along with where the
+// rule is defined and its documentation, if any, followed by the aliases.
+func listTargets(out io.Writer, rs *ruleSet) {
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.isMeta || r.isRoot() || r.url != "" {
+			continue
+		}
+		fmt.Fprintf(out, "%s\t%s", strings.Join(r.targetNames(), " "), r.location())
+		if r.doc != "" {
+			fmt.Fprintf(out, "\t%s", strings.Join(strings.Fields(r.doc), " "))
+		}
+		fmt.Fprintln(out)
+	}
+	for _, name := range rs.aliasNames() {
+		a := rs.aliases[name]
+		fmt.Fprintf(out, "%s -> %s\t%s", name, strings.Join(a.targets, " "), a.location())
+		if a.doc != "" {
+			fmt.Fprintf(out, "\t%s", strings.Join(strings.Fields(a.doc), " "))
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+// Print the variables that don't have their value from the environment, each
+// followed by where it got its value, then every rule, preceded by where it is
+// defined. If names are given, just those variables are printed.
+func printDatabase(out io.Writer, rs *ruleSet, names []string) {
+	if len(names) > 0 {
+		for _, name := range names {
+			if value, ok := lookupVar(rs.vars, name); ok {
+				fmt.Fprintf(out, "%s=%s\t# %s\n", name, shellJoin(value), rs.origins[name])
+			} else {
+				fmt.Fprintf(out, "# %s is not set\n", name)
+			}
+		}
+		return
+	}
+
+	for name := range rs.vars {
+		if rs.origins[name] != originEnvironment {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, _ := lookupVar(rs.vars, name)
+		fmt.Fprintf(out, "%s=%s\t# %s\n", name, shellJoin(value), rs.origins[name])
+	}
+
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.isRoot() {
+			continue
+		}
+		fmt.Fprintf(out, "\n# %s\n", r.location())
+		if r.doc != "" {
+			fmt.Fprintf(out, "## %s\n", strings.Replace(r.doc, "\n", "\n## ", -1))
+		}
+		fmt.Fprintf(out, "%s:", strings.Join(r.targetNames(), " "))
+		if attribs := r.attribString(); attribs != "" {
+			fmt.Fprintf(out, "%s:", attribs)
+		}
+		if len(r.prereqs) > 0 {
+			fmt.Fprintf(out, " %s", strings.Join(r.prereqs, " "))
+		}
+		fmt.Fprintln(out)
+		if r.url != "" {
+			fmt.Fprintf(out, "\t# fetched from %s\n", r.url)
+		}
+		if r.recipe != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(r.recipe, "\n"), "\n") {
+				fmt.Fprintf(out, "\t%s\n", line)
+			}
+		}
+	}
+
+	for _, name := range rs.aliasNames() {
+		a := rs.aliases[name]
+		fmt.Fprintf(out, "\n# %s\n", a.location())
+		if a.doc != "" {
+			fmt.Fprintf(out, "## %s\n", strings.Replace(a.doc, "\n", "\n## ", -1))
+		}
+		fmt.Fprintf(out, "alias %s: %s\n", name, strings.Join(a.targets, " "))
+	}
+}
+
+// The targets built when none are given explicitly: those listed in
+// $MKDEFAULT, aliases among them replaced, or else those of the first
+// non-meta rule in the mkfile. If skipVirtual is true, rules whose targets are
+// all virtual are passed over. A first rule with nothing to do gives none, with
+// a warning suggesting others.
+func defaultTargets(rs *ruleSet, skipVirtual bool) []string {
+	if targets, ok := lookupVar(rs.vars, "MKDEFAULT"); ok && len(targets) > 0 {
+		return rs.resolveAliases(targets)
+	}
+
+	r := defaultRule(rs, skipVirtual)
+	if r == nil {
+		return []string{}
+	}
+
+	// a rule with nothing to do is unlikely to be what was meant
+	if r.recipe == "" && len(r.prereqs) == 0 {
+		mkPrintError(fmt.Sprintf("warning: the first rule in the mkfile, for %s at %s, has no prerequisites or recipe\n"+
+			"candidate targets are: %s\nset MKDEFAULT or name a target explicitly",
+			strings.Join(r.targetNames(), " "), r.location(),
+			strings.Join(candidateTargets(rs, 10), " ")))
+		return []string{}
+	}
+	return r.targetNames()
+}
+
+// The first non-meta rule in the mkfile, or nil if there's none. If
+// skipVirtual is true, rules whose targets are all virtual are passed over.
+func defaultRule(rs *ruleSet, skipVirtual bool) *rule {
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if !r.isMeta && !r.isRoot() && !(skipVirtual && r.attributes.virtual) {
+			return r
+		}
+	}
+	return nil
+}
+
+// List up to n targets of non-meta rules that have something to do.
+func candidateTargets(rs *ruleSet, n int) []string {
+	candidates := make([]string, 0)
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.isMeta || r.isRoot() || (r.recipe == "" && len(r.prereqs) == 0) {
+			continue
+		}
+		for _, target := range r.targetNames() {
+			if len(candidates) == n {
+				return append(candidates, "...")
+			}
+			candidates = append(candidates, target)
+		}
+	}
+	return candidates
+}
+
+// The variables the mkfile starts out with: those of the environment, mk's
+// own, $MKPATH with the directories given, and the assignments among args,
+// which are listed in cmdline. Returns the args that aren't assignments.
+func mkfileEnv(includeDirs []string, args []string) (env map[string][]string, cmdline []string, rest []string) {
+	env = make(map[string][]string)
+	for _, elem := range os.Environ() {
+		vals := strings.SplitN(elem, "=", 2)
+		env[vals[0]] = append(env[vals[0]], vals[1])
+	}
+	setBuiltinVars(env)
+
+	if len(includeDirs) > 0 {
+		env["MKPATH"] = append(includeDirs, env["MKPATH"]...)
+	}
+
+	// assignments on the command line take precedence over the mkfile
+	rest = make([]string, 0)
+	cmdline = make([]string, 0)
+	for _, arg := range args {
+		if k := strings.IndexByte(arg, '='); k > 0 && isValidVarName(arg[:k]) {
+			env[arg[:k]] = splitWords(arg[k+1:])
+			cmdline = append(cmdline, arg[:k])
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return env, cmdline, rest
+}
+
+// Read and parse the mkfiles in order into one rule set, searching
+// includeDirs for included files. A mkfile named - is read from the standard
+// input. Arguments of the form var=value are assigned, and the rest are
+// returned.
+func readMkfile(mkfiles []string, includeDirs []string, args []string, envOverrides bool) (*ruleSet, []string) {
+	// the default mkfile may have been read already, deciding between a
+	// command and a target, and isn't read twice
+	if rs := preparsed; rs != nil && len(mkfiles) == 0 && len(includeDirs) == 0 && !envOverrides && profile == "" {
+		preparsed = nil
+		if _, cmdline, rest := mkfileEnv(nil, args); len(cmdline) == 0 {
+			return rs, rest
+		}
+	}
+	if len(mkfiles) == 0 {
+		mkfiles = []string{defaultMkfile()}
+	}
+	// the mkfiles are read as they're parsed
+	inputs := make([]*os.File, len(mkfiles))
+	abspaths := make([]string, len(mkfiles))
+	for i, mkfilePath := range mkfiles {
+		var err error
+		if mkfilePath == "-" {
+			inputs[i] = os.Stdin
+		} else if inputs[i], err = os.Open(mkfilePath); err != nil {
+			mkError("no mkfile found")
+		} else {
+			defer inputs[i].Close()
+		}
+
+		abspaths[i], err = filepath.Abs(mkfilePath)
+		if err != nil {
+			mkError("unable to find mkfile's absolute path")
+		}
+	}
+
+	env, cmdline, rest := mkfileEnv(includeDirs, args)
+	rs := newRuleSet(env)
+	rs.envOverrides = envOverrides
+	for _, name := range cmdline {
+		rs.origins[name] = originCommandLine
+	}
+	if profile != "" {
+		loadProfile(rs, profile, abspaths[0])
+	}
+	for i, mkfilePath := range mkfiles {
+		if mkfilePath == "-" {
+			mkfilePath = "<stdin>"
+		}
+		parseReader(inputs[i], mkfilePath, rs, abspaths[i])
+	}
+	rs.checkResources()
+	return rs, rest
+}
+
+// How a command reads the mkfile, as given by its -f, -I, -e and -profile
+// flags.
+type mkfileOptions struct {
+	mkfiles      stringList
+	includeDirs  stringList
+	envOverrides bool
+}
+
+// Add the flags that choose the mkfile and how it's read to a command's.
+func mkfileFlags(flags *flag.FlagSet) *mkfileOptions {
+	o := &mkfileOptions{}
+	flags.Var(&o.mkfiles, "f", "use the given file as mkfile (may be repeated, - for the standard input)")
+	flags.Var(&o.includeDirs, "I", "search the given directory for included files (may be repeated)")
+	flags.BoolVar(&o.envOverrides, "e", false, "let environment variables override assignments in the mkfile")
+	flags.StringVar(&profile, "profile", "", "use the variables of profiles/name.mk, keeping outputs in out/name")
+	return o
+}
+
+// Read the mkfile as readMkfile does, as the flags have it.
+func (o *mkfileOptions) read(args []string) (*ruleSet, []string) {
+	return readMkfile(o.mkfiles, o.includeDirs, args, o.envOverrides)
+}
+
+// Commands run by 'mk command' in place of building targets. A command
+// returns false if its arguments are meant as targets after all.
+var commands = map[string]func(args []string) bool{
+	"clean":     cleanCommand,
+	"configure": configureCommand,
+	"daemon":    daemonCommand,
+	"env":       envCommand,
+	"envdiff":   envdiffCommand,
+	"eval":      evalCommand,
+	"help":      helpCommand,
+	"init":      initCommand,
+	"query":     queryCommand,
+	"replay":    replayCommand,
+	"vet":       vetCommand,
+}
+
+// Commands that only run when given a flag of their own, such as 'mk clean
+// -generated', and so needn't give way to a target of the same name.
+var flaggedCommands = map[string]bool{"clean": true}
+
+// The default mkfile as mkfileDefines read it, kept for the next readMkfile
+// to read the same mkfile, so its backticks and pipe includes run only once.
+var preparsed *ruleSet
+
+// True if the mkfile in the current directory has a rule or an alias for the
+// target, which is built rather than running the command of the same name.
+func mkfileDefines(target string) bool {
+	if _, ok := findMkfile(".", mkfileNames()); !ok {
+		return false
+	}
+	preparsed = nil
+	rs, _ := readMkfile(nil, nil, nil, false)
+	preparsed = rs
+	_, isAlias := rs.aliases[target]
+	return len(rs.targetRules[target]) > 0 || isAlias
+}
+
 func main() {
-	var mkfilePath string
+	// mk run by backticks or recipes within mk could otherwise recurse forever
+	level, _ := strconv.Atoi(os.Getenv("MKLEVEL"))
+	if level >= maxMkLevel {
+		mkError(fmt.Sprintf("mk: recursion too deep: MKLEVEL is %d", level))
+	}
+	os.Setenv("MKLEVEL", strconv.Itoa(level+1))
+
+	// recipes with resource limits are run by way of mk, which sets them
+	if len(os.Args) > 1 && os.Args[1] == rlimitArg {
+		if !rlimitCommand(os.Args[2:]) {
+			mkError(fmt.Sprintf("mk: %s: expected name=value ... -- program [arg ...]", rlimitArg))
+		}
+		return
+	}
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok && (flaggedCommands[os.Args[1]] || !mkfileDefines(os.Args[1])) && command(os.Args[2:]) {
+			return
+		}
+	}
+
+	var mkfiles stringList
 	var interactive bool
-	var dryRun bool
+	var confirm bool
+	var noParseExec bool
+	var restrict bool
+	var allowlist string
+	var provenanceDir string
+	var logFile string
+	var recordEnvs bool
+	var printVersion bool
 	var shallowRebuild bool
+	var skipVirtualDefault bool
+	var silent bool
 	var quiet bool
+	var list bool
+	var graphStats bool
+	var graphFormat string
+	var nfs bool
+	var printDB bool
+	var warnUndefined bool
+	var indent string
+	var strict bool
+	var envOverrides bool
+	var printSummary bool
+	var summaryFile string
+	var otlpEndpoint string
+	var metricsFile string
+	var changedList string
+	opts := defaultBuildOptions()
 
-	flag.StringVar(&mkfilePath, "f", "mkfile", "use the given file as mkfile")
-	flag.BoolVar(&dryRun, "n", false, "print commands without actually executing")
+	var includeDirs stringList
+	flag.Var(&mkfiles, "f", "use the given file as mkfile (may be repeated, - for the standard input)")
+	flag.BoolVar(&printVersion, "version", false, "print the version of mk and exit")
+	flag.StringVar(&profile, "profile", "", "use the variables of profiles/name.mk, keeping outputs in out/name")
+	flag.Var(&includeDirs, "I", "search the given directory for included files (may be repeated)")
+	flag.BoolVar(&opts.dryRun, "n", false, "print commands without actually executing")
+	flag.BoolVar(&noParseExec, "noparseexec", false, "report pipe includes and backticks instead of running them, substituting empty output")
+	flag.BoolVar(&restrict, "restricted", false, "don't run commands while parsing, or build or fetch targets outside the working directory; recipes aren't sandboxed")
+	flag.StringVar(&allowlist, "allow", "", "with -restricted, let commands matching the patterns in the given file run while parsing")
 	flag.BoolVar(&shallowRebuild, "r", false, "force building of just targets")
-	flag.BoolVar(&rebuildAll, "a", false, "force building of all dependencies")
-	flag.IntVar(&subprocsAllowed, "p", 1, "maximum number of jobs to execute in parallel")
+	flag.BoolVar(&opts.rebuildAll, "a", false, "force building of all dependencies")
+	flag.IntVar(&opts.jobs, "p", 1, "maximum number of jobs to execute in parallel")
+	flag.IntVar(&opts.fetchJobs, "fetchjobs", 4, "maximum number of URLs to fetch in parallel")
+	flag.BoolVar(&opts.keepGoing, "k", false, "keep building after a recipe fails")
+	flag.Var(&opts.equalTime, "equal", "treatment of targets as old as a prerequisite: uptodate, rebuild or hash")
+	flag.Var(&opts.ambiguity, "ambiguous", "which of several different recipes a target gets: concrete, recent, specific or error")
+	flag.BoolVar(&opts.why, "why", false, "explain how the graph of targets is built")
 	flag.BoolVar(&interactive, "i", false, "prompt before executing rules")
+	flag.BoolVar(&confirm, "confirm", false, "prompt before executing each recipe")
 	flag.BoolVar(&quiet, "q", false, "don't print recipes before executing them")
+	flag.IntVar(&opts.atFile, "atfile", 0, "pass $prereq as @$prereqfile when it is longer than this many bytes")
+	flag.BoolVar(&opts.lineByLine, "lines", false, "execute each line of a recipe in a shell of its own")
+	flag.BoolVar(&opts.markStderr, "markstderr", false, "prefix each line recipes write to stderr with ! and the target")
+	flag.IntVar(&opts.nice, "nice", 0, "run recipes at the given niceness, from 1 to 19")
+	flag.StringVar(&opts.cpus, "cpus", "", "run recipes on the listed CPUs, such as 0-3,8")
+	flag.IntVar(&opts.failTail, "failtail", 0, "print quiet recipes that fail with this many of their last lines of output")
+	flag.BoolVar(&silent, "s", false, "don't report targets that are up to date")
+	flag.BoolVar(&skipVirtualDefault, "novirtdefault", false, "don't pick virtual rules as the default target")
+	flag.IntVar(&opts.statWorkers, "statjobs", 16, "maximum number of files to stat in parallel")
+	flag.IntVar(&opts.chain, "chain", maxRuleCnt, "maximum number of times a rule may be applied in one chain of inference")
+	flag.BoolVar(&opts.intermediates, "intermediates", false, "take files only meta-rules produce for other meta-rules to be intermediate, and remove them")
+	flag.IntVar(&opts.metaDepth, "metadepth", defaultMetaDepth, "maximum number of meta-rules applied in a row to files that are missing, or 0, the default, for no limit")
+	flag.BoolVar(&opts.dirNewest, "dirnewest", false, "date directories by the newest file within them")
+	flag.DurationVar(&opts.skew, "skew", 0, "take timestamps closer together than the given duration as equal")
+	flag.BoolVar(&nfs, "nfs", false, "tolerate a network filesystem: a skew of 2s unless -skew is given, and retrying stats")
+	flag.Var(&opts.future, "future", "treatment of files modified in the future: warn, touch, equal or error")
+	flag.BoolVar(&opts.skipVirtualStat, "novirtstat", false, "don't stat targets of virtual rules")
+	flag.BoolVar(&list, "list", false, "list the targets of the mkfile's rules and where they are defined")
+	flag.BoolVar(&graphStats, "graphstats", false, "print statistics about the graph of the targets instead of building them")
+	flag.StringVar(&graphFormat, "graph", "", "print the graph of the targets in the given format, dot, json or html, instead of building them")
+	flag.BoolVar(&printDB, "printdb", false, "print the mkfile's variables and rules and where they are defined, or just the named variables")
+	flag.BoolVar(&warnUndefined, "warnundefined", false, "warn about references to variables that aren't set")
+	flag.StringVar(&indent, "indent", "any", "how recipes must be indented: any, tabs or spaces")
+	flag.BoolVar(&strict, "strict", false, "fail on references to variables that aren't set")
+	flag.BoolVar(&printSummary, "summary", false, "print a summary of the build once it's done")
+	flag.StringVar(&summaryFile, "summaryjson", "", "write a summary of the build to the given file as JSON")
+	flag.StringVar(&otlpEndpoint, "otlp", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "export the build as a trace to the given OTLP/HTTP endpoint")
+	flag.StringVar(&metricsFile, "metrics", "", "add the build to the Prometheus metrics in the given file")
+	flag.StringVar(&changedList, "changed", "", "build just the targets affected by the files listed in the given file, or - for stdin")
+	flag.StringVar(&provenanceDir, "provenance", "", "write SLSA provenance for each target built into the given directory")
+	flag.StringVar(&logFile, "log", "", "log the recipes executed to the given file as JSON, for mk replay")
+	flag.BoolVar(&recordEnvs, "recordenv", false, "record hashes of the environment and the tools' versions in .mkenvs, for mk envdiff")
+	flag.BoolVar(&envOverrides, "e", false, "let environment variables override assignments in the mkfile")
 	flag.Parse()
+	checkSchedule(opts)
 
-	mkfile, err := os.Open(mkfilePath)
-	if err != nil {
-		mkError("no mkfile found")
+	if printVersion {
+		fmt.Printf("mk version %s %s/%s\n", version(), runtime.GOOS, runtime.GOARCH)
+		return
 	}
-	input, _ := ioutil.ReadAll(mkfile)
-	mkfile.Close()
 
-	abspath, err := filepath.Abs(mkfilePath)
-	if err != nil {
-		mkError("unable to find mkfile's absolute path")
+	// without -f, run in the nearest directory above with a mkfile if there's
+	// none here, translating the targets named
+	subdir := ""
+	if len(mkfiles) == 0 {
+		if _, ok := findMkfile(".", mkfileNames()); !ok {
+			cwd, err := os.Getwd()
+			if err != nil {
+				mkError(fmt.Sprintf("mk: %s", err))
+			}
+			if dir, ok := findMkfileDir(cwd, mkfileNames()); ok {
+				subdir, _ = filepath.Rel(dir, cwd)
+				if err := os.Chdir(dir); err != nil {
+					mkError(fmt.Sprintf("mk: %s", err))
+				}
+				mkPrintMessage(fmt.Sprintf("mk: entering directory %s", dir))
+			}
+		}
 	}
 
-	env := make(map[string][]string)
-	for _, elem := range os.Environ() {
-		vals := strings.SplitN(elem, "=", 2)
-		env[vals[0]] = append(env[vals[0]], vals[1])
+	if noParseExec {
+		parseExecutor = parseReporter{}
+	}
+	configureDryRun = opts.dryRun
+	if restrict || allowlist != "" {
+		x, err := newRestrictions(".", allowlist)
+		if err != nil {
+			mkError(fmt.Sprintf("unable to read the allowlist: %s", err))
+		}
+		restricted = x
+		parseExecutor = restrictedExecutor{x, parseExecutor}
+	}
+	if policy, err := parseIndentPolicy(indent); err != nil {
+		mkError(err.Error())
+	} else {
+		recipeIndent = policy
+	}
+	if opts.skew < 0 {
+		mkError("the skew tolerated can't be negative")
+	}
+	if opts.chain < 1 || opts.chain > maxChain {
+		mkError(fmt.Sprintf("the chain length must be from 1 to %d", maxChain))
+	}
+	if nfs {
+		if opts.skew == 0 {
+			opts.skew = nfsSkew
+		}
+		opts.stats.retries = nfsStatRetries
+	}
+	if strict {
+		undefinedRefs = undefinedError
+	} else if warnUndefined {
+		undefinedRefs = undefinedWarn
 	}
 
-	rs := parse(string(input), mkfilePath, abspath, env)
+	rs, targets := readMkfile(mkfiles, includeDirs, flag.Args(), envOverrides)
+	if !printDB {
+		targets = rs.resolveAliases(targets)
+	}
+	if subdir != "" {
+		targets = translateTargets(rs, subdir, targets)
+	}
 	if quiet {
 		for i := range rs.rules {
 			rs.rules[i].attributes.quiet = true
 		}
 	}
 
-	targets := flag.Args()
+	if list {
+		listTargets(os.Stdout, rs)
+		return
+	}
+	if printDB {
+		printDatabase(os.Stdout, rs, targets)
+		return
+	}
+
+	if shallowRebuild {
+		targets = opts.forceRebuild(targets)
+	}
 
-	// build the first non-meta rule in the makefile, if none are given explicitly
 	if len(targets) == 0 {
-		for i := range rs.rules {
-			if !rs.rules[i].isMeta {
-				for j := range rs.rules[i].targets {
-					targets = append(targets, rs.rules[i].targets[j].spat)
-				}
-				break
-			}
-		}
+		targets = defaultTargets(rs, skipVirtualDefault)
 	}
 
 	if len(targets) == 0 {
@@ -361,22 +1026,59 @@ func main() {
 		return
 	}
 
-	if shallowRebuild {
-		for i := range targets {
-			rebuildTargets[targets[i]] = true
-		}
+	// the default targets are forced by -r alone, not by -r with patterns
+	if shallowRebuild && len(opts.rebuildPatterns) == 0 && len(opts.rebuildTargets) == 0 {
+		opts.forceRebuild(targets)
 	}
 
-	// Create a dummy virtual rule that depends on every target
-	root := rule{}
-	root.targets = []pattern{pattern{false, "", nil}}
-	root.attributes = attribSet{false, false, false, false, false, false, false, true, false}
-	root.prereqs = targets
-	rs.add(root)
+	rs.addRoot(targets)
+
+	if opts.equalTime == equalTimeHash {
+		opts.hashes = loadHashStore(statePath(".mkhashes"))
+	}
 
+	opts.outputs = loadOutputStore(statePath(".mkoutputs"))
+	opts.tests = loadTestStore(statePath(".mktests"))
+	opts.inputs = loadInputStore(statePath(".mkinputs"))
+	opts.statuses = loadStatusStore(statePath(".mkstatus"))
+
+	g := buildgraph(rs, "", opts)
+
+	// with -changed, the graph is rooted at just the affected targets instead,
+	// whose rebuild is forced
+	if changedList != "" {
+		changed, err := readChangedFiles(changedList)
+		if err != nil {
+			mkError(fmt.Sprintf("unable to read the changed files: %s", err))
+		}
+		targets = g.affectedBy(changed)
+		if len(targets) == 0 {
+			fmt.Println("mk: nothing affected by the changes")
+			return
+		}
+		for _, target := range targets {
+			opts.rebuildTargets[target] = true
+		}
+		rs.rules[len(rs.rules)-1].prereqs = targets
+		g = buildgraph(rs, "", opts)
+	}
+
+	if graphStats {
+		g.stats().print(os.Stdout)
+		return
+	}
+	if graphFormat != "" {
+		if err := g.export(os.Stdout, graphFormat); err != nil {
+			mkError(err.Error())
+		}
+		return
+	}
 	if interactive {
-		g := buildgraph(rs, "")
-		mkNode(g, g.root, true, true)
+		// preview the build, then start over on the same graph
+		preview := *opts
+		preview.dryRun = true
+		mkNode(g, g.root, &preview, true)
+		g.reset()
 		fmt.Print("Proceed? ")
 		in := bufio.NewReader(os.Stdin)
 		for {
@@ -393,6 +1095,108 @@ func main() {
 		}
 	}
 
-	g := buildgraph(rs, "")
-	mkNode(g, g.root, dryRun, true)
+	if otlpEndpoint != "" {
+		opts.tracer = newTracer()
+	}
+	if provenanceDir != "" {
+		opts.provenance = newProvenanceWriter(provenanceDir)
+	}
+	if logFile != "" {
+		log, err := newBuildLog(logFile)
+		if err != nil {
+			mkError(fmt.Sprintf("unable to create the log: %s", err))
+		}
+		opts.log = log
+	}
+	if metricsFile != "" {
+		metrics, err := loadMetrics(metricsFile)
+		if err != nil {
+			mkError(fmt.Sprintf("unable to load the metrics: %s", err))
+		}
+		opts.metrics = metrics
+	}
+	// the first interrupt cancels the build, and another stops mk at once
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		mkPrintError("mk: interrupted")
+		cancel()
+	}()
+	opts.ctx = ctx
+	if confirm {
+		opts.prompts = newPromptBroker(os.Stdin, os.Stdout, cancel)
+	}
+
+	start := time.Now()
+	mkRoot(g, opts)
+	if !opts.dryRun {
+		g.removeIntermediates()
+	}
+	summary := g.summarize(start)
+	if printSummary {
+		mkPrintMessage(summary.String())
+	}
+	if summaryFile != "" {
+		if err := summary.save(summaryFile); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to write the summary: %s", err))
+		}
+	}
+	if opts.metrics != nil {
+		opts.metrics.build(start, g.root.status != nodeStatusFailed)
+		if err := opts.metrics.save(metricsFile); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to write the metrics: %s", err))
+		}
+	}
+	if opts.tracer != nil {
+		if err := opts.tracer.export(otlpEndpoint, targets, g.root.status != nodeStatusFailed); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to export the trace: %s", err))
+		}
+	}
+	if opts.hashes != nil {
+		if err := opts.hashes.save(); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to save hashes: %s", err))
+		}
+	}
+	if err := opts.outputs.save(); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to save outputs: %s", err))
+	}
+	if err := opts.inputs.save(); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to save inputs: %s", err))
+	}
+	if !opts.dryRun {
+		opts.statuses.recordGraph(g)
+		if err := opts.statuses.save(); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to save statuses: %s", err))
+		}
+	}
+	if recordEnvs && !opts.dryRun {
+		if err := recordEnv(statePath(".mkenvs"), rs, start); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to record the environment: %s", err))
+		}
+	}
+	if err := opts.log.close(); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to write the log: %s", err))
+	}
+	if opts.tests.ran() {
+		mkPrintMessage(opts.tests.report())
+		if err := opts.tests.save(); err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to save test results: %s", err))
+		}
+	}
+	if g.root.status == nodeStatusFailed {
+		os.Exit(1)
+	}
+
+	if !silent {
+		for _, target := range targets {
+			u, ok := g.nodes[target]
+			if ok && g.upToDate(u) {
+				mkPrintMessage(fmt.Sprintf("mk: '%s' is up to date", target))
+			}
+		}
+	}
 }
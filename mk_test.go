@@ -0,0 +1,716 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run f with the working directory set to dir.
+func inDir(t testing.TB, dir string, f func()) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	f()
+}
+
+func writeFile(t testing.TB, name string, content string) {
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read a file of whitespace separated words, returning them sorted. A missing
+// file has no words.
+func readWords(t testing.TB, name string) []string {
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return []string{}
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	words := strings.Fields(string(content))
+	sort.Strings(words)
+	return words
+}
+
+// Value panicked with in place of exiting when fatal errors are recovered.
+type mkExitPanic struct{}
+
+// An executor that runs nothing, recording the input of every command.
+type stubExecutor struct {
+	mutex  sync.Mutex
+	inputs []string
+	dirs   []string
+	output string
+	fail   bool
+}
+
+func (x *stubExecutor) run(ctx context.Context, program string, args []string, dir string, input string, capture captureMode) (string, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.inputs = append(x.inputs, input)
+	x.dirs = append(x.dirs, dir)
+	if x.fail {
+		return x.output, errors.New("exit status 1")
+	}
+	return x.output, nil
+}
+
+// Run f in a sandbox where fatal errors return from f rather than exiting,
+// and where subprocesses run while parsing produce no output.
+func sandboxed(f func()) {
+	oldExit, oldExecutor := mkExit, parseExecutor
+	mkExit = func(int) { panic(mkExitPanic{}) }
+	parseExecutor = &stubExecutor{}
+	defer func() {
+		mkExit, parseExecutor = oldExit, oldExecutor
+		if r := recover(); r != nil {
+			if _, ok := r.(mkExitPanic); !ok {
+				panic(r)
+			}
+		}
+	}()
+	f()
+}
+
+// Build the given targets (or the default ones) of the mkfile in the current
+// directory, as the mk command would.
+func runMk(t testing.TB, targets []string, opts *buildOptions) *graph {
+	input, err := ioutil.ReadFile("mkfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abspath, err := filepath.Abs("mkfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := parse(string(input), "mkfile", abspath, make(map[string][]string))
+	if len(targets) == 0 {
+		targets = defaultTargets(rs, false)
+	}
+	rs.addRoot(targets)
+
+	g := buildgraph(rs, "", opts)
+	mkRoot(g, opts)
+	if !opts.dryRun {
+		g.removeIntermediates()
+	}
+	return g
+}
+
+// Run the golden mkfile corpus in testdata/golden. Each case is a directory
+// holding a mkfile whose recipes append their target to a file named log,
+// along with:
+//
+//	args:  targets to build (optional)
+//	want:  targets whose recipes are executed
+//	again: targets whose recipes are executed when mk is run a second time
+//	       (optional)
+//
+// Any other files are copied into the directory the mkfile is run in.
+func TestGolden(t *testing.T) {
+	cases, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		c, _ := filepath.Abs(c)
+		t.Run(filepath.Base(c), func(t *testing.T) {
+			dir := t.TempDir()
+			files, err := ioutil.ReadDir(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				switch f.Name() {
+				case "args", "want", "again":
+					continue
+				}
+				content, err := ioutil.ReadFile(filepath.Join(c, f.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, filepath.Join(dir, f.Name()), string(content))
+			}
+
+			args := readWords(t, filepath.Join(c, "args"))
+			runs := []string{"want"}
+			if _, err := os.Stat(filepath.Join(c, "again")); err == nil {
+				runs = append(runs, "again")
+			}
+
+			inDir(t, dir, func() {
+				for _, run := range runs {
+					os.Remove("log")
+					runMk(t, args, defaultBuildOptions())
+					got := readWords(t, "log")
+					want := readWords(t, filepath.Join(c, run))
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%s: executed %q, want %q", run, got, want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestStubExecutor(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "mkfile", "all:V: a b\n\techo all\na b:V:\n\techo $target\n")
+		opts := defaultBuildOptions()
+		x := &stubExecutor{}
+		opts.executor = x
+		runMk(t, nil, opts)
+
+		sort.Strings(x.inputs)
+		want := []string{"echo a\n", "echo all\n", "echo b\n"}
+		if !reflect.DeepEqual(x.inputs, want) {
+			t.Errorf("executed %q, want %q", x.inputs, want)
+		}
+	})
+}
+
+func TestSubdir(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		if err := os.Mkdir("lib", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, "lib/mkfile", "<vars.mk\nY=`cat vars.mk`\n<|cat vars.mk\nall:V: x.o\n\techo $prereq $X $Y\n%.o:V:\n\techo $target\n")
+		writeFile(t, "lib/vars.mk", "X=lib\n")
+		writeFile(t, "vars.mk", "X=top\n")
+		writeFile(t, "mkfile", "subdir lib\n")
+
+		opts := defaultBuildOptions()
+		x := &stubExecutor{}
+		opts.executor = x
+		g := runMk(t, nil, opts)
+
+		if _, ok := g.nodes["lib/x.o"]; !ok {
+			t.Errorf("graph has no node lib/x.o")
+		}
+		// includes, backticks and pipe includes all read lib/vars.mk
+		want := []string{"echo x.o\n", "echo x.o lib X = lib\n"}
+		if !reflect.DeepEqual(x.inputs, want) {
+			t.Errorf("executed %q, want %q", x.inputs, want)
+		}
+		if !reflect.DeepEqual(x.dirs, []string{"lib", "lib"}) {
+			t.Errorf("executed in %q, want [lib lib]", x.dirs)
+		}
+	})
+}
+
+func TestRecipeVariables(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "mkfile", "out/a.o:V: src/a.c inc/a.h inc/b.h\n\techo $targetdir $prereqdirs $mkfile\n")
+		for _, f := range []string{"src/a.c", "inc/a.h", "inc/b.h"} {
+			os.MkdirAll(filepath.Dir(f), 0755)
+			writeFile(t, f, "")
+		}
+
+		opts := defaultBuildOptions()
+		x := &stubExecutor{}
+		opts.executor = x
+		runMk(t, nil, opts)
+
+		want := []string{fmt.Sprintf("echo out src inc %s\n", filepath.Join(dir, "mkfile"))}
+		if !reflect.DeepEqual(x.inputs, want) {
+			t.Errorf("executed %q, want %q", x.inputs, want)
+		}
+	})
+}
+
+func TestPrintDatabase(t *testing.T) {
+	vars := map[string][]string{"HOME": {"/home/x"}}
+	rs := parse("CC=cc\n## everything\nall:V: a\n%.o:Q: %.c\n\t$CC -c $stem.c\n", "mkfile", "/mkfile", vars)
+
+	var list, db, origins strings.Builder
+	listTargets(&list, rs)
+	printDatabase(&db, rs, nil)
+	printDatabase(&origins, rs, []string{"HOME", "CC", "none"})
+
+	if want := "all\tmkfile:3\teverything\n"; list.String() != want {
+		t.Errorf("listed %q, want %q", list.String(), want)
+	}
+	want := "CC=cc\t# mkfile\n\n# mkfile:3\n## everything\nall:V: a\n\n# mkfile:4\n%.o:Q: %.c\n\tcc -c $stem.c\n"
+	if db.String() != want {
+		t.Errorf("printed %q, want %q", db.String(), want)
+	}
+	want = "HOME=/home/x\t# environment\nCC=cc\t# mkfile\n# none is not set\n"
+	if origins.String() != want {
+		t.Errorf("printed %q, want %q", origins.String(), want)
+	}
+}
+
+func TestVariablePrecedence(t *testing.T) {
+	tests := []struct {
+		envOverrides bool
+		want         string
+	}{
+		{false, "mkfile"},
+		{true, "env"},
+	}
+
+	for _, test := range tests {
+		rs := newRuleSet(map[string][]string{"A": {"env"}, "B": {"cmd"}})
+		rs.origins["B"] = originCommandLine
+		rs.envOverrides = test.envOverrides
+		parseInto("A=mkfile\nB=mkfile\nC=$A $B\n", "mkfile", rs, "/mkfile")
+
+		want := []string{test.want, "cmd"}
+		if !reflect.DeepEqual(rs.vars["C"], want) {
+			t.Errorf("with envOverrides %v, $C = %q, want %q", test.envOverrides, rs.vars["C"], want)
+		}
+	}
+}
+
+func TestMultipleMkfiles(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "gen.mk", "OBJ=a.o b.o\nprog: $OBJ\n\tcc -o $target $prereq\n")
+		writeFile(t, "mkfile", "CC=cc\n%.o: %.c\n\t$CC -c $stem.c\nprog: main.o\n")
+
+		rs, _ := readMkfile([]string{"gen.mk", "mkfile"}, nil, nil, false)
+		if got := defaultTargets(rs, false); !reflect.DeepEqual(got, []string{"prog"}) {
+			t.Errorf("default targets are %q, want [prog]", got)
+		}
+		if got := defaultTargets(parse("clean:\nprog: main.o\n", "mkfile", "/mkfile", rs.vars), false); len(got) != 0 {
+			t.Errorf("default targets are %q after a rule with nothing to do, want none", got)
+		}
+		if got := rs.vars["OBJ"]; !reflect.DeepEqual(got, []string{"a.o", "b.o"}) {
+			t.Errorf("$OBJ = %q, want [a.o b.o]", got)
+		}
+		if n := len(rs.targetRules["prog"]); n != 2 {
+			t.Errorf("%d rules for prog, want 2", n)
+		}
+		if r := rs.rules[len(rs.rules)-1]; r.file != "mkfile" || r.line != 4 {
+			t.Errorf("last rule is at %s, want mkfile:4", r.location())
+		}
+	})
+}
+
+func TestBuiltinVars(t *testing.T) {
+	env := map[string][]string{"MKVERSION": {"old"}, "OS": {"Windows_NT"}, "ARCH": {"arm64"}, "HOME": {"/home/x"}}
+	setBuiltinVars(env)
+	rs := newRuleSet(env)
+	parseInto("MKARCH=mine\nV=$MKVERSION $MKOS $MKARCH $OS $ARCH $HOME\n", "mkfile", rs, "/mkfile")
+
+	want := []string{version(), runtime.GOOS, "mine", runtime.GOOS, "arm64", "/home/x"}
+	if !reflect.DeepEqual(rs.vars["V"], want) {
+		t.Errorf("$V = %q, want %q", rs.vars["V"], want)
+	}
+	if got, want := rs.vars["NPROC"], []string{strconv.Itoa(runtime.NumCPU())}; !reflect.DeepEqual(got, want) {
+		t.Errorf("$NPROC = %q, want %q", got, want)
+	}
+}
+
+func TestPrintEnv(t *testing.T) {
+	rs := newRuleSet(map[string][]string{"HOME": {"/home/x"}})
+	parseInto("CC=cc\nCFLAGS=-O2 -g\nMSG='hi there'\n", "mkfile", rs, "/mkfile")
+
+	var sh, js, named strings.Builder
+	printEnv(&sh, rs, nil, envFormatShell)
+	printEnv(&js, rs, nil, envFormatJSON)
+	sandboxed(func() { printEnv(&named, rs, []string{"HOME", "none"}, envFormatShell) })
+
+	if want := "CC=cc\nCFLAGS='-O2 -g'\nMSG='hi there'\n"; sh.String() != want {
+		t.Errorf("printed %q, want %q", sh.String(), want)
+	}
+	want := "{\n\t\"CC\": [\n\t\t\"cc\"\n\t],\n\t\"CFLAGS\": [\n\t\t\"-O2\",\n\t\t\"-g\"\n\t],\n\t\"MSG\": [\n\t\t\"hi there\"\n\t]\n}\n"
+	if js.String() != want {
+		t.Errorf("printed %q, want %q", js.String(), want)
+	}
+	if want := "HOME=/home/x\n"; named.String() != want {
+		t.Errorf("printed %q, want %q", named.String(), want)
+	}
+}
+
+func TestMkfileDefines(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		if mkfileDefines("vet") {
+			t.Errorf("vet is defined without a mkfile")
+		}
+		writeFile(t, "mkfile", "<mk:go\nalias env: all\n")
+		for name, want := range map[string]bool{"vet": true, "env": true, "query": false} {
+			if got := mkfileDefines(name); got != want {
+				t.Errorf("mkfileDefines(%q) = %v, want %v", name, got, want)
+			}
+		}
+
+		// the mkfile read to decide is the one the command goes on to read
+		writeFile(t, "mkfile", "X=`echo x >>count; echo 1`\n")
+		mkfileDefines("env")
+		rs, rest := readMkfile(nil, nil, []string{"X"}, false)
+		if got, _ := lookupVar(rs.vars, "X"); !reflect.DeepEqual(got, []string{"1"}) || !reflect.DeepEqual(rest, []string{"X"}) {
+			t.Errorf("X=%q and %q left, want X=[1] and [X]", got, rest)
+		}
+		if count := readWords(t, "count"); len(count) != 1 {
+			t.Errorf("backtick ran %d times, want once", len(count))
+		}
+		readMkfile(nil, nil, nil, false)
+		if count := readWords(t, "count"); len(count) != 2 {
+			t.Errorf("backtick ran %d times, want twice reading the mkfile again", len(count))
+		}
+	})
+}
+
+func TestForceRebuild(t *testing.T) {
+	opts := defaultBuildOptions()
+	if targets := opts.forceRebuild([]string{"foo", "lib/*"}); !reflect.DeepEqual(targets, []string{"foo"}) {
+		t.Errorf("targets %q, want foo", targets)
+	}
+	for target, want := range map[string]bool{"foo": true, "lib/a.o": true, "bar": false, "lib/x/a.o": false} {
+		if got := opts.forcesRebuild(target); got != want {
+			t.Errorf("forcesRebuild(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestPrintEval(t *testing.T) {
+	rs := newRuleSet(map[string][]string{"HOME": {"/home/x"}})
+	parseInto("SRCS=a.c b.c 'c d.c'\nOBJS=D=${SRCS:%.c=%.o}\n", "mkfile", rs, "/mkfile")
+
+	var out strings.Builder
+	printEval(&out, rs, []string{"${SRCS:%.c=%.o}", "$HOME/$OBJS"})
+	// text joined to a list is joined to its first word alone
+	if want := "a.o\nb.o\nc d.o\n/home/x/a.o\nb.o\nc d.o\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+}
+
+func TestCleanOutputs(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "mkfile", "all:V: a.o keep.db\n\ttouch all\n%.o:\n\ttouch $target\nkeep.db:K:\n\ttouch $target\n")
+		opts := defaultBuildOptions()
+		opts.outputs = loadOutputStore(".mkoutputs")
+		runMk(t, nil, opts)
+		if err := opts.outputs.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		s := loadOutputStore(".mkoutputs")
+		if got := s.sorted(); !reflect.DeepEqual(got, []string{"a.o"}) {
+			t.Fatalf("recorded %q, want [a.o]", got)
+		}
+
+		writeFile(t, "old.o", "")
+		s.record("old.o")
+		rs := parse("%.o:\n\ttouch $target\nkeep.db:K:\n", "mkfile", filepath.Join(dir, "mkfile"), make(map[string][]string))
+		if !cleanOutputs(rs, s, false) {
+			t.Fatal("cleaning failed")
+		}
+		for _, name := range []string{"a.o", "old.o"} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("%s wasn't removed", name)
+			}
+		}
+		for _, name := range []string{"all", "keep.db"} {
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("%s was removed", name)
+			}
+		}
+
+		// -generated may come after the other flags, and without it clean is
+		// a target
+		writeFile(t, "b.o", "")
+		s.record("b.o")
+		if err := s.save(); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{{}, {"-n"}, {"all"}, {"-z"}} {
+			if cleanCommand(args) {
+				t.Errorf("mk clean %q was taken as the command", args)
+			}
+		}
+		if !cleanCommand([]string{"-n", "-generated"}) {
+			t.Errorf("mk clean -n -generated was taken as targets")
+		}
+		if _, err := os.Stat("b.o"); err != nil {
+			t.Errorf("b.o was removed by a dry run")
+		}
+	})
+}
+
+func TestFailTail(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	mkPrintFailure("a", "echo a\nexit 1\n", "1\n2\n3\n", errors.New("exit status 1"), 2)
+	os.Stderr = stderr
+	w.Close()
+	got, _ := ioutil.ReadAll(r)
+
+	want := "mk: recipe for a failed (exit status 1):\n\techo a\n\texit 1\nmk: last 2 lines of output:\n\t2\n\t3\n"
+	if string(got) != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
+
+func TestLineByLine(t *testing.T) {
+	got := recipeLines("@echo a\n-false\n\ncc \\\n  -c x.c\ncat <<EOF\nx\nEOF\necho\n", 10)
+	want := []recipeLine{
+		{"echo a", 10, false, true},
+		{"false", 11, true, false},
+		{"cc \\\n  -c x.c", 13, true, true},
+		{"cat <<EOF\nx\nEOF", 15, true, true},
+		{"echo", 18, true, true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("split into %+v, want %+v", got, want)
+	}
+
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "a:VL:\n\t-one\n\ttwo\n\tthree\n")
+		opts := defaultBuildOptions()
+		x := &stubExecutor{fail: true}
+		opts.executor = x
+		runMk(t, nil, opts)
+
+		if want := []string{"one\n", "two\n"}; !reflect.DeepEqual(x.inputs, want) {
+			t.Errorf("executed %q, want %q", x.inputs, want)
+		}
+	})
+}
+
+func TestHeredocDelimiters(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"cat <<EOF >out", []string{"EOF"}},
+		{"cat <<-'END' | sort; cat << \"X Y\"", []string{"END", "X Y"}},
+		{"cat <<\\EOF", []string{"EOF"}},
+		{"cat <<<word; echo $((1<<4)) $((x<<$n))", []string{}},
+		{`echo "x << y" 'a <<b' \<<c; cat <<"d"`, []string{"d"}},
+	}
+	for _, test := range tests {
+		if got := heredocDelimiters(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("heredocDelimiters(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestSubprocessInput(t *testing.T) {
+	// much more than a pipe holds, and read either in full or not at all
+	recipe := strings.Repeat(": "+strings.Repeat("x", 1000)+"\n", 4096) + "echo done\n"
+	output, err := subprocess(context.Background(), "sh", nil, "", recipe, captureOutput)
+	if err != nil || output != "done\n" {
+		t.Errorf("sh printed %q, %v, want done", output, err)
+	}
+	if _, err := subprocess(context.Background(), "true", nil, "", recipe, captureOutput); err != nil {
+		t.Errorf("true failed without reading its input: %s", err)
+	}
+}
+
+func TestOutputRecipe(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "version.txt:QO:\n\techo 1.2\nbad.txt:QO:\n\techo partial; false\n")
+		opts := defaultBuildOptions()
+		opts.keepGoing = true
+		runMk(t, []string{"version.txt", "bad.txt"}, opts)
+		if got := readWords(t, "version.txt"); !reflect.DeepEqual(got, []string{"1.2"}) {
+			t.Errorf("version.txt is %q, want [1.2]", got)
+		}
+		if _, err := os.Stat("bad.txt"); err == nil {
+			t.Error("wrote the output of a failed recipe")
+		}
+	})
+}
+
+func TestMarkStderr(t *testing.T) {
+	opts := defaultBuildOptions()
+	opts.markStderr = true
+	ctx := recipeContext("a.o", opts)
+	output, err := subprocess(ctx, "sh", []string{"-c", "echo out; echo err >&2; printf last >&2"}, "", "", captureOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	sort.Strings(lines)
+	if want := []string{"! a.o: err", "! a.o: last", "out"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("output is %q, want %q", lines, want)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"exit 0", ""},
+		{"exit 3", "exit status 3"},
+		{"kill -SEGV $$", "killed by signal 11 (segmentation fault)"},
+		{"kill -KILL $$", "killed by signal 9 (killed), possibly for running out of memory"},
+	}
+	for _, test := range tests {
+		_, err := subprocess(context.Background(), "sh", []string{"-c", test.command}, "", "", captureNone)
+		if got := fmt.Sprint(err); (err == nil && test.want != "") || (err != nil && got != test.want) {
+			t.Errorf("%s: failed with %v, want %q", test.command, err, test.want)
+		}
+	}
+}
+
+func TestShebangRecipe(t *testing.T) {
+	got := stripIndentation("#!/bin/sh\n\tif true; then\n\n\t\techo a\n\tfi\n", 1)
+	if want := "#!/bin/sh\nif true; then\n\n\techo a\nfi\n"; got != want {
+		t.Errorf("unindented %q, want %q", got, want)
+	}
+	got = stripIndentation("\techo a\n\n\techo b\n    \n\n", 1)
+	if want := "echo a\n\necho b\n"; got != want {
+		t.Errorf("unindented %q, want %q", got, want)
+	}
+
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "out:Q:\n\t#!/bin/sh\n\tif test -n \"$target\"; then\n\n\t\techo $target > out\n\tfi\n")
+		runMk(t, nil, defaultBuildOptions())
+		if got := readWords(t, "out"); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("out is %q, want [out]", got)
+		}
+	})
+}
+
+func TestPrereqFile(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "a", "")
+		writeFile(t, "my b", "")
+		writeFile(t, "mkfile", "list:V: a 'my b'\n\tcat $prereqfile > list; echo $prereq > arg\n")
+		opts := defaultBuildOptions()
+		opts.atFile = 4
+		runMk(t, nil, opts)
+
+		if got, _ := ioutil.ReadFile("list"); string(got) != "a\n'my b'\n" {
+			t.Errorf("$prereqfile holds %q, want %q", got, "a\n'my b'\n")
+		}
+		if got, _ := ioutil.ReadFile("arg"); !strings.HasPrefix(string(got), "@") {
+			t.Errorf("$prereq is %q, want a response file", got)
+		}
+	})
+}
+
+func TestBuildSummary(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "a", "")
+		writeFile(t, "mkfile", "all:V: a b\na b:\n\ttouch $target\n")
+		opts := defaultBuildOptions()
+		opts.executor = &stubExecutor{}
+		g := runMk(t, nil, opts)
+
+		got := g.summarize(time.Now())
+		got.WallTime = 0
+		want := buildSummary{Examined: 3, Rebuilt: 1, UpToDate: 2, MaxParallel: 1}
+		if got != want {
+			t.Errorf("summarized %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestCancelBuild(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "all:V: out next\nout:\n\techo partial > out; sleep 30\nnext: out\n\ttouch next\n")
+		ctx, cancel := context.WithCancel(context.Background())
+		opts := defaultBuildOptions()
+		opts.ctx = ctx
+		time.AfterFunc(500*time.Millisecond, cancel)
+		start := time.Now()
+		g := runMk(t, nil, opts)
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("cancelled build took %s", elapsed)
+		}
+		if g.root.status != nodeStatusFailed {
+			t.Errorf("cancelled build finished with status %s", g.root.status)
+		}
+		for _, name := range []string{"out", "next"} {
+			if _, err := os.Stat(name); err == nil {
+				t.Errorf("%s exists after the build was cancelled", name)
+			}
+		}
+	})
+}
+
+func TestDeleteFailed(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "a:D:\n\ttouch a; false\nb:\n\ttouch b; false\n")
+		runMk(t, []string{"a"}, defaultBuildOptions())
+		runMk(t, []string{"b"}, defaultBuildOptions())
+		if _, err := os.Stat("a"); err == nil {
+			t.Error("a's recipe failed, but a wasn't deleted")
+		}
+		if _, err := os.Stat("b"); err != nil {
+			t.Error("b was deleted without the D attribute")
+		}
+	})
+}
+
+func TestConfirmRecipes(t *testing.T) {
+	for _, test := range []struct {
+		answers  string
+		executed int
+		failed   bool
+	}{
+		{"y\ny\ny\n", 3, false},
+		{"huh\nA\n", 3, false},
+		{"N\n", 0, false},
+		{"q\n", 0, true},
+		{"", 0, true},
+	} {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", "all:V: a b c\na b c:\n\ttouch $target\n")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			executor := &stubExecutor{}
+			opts := defaultBuildOptions()
+			opts.ctx = ctx
+			opts.executor = executor
+			opts.prompts = newPromptBroker(strings.NewReader(test.answers), ioutil.Discard, cancel)
+			g := runMk(t, nil, opts)
+			if len(executor.inputs) != test.executed {
+				t.Errorf("answering %q executed %d recipes, want %d", test.answers, len(executor.inputs), test.executed)
+			}
+			if failed := g.root.status == nodeStatusFailed; failed != test.failed {
+				t.Errorf("answering %q, the build failed: %v, want %v", test.answers, failed, test.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Keeping track of the targets recipes have produced, so they can be cleaned.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Targets produced by recipes in this and earlier builds.
+type outputStore struct {
+	state *stateStore // the targets, each with no fields
+}
+
+// Load the targets listed in the given file. A missing file lists none.
+func loadOutputStore(path string) *outputStore {
+	return &outputStore{loadStateStore(path, 0)}
+}
+
+// Write the targets back to their file, if they changed.
+func (s *outputStore) save() error {
+	return s.state.save()
+}
+
+// Record that a recipe produced the target.
+func (s *outputStore) record(target string) {
+	s.state.set(target)
+}
+
+// The recorded targets, in sorted order.
+func (s *outputStore) sorted() []string {
+	return s.state.names()
+}
+
+// True if a rule of the rule set matching the target is virtual or precious,
+// so that it mustn't be removed.
+func keepTarget(rs *ruleSet, target string) bool {
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if !r.attributes.virtual && !r.attributes.precious {
+			continue
+		}
+		for j := range r.targets {
+			if r.targets[j].match(target) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Remove the recorded targets that the rule set doesn't keep, printing each
+// one. With dryRun, just print them. Returns false if any couldn't be removed.
+func cleanOutputs(rs *ruleSet, s *outputStore, dryRun bool) bool {
+	ok := true
+	for _, name := range s.sorted() {
+		if keepTarget(rs, name) {
+			continue
+		}
+		mkPrintMessage(fmt.Sprintf("rm %s", shellQuote(name)))
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			mkPrintError(fmt.Sprintf("mk: %s", err))
+			ok = false
+			continue
+		}
+		s.state.delete(name)
+	}
+	return ok
+}
+
+// Run 'mk clean -generated [options] [var=value]', removing the targets
+// recipes have produced. Returns false, leaving mk to build a target named
+// clean, without -generated among the flags.
+func cleanCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk clean", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var generated, dryRun bool
+	mkfile := mkfileFlags(flags)
+	flags.BoolVar(&generated, "generated", false, "remove the targets recipes have produced")
+	flags.BoolVar(&dryRun, "n", false, "print the files to remove without removing them")
+	err := flags.Parse(args)
+	if err != nil {
+		// the arguments are targets, unless -generated was meant
+		for _, arg := range args {
+			name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+			if strings.HasPrefix(arg, "-") && name == "generated" {
+				mkError(fmt.Sprintf("mk clean: %s", err))
+			}
+		}
+		return false
+	}
+	if !generated {
+		return false
+	}
+
+	rs, _ := mkfile.read(flags.Args())
+	s := loadOutputStore(statePath(".mkoutputs"))
+	ok := cleanOutputs(rs, s, dryRun)
+	if err := s.save(); err != nil {
+		mkError(fmt.Sprintf("mk: unable to save outputs: %s", err))
+	}
+	if !ok {
+		mkExit(1)
+	}
+	return true
+}
@@ -49,7 +49,7 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -97,21 +97,29 @@ type parserStateFun func(*parser, token) parserStateFun
 
 // Parse a mkfile, returning a new ruleSet.
 func parse(input string, name string, path string, env map[string][]string) *ruleSet {
-	rules := &ruleSet{env,
-		make([]rule, 0),
-		make(map[string][]int)}
+	rules := newRuleSet(env)
 	parseInto(input, name, rules, path)
 	return rules
 }
 
 // Parse a mkfile inserting rules and variables into a given ruleSet.
 func parseInto(input string, name string, rules *ruleSet, path string) {
-	l, tokens := lex(input)
+	parseLexed(lex(input), name, rules, path)
+}
+
+// Parse a mkfile read from r as parseInto does, reading it as it's parsed.
+func parseReader(r io.Reader, name string, rules *ruleSet, path string) {
+	parseLexed(lexReader(r), name, rules, path)
+}
+
+// Parse the tokens of a mkfile into a given ruleSet.
+func parseLexed(l *lexer, name string, rules *ruleSet, path string) {
 	p := &parser{l, name, path, []token{}, rules}
-	oldmkfiledir := p.rules.vars["mkfiledir"]
+	oldmkfiledir, hadmkfiledir := p.rules.vars["mkfiledir"]
 	p.rules.vars["mkfiledir"] = []string{filepath.Dir(path)}
+
 	state := parseTopLevel
-	for t := range tokens {
+	for t, ok := l.nextToken(); ok; t, ok = l.nextToken() {
 		if t.typ == tokenError {
 			p.basicErrorAtLine(l.errMsg, t.line)
 			break
@@ -122,9 +130,13 @@ func parseInto(input string, name string, rules *ruleSet, path string) {
 
 	// insert a dummy newline to allow parsing of any assignments or recipeless
 	// rules to finish.
-	state = state(p, token{tokenNewline, "\n", l.line, l.col})
+	state = state(p, token{typ: tokenNewline, val: "\n", line: l.line, col: l.col})
 
-	p.rules.vars["mkfiledir"] = oldmkfiledir
+	if hadmkfiledir {
+		p.rules.vars["mkfiledir"] = oldmkfiledir
+	} else {
+		delete(p.rules.vars, "mkfiledir")
+	}
 
 	// TODO: Error when state != parseTopLevel
 }
@@ -140,7 +152,23 @@ func parseTopLevel(p *parser, t token) parserStateFun {
 	case tokenRedirInclude:
 		return parseRedirInclude
 	case tokenWord:
+		switch t.val {
+		case "use", "subdir", "resource", "pool", "alias":
+			p.push(t)
+			return parseDirective
+		}
 		return parseAssignmentOrTarget(p, t)
+	case tokenDefine:
+		if err := p.rules.executeDefine(t, p.name); err != nil {
+			p.basicErrorAtToken(err.what, err.where)
+		}
+		return parseTopLevel
+	case tokenFor:
+		p.loop(t)
+		return parseTopLevel
+	case tokenRecipe:
+		p.strayRecipe(t)
+		return parseTopLevel
 	default:
 		p.parseError("parsing mkfile",
 			"a rule, include, or assignment", t)
@@ -157,23 +185,27 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 			p.basicErrorAtToken("empty pipe include", t)
 		}
 
-		args := make([]string, len(p.tokenBuf)+1)
-		args[0] = "-c"
+		words := make([]string, len(p.tokenBuf))
 		for i := 0; i < len(p.tokenBuf); i++ {
 			s := p.tokenBuf[i].val
-			expanded := expand(s, p.rules.vars, false)
+			expanded, _ := p.rules.expand(s, false)
 			if len(expanded) > 0 {
 				s = expanded[0]
 			}
-			args[i+1] = s
+			words[i] = s
 		}
 
-		output, success := subprocess("sh", args, "", true)
-		if !success {
-			p.basicErrorAtToken("subprocess include failed", t)
+		sh, args := mkShell(p.rules.vars)
+		args = append(args, "-c")
+		args = append(args, words...)
+
+		output, err := runParseCommand(sh, args, p.rules.dir, "")
+		if err != nil {
+			p.basicErrorAtToken(fmt.Sprintf("subprocess include failed: %s", err), t)
 		}
 
-		parseInto(output, fmt.Sprintf("%s:sh", p.name), p.rules, p.path)
+		parseInto(output, fmt.Sprintf("<|%s (%s:%d)", strings.Join(words, " "), p.name, p.tokenBuf[0].line),
+			p.rules, p.path)
 
 		p.clear()
 		return parseTopLevel
@@ -197,36 +229,136 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 	return parsePipeInclude
 }
 
+// Parse an included file. If namespace isn't empty, the file is parsed with a
+// copy of the variables, and those it assigns are then copied back prefixed
+// with namespace and '_', so that it can't change the including file's.
+func (p *parser) parseScoped(l *lexer, name string, path string, namespace string) {
+	if namespace == "" {
+		parseLexed(l, name, p.rules, path)
+		return
+	}
+
+	vars, origins, assigned := p.rules.vars, p.rules.origins, p.rules.assigned
+	p.rules.vars, p.rules.origins = copyVars(vars, origins)
+	p.rules.assigned = make(map[string]bool)
+	scope, scopeAssigned := p.rules.vars, p.rules.assigned
+	parseLexed(l, name, p.rules, path)
+	p.rules.vars, p.rules.origins, p.rules.assigned = vars, origins, assigned
+
+	for k := range scopeAssigned {
+		vars[namespace+"_"+k] = scope[k]
+		delete(origins, namespace+"_"+k)
+		if assigned != nil {
+			assigned[namespace+"_"+k] = true
+		}
+	}
+}
+
+// Copy variables along with their origins.
+func copyVars(vars map[string][]string, origins map[string]varOrigin) (map[string][]string, map[string]varOrigin) {
+	varsCopy := make(map[string][]string, len(vars))
+	for k, v := range vars {
+		varsCopy[k] = v
+	}
+	originsCopy := make(map[string]varOrigin, len(origins))
+	for k, o := range origins {
+		originsCopy[k] = o
+	}
+	return varsCopy, originsCopy
+}
+
+// True if a and b hold the same words.
+func sameWords(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Consumed a '<'
 func parseRedirInclude(p *parser, t token) parserStateFun {
 	switch t.typ {
 	case tokenNewline:
+		if len(p.tokenBuf) == 0 {
+			p.basicErrorAtToken("empty include", t)
+		}
+		p.preloadAhead()
+
+		// '<file as name' includes file in its own scope
+		buf := p.tokenBuf
+		namespace := ""
+		if n := len(buf); n >= 3 && buf[n-2].typ == tokenWord && buf[n-2].val == "as" &&
+			buf[n-1].typ == tokenWord {
+			namespace = buf[n-1].val
+			if !isValidVarName(namespace) {
+				p.basicErrorAtToken(fmt.Sprintf("not a valid namespace: \"%s\"", namespace), buf[n-1])
+			}
+			buf = buf[:n-2]
+		}
+
 		filename := ""
-		for i := range p.tokenBuf {
-			filename += p.tokenBuf[i].val
+		for i := range buf {
+			filename += buf[i].val
 		}
-		expanded := expand(filename, p.rules.vars, false)
+		expanded, _ := p.rules.expand(filename, false)
 		if len(expanded) > 0 {
 			filename = expanded[0]
 		}
-		fmt.Printf("parsed filename: %v\nexpanded filename: %v\n", filename, expanded)
-		file, err := os.Open(filename)
-		if err != nil {
-			p.basicErrorAtToken(fmt.Sprintf("cannot open %s", filename), p.tokenBuf[0])
+		if isStdlibInclude(filename) {
+			input, err := readStdlib(filename)
+			if err != nil {
+				p.basicErrorAtToken(fmt.Sprintf("no such standard library fragment: %s", filename), p.tokenBuf[0])
+			}
+			p.rules.includes = append(p.rules.includes,
+				include{filename, filename, p.name, p.tokenBuf[0].line})
+			p.parseScoped(lex(string(input)), filename, p.path, namespace)
+			p.clear()
+			return parseTopLevel
 		}
-		input, _ := ioutil.ReadAll(file)
 
-		path, err := filepath.Abs(filename)
+		// in a dry run, a configuration that would be written is parsed instead
+		if input, ok := autoConfigure(mountedPath(p.rules.dir, filename)); ok {
+			p.parseScoped(lex(input), filename, p.path, namespace)
+			p.clear()
+			return parseTopLevel
+		}
+		found, searched := findInclude(filename, p.rules.dir, p.rules.vars)
+		if found == "" {
+			p.basicErrorAtToken(fmt.Sprintf("cannot find %s (searched %s)",
+				filename, strings.Join(searched, ", ")), p.tokenBuf[0])
+		}
+		if restricted != nil && !restricted.inWorkspace(found) {
+			p.basicErrorAtToken(fmt.Sprintf("restricted: %s is outside the workspace", found), p.tokenBuf[0])
+		}
+		l := p.rules.takePreload(found)
+		if l == nil {
+			file, err := os.Open(found)
+			if err != nil {
+				p.basicErrorAtToken(fmt.Sprintf("cannot open %s", found), p.tokenBuf[0])
+			}
+			defer file.Close()
+			l = lexReader(file)
+		}
+
+		path, err := filepath.Abs(found)
 		if err != nil {
 			mkError("unable to find mkfile's absolute path")
 		}
+		p.rules.includes = append(p.rules.includes,
+			include{filename, path, p.name, p.tokenBuf[0].line})
 
-		parseInto(string(input), filename, p.rules, path)
+		p.parseScoped(l, found, path, namespace)
 
 		p.clear()
 		return parseTopLevel
 
-	case tokenWord:
+	// colons are part of the name of standard library includes, e.g. mk:cc
+	case tokenWord, tokenColon:
 		p.tokenBuf = append(p.tokenBuf, t)
 
 	default:
@@ -236,6 +368,280 @@ func parseRedirInclude(p *parser, t token) parserStateFun {
 	return parseRedirInclude
 }
 
+// Look for an included file, first relative to dir, the directory the
+// including mkfile is mounted at, then in each directory listed in $MKPATH.
+// Returns the path at which the file was found, or "" if it wasn't, along with
+// the directories searched.
+func findInclude(filename string, dir string, vars map[string][]string) (string, []string) {
+	searched := []string{"."}
+	if dir != "" {
+		searched[0] = dir
+	}
+	if candidate := mountedPath(dir, filename); filepath.IsAbs(filename) {
+		return candidate, searched
+	} else if _, err := os.Stat(candidate); err == nil {
+		return candidate, searched
+	}
+
+	mkpath, _ := lookupVar(vars, "MKPATH")
+	for _, elem := range mkpath {
+		for _, dir := range filepath.SplitList(elem) {
+			if dir == "" {
+				continue
+			}
+			searched = append(searched, dir)
+			candidate := filepath.Join(dir, filename)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, searched
+			}
+		}
+	}
+
+	return "", searched
+}
+
+// Consumed 'use' or 'subdir'. Unless it turns out to be a target or variable
+// of that name, everything up to the newline is its arguments.
+func parseDirective(p *parser, t token) parserStateFun {
+	switch t.typ {
+	case tokenNewline:
+		if len(p.tokenBuf) < 2 {
+			p.basicErrorAtToken(fmt.Sprintf("expected a name after %s", p.tokenBuf[0].val), t)
+		}
+		if p.tokenBuf[0].val == "alias" {
+			p.basicErrorAtToken(fmt.Sprintf("expected ':' after the name of alias %s", p.tokenBuf[1].val), p.tokenBuf[1])
+		} else if p.tokenBuf[0].val == "use" {
+			p.use(p.tokenBuf[1], p.tokenBuf[2:])
+		} else if p.tokenBuf[0].val == "resource" || p.tokenBuf[0].val == "pool" {
+			p.resource(p.tokenBuf[0], p.tokenBuf[1:])
+		} else {
+			for _, dir := range p.tokenBuf[1:] {
+				p.subdir(dir)
+			}
+		}
+		p.clear()
+		return parseTopLevel
+
+	case tokenWord:
+		p.push(t)
+
+	case tokenColon:
+		// 'alias name:', while 'alias:' and 'alias a b:' begin rules
+		if p.tokenBuf[0].val == "alias" && len(p.tokenBuf) == 2 {
+			return parseAlias
+		}
+		return parseEqualsOrTarget(p, t)
+
+	case tokenAssign:
+		if len(p.tokenBuf) == 1 {
+			return parseAssignment
+		}
+		fallthrough
+
+	default:
+		return parseEqualsOrTarget(p, t)
+	}
+
+	return parseDirective
+}
+
+// Consumed 'alias name:'. Everything else is a target the alias stands for.
+func parseAlias(p *parser, t token) parserStateFun {
+	switch t.typ {
+	case tokenNewline:
+		p.alias(p.tokenBuf[0], p.tokenBuf[1], p.tokenBuf[2:])
+		p.clear()
+		return parseTopLevel
+
+	case tokenWord:
+		p.push(t)
+
+	default:
+		p.parseError("reading an alias's targets", "filename", t)
+	}
+
+	return parseAlias
+}
+
+// Remove the backslashes escaping ':', '=', '#' and '%' in a target or
+// prerequisite name, which would otherwise end the name, begin a comment or
+// make it a pattern. Those escaping '%' are kept if keepPercent is set, as a
+// pattern still needs them.
+func unescapeName(name string, keepPercent bool) string {
+	if !strings.ContainsRune(name, '\\') {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+1 < len(name) {
+			switch c := name[i+1]; {
+			case c == ':' || c == '=' || c == '#' || c == '%' && !keepPercent:
+				i++
+			case c == '%' || c == '\\':
+				b.WriteByte('\\')
+				i++
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// The index of the first '%' in a target not escaped by a backslash, or -1 if
+// it isn't a pattern.
+func patternIndex(target string) int {
+	for i := 0; i < len(target); i++ {
+		if target[i] == '\\' {
+			i++
+		} else if target[i] == '%' {
+			return i
+		}
+	}
+	return -1
+}
+
+// Mount the mkfile in a subdirectory: its rules are added with targets and
+// prerequisites relative to the subdirectory, and their recipes are executed
+// in it. It's parsed with a copy of the variables.
+func (p *parser) subdir(t token) {
+	parts, err := p.rules.expand(t.val, true)
+	if err != nil {
+		p.basicErrorAtToken(err.what, t)
+	}
+
+	for _, dir := range parts {
+		dir = mountedPath(p.rules.dir, dir)
+		if restricted != nil && !restricted.inWorkspace(dir) {
+			p.basicErrorAtToken(fmt.Sprintf("restricted: %s is outside the workspace", dir), t)
+		}
+		mkfile := filepath.Join(dir, "mkfile")
+		file, err := os.Open(mkfile)
+		if err != nil {
+			p.basicErrorAtToken(fmt.Sprintf("cannot open %s", mkfile), t)
+		}
+		path, err := filepath.Abs(mkfile)
+		if err != nil {
+			mkError("unable to find mkfile's absolute path")
+		}
+		p.rules.includes = append(p.rules.includes,
+			include{mkfile, path, p.name, t.line})
+
+		vars, origins, olddir := p.rules.vars, p.rules.origins, p.rules.dir
+		p.rules.vars, p.rules.origins = copyVars(vars, origins)
+		p.rules.dir = dir
+		parseReader(file, mkfile, p.rules, path)
+		file.Close()
+		p.rules.vars, p.rules.origins, p.rules.dir = vars, origins, olddir
+	}
+}
+
+// The path of a file named in a mkfile mounted at dir.
+func mountedPath(dir string, name string) string {
+	if dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// Instantiate a template, binding its parameters to the expanded arguments.
+// The last parameter takes any remaining arguments.
+func (p *parser) use(name token, args []token) {
+	tmpl, ok := p.rules.templates[name.val]
+	if !ok {
+		p.basicErrorAtToken(fmt.Sprintf("no template named %s", name.val), name)
+	}
+
+	values := make([]string, 0)
+	for _, arg := range args {
+		parts, err := p.rules.expand(arg.val, true)
+		if err != nil {
+			p.basicErrorAtToken(err.what, arg)
+		}
+		values = append(values, parts...)
+	}
+	if len(values) < len(tmpl.params) {
+		p.basicErrorAtToken(fmt.Sprintf("template %s expects %d arguments, but was given %d",
+			name.val, len(tmpl.params), len(values)), name)
+	}
+
+	if p.rules.useDepth >= maxUseDepth {
+		p.basicErrorAtToken(fmt.Sprintf("templates nested too deeply using %s", name.val), name)
+	}
+
+	bound := make([][]string, len(tmpl.params))
+	for i := range tmpl.params {
+		if i == len(tmpl.params)-1 {
+			bound[i] = values[i:]
+		} else {
+			bound[i] = values[i : i+1]
+		}
+	}
+
+	p.rules.useDepth++
+	p.parseWith(tmpl.body+"\n", fmt.Sprintf("%s:%s", tmpl.file, name.val), tmpl.params, bound)
+	p.rules.useDepth--
+}
+
+// Expand a 'for name in word ...' loop, parsing its body once for each value
+// of the expanded words, with name bound to it.
+func (p *parser) loop(t token) {
+	header, body := t.val, ""
+	if k := strings.IndexByte(t.val, '\n'); k >= 0 {
+		header, body = t.val[:k], t.val[k+1:]
+	}
+
+	fields := strings.Fields(header)
+	name := fields[1]
+	if !isValidVarName(name) {
+		p.basicErrorAtToken(fmt.Sprintf("not a valid variable name in for: \"%s\"", name), t)
+	}
+
+	// the words following 'in'
+	rest := strings.TrimLeft(header, " \t")[len("for"):]
+	rest = strings.TrimLeft(rest, " \t")[len(name):]
+	rest = strings.TrimLeft(rest, " \t")[len("in"):]
+
+	values := make([]string, 0)
+	l := lexWords(strings.TrimLeft(rest, " \t"))
+	for w, ok := l.nextToken(); ok; w, ok = l.nextToken() {
+		parts, err := p.rules.expand(w.val, true)
+		if err != nil {
+			p.basicErrorAtToken(err.what, t)
+		}
+		values = append(values, parts...)
+	}
+
+	for _, value := range values {
+		p.parseWith(body, fmt.Sprintf("%s:%d:for", p.name, t.line),
+			[]string{name}, [][]string{{value}})
+	}
+}
+
+// Parse input into the current rule set with the given variables bound to
+// values, restoring them afterwards.
+func (p *parser) parseWith(input string, name string, vars []string, values [][]string) {
+	saved := make(map[string][]string)
+	for i, v := range vars {
+		if old, ok := p.rules.vars[v]; ok {
+			saved[v] = old
+		}
+		p.rules.vars[v] = values[i]
+	}
+
+	parseInto(input, name, p.rules, p.path)
+
+	for _, v := range vars {
+		if old, ok := saved[v]; ok {
+			p.rules.vars[v] = old
+		} else {
+			delete(p.rules.vars, v)
+		}
+	}
+}
+
+// How deeply templates may use other templates.
+const maxUseDepth = 64
+
 // Encountered a bare string at the beginning of the line.
 func parseAssignmentOrTarget(p *parser, t token) parserStateFun {
 	p.push(t)
@@ -307,7 +713,7 @@ func parseAttributesOrPrereqs(p *parser, t token) parserStateFun {
 	case tokenColon:
 		p.push(t)
 		return parsePrereqs
-	case tokenWord:
+	case tokenWord, tokenAssign:
 		p.push(t)
 	default:
 		p.parseError("reading a rule's attributes or prerequisites",
@@ -350,12 +756,44 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	if j < len(p.tokenBuf) {
 		attribs := make([]string, 0)
 		for k := i + 1; k < j; k++ {
-			exparts := expand(p.tokenBuf[k].val, p.rules.vars, true)
+			// name=value attributes are lexed as a word, '=' and a word
+			if p.tokenBuf[k].typ == tokenAssign {
+				if len(attribs) == 0 || k+1 >= j || p.tokenBuf[k+1].typ != tokenWord {
+					p.basicErrorAtToken("expected name=value among a rule's attributes", p.tokenBuf[k])
+				}
+				value, err := p.rules.expand(p.tokenBuf[k+1].val, true)
+				if err != nil {
+					p.basicErrorAtToken(err.what, p.tokenBuf[k+1])
+				}
+				// inputs=... takes the rest of the attributes as its value
+				if attribs[len(attribs)-1] == "inputs" {
+					for k += 2; k < j; k++ {
+						if p.tokenBuf[k].typ != tokenWord {
+							p.basicErrorAtToken("expected words after inputs=", p.tokenBuf[k])
+						}
+						more, err := p.rules.expand(p.tokenBuf[k].val, true)
+						if err != nil {
+							p.basicErrorAtToken(err.what, p.tokenBuf[k])
+						}
+						value = append(value, more...)
+					}
+				}
+				attribs[len(attribs)-1] += "=" + strings.Join(value, " ")
+				k++
+				continue
+			}
+			exparts, err := p.rules.expand(p.tokenBuf[k].val, true)
+			if err != nil {
+				p.basicErrorAtToken(err.what, p.tokenBuf[k])
+			}
 			attribs = append(attribs, exparts...)
 		}
 		err := r.parseAttribs(attribs)
 		if err != nil {
 			msg := fmt.Sprintf("while reading a rule's attributes expected an attribute but found \"%c\".", err.found)
+			if err.what != "" {
+				msg = fmt.Sprintf("while reading a rule's attributes %s.", err.what)
+			}
 			p.basicErrorAtToken(msg, p.tokenBuf[i+1])
 		}
 
@@ -369,9 +807,25 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	// targets
 	r.targets = make([]pattern, 0)
 	for k := 0; k < i; k++ {
-		exparts := expand(p.tokenBuf[k].val, p.rules.vars, true)
+		p.checkUnset(p.tokenBuf[k].val, p.tokenBuf[k].line, false)
+		exparts, err := p.rules.expand(p.tokenBuf[k].val, true)
+		if err != nil {
+			p.basicErrorAtToken(err.what, p.tokenBuf[k])
+		}
 		for i := range exparts {
 			targetstr := exparts[i]
+			idx := -1
+			if !r.attributes.regex {
+				idx = patternIndex(targetstr)
+				targetstr = unescapeName(targetstr, idx >= 0)
+			}
+			if p.rules.dir != "" {
+				if r.attributes.regex {
+					targetstr = regexp.QuoteMeta(p.rules.dir+"/") + targetstr
+				} else {
+					targetstr = mountedPath(p.rules.dir, targetstr)
+				}
+			}
 			r.targets = append(r.targets, pattern{spat: targetstr})
 
 			if r.attributes.regex {
@@ -382,14 +836,14 @@ func parseRecipe(p *parser, t token) parserStateFun {
 				}
 				r.targets[len(r.targets)-1].rpat = rpat
 			} else {
-				idx := strings.IndexRune(targetstr, '%')
 				if idx >= 0 {
+					idx = patternIndex(targetstr)
 					var left, right string
 					if idx > 0 {
-						left = regexp.QuoteMeta(targetstr[:idx])
+						left = regexp.QuoteMeta(unescapeName(targetstr[:idx], false))
 					}
 					if idx < len(targetstr)-1 {
-						right = regexp.QuoteMeta(targetstr[idx+1:])
+						right = regexp.QuoteMeta(unescapeName(targetstr[idx+1:], false))
 					}
 
 					patstr := fmt.Sprintf("^%s(.*)%s$", left, right)
@@ -409,15 +863,50 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	// prereqs
 	r.prereqs = make([]string, 0)
 	for k := j + 1; k < len(p.tokenBuf); k++ {
-		exparts := expand(p.tokenBuf[k].val, p.rules.vars, true)
-		r.prereqs = append(r.prereqs, exparts...)
+		if p.tokenBuf[k].typ == tokenAssign {
+			p.parseError("reading a rule's prerequisites", "filename or pattern", p.tokenBuf[k])
+		}
+		p.checkUnset(p.tokenBuf[k].val, p.tokenBuf[k].line, false)
+		exparts, err := p.rules.expand(p.tokenBuf[k].val, true)
+		if err != nil {
+			p.basicErrorAtToken(err.what, p.tokenBuf[k])
+		}
+		for i := range exparts {
+			// a meta-rule's prerequisites keep '\\%' until the stem is substituted
+			exparts[i] = unescapeName(exparts[i], r.isMeta && !r.attributes.regex)
+			if p.rules.dir != "" && !isURL(exparts[i]) {
+				exparts[i] = mountedPath(p.rules.dir, exparts[i])
+			}
+			r.prereqs = append(r.prereqs, exparts[i])
+		}
 	}
+	r.dir = p.rules.dir
+	r.path = p.path
+	r.file = p.name
+	r.line = p.tokenBuf[0].line
+	r.doc = p.tokenBuf[0].doc
 
 	if t.typ == tokenRecipe {
-		r.recipe = expandRecipeSigils(stripIndentation(t.val, t.col), p.rules.vars)
+		p.checkIndentation(t, r.line+1)
+		if len(r.shell) == 0 {
+			p.checkUnset(t.val, r.line+1, true)
+		}
+		shell := r.shell
+		if len(shell) == 0 {
+			shell, _ = lookupVar(p.rules.vars, "MKSHELL")
+		}
+		r.recipe = expandRecipeSigils(stripIndentation(t.val, t.col), p.rules.vars, shell)
 	}
 
-	p.rules.add(r)
+	if len(r.shell) == 0 {
+		if shell, ok := lookupVar(p.rules.vars, "MKSHELL"); ok && len(shell) > 0 {
+			r.shell = append(r.shell, shell...)
+		}
+	}
+
+	if p.rules.add(r) {
+		p.addFetchRules(&p.rules.rules[len(p.rules.rules)-1])
+	}
 	p.clear()
 
 	// the current token doesn't belong to this rule
@@ -0,0 +1,505 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The interesting parts of a parsed rule.
+type parsedRule struct {
+	targets []string
+	prereqs []string
+	recipe  string
+	isMeta  bool
+}
+
+func summarizeRules(rs *ruleSet) []parsedRule {
+	rules := make([]parsedRule, 0)
+	for _, r := range rs.rules {
+		pr := parsedRule{prereqs: r.prereqs, recipe: r.recipe, isMeta: r.isMeta}
+		for _, t := range r.targets {
+			pr.targets = append(pr.targets, t.spat)
+		}
+		rules = append(rules, pr)
+	}
+	return rules
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []parsedRule
+	}{
+		{"a: b c\n\techo a\n", []parsedRule{
+			{[]string{"a"}, []string{"b", "c"}, "echo a\n", false}}},
+		{"a b: c\n", []parsedRule{
+			{[]string{"a", "b"}, []string{"c"}, "", false}}},
+		{"%.o: %.c\n\tcc -c $stem.c\n", []parsedRule{
+			{[]string{"%.o"}, []string{"%.c"}, "cc -c $stem.c\n", true}}},
+		{"x=1 2\na: $x\n", []parsedRule{
+			{[]string{"a"}, []string{"1", "2"}, "", false}}},
+		{"o=D=${s:%.c=%.o}\ns=a.c\ns=$s b.c\na: $o\n", []parsedRule{
+			{[]string{"a"}, []string{"a.o", "b.o"}, "", false}}},
+		{"define x\necho 'a b'\necho c\nendef\na:\n\t$x\n", []parsedRule{
+			{[]string{"a"}, []string{}, "echo 'a b'\necho c\n", false}}},
+		{"define prog name srcs\n$name: ${srcs:%.c=%.o}\n\tcc $prereq\nendef\nuse prog a a.c\nuse prog b b.c c.c\n", []parsedRule{
+			{[]string{"a"}, []string{"a.o"}, "cc $prereq\n", false},
+			{[]string{"b"}, []string{"b.o", "c.o"}, "cc $prereq\n", false}}},
+		{"l=a b\nfor x in $l\n$x.o: $x.c\n\tcc $x.c\nend\n", []parsedRule{
+			{[]string{"a.o"}, []string{"a.c"}, "cc a.c\n", false},
+			{[]string{"b.o"}, []string{"b.c"}, "cc b.c\n", false}}},
+		{"for x in 1 2\nfor y in a b\n$x$y: $x\nend\nend\n", []parsedRule{
+			{[]string{"1a"}, []string{"1"}, "", false},
+			{[]string{"1b"}, []string{"1"}, "", false},
+			{[]string{"2a"}, []string{"2"}, "", false},
+			{[]string{"2b"}, []string{"2"}, "", false}}},
+		{"for: x\n", []parsedRule{
+			{[]string{"for"}, []string{"x"}, "", false}}},
+		{"use: x\nuse=1\nb: $use\n", []parsedRule{
+			{[]string{"use"}, []string{"x"}, "", false},
+			{[]string{"b"}, []string{"1"}, "", false}}},
+		{"a:\n\tone\n\ttwo\nb:\n", []parsedRule{
+			{[]string{"a"}, []string{}, "one\ntwo\n", false},
+			{[]string{"b"}, []string{}, "", false}}},
+		{"a:\n\tcat <<EOF >a\nx:\n  y\nEOF\n\techo\nb:\n", []parsedRule{
+			{[]string{"a"}, []string{}, "cat <<EOF >a\nx:\n  y\nEOF\necho\n", false},
+			{[]string{"b"}, []string{}, "", false}}},
+		{"a:\n\tcat <<-'EOF'\n\t\tx\n\tEOF\nb:\n", []parsedRule{
+			{[]string{"a"}, []string{}, "cat <<-'EOF'\n\tx\nEOF\n", false},
+			{[]string{"b"}, []string{}, "", false}}},
+		{"a\\:b c\\=d e\\#f g\\ h: C\\:\\src\\x.c 'y:z' \"1 2\"\n", []parsedRule{
+			{[]string{"a:b", "c=d", "e#f", "g h"}, []string{"C:\\src\\x.c", "y:z", "1 2"}, "", false}}},
+		{"12\\:00\\%.log: a\\\\b\n", []parsedRule{
+			{[]string{"12:00%.log"}, []string{"a\\\\b"}, "", false}}},
+		{"a: b # c\n\tone\n# two\n\n\tthree\n# four\nb:\n", []parsedRule{
+			{[]string{"a"}, []string{"b"}, "one\n\n\nthree\n", false},
+			{[]string{"b"}, []string{}, "", false}}},
+		{"a:V:\n\techo \"x << y\"\nb:V:\n\techo b\n", []parsedRule{
+			{[]string{"a"}, []string{}, "echo \"x << y\"\n", false},
+			{[]string{"b"}, []string{}, "echo b\n", false}}},
+		{"a:\n\tcat <<EOF\n\tx\nb:\n\techo b\n", []parsedRule{
+			{[]string{"a"}, []string{}, "cat <<EOF\nx\n", false},
+			{[]string{"b"}, []string{}, "echo b\n", false}}},
+		{"a:\n\tcat <<EOF\n#define X\n\tEOF\n\t# kept\n", []parsedRule{
+			{[]string{"a"}, []string{}, "cat <<EOF\n#define X\nEOF\n# kept\n", false}}},
+		{"a:\n\t#!/bin/sh\n#\n\ttrue\n", []parsedRule{
+			{[]string{"a"}, []string{}, "#!/bin/sh\n\ntrue\n", false}}},
+		{"a: b \\\n\tc\\\r\nd\n\techo \\\n\t\t1 \\\n2 '\\\\'\n\t3\n", []parsedRule{
+			{[]string{"a"}, []string{"b", "c", "d"}, "echo \\\n\t\t1 \\\n2 '\\\\'\n3\n", false}}},
+		{"%\\:\\%.o: %\\:\\%.c\n", []parsedRule{
+			{[]string{"%:\\%.o"}, []string{"%:\\%.c"}, "", true}}},
+	}
+
+	for _, test := range tests {
+		rs := parse(test.input, "mkfile", "/mkfile", make(map[string][]string))
+		got := summarizeRules(rs)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parse(%q) rules = %+v, want %+v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestEscapedPattern(t *testing.T) {
+	rs := parse("\\%\\%-%.o: %.c\n", "mkfile", "/mkfile", make(map[string][]string))
+	target := rs.rules[0].targets[0]
+	if got := target.match("%%-a:b.o"); len(got) != 2 || got[1] != "a:b" {
+		t.Errorf("match(%q) = %q, want stem a:b", "%%-a:b.o", got)
+	}
+	if got := target.match("x%-a.o"); got != nil {
+		t.Errorf("match(%q) = %q, want no match", "x%-a.o", got)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	rs := parse("a:VQX: b\n\ttrue\nc:Spython -u: d\n\tprint(1)\n",
+		"mkfile", "/mkfile", make(map[string][]string))
+	if len(rs.rules) != 2 {
+		t.Fatalf("parsed %d rules, want 2", len(rs.rules))
+	}
+
+	attrs := rs.rules[0].attributes
+	if !attrs.virtual || !attrs.quiet || !attrs.exclusive {
+		t.Errorf("attributes = %+v, want virtual, quiet and exclusive", attrs)
+	}
+
+	shell := rs.rules[1].shell
+	if !reflect.DeepEqual(shell, []string{"python", "-u"}) {
+		t.Errorf("shell = %q, want [python -u]", shell)
+	}
+}
+
+func TestParseAssignments(t *testing.T) {
+	tests := []struct {
+		input string
+		name  string
+		want  []string
+	}{
+		{"x=1\n", "x", []string{"1"}},
+		{"x = a b c\n", "x", []string{"a", "b", "c"}},
+		{"x=a\ny=$x.o\n", "y", []string{"a.o"}},
+		{"x='a b'\n", "x", []string{"a b"}},
+		{"x=a b\ny=${x:%=%.c}\n", "y", []string{"a.c", "b.c"}},
+		{"define x\na: $b\n  'c'\nendef\n", "x", []string{"a: $b\n  'c'"}},
+		{"define x\nendef\ny=1\n", "y", []string{"1"}},
+		{"x = a \\\n  b\\\nc \\\r\nd\n", "x", []string{"a", "b", "c", "d"}},
+		{"x = \"a \\\n b\" 'c \\\nd'\n", "x", []string{"a  b", "c \\\nd"}},
+	}
+
+	for _, test := range tests {
+		rs := parse(test.input, "mkfile", "/mkfile", make(map[string][]string))
+		got := rs.vars[test.name]
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parse(%q) $%s = %q, want %q", test.input, test.name, got, test.want)
+		}
+	}
+}
+
+func TestNamespacedInclude(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "rules.mk", "CFLAGS=-g $CFLAGS\nCC=cc\nobjs=a.o\nlib.a: $objs\n")
+
+		rs := parse("CFLAGS=-O2\nCC=cc\n<rules.mk as lib\n", "mkfile", dir+"/mkfile",
+			make(map[string][]string))
+		want := map[string][]string{
+			"CFLAGS":     {"-O2"},
+			"lib_CC":     {"cc"},
+			"lib_CFLAGS": {"-g", "-O2"},
+			"lib_objs":   {"a.o"},
+		}
+		for name, value := range want {
+			if !reflect.DeepEqual(rs.vars[name], value) {
+				t.Errorf("$%s = %q, want %q", name, rs.vars[name], value)
+			}
+		}
+		if _, ok := rs.vars["objs"]; ok {
+			t.Errorf("$objs leaked out of the namespaced include")
+		}
+		if len(rs.rules) != 1 || !reflect.DeepEqual(rs.rules[0].prereqs, []string{"a.o"}) {
+			t.Errorf("rules = %+v, want lib.a: a.o", summarizeRules(rs))
+		}
+	})
+}
+
+func TestRuleLocations(t *testing.T) {
+	sandboxed(func() {
+		oldExecutor := parseExecutor
+		defer func() { parseExecutor = oldExecutor }()
+		parseExecutor = &stubExecutor{output: "c:\n"}
+
+		rs := parse("x=1\na: b\n\ttrue\n\nb:\n<|gen\n", "mkfile", "/mkfile",
+			make(map[string][]string))
+		want := []string{"mkfile:2", "mkfile:5", "<|gen (mkfile:6):1"}
+		got := make([]string, 0)
+		for i := range rs.rules {
+			got = append(got, rs.rules[i].location())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("rules defined at %q, want %q", got, want)
+		}
+	})
+}
+
+func TestDuplicateRules(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "rules.mk", "a: b\n\techo a\n%.o: %.c\n\tcc $stem.c\n")
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stderr := os.Stderr
+		os.Stderr = w
+		rs := parse("<rules.mk\n<rules.mk\na: c\na:\n\techo other\n", "mkfile", dir+"/mkfile",
+			make(map[string][]string))
+		os.Stderr = stderr
+		w.Close()
+		printed, _ := ioutil.ReadAll(r)
+
+		want := []parsedRule{
+			{[]string{"a"}, []string{"b"}, "echo a\n", false},
+			{[]string{"%.o"}, []string{"%.c"}, "cc $stem.c\n", true},
+			{[]string{"a"}, []string{"c"}, "", false},
+			{[]string{"a"}, []string{}, "echo other\n", false},
+		}
+		if got := summarizeRules(rs); !reflect.DeepEqual(got, want) {
+			t.Errorf("rules = %+v, want %+v", got, want)
+		}
+		warning := "warning: mkfile:4: recipe for a conflicts with the one at rules.mk:1\n"
+		if string(printed) != warning {
+			t.Errorf("printed %q, want %q", printed, warning)
+		}
+	})
+}
+
+func TestRuleDocs(t *testing.T) {
+	input := "## builds the frontend\n##   bundle  \nweb:V:\n\tnpm run build\n" +
+		"## not directly above\n\nb:\n" +
+		"### a banner\nc:\n" +
+		"## a doc\n# a comment\nd:\n" +
+		"x=1 ## not a doc\n## e\ne: x ## nor this\n"
+	rs := parse(input, "mkfile", "/mkfile", make(map[string][]string))
+	want := []string{"builds the frontend\nbundle", "", "", "", "e"}
+	got := make([]string, 0)
+	for _, r := range rs.rules {
+		got = append(got, r.doc)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("docs are %q, want %q", got, want)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	input := "D=front/dist\n## the bundle\nalias fe: $D/bundle.js\nalias all: fe b loop\n" +
+		"alias loop: loop\nalias: x\nx:\n"
+	rs := parse(input, "mkfile", "/mkfile", make(map[string][]string))
+	got := rs.resolveAliases([]string{"all", "c"})
+	if want := []string{"front/dist/bundle.js", "b", "loop", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveAliases() = %q, want %q", got, want)
+	}
+	if fe := rs.aliases["fe"]; fe.doc != "the bundle" || fe.location() != "mkfile:3" {
+		t.Errorf("fe has doc %q at %s", fe.doc, fe.location())
+	}
+	// 'alias:' begins a rule for a target named alias
+	if len(rs.rules) != 2 || rs.rules[0].targets[0].spat != "alias" {
+		t.Errorf("rules are %v", rs.rules)
+	}
+
+	var out strings.Builder
+	listTargets(&out, rs)
+	want := "alias\tmkfile:6\nx\tmkfile:7\nall -> fe b loop\tmkfile:4\n" +
+		"fe -> front/dist/bundle.js\tmkfile:3\tthe bundle\nloop -> loop\tmkfile:5\n"
+	if out.String() != want {
+		t.Errorf("listTargets() printed %q, want %q", out.String(), want)
+	}
+
+	for _, input := range []string{"alias a\n", "alias a:\n", "alias a: b\nalias a: c\n", "alias a b c: d\nalias $x $y: d\n"} {
+		parsed := false
+		sandboxed(func() {
+			parse(input, "mkfile", "/mkfile", map[string][]string{"x": {"1"}, "y": {"2"}})
+			parsed = true
+		})
+		if want := strings.HasPrefix(input, "alias a b"); parsed != want {
+			t.Errorf("parse(%q) succeeded = %v, want %v", input, parsed, want)
+		}
+	}
+}
+
+func TestVariableRecursion(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"a=D=$b\nb=D=1\nx=$a\n", true},
+		{"a=D=$a y\nx=$a\n", false},
+		{"a=D=$b\nb=D=${a:%=%.o}\nx: $a\n", false},
+		{"a=D=$b\nb=D=$a\n", true},
+		{"a=D=1\nb=D=$a $a\nx=$b $b\n", true},
+	}
+
+	for _, test := range tests {
+		parsed := false
+		sandboxed(func() {
+			parse(test.input, "mkfile", "/mkfile", make(map[string][]string))
+			parsed = true
+		})
+		if parsed != test.ok {
+			t.Errorf("parse(%q) succeeded = %v, want %v", test.input, parsed, test.ok)
+		}
+	}
+
+	// expanding leaves nothing behind among the variables
+	vars := map[string][]string{"a": {deferredMarker, "$b"}, "b": {deferredMarker, "1"}}
+	if values, ok := lookupVar(vars, "a"); !ok || !reflect.DeepEqual(values, []string{"1"}) || len(vars) != 2 {
+		t.Errorf("looked up %q, leaving %q", values, vars)
+	}
+}
+
+func TestStrictUndefined(t *testing.T) {
+	old := undefinedRefs
+	defer func() { undefinedRefs = old }()
+	undefinedRefs = undefinedError
+
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"x=1\na: $x\n\techo $target $prereq $stem2\n", true},
+		{"a: $typo\n", false},
+		{"a: '$quoted'\n", true},
+		{"a:\n\techo $targte\n", false},
+		{"a:\n\tfor f in *; do\n\t\techo $f $$ \\$x\n\tdone\n", true},
+		{"a:\n\tx=1; echo ${x} $y\n", false},
+		{"a:\n\tls | while read -r f; do echo $f; done\n", true},
+		{"a:\n\twhile getopts ab: opt; do echo $opt $OPTARG; done\n", true},
+		{"a:\n\texport X; echo $X && echo $Y\n", false},
+	}
+
+	for _, test := range tests {
+		parsed := false
+		sandboxed(func() {
+			parse(test.input, "mkfile", "/mkfile", make(map[string][]string))
+			parsed = true
+		})
+		if parsed != test.ok {
+			t.Errorf("parse(%q) succeeded = %v, want %v", test.input, parsed, test.ok)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("a: b c\n\techo $target\n")
+	f.Add("x=1 2\na:VQ: $x\n\ttrue\n")
+	f.Add("%.o: %.c\n\tcc -c $stem.c\n")
+	f.Add("(.*)\\.o:R: \\1.c\n\ttrue\n")
+	f.Add("x=`echo a`\n<|echo b\n")
+	f.Add("define x\na: b\nendef\n")
+	f.Add("for x in a b\n$x: c\nend\n")
+	f.Add("<mk:c\n<rules.mk\n</dev/zero\n")
+	f.Add("<\n")
+
+	// includes are confined to an empty directory, as nothing outside it, such
+	// as a device that could block forever, may be read in restricted mode
+	dir := f.TempDir()
+	x, err := newRestrictions(dir, "")
+	if err != nil {
+		f.Fatal(err)
+	}
+	restricted = x
+	defer func() { restricted = nil }()
+	f.Fuzz(func(t *testing.T, input string) {
+		sandboxed(func() {
+			parse(input, "mkfile", filepath.Join(dir, "mkfile"), make(map[string][]string))
+		})
+	})
+}
+
+func TestIncludeSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		if err := os.Mkdir("lib", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, "lib/rules.mk", "x=1\n")
+
+		env := map[string][]string{"MKPATH": {"nowhere:lib"}}
+		rs := parse("<rules.mk\n", "mkfile", dir+"/mkfile", env)
+		if !reflect.DeepEqual(rs.vars["x"], []string{"1"}) {
+			t.Errorf("$x = %q, want [1]", rs.vars["x"])
+		}
+		if len(rs.includes) != 1 || rs.includes[0].path != filepath.Join(dir, "lib", "rules.mk") {
+			t.Errorf("includes = %+v, want lib/rules.mk", rs.includes)
+		}
+	})
+}
+
+func TestStdlibIncludes(t *testing.T) {
+	for _, name := range []string{"mk:cc", "mk:go", "mk:proto"} {
+		ok := false
+		sandboxed(func() {
+			rs := parse("<"+name+"\n", "mkfile", "/mkfile", make(map[string][]string))
+			ok = len(rs.rules) > 0
+		})
+		if !ok {
+			t.Errorf("including %s defined no rules", name)
+		}
+	}
+
+	// mk:cc includes the header dependencies the compiler found
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "a.d", "a.o: a.c h.h\n")
+		rs := parse("TARG=prog\nOFILES=a.o\n<mk:cc\n", "mkfile", dir+"/mkfile", make(map[string][]string))
+		found := false
+		for _, r := range rs.rules {
+			if len(r.targets) == 1 && r.targets[0].spat == "a.o" && reflect.DeepEqual(r.prereqs, []string{"a.c", "h.h"}) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("including mk:cc with a.d present defined %+v, want a.o: a.c h.h among them", summarizeRules(rs))
+		}
+	})
+}
+
+func TestParseReporter(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		oldExecutor := parseExecutor
+		defer func() { parseExecutor = oldExecutor }()
+		parseExecutor = parseReporter{}
+
+		rs := parse("X=`touch sideeffect; echo hi`\n<|touch sideeffect; echo Y=1\n",
+			"mkfile", "/mkfile", make(map[string][]string))
+		autoConfigure("config.mk")
+		if x, ok := rs.vars["X"]; !ok || len(x) != 0 {
+			t.Errorf("X is %q, want it set and empty", x)
+		}
+		if _, ok := rs.vars["Y"]; ok {
+			t.Errorf("the pipe include was parsed as if it had output")
+		}
+		for _, name := range []string{"sideeffect", "config.mk"} {
+			if _, err := os.Stat(name); err == nil {
+				t.Errorf("%s was created while parsing", name)
+			}
+		}
+	})
+}
+
+// Write a generated mkfile of about size bytes to w, as a pipe include of a
+// generator might: rules compiling one file each, with the odd assignment.
+func generateMkfile(w io.Writer, size int) {
+	out := bufio.NewWriter(w)
+	for i, n := 0, 0; n < size; i++ {
+		if i%100 == 0 {
+			k, _ := fmt.Fprintf(out, "CFLAGS_%d = -O2 -Iinclude -DPART=%d\n", i/100, i/100)
+			n += k
+		}
+		k, _ := fmt.Fprintf(out, "obj/f%d.o: src/f%d.c include/common.h\n\t$CC $CFLAGS_%d -c -o $target src/f%d.c\n",
+			i, i, i/100, i)
+		n += k
+	}
+	out.Flush()
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, size := range []int{1 << 20, 10 << 20, 100 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				r, w := io.Pipe()
+				go func() {
+					generateMkfile(w, size)
+					w.Close()
+				}()
+				rs := newRuleSet(map[string][]string{"CC": {"cc"}})
+				parseReader(r, "mkfile", rs, "/mkfile")
+			}
+		})
+	}
+}
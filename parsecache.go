@@ -0,0 +1,198 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+)
+
+// How many pipe includes and backticks have been run, or reported, while
+// parsing.
+var parseCommands int64
+
+// Run a pipe include or backtick with parseExecutor in dir, piping input into
+// it, and return its output.
+func runParseCommand(program string, args []string, dir string, input string) (string, error) {
+	atomic.AddInt64(&parseCommands, 1)
+	return parseExecutor.run(context.Background(), program, args, dir, input, captureStdout)
+}
+
+// Words that may name variables.
+var varNameRegexp = regexp.MustCompile(`[\p{L}_][\p{L}\p{N}_]*`)
+
+// The rule set last read by a daemon, reused for as long as nothing it was read
+// from changes: the arguments, the files parsed, and the environment variables
+// they mention. Mkfiles that run commands while they're parsed aren't reused.
+type parseCache struct {
+	params string              // the arguments it was read with
+	files  map[string][32]byte // the hash of each file parsed, by path
+	env    map[string][]string // the values of the variables they mention
+	unset  []string            // the words they mention that aren't variables
+	rs     *ruleSet            // the rule set, copied before it's used
+	rest   []string            // the arguments that weren't assignments
+}
+
+// Read the mkfiles as readMkfile does, unless they were read last time and
+// nothing they were read from has changed.
+func (c *parseCache) read(mkfiles []string, includeDirs []string, args []string, envOverrides bool) (*ruleSet, []string) {
+	params := fmt.Sprintf("%q %q %q %v %q", mkfiles, includeDirs, args, envOverrides, profile)
+	env, _, _ := mkfileEnv(includeDirs, args)
+	if c.rs != nil && c.params == params && c.unchanged(env) {
+		return c.rs.clone(env), append([]string(nil), c.rest...)
+	}
+
+	c.rs = nil
+	commands := atomic.LoadInt64(&parseCommands)
+	rs, rest := readMkfile(mkfiles, includeDirs, args, envOverrides)
+	if atomic.LoadInt64(&parseCommands) != commands {
+		return rs, rest
+	}
+	files, ok := parsedFiles(rs, mkfiles)
+	if !ok {
+		return rs, rest
+	}
+
+	c.files = make(map[string][32]byte, len(files))
+	words := make(map[string]bool)
+	for _, path := range files {
+		input, err := ioutil.ReadFile(path)
+		if err != nil {
+			return rs, rest
+		}
+		c.files[path] = sha256.Sum256(input)
+		for _, word := range varNameRegexp.FindAllString(string(input), -1) {
+			words[word] = true
+		}
+	}
+	// with -e, the environment overrides any assignment
+	c.env = make(map[string][]string)
+	for name, value := range env {
+		if words[name] || envOverrides || name == "MKPATH" {
+			c.env[name] = value
+		}
+	}
+	c.unset = make([]string, 0)
+	for name := range words {
+		if _, ok := env[name]; !ok {
+			c.unset = append(c.unset, name)
+		}
+	}
+	c.params, c.rs, c.rest = params, rs.clone(nil), append([]string(nil), rest...)
+	return rs, rest
+}
+
+// The paths of the files parsed into a rule set read from mkfiles, or false if
+// one of them isn't a file, such as the standard input.
+func parsedFiles(rs *ruleSet, mkfiles []string) ([]string, bool) {
+	if len(mkfiles) == 0 {
+		mkfiles = []string{defaultMkfile()}
+	}
+	files := make([]string, 0, len(mkfiles)+len(rs.includes)+1)
+	for _, mkfile := range mkfiles {
+		if mkfile == "-" {
+			return nil, false
+		}
+		path, err := filepath.Abs(mkfile)
+		if err != nil {
+			return nil, false
+		}
+		files = append(files, path)
+	}
+	if profile != "" {
+		files = append(files, filepath.Join(filepath.Dir(files[0]), "profiles", profile+".mk"))
+	}
+	for _, inc := range rs.includes {
+		if inc.path != inc.name || !isStdlibInclude(inc.name) {
+			files = append(files, inc.path)
+		}
+	}
+	return files, true
+}
+
+// True if the files and the variables the rule set was read from are as they
+// were, and config.mk wouldn't be configured again.
+func (c *parseCache) unchanged(env map[string][]string) bool {
+	for name, value := range c.env {
+		if current, ok := env[name]; !ok || !sameWords(current, value) {
+			return false
+		}
+	}
+	for _, name := range c.unset {
+		if _, ok := env[name]; ok {
+			return false
+		}
+	}
+	for path, sum := range c.files {
+		input, err := ioutil.ReadFile(path)
+		if err != nil || sha256.Sum256(input) != sum {
+			return false
+		}
+		if filepath.Base(path) == configureFile && configureStale(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// A copy of the rule set that may be added to without changing it. If env
+// isn't nil, the variables that came from the environment are taken from env
+// instead, as are those the rule set doesn't have.
+func (rs *ruleSet) clone(env map[string][]string) *ruleSet {
+	c := *rs
+	c.vars, c.origins = copyVars(rs.vars, rs.origins)
+	c.rules = append([]rule(nil), rs.rules...)
+	c.targetRules = make(map[string][]int, len(rs.targetRules))
+	for target, ks := range rs.targetRules {
+		c.targetRules[target] = append([]int(nil), ks...)
+	}
+	c.fingerprints = make(map[string]int, len(rs.fingerprints))
+	for fp, k := range rs.fingerprints {
+		c.fingerprints[fp] = k
+	}
+	c.aliases = make(map[string]alias, len(rs.aliases))
+	for name, a := range rs.aliases {
+		c.aliases[name] = a
+	}
+	c.includes = append([]include(nil), rs.includes...)
+	c.preloads = nil
+
+	if env == nil {
+		return &c
+	}
+	for name, origin := range c.origins {
+		if _, ok := env[name]; !ok && origin == originEnvironment {
+			delete(c.vars, name)
+			delete(c.origins, name)
+		}
+	}
+	for name, value := range env {
+		origin, hasOrigin := c.origins[name]
+		if _, ok := c.vars[name]; !ok || hasOrigin && origin == originEnvironment {
+			c.vars[name] = value
+			c.origins[name] = originEnvironment
+		}
+	}
+	return &c
+}
@@ -0,0 +1,64 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCache(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		t.Setenv("CC", "cc")
+		t.Setenv("UNUSED", "a")
+		writeFile(t, "mkfile", "<rules.mk\nall:V: $CC.o\n")
+		writeFile(t, "rules.mk", "%.o:\n\ttouch $target\n")
+
+		var c parseCache
+		read := func() *ruleSet {
+			rs, _ := c.read([]string{"mkfile"}, nil, nil, false)
+			return rs
+		}
+		rs := read()
+		cached := c.rs
+		rs.addRoot([]string{"all"})
+
+		// variables it doesn't mention are taken afresh
+		t.Setenv("UNUSED", "b")
+		rs = read()
+		if c.rs != cached || len(rs.rules) != 2 || !reflect.DeepEqual(rs.vars["UNUSED"], []string{"b"}) {
+			t.Errorf("mkfile was read again, or read with %d rules and $UNUSED %q", len(rs.rules), rs.vars["UNUSED"])
+		}
+
+		t.Setenv("CC", "gcc")
+		if rs = read(); c.rs == cached || !reflect.DeepEqual(rs.rules[1].prereqs, []string{"gcc.o"}) {
+			t.Errorf("mkfile wasn't read again after $CC changed")
+		}
+		cached = c.rs
+		writeFile(t, "rules.mk", "%.o:\n\ttouch $target $prereq\n")
+		if read(); c.rs == cached {
+			t.Errorf("mkfile wasn't read again after rules.mk changed")
+		}
+
+		writeFile(t, "mkfile", "X=`echo x`\n")
+		if read(); c.rs != nil {
+			t.Errorf("mkfile running a command while parsed was cached")
+		}
+	})
+}
@@ -0,0 +1,143 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How many of the includes following the one being parsed are read ahead.
+const includeLookahead = 16
+
+// How many included files are read at once.
+var preloadSlots = make(chan struct{}, 8)
+
+// An included file read and lexed ahead of being parsed. Includes are parsed
+// in order, as what one assigns may change what the next means, but the files
+// of a run of includes are read and lexed in parallel while they're waited on.
+type preload struct {
+	done chan struct{} // closed once the file has been lexed
+	info os.FileInfo   // the file as it was opened
+	l    *lexer        // its tokens
+	err  error         // why it couldn't be read, if it couldn't
+}
+
+// Start reading the files named by the includes following the current
+// statement, up to the first statement that isn't an include. A file is only
+// used if it's still the one an include finds once it's parsed.
+func (p *parser) preloadAhead() {
+	n := 0
+	for i := 0; i < includeLookahead; i++ {
+		tokens := p.l.peekTokens(n + 1)
+		if n >= len(tokens) || tokens[n].typ != tokenRedirInclude {
+			return
+		}
+		end := n + 1
+		for {
+			tokens = p.l.peekTokens(end + 1)
+			if end >= len(tokens) {
+				return
+			}
+			if tokens[end].typ == tokenNewline {
+				break
+			}
+			if tokens[end].typ != tokenWord && tokens[end].typ != tokenColon {
+				return
+			}
+			end++
+		}
+		p.preload(tokens[n+1 : end])
+		n = end + 1
+	}
+}
+
+// Start reading the file an include's words name, unless it isn't a plain
+// file or is already being read. Names with variables or commands in them are
+// left alone, as expanding them ahead of time could run commands.
+func (p *parser) preload(words []token) {
+	if n := len(words); n >= 3 && words[n-2].val == "as" {
+		words = words[:n-2]
+	}
+	filename := ""
+	for _, w := range words {
+		filename += w.val
+	}
+	if strings.ContainsAny(filename, "$`") {
+		return
+	}
+	if isStdlibInclude(filename) || filepath.Base(filename) == configureFile {
+		return
+	}
+	found, _ := findInclude(filename, p.rules.dir, p.rules.vars)
+	if found == "" || restricted != nil && !restricted.inWorkspace(found) {
+		return
+	}
+	if p.rules.preloads == nil {
+		p.rules.preloads = make(map[string]*preload)
+	}
+	if _, ok := p.rules.preloads[found]; ok {
+		return
+	}
+
+	pl := &preload{done: make(chan struct{})}
+	p.rules.preloads[found] = pl
+	go func() {
+		defer close(pl.done)
+		preloadSlots <- struct{}{}
+		defer func() { <-preloadSlots }()
+
+		file, err := os.Open(found)
+		if err != nil {
+			pl.err = err
+			return
+		}
+		defer file.Close()
+		if pl.info, pl.err = file.Stat(); pl.err != nil {
+			return
+		}
+		l := lexReader(file)
+		tokens := make([]token, 0)
+		for t, ok := l.nextToken(); ok; t, ok = l.nextToken() {
+			tokens = append(tokens, t)
+		}
+		pl.l = &lexer{tokens: tokens, errMsg: l.errMsg, line: l.line, col: l.col}
+	}()
+}
+
+// The tokens of the included file at path, if it was read ahead and hasn't
+// changed since, or nil.
+func (rs *ruleSet) takePreload(path string) *lexer {
+	pl, ok := rs.preloads[path]
+	if !ok {
+		return nil
+	}
+	delete(rs.preloads, path)
+	<-pl.done
+	if pl.err != nil {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || !os.SameFile(info, pl.info) || info.Size() != pl.info.Size() ||
+		!info.ModTime().Equal(pl.info.ModTime()) {
+		return nil
+	}
+	return pl.l
+}
@@ -0,0 +1,55 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreloadIncludes(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "a.mk", "A=a\nB=b.mk\n")
+		writeFile(t, "b.mk", "x=1\n")
+		writeFile(t, "c.mk", "x=$x 2\nall:V:\n\ttrue\n")
+		writeFile(t, "d.mk", "y=1\n")
+		writeFile(t, "gen.mk", "G=`echo y=22 > d.mk`\n")
+		// $B names c.mk until a.mk is parsed, and d.mk changes as gen.mk is
+		mkfile := "B=c.mk\n<a.mk\n<$B\n<c.mk as c\n\n<gen.mk\n<d.mk\n"
+
+		rs := parse(mkfile, "mkfile", "mkfile", make(map[string][]string))
+		for name, want := range map[string][]string{"A": {"a"}, "x": {"1"}, "c_x": {"1", "2"}, "y": {"22"}} {
+			if got := rs.vars[name]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s is %q, want %q", name, got, want)
+			}
+		}
+		if len(rs.preloads) != 0 {
+			t.Errorf("%d files read ahead weren't taken", len(rs.preloads))
+		}
+		if _, ok := rs.targetRules["all"]; !ok {
+			t.Errorf("rule in c.mk is missing")
+		}
+
+		// a deferred variable naming an include is expanded once
+		parse("X=D=`echo run >>log; echo b.mk`\n<a.mk\n<$X\n", "mkfile", "mkfile", make(map[string][]string))
+		if got := readWords(t, "log"); !reflect.DeepEqual(got, []string{"run"}) {
+			t.Errorf("command ran %d times, want once", len(got))
+		}
+	})
+}
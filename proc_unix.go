@@ -0,0 +1,161 @@
+//go:build !windows
+// +build !windows
+
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Whether mk has a controlling terminal. Recipes may need to read from it, say
+// for a password prompt, which only the terminal's foreground process group
+// can do without being stopped.
+var hasTerminal = func() bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}()
+
+// Start subprocesses in process groups of their own, so that whatever a
+// recipe starts can be killed along with it, unless mk has a terminal, in
+// which case they're left in mk's, which the terminal interrupts as a whole.
+func processGroup() *syscall.SysProcAttr {
+	if hasTerminal {
+		return nil
+	}
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Terminate a subprocess, along with its process group if it has its own,
+// and kill it if it hasn't exited a few seconds later.
+func killProcessGroup(proc *os.Process, exited chan bool) {
+	pid := proc.Pid
+	if !hasTerminal {
+		pid = -pid
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// Run a program at the given niceness, if any, with nice, and pinned to the
+// listed CPUs with taskset. On Linux, a nice program gets the lowest
+// best-effort I/O priority from ionice as well, if it's installed.
+func scheduleCommand(nice int, cpus string, program string, args []string) (string, []string) {
+	command := append([]string{program}, args...)
+	if cpus != "" {
+		if runtime.GOOS != "linux" {
+			mkError("mk: pinning recipes to CPUs is only supported on Linux")
+		}
+		command = append([]string{"taskset", "-c", cpus}, command...)
+	}
+	if nice > 0 {
+		if _, err := exec.LookPath("ionice"); err == nil && runtime.GOOS == "linux" {
+			command = append([]string{"ionice", "-c", "2", "-n", "7"}, command...)
+		}
+		command = append([]string{"nice", "-n", strconv.Itoa(nice)}, command...)
+	}
+	return command[0], command[1:]
+}
+
+// The resource limited by each of the limit settings.
+var rlimitResources = map[string]int{
+	"maxmem":   rlimitMemory,
+	"maxfiles": syscall.RLIMIT_NOFILE,
+	"maxcore":  syscall.RLIMIT_CORE,
+}
+
+// Run a program under the given limits, name=value as rlimitArg takes them,
+// by way of mk itself.
+func limitCommand(limits []string, program string, args []string) (string, []string) {
+	if len(limits) == 0 {
+		return program, args
+	}
+	self, err := os.Executable()
+	if err != nil {
+		mkError(fmt.Sprintf("mk: unable to limit recipes: %s", err))
+	}
+	command := append([]string{rlimitArg}, limits...)
+	command = append(append(command, "--", program), args...)
+	return self, command
+}
+
+// mk -_rlimit name=value ... -- program [arg ...]: set the limits and execute
+// the program in place of mk. Returns false if the arguments are malformed.
+func rlimitCommand(args []string) bool {
+	k := 0
+	for k < len(args) && args[k] != "--" {
+		k++
+	}
+	if k+1 >= len(args) {
+		return false
+	}
+	resources := make([]int, k)
+	rlims := make([]syscall.Rlimit, k)
+	for j, limit := range args[:k] {
+		i := strings.IndexByte(limit, '=')
+		if i < 0 {
+			return false
+		}
+		var ok bool
+		if resources[j], ok = rlimitResources[limit[:i]]; !ok {
+			return false
+		}
+		// scanned, as the limits' type varies between systems
+		syscall.Getrlimit(resources[j], &rlims[j])
+		max := rlims[j].Max
+		if _, err := fmt.Sscan(limit[i+1:], &rlims[j].Cur); err != nil {
+			return false
+		}
+		if rlims[j].Cur > max {
+			rlims[j].Cur = max
+		}
+	}
+	for j := range resources {
+		if err := syscall.Setrlimit(resources[j], &rlims[j]); err != nil {
+			mkError(fmt.Sprintf("mk: unable to set %s: %s", args[j], err))
+		}
+	}
+	// this mk isn't one level deeper as far as the program is concerned
+	if level, err := strconv.Atoi(os.Getenv("MKLEVEL")); err == nil {
+		os.Setenv("MKLEVEL", strconv.Itoa(level-1))
+	}
+	program, err := exec.LookPath(args[k+1])
+	if err != nil {
+		mkError(fmt.Sprintf("mk: %s", err))
+	}
+	err = syscall.Exec(program, args[k+1:], os.Environ())
+	mkError(fmt.Sprintf("mk: unable to execute %s: %s", program, err))
+	return true
+}
@@ -0,0 +1,79 @@
+//go:build windows
+// +build windows
+
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Process groups are left alone where there aren't any to speak of.
+func processGroup() *syscall.SysProcAttr {
+	return nil
+}
+
+// Kill a subprocess.
+func killProcessGroup(proc *os.Process, exited chan bool) {
+	proc.Kill()
+}
+
+// Run a program below normal priority, or at low priority if it's 15 or more
+// nice, and with an affinity for the listed CPUs, by way of start.
+func scheduleCommand(nice int, cpus string, program string, args []string) (string, []string) {
+	if nice == 0 && cpus == "" {
+		return program, args
+	}
+	command := []string{"/c", "start", "/b", "/wait"}
+	if nice >= 15 {
+		command = append(command, "/low")
+	} else if nice > 0 {
+		command = append(command, "/belownormal")
+	}
+	if cpus != "" {
+		list, _ := parseCPUList(cpus)
+		mask := uint64(0)
+		for _, cpu := range list {
+			mask |= 1 << uint(cpu)
+		}
+		command = append(command, "/affinity", fmt.Sprintf("%x", mask))
+	}
+	return "cmd", append(append(command, program), args...)
+}
+
+var limitWarning sync.Once
+
+// Resource limits aren't supported, so programs run without them.
+func limitCommand(limits []string, program string, args []string) (string, []string) {
+	if len(limits) > 0 {
+		limitWarning.Do(func() {
+			mkPrintError("mk: warning: recipes' resource limits are ignored on Windows")
+		})
+	}
+	return program, args
+}
+
+// There's no 'mk -_rlimit' on Windows.
+func rlimitCommand(args []string) bool {
+	return false
+}
@@ -0,0 +1,86 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Profiles, sets of variables such as those for cross-compiling to a
+// platform, each building into its own output directory.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The profile chosen with -profile, if any.
+var profile string
+
+// The directory of a profile's outputs and of mk's state while using it, so
+// that builds using different profiles can run at once.
+func profileOutDir(name string) string {
+	return filepath.Join("out", name)
+}
+
+// The path of one of mk's state files, such as .mkoutputs, which is kept in
+// the profile's output directory if there's a profile.
+func statePath(name string) string {
+	if profile == "" {
+		return name
+	}
+	dir := profileOutDir(profile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		mkError(fmt.Sprintf("mk: unable to create %s: %s", dir, err))
+	}
+	return filepath.Join(dir, name)
+}
+
+// Read profiles/<name>.mk, next to the mkfile at path, setting the variables
+// it assigns along with $PROFILE and $OUTDIR. They take precedence over the
+// mkfile, but not over the command line. The profile's rules are ignored.
+func loadProfile(rs *ruleSet, name string, path string) {
+	file := filepath.Join(filepath.Dir(path), "profiles", name+".mk")
+	input, err := ioutil.ReadFile(file)
+	if err != nil {
+		mkError(fmt.Sprintf("mk: unable to read profile %s: %s", name, err))
+	}
+
+	// the profile sees the same variables as the mkfile does
+	layer := newRuleSet(make(map[string][]string, len(rs.vars)))
+	for k, v := range rs.vars {
+		layer.vars[k] = v
+		layer.origins[k] = rs.origins[k]
+	}
+	layer.envOverrides = rs.envOverrides
+	parseInto(string(input), file, layer, file)
+
+	set := func(k string, v []string) {
+		if rs.origins[k] != originCommandLine {
+			rs.vars[k] = v
+			rs.origins[k] = originProfile
+		}
+	}
+	for k, v := range layer.vars {
+		if _, ok := layer.origins[k]; !ok {
+			set(k, v)
+		}
+	}
+	rs.includes = append(rs.includes, layer.includes...)
+	set("PROFILE", []string{name})
+	set("OUTDIR", []string{profileOutDir(name)})
+}
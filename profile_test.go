@@ -0,0 +1,63 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		if err := os.Mkdir("profiles", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, "profiles/arm64-linux.mk", "CC=$ARCH_PREFIX-cc\nCFLAGS=-O2\nnever:\n\ttrue\n")
+		writeFile(t, "mkfile", "CC=cc\nCFLAGS=-g\nLDFLAGS=-s\n$OUTDIR/prog:\n\t$CC $CFLAGS -o $target\n")
+		profile = "arm64-linux"
+		defer func() { profile = "" }()
+
+		rs, _ := readMkfile(nil, nil, []string{"ARCH_PREFIX=aarch64", "CFLAGS=-O0"}, false)
+		for name, want := range map[string][]string{
+			"CC":      {"aarch64-cc"},
+			"CFLAGS":  {"-O0"},
+			"LDFLAGS": {"-s"},
+			"PROFILE": {"arm64-linux"},
+			"OUTDIR":  {filepath.Join("out", "arm64-linux")},
+		} {
+			if got := rs.vars[name]; !reflect.DeepEqual(got, want) {
+				t.Errorf("$%s = %q, want %q", name, got, want)
+			}
+		}
+		if origin := rs.origins["CC"]; origin != originProfile {
+			t.Errorf("$CC comes from the %s, want the profile", origin)
+		}
+		if len(rs.targetRules["never"]) != 0 {
+			t.Error("read the profile's rules")
+		}
+		if len(rs.targetRules[filepath.Join("out", "arm64-linux", "prog")]) != 1 {
+			t.Error("no rule for the profile's output")
+		}
+		if got, want := statePath(".mkoutputs"), filepath.Join("out", "arm64-linux", ".mkoutputs"); got != want {
+			t.Errorf("state is kept in %s, want %s", got, want)
+		}
+	})
+}
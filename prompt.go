@@ -0,0 +1,98 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Asking before each recipe is executed, one question at a time however many
+// recipes are ready at once.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// An answer to whether to execute a recipe.
+type promptAnswer int
+
+const (
+	answerYes  promptAnswer = iota // execute it
+	answerNo                       // skip it, leaving its target as it is
+	answerQuit                     // cancel the build
+)
+
+// Asks whether to execute recipes, serializing the questions so that
+// concurrent jobs don't garble them, and remembering answers for all.
+type promptBroker struct {
+	mutex  sync.Mutex
+	in     *bufio.Reader
+	out    io.Writer
+	always *promptAnswer // answer given for every recipe, if any
+	cancel func()        // cancels the build
+}
+
+func newPromptBroker(in io.Reader, out io.Writer, cancel func()) *promptBroker {
+	return &promptBroker{in: bufio.NewReader(in), out: out, cancel: cancel}
+}
+
+// Ask whether to execute the recipe for the target. Answers are y (yes), n
+// (no), A (yes to all), N (no to all) and q (quit); the end of input quits.
+func (b *promptBroker) confirm(target string, recipe string) promptAnswer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.always != nil {
+		return *b.always
+	}
+
+	// nothing else mk prints gets in the way of the question
+	mkMsgMutex.Lock()
+	defer mkMsgMutex.Unlock()
+	fmt.Fprintf(b.out, "%s: ", target)
+	printIndented(b.out, recipe, len(target)+2)
+	if !strings.HasSuffix(recipe, "\n") {
+		fmt.Fprintln(b.out)
+	}
+	for {
+		fmt.Fprint(b.out, "execute? [y,n,A,N,q] ")
+		line, err := b.in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if err != nil && answer == "" {
+			answer = "q"
+		}
+		var always promptAnswer
+		switch answer {
+		case "y":
+			return answerYes
+		case "n":
+			return answerNo
+		case "A":
+			always = answerYes
+		case "N":
+			always = answerNo
+		case "q":
+			always = answerQuit
+			b.cancel()
+		default:
+			continue
+		}
+		b.always = &always
+		return always
+	}
+}
@@ -0,0 +1,136 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Recording how each target was built, as an in-toto statement with an SLSA
+// provenance predicate, for supply chain attestations of what mk produces.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The build type of mk's provenance, identifying what its parameters mean.
+const provenanceBuildType = "https://github.com/lenticularis39/mk/provenance/recipe/v1"
+
+// An artifact and its digests.
+type provenanceResource struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []provenanceResource `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     provenancePredicate  `json:"predicate"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition struct {
+		BuildType          string               `json:"buildType"`
+		ExternalParameters map[string]string    `json:"externalParameters"`
+		ResolvedDeps       []provenanceResource `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Writes provenance records into a directory, each at the path of its target
+// with .intoto.json appended.
+type provenanceWriter struct {
+	mutex   sync.Mutex
+	dir     string
+	recipes map[string]string // recipes as executed, by target
+}
+
+func newProvenanceWriter(dir string) *provenanceWriter {
+	return &provenanceWriter{dir: dir, recipes: make(map[string]string)}
+}
+
+// Note the recipe executed for a target, its variables expanded.
+func (p *provenanceWriter) noteRecipe(target string, recipe string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.recipes[target] = recipe
+	p.mutex.Unlock()
+}
+
+// A resource for a file, with its SHA-256 if it can be read.
+func fileResource(name string) provenanceResource {
+	res := provenanceResource{Name: name}
+	if hash := hashFile(name); hash != "" {
+		res.Digest = map[string]string{"sha256": hash}
+	}
+	return res
+}
+
+// Write the provenance of a target the rule has just built, its recipe
+// having started at the given time.
+func (p *provenanceWriter) write(target string, r *rule, prereqs []*node, start time.Time) error {
+	p.mutex.Lock()
+	recipe := p.recipes[target]
+	p.mutex.Unlock()
+
+	s := provenanceStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       []provenanceResource{fileResource(target)},
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+	def := &s.Predicate.BuildDefinition
+	def.BuildType = provenanceBuildType
+	def.ExternalParameters = map[string]string{
+		"target": target,
+		"rule":   r.location(),
+		"recipe": recipe,
+	}
+	def.ResolvedDeps = make([]provenanceResource, 0, len(prereqs))
+	for _, v := range prereqs {
+		def.ResolvedDeps = append(def.ResolvedDeps, fileResource(v.name))
+	}
+	run := &s.Predicate.RunDetails
+	run.Builder.ID = "mk"
+	run.Builder.Version = map[string]string{"mk": version()}
+	run.Metadata.StartedOn = start.UTC().Format(time.RFC3339)
+	run.Metadata.FinishedOn = time.Now().UTC().Format(time.RFC3339)
+
+	content, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(p.dir, target+".intoto.json")
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(content, '\n'), 0644)
+}
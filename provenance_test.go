@@ -0,0 +1,62 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "in", "hello\n")
+		writeFile(t, "mkfile", "MSG=built\nsub/out:Q: in\n\tmkdir -p sub; echo $MSG > $target\nall:V: sub/out\n")
+		opts := defaultBuildOptions()
+		opts.provenance = newProvenanceWriter("prov")
+		runMk(t, nil, opts)
+
+		content, err := ioutil.ReadFile(filepath.Join("prov", "sub", "out.intoto.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s provenanceStatement
+		if err := json.Unmarshal(content, &s); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Subject) != 1 || s.Subject[0].Name != "sub/out" || s.Subject[0].Digest["sha256"] != hashFile("sub/out") {
+			t.Errorf("subject is %+v, want sub/out with its digest", s.Subject)
+		}
+		def := s.Predicate.BuildDefinition
+		if recipe := def.ExternalParameters["recipe"]; !strings.Contains(recipe, "echo built > sub/out") {
+			t.Errorf("recipe is %q, want it expanded", recipe)
+		}
+		if rule := def.ExternalParameters["rule"]; !strings.HasPrefix(rule, "mkfile:2") {
+			t.Errorf("rule is at %q, want mkfile:2", rule)
+		}
+		if len(def.ResolvedDeps) != 1 || def.ResolvedDeps[0].Name != "in" || def.ResolvedDeps[0].Digest["sha256"] != hashFile("in") {
+			t.Errorf("dependencies are %+v, want in with its digest", def.ResolvedDeps)
+		}
+		if _, err := ioutil.ReadFile(filepath.Join("prov", "all.intoto.json")); err == nil {
+			t.Error("wrote provenance for a virtual target")
+		}
+	})
+}
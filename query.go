@@ -0,0 +1,286 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Querying the graph without building anything: which targets a target
+// depends on, which depend on it, and how two targets are connected.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A query is a target name or glob pattern, or a function applied to queries:
+//
+//	deps(q)     targets the targets of q depend on, directly or not
+//	rdeps(q)    targets that depend on the targets of q, directly or not
+//	path(q, r)  targets on the way from those of q to those of r, inclusive
+type query struct {
+	function string   // function applied, or "" for a name
+	name     string   // target name or glob pattern
+	args     []*query // arguments of the function
+}
+
+// The number of arguments each function takes.
+var queryFunctions = map[string]int{"deps": 1, "rdeps": 1, "path": 2}
+
+type queryParser struct {
+	input string
+	pos   int
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) parse() (*query, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && strings.IndexByte("(), \t\n", p.input[p.pos]) < 0 {
+		p.pos++
+	}
+	word := p.input[start:p.pos]
+	if word == "" {
+		return nil, p.errorf("expected a target or function")
+	}
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '(' {
+		return &query{name: word}, nil
+	}
+
+	arity, ok := queryFunctions[word]
+	if !ok {
+		return nil, fmt.Errorf("no function %s", word)
+	}
+	p.pos++
+	q := &query{function: word}
+	for {
+		arg, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		q.args = append(q.args, arg)
+		p.skipSpace()
+		if p.pos < len(p.input) && p.input[p.pos] == ',' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+		return nil, p.errorf("expected ) to close %s", word)
+	}
+	p.pos++
+	if len(q.args) != arity {
+		return nil, fmt.Errorf("%s takes %d arguments, not %d", word, arity, len(q.args))
+	}
+	return q, nil
+}
+
+// Parse a query, such as rdeps(config.h).
+func parseQuery(input string) (*query, error) {
+	p := &queryParser{input: input}
+	q, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return q, nil
+}
+
+// The target names a query mentions, which the graph must include.
+func (q *query) names() []string {
+	if q.function == "" {
+		if isGlobPattern(q.name) {
+			return nil
+		}
+		return []string{q.name}
+	}
+	var names []string
+	for _, arg := range q.args {
+		names = append(names, arg.names()...)
+	}
+	return names
+}
+
+// A set of nodes.
+type nodeSet map[*node]bool
+
+// Nodes reachable from those in the set, following prerequisites, or
+// dependents if reverse is set, not counting the set's own.
+func (s nodeSet) reach(dependents map[*node][]*node, reverse bool) nodeSet {
+	reached := make(nodeSet)
+	stack := make([]*node, 0, len(s))
+	for u := range s {
+		stack = append(stack, u)
+	}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		var next []*node
+		if reverse {
+			next = dependents[u]
+		} else {
+			for _, e := range u.prereqs {
+				if e.v != nil {
+					next = append(next, e.v)
+				}
+			}
+		}
+		for _, v := range next {
+			if !reached[v] {
+				reached[v] = true
+				stack = append(stack, v)
+			}
+		}
+	}
+	for u := range s {
+		delete(reached, u)
+	}
+	return reached
+}
+
+// Evaluate a query over the graph.
+func (g *graph) evalQuery(q *query, dependents map[*node][]*node) (nodeSet, error) {
+	if q.function == "" {
+		s := make(nodeSet)
+		for name, u := range g.nodes {
+			if u == g.root {
+				continue
+			}
+			if matched, _ := filepath.Match(q.name, name); matched || name == q.name {
+				s[u] = true
+			}
+		}
+		if len(s) == 0 {
+			return nil, fmt.Errorf("no target matches %s", q.name)
+		}
+		return s, nil
+	}
+
+	args := make([]nodeSet, len(q.args))
+	for i := range q.args {
+		var err error
+		if args[i], err = g.evalQuery(q.args[i], dependents); err != nil {
+			return nil, err
+		}
+	}
+	switch q.function {
+	case "deps":
+		return args[0].reach(dependents, false), nil
+	case "rdeps":
+		return args[0].reach(dependents, true), nil
+	}
+
+	// path: whatever lies below the start and above the end, with both
+	below := args[0].reach(dependents, false)
+	above := args[1].reach(dependents, true)
+	for u := range args[0] {
+		below[u] = true
+	}
+	for u := range args[1] {
+		above[u] = true
+	}
+	s := make(nodeSet)
+	for u := range below {
+		if above[u] {
+			s[u] = true
+		}
+	}
+	return s, nil
+}
+
+// Each node's dependents, the reverse of its prerequisites.
+func (g *graph) dependents() map[*node][]*node {
+	dependents := make(map[*node][]*node)
+	for _, u := range g.nodes {
+		if u == g.root {
+			continue
+		}
+		for _, e := range u.prereqs {
+			if e.v != nil {
+				dependents[e.v] = append(dependents[e.v], u)
+			}
+		}
+	}
+	return dependents
+}
+
+// Print the names of the targets in the set, sorted.
+func printNodes(out io.Writer, s nodeSet) {
+	names := make([]string, 0, len(s))
+	for u := range s {
+		names = append(names, u.name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(out, name)
+	}
+}
+
+// The graph of every target of a rule that isn't a meta-rule, and of the
+// given names.
+func queryGraph(rs *ruleSet, names []string) *graph {
+	targets := make([]string, 0)
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if !r.isMeta && !r.isRoot() && r.url == "" {
+			targets = append(targets, r.targetNames()...)
+		}
+	}
+	rs.addRoot(append(targets, names...))
+	return buildgraph(rs, "", defaultBuildOptions())
+}
+
+// mk query [-f mkfile] [options] query [var=value]: print the targets that
+// match a query. Without a query, query is a target to build.
+func queryCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk query", flag.ExitOnError)
+	mkfile := mkfileFlags(flags)
+	flags.Parse(args)
+
+	rs, rest := mkfile.read(flags.Args())
+	if len(rest) == 0 {
+		return false
+	}
+	q, err := parseQuery(strings.Join(rest, " "))
+	if err != nil {
+		mkError(fmt.Sprintf("mk query: %s", err))
+	}
+	g := queryGraph(rs, q.names())
+	s, err := g.evalQuery(q, g.dependents())
+	if err != nil {
+		mkError(fmt.Sprintf("mk query: %s", err))
+	}
+	printNodes(os.Stdout, s)
+	return true
+}
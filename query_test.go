@@ -0,0 +1,72 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		for _, name := range []string{"a.c", "b.c", "c.c", "config.h"} {
+			writeFile(t, name, "")
+		}
+		for _, test := range []struct {
+			query string
+			want  string
+		}{
+			{"rdeps(config.h)", "a.o all b.o c.o p q"},
+			{"deps(q)", "c.c c.o config.h"},
+			{"deps(*.o)", "a.c b.c c.c config.h"},
+			{"path(all, a.c)", "a.c a.o all p"},
+			{"rdeps(deps(q))", "a.o all b.o p q"},
+			{"b.o", "b.o"},
+		} {
+			rs := parse("all:V: p q\np: a.o b.o\n\tcc\nq: c.o\n\tcc\n%.o: %.c config.h\n\tcc\n",
+				"mkfile", dir+"/mkfile", make(map[string][]string))
+			q, err := parseQuery(test.query)
+			if err != nil {
+				t.Errorf("%s: %s", test.query, err)
+				continue
+			}
+			g := queryGraph(rs, q.names())
+			s, err := g.evalQuery(q, g.dependents())
+			if err != nil {
+				t.Errorf("%s: %s", test.query, err)
+				continue
+			}
+			var out bytes.Buffer
+			printNodes(&out, s)
+			if got := strings.Join(strings.Fields(out.String()), " "); got != test.want {
+				t.Errorf("%s matched %q, want %q", test.query, got, test.want)
+			}
+		}
+	})
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, input := range []string{"", "deps(", "deps(a", "path(a)", "deps(a, b)", "nope(a)", "a b", "deps(a))"} {
+		if _, err := parseQuery(input); err == nil {
+			t.Errorf("parsed %q without an error", input)
+		}
+	}
+}
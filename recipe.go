@@ -48,28 +48,95 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
+// How a line of a recipe is unindented.
+type recipeLineKind int
+
+const (
+	lineIndented recipeLineKind = iota // indented like the recipe
+	lineVerbatim                       // continuing the previous line, or in an unindented here-document
+	lineComment                        // a comment in column 0 between the recipe's lines
+)
+
+// How each of the lines of a recipe is unindented. Here-documents whose
+// delimiter ends them in column 0 are kept as they are, as are lines
+// continuing the previous one, which are left to the shell.
+func recipeLineKinds(lines []string) []recipeLineKind {
+	kinds := make([]recipeLineKind, len(lines))
+	verbatim := 0 // lines of an unindented here-document left
+	heredoc := 0  // lines of an indented here-document left
+	for k, line := range lines {
+		if k > 0 && continuedLine(lines[k-1]) && verbatim == 0 && heredoc == 0 {
+			kinds[k] = lineVerbatim
+			continue
+		}
+		if verbatim > 0 {
+			kinds[k] = lineVerbatim
+			verbatim--
+			continue
+		}
+		if heredoc > 0 {
+			heredoc--
+		} else if k > 0 && strings.HasPrefix(line, "#") {
+			kinds[k] = lineComment
+			continue
+		}
+
+		end := k
+		for _, delim := range heredocDelimiters(line) {
+			if i := heredocEndLine(lines, end, delim); i >= 0 {
+				end = i
+			}
+		}
+		if end > k && strings.IndexAny(lines[end], " \t") != 0 {
+			verbatim = end - k
+		} else {
+			heredoc = end - k
+		}
+	}
+	return kinds
+}
+
 // Try to unindent a recipe, so that it begins an column 0. (This is mainly for
-// recipes in python, or other indentation-significant languages.)
+// recipes in python, or other indentation-significant languages.) Only the
+// indentation of the first line is removed from the others, so blank lines and
+// deeper indentation are kept, though blank lines at the end aren't. Comments
+// in column 0 are blanked, keeping the line numbers.
 func stripIndentation(s string, minCol int) string {
-	// trim leading whitespace
-	reader := bufio.NewReader(strings.NewReader(s))
+	lines := strings.SplitAfter(s, "\n")
 	output := ""
-	for {
-		line, err := reader.ReadString('\n')
+	for k, kind := range recipeLineKinds(lines) {
+		line := lines[k]
+		switch kind {
+		case lineVerbatim:
+			output += line
+			continue
+		case lineComment:
+			output += "\n"
+			continue
+		}
 		col := 0
 		i := 0
 		for i < len(line) && col < minCol {
 			c, w := utf8.DecodeRuneInString(line[i:])
-			if strings.IndexRune(" \t\n", c) >= 0 {
+			if c == ' ' || c == '\t' {
 				col += 1
 				i += w
 			} else {
@@ -77,12 +144,16 @@ func stripIndentation(s string, minCol int) string {
 			}
 		}
 		output += line[i:]
+	}
 
-		if err != nil {
+	// drop blank lines following the last command
+	for {
+		k := strings.LastIndexByte(strings.TrimSuffix(output, "\n"), '\n')
+		if k < 0 || strings.TrimSpace(output[k+1:]) != "" {
 			break
 		}
+		output = output[:k+1]
 	}
-
 	return output
 }
 
@@ -106,10 +177,11 @@ func printIndented(out io.Writer, s string, ind int) {
 	}
 }
 
-// Execute a recipe.
-func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
+// The variables a recipe is expanded with, other than those naming a response
+// file or the process.
+func recipeSigils(target string, u *node, e *edge) map[string][]string {
 	vars := make(map[string][]string)
-	vars["target"] = []string{target}
+	vars["target"] = []string{e.r.relPath(target)}
 	if e.r.isMeta {
 		if e.r.attributes.regex {
 			for i := range e.matches {
@@ -127,52 +199,415 @@ func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
 	prereqs := make([]string, 0)
 	for i := range u.prereqs {
 		if u.prereqs[i].r == e.r && u.prereqs[i].v != nil {
-			prereqs = append(prereqs, u.prereqs[i].v.name)
+			prereqs = append(prereqs, e.r.relPath(u.prereqs[i].v.name))
 		}
 	}
 	vars["prereq"] = prereqs
 
-	input := expandRecipeSigils(e.r.recipe, vars)
+	prereqdirs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, prereq := range prereqs {
+		if dir := filepath.Dir(prereq); !seen[dir] {
+			seen[dir] = true
+			prereqdirs = append(prereqdirs, dir)
+		}
+	}
+	vars["prereqdirs"] = prereqdirs
+	vars["targetdir"] = []string{filepath.Dir(vars["target"][0])}
+	vars["mkfile"] = []string{e.r.path}
+	return vars
+}
+
+// Execute a recipe.
+func dorecipe(target string, u *node, e *edge, opts *buildOptions) bool {
+	vars := recipeSigils(target, u, e)
+	prereqs := vars["prereq"]
+
+	// long lists of prerequisites can be passed in a response file instead
+	tooLong := opts.atFile > 0 && len(shellJoin(prereqs)) > opts.atFile
+	if tooLong || strings.Contains(e.r.recipe, "prereqfile") {
+		name, err := writeResponseFile(prereqs)
+		if err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to write the prerequisites of %s: %s", target, err))
+			return false
+		}
+		defer os.Remove(name)
+		vars["prereqfile"] = []string{name}
+		if tooLong {
+			vars["prereq"] = []string{"@" + name}
+		}
+	}
+
+	vars["pid"] = []string{strconv.Itoa(os.Getpid())}
+
+	input := expandRecipeSigils(e.r.recipe, vars, e.r.shell)
+	opts.provenance.noteRecipe(target, input)
+	start := time.Now()
+	ok := runRecipe(target, e.r, input, opts)
+	opts.log.record(target, e.r, input, ok, start)
+	return ok
+}
+
+// Execute the recipe of a rule for the target, its variables already expanded.
+func runRecipe(target string, r *rule, input string, opts *buildOptions) bool {
 	sh := "sh"
 	args := []string{}
 
-	if len(e.r.shell) > 0 {
-		sh = e.r.shell[0]
-		args = e.r.shell[1:]
+	if len(r.shell) > 0 {
+		sh = r.shell[0]
+		args = r.shell[1:]
+	}
+
+	// a recipe beginning with #! is a script for the interpreter it names
+	script := strings.HasPrefix(input, "#!")
+	if !script && !r.attributes.output && (r.attributes.lines || opts.lineByLine) {
+		return runLines(target, r, input, sh, args, opts)
 	}
 
-	mkPrintRecipe(target, input, e.r.attributes.quiet)
+	mkPrintRecipe(target, input, r.attributes.quiet)
 
-	if dryrun {
+	if opts.dryRun {
 		return true
 	}
 
-	_, success := subprocess(
-		sh,
-		args,
-		input,
-		false)
+	stdin := input
+	if script {
+		name, err := writeScript(input)
+		if err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to write the script for %s: %s", target, err))
+			return false
+		}
+		defer os.Remove(name)
+		sh, args, stdin = name, nil, ""
+	}
+
+	sh, args = limitCommand(r.limitArgs(), sh, args)
+	nice, cpus := recipeSchedule(r, opts)
+	sh, args = scheduleCommand(nice, cpus, sh, args)
+	ctx := recipeContext(target, opts)
+
+	// with the O attribute, what the recipe prints is written to the target
+	// once it succeeds
+	if r.attributes.output {
+		output, err := opts.executor.run(ctx, sh, args, r.dir, stdin, captureStdout)
+		if err == nil {
+			err = writeOutput(target, output)
+		}
+		if err != nil {
+			mkPrintError(fmt.Sprintf("mk: recipe for %s failed: %s", target, err))
+		}
+		return err == nil
+	}
+
+	// with -failtail, quiet recipes' output is only shown in full once they
+	// succeed, while a failure shows the recipe and the end of the output
+	if r.attributes.quiet && opts.failTail > 0 {
+		output, err := opts.executor.run(ctx, sh, args, r.dir, stdin, captureOutput)
+		if err == nil {
+			mkPrintOutput(output)
+		} else {
+			mkPrintFailure(target, input, output, err, opts.failTail)
+		}
+		return err == nil
+	}
+
+	_, err := opts.executor.run(ctx, sh, args, r.dir, stdin, captureNone)
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: recipe for %s failed: %s", target, err))
+	}
+
+	return err == nil
+}
+
+// Write the output of a recipe to its target, replacing it only once it's
+// written in full.
+func writeOutput(target string, output string) error {
+	file, err := ioutil.TempFile(filepath.Dir(target), ".mkoutput")
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(output)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), target)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// The context of a target's recipe, which with -markstderr carries the
+// marker of what it writes to stderr.
+func recipeContext(target string, opts *buildOptions) context.Context {
+	if !opts.markStderr {
+		return opts.ctx
+	}
+	return context.WithValue(opts.ctx, stderrMarkerKey{}, "! "+target+": ")
+}
+
+// The key of the marker of each line a program writes to stderr in a
+// context, if it's to be marked.
+type stderrMarkerKey struct{}
+
+// Write words to a temporary response file, one per line and quoted as needed,
+// returning its name.
+func writeResponseFile(words []string) (string, error) {
+	file, err := ioutil.TempFile("", "mkprereq")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(file)
+	for _, word := range words {
+		fmt.Fprintln(w, shellQuote(word))
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Write a script to an executable temporary file, returning its name.
+func writeScript(script string) (string, error) {
+	file, err := ioutil.TempFile("", "mk")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.WriteString(script)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0700)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Which of a program's output is returned rather than echoed.
+type captureMode int
+
+const (
+	captureNone   captureMode = iota
+	captureStdout             // stdout, as backticks need
+	captureOutput             // stdout and stderr, interleaved
+)
+
+// The delimiters of the here-documents a line of a recipe begins, such as EOF
+// for 'cat <<EOF' or "cat <<-'EOF'", in order. A '<<' within quotes doesn't
+// begin one.
+func heredocDelimiters(line string) []string {
+	delims := make([]string, 0)
+	quote := byte(0)
+	for i := 0; i+2 < len(line); i++ {
+		if quote != 0 {
+			if line[i] == '\\' && quote == '"' {
+				i++
+			} else if line[i] == quote {
+				quote = 0
+			}
+			continue
+		}
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '\'' || line[i] == '"' {
+			quote = line[i]
+			continue
+		}
+		if line[i] != '<' || line[i+1] != '<' || line[i+2] == '<' || (i > 0 && line[i-1] == '<') {
+			continue
+		}
+		j := i + 2
+		if line[j] == '-' {
+			j++
+		}
+		for j < len(line) && (line[j] == ' ' || line[j] == '\t') {
+			j++
+		}
+		delim := ""
+		if j < len(line) && (line[j] == '\'' || line[j] == '"') {
+			if k := strings.IndexByte(line[j+1:], line[j]); k >= 0 {
+				delim = line[j+1 : j+1+k]
+				j += k + 2
+			}
+		} else {
+			k := j
+			for k < len(line) && strings.IndexByte(" \t\r\n;&|<>()", line[k]) < 0 {
+				k++
+			}
+			delim = strings.Replace(line[j:k], "\\", "", -1)
+			j = k
+		}
+		// not shifts in arithmetic, as in $((1<<4))
+		if delim != "" && !unicode.IsDigit(rune(delim[0])) && delim[0] != '$' {
+			delims = append(delims, delim)
+		}
+		i = j - 1
+	}
+	return delims
+}
+
+// Whether a line ends a here-document with the given delimiter, which may be
+// indented like the recipe.
+func endsHeredoc(line string, delim string) bool {
+	return strings.TrimRight(strings.TrimLeft(line, " \t"), "\r\n") == delim
+}
+
+// The index of the line after lines[k] ending a here-document with the given
+// delimiter, or -1 if none does.
+func heredocEndLine(lines []string, k int, delim string) int {
+	for i := k + 1; i < len(lines); i++ {
+		if endsHeredoc(lines[i], delim) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether a line, less its line ending, is continued on the next by a
+// backslash, which isn't itself escaped.
+func continuedLine(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	return (len(line)-len(strings.TrimRight(line, "\\")))%2 == 1
+}
 
-	return success
+// A line of a recipe executed on its own, by the L attribute or -lines.
+type recipeLine struct {
+	command string // the line, with its prefixes removed
+	line    int    // where it begins in the mkfile
+	echo    bool   // echo it before executing it: no '@' prefix
+	check   bool   // stop if it fails: no '-' prefix
+}
+
+// Split a recipe into lines executed on their own, joining those continued by
+// a backslash and here-documents to the line beginning them. Lines beginning
+// with '@' aren't echoed, and those beginning with '-' don't stop the recipe
+// when they fail.
+func recipeLines(recipe string, first int) []recipeLine {
+	lines := make([]recipeLine, 0)
+	text := strings.Split(strings.TrimSuffix(recipe, "\n"), "\n")
+	for i := 0; i < len(text); i++ {
+		l := recipeLine{command: text[i], line: first + i, echo: true, check: true}
+		for continuedLine(l.command) && i+1 < len(text) {
+			i++
+			l.command += "\n" + text[i]
+		}
+		for _, delim := range heredocDelimiters(l.command) {
+			if end := heredocEndLine(text, i, delim); end >= 0 {
+				l.command += "\n" + strings.Join(text[i+1:end+1], "\n")
+				i = end
+			}
+		}
+		for len(l.command) > 0 && (l.command[0] == '@' || l.command[0] == '-') {
+			if l.command[0] == '@' {
+				l.echo = false
+			} else {
+				l.check = false
+			}
+			l.command = l.command[1:]
+		}
+		if strings.TrimSpace(l.command) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// Execute each line of a recipe in a shell of its own, stopping at the first
+// one that fails and reporting where it is.
+func runLines(target string, r *rule, input string, sh string, args []string, opts *buildOptions) bool {
+	if r.attributes.quiet {
+		mkPrintRecipe(target, "", true)
+	}
+	sh, args = limitCommand(r.limitArgs(), sh, args)
+	nice, cpus := recipeSchedule(r, opts)
+	sh, args = scheduleCommand(nice, cpus, sh, args)
+	ctx := recipeContext(target, opts)
+	for _, l := range recipeLines(input, r.line+1) {
+		if !r.attributes.quiet && (l.echo || opts.dryRun) {
+			mkPrintRecipe(target, l.command+"\n", false)
+		}
+		if opts.dryRun {
+			continue
+		}
+		_, err := opts.executor.run(ctx, sh, args, r.dir, l.command+"\n", captureNone)
+		if err != nil && l.check {
+			mkPrintError(fmt.Sprintf("mk: %s:%d: recipe for %s failed (%s): %s", r.file, l.line, target, err, l.command))
+			return false
+		}
+	}
+	return true
+}
+
+// Something that runs commands on behalf of mk: recipes, pipe includes and
+// backticks.
+type executor interface {
+	// Run a program in dir, or the working directory if dir is empty, piping
+	// input into its stdin. The output selected by capture is returned rather
+	// than echoed. Returns the output, and why the program failed if it did.
+	// The program is killed if ctx is cancelled before it finishes.
+	run(ctx context.Context, program string, args []string, dir string, input string, capture captureMode) (string, error)
+}
+
+// Executes commands as local subprocesses.
+type processExecutor struct{}
+
+func (processExecutor) run(ctx context.Context, program string, args []string, dir string, input string, capture captureMode) (string, error) {
+	return subprocess(ctx, program, args, dir, input, capture)
+}
+
+// Executor for pipe includes and backticks, which are run while parsing.
+var parseExecutor executor = processExecutor{}
+
+// Reports the commands that would run while parsing instead of running them,
+// so that dry runs have no side effects. Each succeeds with no output.
+type parseReporter struct{}
+
+func (parseReporter) run(ctx context.Context, program string, args []string, dir string, input string, capture captureMode) (string, error) {
+	command := input
+	if command == "" && len(args) > 0 {
+		command = args[len(args)-1]
+	}
+	mkPrintError(fmt.Sprintf("mk: not executed while parsing: %s", strings.TrimSpace(command)))
+	return "", nil
 }
 
 // Execute a subprocess (typically a recipe).
 //
 // Args:
+//   ctx: Context whose cancellation kills the program, with its process group
 //   program: Program path or name located in PATH
+//   dir: Directory to run the program in, or "" for the working directory
 //   input: String piped into the program's stdin
-//   capture_out: If true, capture and return the program's stdout rather than echoing it.
+//   capture: Output to capture and return rather than echo.
 //
 // Returns
-//   (output, success)
+//   (output, err)
 //   output is an empty string of catputer_out is false, or the collected output from the profram is true.
 //
-//   success is true if the exit code was 0 and false otherwise
+//   err is nil if the exit code was 0, and otherwise tells how the program ended
 //
-func subprocess(program string,
+func subprocess(ctx context.Context,
+	program string,
 	args []string,
+	dir string,
 	input string,
-	capture_out bool) (string, bool) {
+	capture captureMode) (string, error) {
 	program_path, err := exec.LookPath(program)
 	if err != nil {
 		log.Fatal(err)
@@ -186,17 +621,21 @@ func subprocess(program string,
 		log.Fatal(err)
 	}
 
-	attr := os.ProcAttr{Files: []*os.File{stdin_pipe_read, os.Stdout, os.Stderr}}
+	attr := os.ProcAttr{Dir: dir, Files: []*os.File{stdin_pipe_read, os.Stdout, os.Stderr}, Sys: processGroup()}
 
 	output := make([]byte, 0)
+	var output_mutex sync.Mutex // both stdout and marked stderr may be captured
 	capture_done := make(chan bool)
-	if capture_out {
+	if capture != captureNone {
 		stdout_pipe_read, stdout_pipe_write, err := os.Pipe()
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		attr.Files[1] = stdout_pipe_write
+		if capture == captureOutput {
+			attr.Files[2] = stdout_pipe_write
+		}
 
 		go func() {
 			buf := make([]byte, 1024)
@@ -209,44 +648,115 @@ func subprocess(program string,
 					log.Fatal(err)
 				}
 
+				output_mutex.Lock()
 				output = append(output, buf[:n]...)
+				output_mutex.Unlock()
 			}
 
 			capture_done <- true
 		}()
 	}
 
+	// mark each line written to stderr, if the context has a marker
+	marker, _ := ctx.Value(stderrMarkerKey{}).(string)
+	marker_done := make(chan bool)
+	if marker != "" {
+		stderr_pipe_read, stderr_pipe_write, err := os.Pipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		attr.Files[2] = stderr_pipe_write
+
+		go func() {
+			reader := bufio.NewReader(stderr_pipe_read)
+			for {
+				line, err := reader.ReadString('\n')
+				if line != "" {
+					line = marker + strings.TrimSuffix(line, "\n") + "\n"
+					if capture == captureOutput {
+						output_mutex.Lock()
+						output = append(output, line...)
+						output_mutex.Unlock()
+					} else {
+						mkMsgMutex.Lock()
+						os.Stderr.WriteString(line)
+						mkMsgMutex.Unlock()
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+			stderr_pipe_read.Close()
+			marker_done <- true
+		}()
+	}
+
 	proc, err := os.StartProcess(program_path, proc_args, &attr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the program has its own copy, and once it's gone, writing fails rather
+	// than blocking
+	stdin_pipe_read.Close()
 
+	// the program may exit or close its stdin without reading all of the
+	// input, which is up to it, so failing to write isn't an error
 	go func() {
-		_, err := stdin_pipe_write.WriteString(input)
-		if err != nil {
-			log.Fatal(err)
-		}
+		io.WriteString(stdin_pipe_write, input)
+		stdin_pipe_write.Close()
+	}()
 
-		err = stdin_pipe_write.Close()
-		if err != nil {
-			log.Fatal(err)
+	// kill the program, and whatever it started, if the build is cancelled
+	exited := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(proc, exited)
+		case <-exited:
 		}
 	}()
 
 	state, err := proc.Wait()
+	close(exited)
 
 	if attr.Files[1] != os.Stdout {
 		attr.Files[1].Close()
 	}
+	if marker != "" {
+		attr.Files[2].Close()
+	}
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// wait until stdout copying in finished
-	if capture_out {
+	if capture != captureNone {
 		<-capture_done
 	}
+	if marker != "" {
+		<-marker_done
+	}
+
+	return string(output), exitError(ctx, state)
+}
 
-	return string(output), state.Success()
+// Why a program failed, or nil if it didn't: the status it exited with, or the
+// signal that killed it. SIGKILL is often the out of memory killer's doing.
+func exitError(ctx context.Context, state *os.ProcessState) error {
+	if state.Success() {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return errors.New("interrupted")
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		sig := status.Signal()
+		if sig == syscall.SIGKILL {
+			return fmt.Errorf("killed by signal %d (%s), possibly for running out of memory", int(sig), sig)
+		}
+		return fmt.Errorf("killed by signal %d (%s)", int(sig), sig)
+	}
+	return fmt.Errorf("exit status %d", state.ExitCode())
 }
@@ -0,0 +1,240 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// A structured log of the recipes a build executes, written with -log, and
+// replaying them from it with 'mk replay'.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The first entry of a log: what the recipes were executed with.
+type logHeader struct {
+	Version string   `json:"mk"`
+	Dir     string   `json:"dir"`
+	Env     []string `json:"env"`
+	Started string   `json:"started"`
+}
+
+// An entry of a log for a recipe executed, its variables expanded.
+type logRecipe struct {
+	Target  string           `json:"target"`
+	Rule    string           `json:"rule"`
+	Dir     string           `json:"dir,omitempty"`
+	Shell   []string         `json:"shell,omitempty"`
+	Recipe  string           `json:"recipe"`
+	Lines   bool             `json:"lines,omitempty"`
+	Output  bool             `json:"output,omitempty"`
+	Quiet   bool             `json:"quiet,omitempty"`
+	Nice    int              `json:"nice,omitempty"`
+	CPUs    string           `json:"cpus,omitempty"`
+	Limits  map[string]int64 `json:"limits,omitempty"`
+	Failed  bool             `json:"failed,omitempty"`
+	Started string           `json:"started"`
+	Seconds float64          `json:"seconds"`
+}
+
+// Writes a log of the recipes executed as JSON, an entry per line, each as
+// soon as its recipe finishes.
+type buildLog struct {
+	mutex sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+}
+
+// Create the log, writing its header.
+func newBuildLog(name string) (*buildLog, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := os.Getwd()
+	l := &buildLog{file: file, enc: json.NewEncoder(file)}
+	l.enc.SetEscapeHTML(false)
+	err = l.enc.Encode(logHeader{
+		Version: version(),
+		Dir:     dir,
+		Env:     redactEnv(os.Environ()),
+		Started: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log a recipe executed for the target, which started at the given time.
+func (l *buildLog) record(target string, r *rule, input string, ok bool, start time.Time) {
+	if l == nil {
+		return
+	}
+	entry := logRecipe{
+		Target:  target,
+		Rule:    r.location(),
+		Dir:     r.dir,
+		Shell:   r.shell,
+		Recipe:  input,
+		Lines:   r.attributes.lines,
+		Output:  r.attributes.output,
+		Quiet:   r.attributes.quiet,
+		Nice:    r.nice,
+		CPUs:    r.cpus,
+		Limits:  r.limits,
+		Failed:  !ok,
+		Started: start.UTC().Format(time.RFC3339Nano),
+		Seconds: time.Since(start).Seconds(),
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to write the log: %s", err))
+	}
+}
+
+func (l *buildLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Read a log, returning its header and its recipes in the order they
+// finished.
+func readBuildLog(r io.Reader) (logHeader, []logRecipe, error) {
+	var header logHeader
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&header); err != nil {
+		return header, nil, err
+	}
+	recipes := make([]logRecipe, 0)
+	for {
+		var entry logRecipe
+		if err := dec.Decode(&entry); err == io.EOF {
+			return header, recipes, nil
+		} else if err != nil {
+			return header, recipes, err
+		}
+		recipes = append(recipes, entry)
+	}
+}
+
+// The rule a logged recipe was executed with, as far as executing it again
+// needs.
+func (entry *logRecipe) rule() *rule {
+	r := &rule{dir: entry.Dir, shell: entry.Shell, recipe: entry.Recipe,
+		nice: entry.Nice, cpus: entry.CPUs, limits: entry.Limits}
+	r.attributes.lines = entry.Lines
+	r.attributes.output = entry.Output
+	r.attributes.quiet = entry.Quiet
+	r.file, r.line = entry.Rule, 0
+	if k := strings.LastIndexByte(entry.Rule, ':'); k >= 0 {
+		r.file = entry.Rule[:k]
+		fmt.Sscan(entry.Rule[k+1:], &r.line)
+	}
+	return r
+}
+
+// Replace the environment with the one the log was written in, but for
+// MKLEVEL and the secrets kept out of the log, which stay as they are.
+func restoreEnv(env []string) {
+	current := envMap(os.Environ())
+	os.Clearenv()
+	for name, value := range envMap(env) {
+		if strings.HasPrefix(value, redactedPrefix) {
+			if value, ok := current[name]; ok {
+				os.Setenv(name, value)
+			}
+			continue
+		}
+		os.Setenv(name, value)
+	}
+	if level, ok := current["MKLEVEL"]; ok {
+		os.Setenv("MKLEVEL", level)
+	} else {
+		os.Unsetenv("MKLEVEL")
+	}
+}
+
+func replayCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk replay", flag.ExitOnError)
+	var failed, keepGoing, dryRun, keepEnv bool
+	flags.BoolVar(&failed, "failed", false, "replay just the recipes that failed")
+	flags.BoolVar(&keepGoing, "k", false, "keep replaying after a recipe fails")
+	flags.BoolVar(&dryRun, "n", false, "print the recipes without executing them")
+	flags.BoolVar(&keepEnv, "keepenv", false, "execute recipes in the current environment rather than the logged one")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: mk replay [options] log.json [target ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		mkExit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		mkError(fmt.Sprintf("mk replay: %s", err))
+	}
+	header, recipes, err := readBuildLog(file)
+	file.Close()
+	if err != nil {
+		mkError(fmt.Sprintf("mk replay: unable to read %s: %s", flags.Arg(0), err))
+	}
+
+	targets := make(map[string]bool)
+	for _, target := range flags.Args()[1:] {
+		targets[target] = true
+	}
+	if !keepEnv {
+		restoreEnv(header.Env)
+	}
+	if dir, _ := os.Getwd(); dir != header.Dir {
+		mkPrintMessage(fmt.Sprintf("mk: replaying recipes logged in %s", header.Dir))
+	}
+
+	opts := defaultBuildOptions()
+	opts.dryRun = dryRun
+	ok := true
+	for i := range recipes {
+		entry := &recipes[i]
+		if failed && !entry.Failed || len(targets) > 0 && !targets[entry.Target] {
+			continue
+		}
+		if !runRecipe(entry.Target, entry.rule(), entry.Recipe, opts) {
+			ok = false
+			if !keepGoing {
+				break
+			}
+		}
+	}
+	if !ok {
+		mkExit(1)
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "all:V: a b\na:\n\techo $target >$target\nb:V:\n\texit 1\n")
+
+		opts := defaultBuildOptions()
+		opts.keepGoing = true
+		log, err := newBuildLog("log.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.log = log
+		runMk(t, nil, opts)
+		if err := log.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open("log.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		header, recipes, err := readBuildLog(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(header.Env) == 0 {
+			t.Errorf("logged environment is empty")
+		}
+		got := make(map[string]bool)
+		for _, entry := range recipes {
+			got[entry.Target] = entry.Failed
+		}
+		if want := map[string]bool{"a": false, "b": true}; !reflect.DeepEqual(got, want) {
+			t.Errorf("logged recipes failed = %v, want %v", got, want)
+		}
+
+		// the logged recipes execute as they were, without the mkfile
+		os.Remove("a")
+		os.Remove("mkfile")
+		for i := range recipes {
+			entry := &recipes[i]
+			if ok := runRecipe(entry.Target, entry.rule(), entry.Recipe, defaultBuildOptions()); ok == entry.Failed {
+				t.Errorf("replaying %s succeeded = %v", entry.Target, ok)
+			}
+		}
+		if got := readWords(t, "a"); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("replayed a = %q, want [a]", got)
+		}
+	})
+}
@@ -0,0 +1,378 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Scheduling recipes: weighing them against the job slots and the resource
+// classes the mkfile declares, such as memory, and running exclusive ones
+// alone.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Limits the number of recipes a build executes simultaneously, or the amount
+// of a resource class they use.
+type jobPool struct {
+	cond      *sync.Cond // wakeup on freed slots, guarding the rest
+	allowed   int64      // maximum number of slots in use
+	running   int64      // slots in use
+	exclusive bool       // an exclusive recipe is running
+	draining  int        // exclusive recipes waiting for the rest to finish
+	cancelled bool       // no more slots are handed out
+	peak      int64      // most slots in use at once
+}
+
+func newJobPool(allowed int64) *jobPool {
+	if allowed < 1 {
+		allowed = 1
+	}
+	return &jobPool{allowed: allowed, cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// The slots a recipe weighing n takes. A recipe weighing more than the pool
+// allows takes all of it, rather than waiting forever.
+func (p *jobPool) weigh(n int64) int64 {
+	if n > p.allowed {
+		return p.allowed
+	}
+	return n
+}
+
+// Wait until there are n available slots, returning false if the pool is
+// cancelled meanwhile. Recipes don't start while an exclusive one waits for
+// the others to drain, so that it isn't starved.
+func (p *jobPool) reserve(n int64) bool {
+	n = p.weigh(n)
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	for !p.cancelled && (p.exclusive || p.draining > 0 || p.running+n > p.allowed) {
+		p.cond.Wait()
+	}
+	if p.cancelled {
+		return false
+	}
+	p.running += n
+	if p.running > p.peak {
+		p.peak = p.running
+	}
+	return true
+}
+
+// Free up n slots for other recipes.
+func (p *jobPool) finish(n int64) {
+	p.cond.L.Lock()
+	p.running -= p.weigh(n)
+	p.cond.Broadcast()
+	p.cond.L.Unlock()
+}
+
+// Wait until every running recipe has finished, then keep any other from
+// starting until finishExclusive. Returns false if the pool is cancelled
+// meanwhile.
+func (p *jobPool) reserveExclusive() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	p.draining++
+	for !p.cancelled && (p.exclusive || p.running > 0) {
+		p.cond.Wait()
+	}
+	p.draining--
+	if p.cancelled {
+		p.cond.Broadcast()
+		return false
+	}
+	p.exclusive = true
+	if p.peak < 1 {
+		p.peak = 1
+	}
+	return true
+}
+
+// Let other recipes run again after an exclusive one.
+func (p *jobPool) finishExclusive() {
+	p.cond.L.Lock()
+	p.exclusive = false
+	p.cond.Broadcast()
+	p.cond.L.Unlock()
+}
+
+// Stop handing out slots, waking every recipe waiting for them.
+func (p *jobPool) cancel() {
+	p.cond.L.Lock()
+	p.cancelled = true
+	p.cond.Broadcast()
+	p.cond.L.Unlock()
+}
+
+// Hand out slots again after cancel.
+func (p *jobPool) uncancel() {
+	p.cond.L.Lock()
+	p.cancelled = false
+	p.cond.L.Unlock()
+}
+
+// Parse an amount of a resource, with an optional K, M, G or T suffix
+// multiplying it by a power of 1024.
+func parseAmount(s string) (int64, bool) {
+	multiplier := int64(1)
+	if s != "" {
+		if k := strings.IndexByte("KMGT", byte(unicode.ToUpper(rune(s[len(s)-1])))); k >= 0 {
+			multiplier = int64(1) << (10 * uint(k+1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n * multiplier, true
+}
+
+// True if s names a setting, such as jobs, rather than being attributes.
+func isSettingName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !unicode.IsLower(c) && !unicode.IsDigit(c) && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Count the recipe as a number of jobs.
+func (r *rule) setJobs(name string, value string) *attribError {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return &attribError{'j', fmt.Sprintf("expected a number of jobs but found %q", value)}
+	}
+	r.weight = n
+	return nil
+}
+
+// Run the recipe in a pool. Whether it's declared is checked once the mkfile
+// is parsed.
+func (r *rule) setPool(name string, value string) *attribError {
+	if !isSettingName(value) {
+		return &attribError{'p', fmt.Sprintf("expected the name of a pool but found %q", value)}
+	}
+	r.useResource(value, 1)
+	return nil
+}
+
+// Have the recipe use an amount of a resource class.
+func (r *rule) setResource(name string, value string) *attribError {
+	amount, ok := parseAmount(value)
+	if !ok {
+		return &attribError{rune(name[0]), fmt.Sprintf("expected an amount of %s but found %q", name, value)}
+	}
+	r.useResource(name, amount)
+	return nil
+}
+
+// Note the amount of a resource class or pool the recipe uses.
+func (r *rule) useResource(name string, amount int64) {
+	if r.resources == nil {
+		r.resources = make(map[string]int64)
+	}
+	r.resources[name] = amount
+}
+
+// True if a resource class or pool may be given the name.
+func isResourceName(name string) bool {
+	_, setting := ruleSettings[name]
+	return isSettingName(name) && !setting
+}
+
+// Fail unless the resource classes and pools the rules use are declared, with
+// enough of each for every recipe.
+func (rs *ruleSet) checkResources() {
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		for _, name := range r.resourceNames() {
+			capacity, ok := rs.resources[name]
+			if !ok {
+				mkError(fmt.Sprintf("%s: unknown resource class or pool %s", r.location(), name))
+			} else if r.resources[name] > capacity {
+				mkError(fmt.Sprintf("%s: uses %s of %s, but only %s is available", r.location(),
+					formatAmount(r.resources[name]), name, formatAmount(capacity)))
+			}
+		}
+	}
+}
+
+// The name=value attributes of the rule: jobs, nice, cpus and limits, the resource
+// classes in sorted order, and inputs, which comes last since it takes the
+// rest of the attributes.
+func (r *rule) settings() []string {
+	settings := make([]string, 0, len(r.resources)+1)
+	if r.weight > 0 {
+		settings = append(settings, fmt.Sprintf("jobs=%d", r.weight))
+	}
+	if r.nice > 0 {
+		settings = append(settings, fmt.Sprintf("nice=%d", r.nice))
+	}
+	if r.cpus != "" {
+		settings = append(settings, "cpus="+r.cpus)
+	}
+	if r.ambiguity != ambiguousUnset {
+		settings = append(settings, "ambiguous="+r.ambiguity.String())
+	}
+	if r.chain > 0 {
+		settings = append(settings, fmt.Sprintf("chain=%d", r.chain))
+	}
+	settings = append(settings, r.limitArgs()...)
+	for _, name := range r.resourceNames() {
+		settings = append(settings, fmt.Sprintf("%s=%s", name, formatAmount(r.resources[name])))
+	}
+	if r.inputs != "" {
+		settings = append(settings, "inputs="+r.inputs)
+	}
+	return settings
+}
+
+// The names of the resource classes the rule uses, in sorted order.
+func (r *rule) resourceNames() []string {
+	names := make([]string, 0, len(r.resources))
+	for name := range r.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Declare a resource class, 'resource name capacity', or a pool, 'pool name
+// limit'. A pool is a resource class each of whose recipes uses one.
+func (p *parser) resource(directive token, args []token) {
+	if len(args) != 2 {
+		p.basicErrorAtToken(fmt.Sprintf("expected a name and a %s after %s", capacityName(directive.val), directive.val), directive)
+	}
+	name, capacity := args[0].val, args[1].val
+	if !isResourceName(name) {
+		p.basicErrorAtToken(fmt.Sprintf("invalid %s name %q", directive.val, name), args[0])
+	}
+	amount, ok := parseAmount(capacity)
+	if directive.val == "pool" {
+		n, err := strconv.Atoi(capacity)
+		amount, ok = int64(n), err == nil
+	}
+	if !ok || amount < 1 {
+		p.basicErrorAtToken(fmt.Sprintf("invalid %s %q for %s", capacityName(directive.val), capacity, name), args[1])
+	}
+	p.rules.resources[name] = amount
+}
+
+// What the number following a resource or pool directive is called.
+func capacityName(directive string) string {
+	if directive == "pool" {
+		return "limit"
+	}
+	return "capacity"
+}
+
+// Format an amount of a resource as parseAmount parses it.
+func formatAmount(n int64) string {
+	suffix := ""
+	for _, s := range []string{"K", "M", "G", "T"} {
+		if n == 0 || n%1024 != 0 {
+			break
+		}
+		n /= 1024
+		suffix = s
+	}
+	return strconv.FormatInt(n, 10) + suffix
+}
+
+// Create a pool for each resource class.
+func (g *graph) newResourcePools() {
+	g.resources = make(map[string]*jobPool)
+	for name, capacity := range g.rs.resources {
+		g.resources[name] = newJobPool(capacity)
+	}
+}
+
+// Wait until the rule's recipe may be executed, reserving the resources it
+// uses and then its job slots. Resources are always reserved in the same
+// order, so that recipes waiting on each other can't deadlock. Those that
+// aren't declared, which checkResources rules out, are passed over. Returns
+// false, having reserved nothing, if the build is cancelled meanwhile.
+func (g *graph) reserve(r *rule) bool {
+	names := r.resourceNames()
+	for i, name := range names {
+		pool, ok := g.resources[name]
+		if ok && !pool.reserve(r.resources[name]) {
+			g.release(r, names[:i])
+			return false
+		}
+	}
+
+	reserved := false
+	if r.attributes.exclusive {
+		reserved = g.jobs.reserveExclusive()
+	} else {
+		reserved = g.jobs.reserve(r.jobWeight())
+	}
+	if !reserved {
+		g.release(r, names)
+	}
+	return reserved
+}
+
+// Release what reserve reserved for the rule.
+func (g *graph) finish(r *rule) {
+	if r.attributes.exclusive {
+		g.jobs.finishExclusive()
+	} else {
+		g.jobs.finish(r.jobWeight())
+	}
+	g.release(r, r.resourceNames())
+}
+
+// Release the named resources the rule reserved.
+func (g *graph) release(r *rule, names []string) {
+	for _, name := range names {
+		if pool, ok := g.resources[name]; ok {
+			pool.finish(r.resources[name])
+		}
+	}
+}
+
+// Keep recipes waiting for slots or resources from starting, such as once a
+// recipe has failed.
+func (g *graph) cancel() {
+	g.jobs.cancel()
+	g.fetches.cancel()
+	for _, pool := range g.resources {
+		pool.cancel()
+	}
+}
+
+// The number of job slots the rule's recipe counts as.
+func (r *rule) jobWeight() int64 {
+	if r.weight > 0 {
+		return int64(r.weight)
+	}
+	return 1
+}
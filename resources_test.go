@@ -0,0 +1,199 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An executor that records how many commands it runs at once, and whether
+// those mentioning "exclusive" ever ran alongside others.
+type concurrencyExecutor struct {
+	mutex     sync.Mutex
+	running   int
+	most      int
+	exclusive bool // a command mentioning "exclusive" is running
+	overlaps  int  // times commands ran alongside an exclusive one
+	executed  int
+}
+
+func (x *concurrencyExecutor) run(ctx context.Context, program string, args []string, dir string, input string, capture captureMode) (string, error) {
+	isExclusive := strings.Contains(input, "exclusive")
+	x.mutex.Lock()
+	x.running++
+	x.executed++
+	if x.running > x.most {
+		x.most = x.running
+	}
+	if x.exclusive || (isExclusive && x.running > 1) {
+		x.overlaps++
+	}
+	if isExclusive {
+		x.exclusive = true
+	}
+	x.mutex.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	x.mutex.Lock()
+	x.running--
+	if isExclusive {
+		x.exclusive = false
+	}
+	x.mutex.Unlock()
+	return "", nil
+}
+
+// Run mk on the mkfile in the current directory, failing if it doesn't finish
+// in time rather than deadlocking the tests.
+func runMkWithin(t *testing.T, targets []string, opts *buildOptions) {
+	done := make(chan bool)
+	go func() {
+		runMk(t, targets, opts)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("mk deadlocked")
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"3", 3, true},
+		{"8G", 8 << 30, true},
+		{"512k", 512 << 10, true},
+		{"G", 0, false},
+		{"-1", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseAmount(test.in)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseAmount(%q) = %d, %v, want %d, %v", test.in, got, ok, test.want, test.ok)
+		}
+		if back, _ := parseAmount(formatAmount(got)); ok && back != got {
+			t.Errorf("formatAmount(%d) = %q doesn't parse back", got, formatAmount(got))
+		}
+	}
+}
+
+func TestCheckResources(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		ok     bool
+	}{
+		{"resource mem 4G\npool link 1\na:V mem=2G pool=link:\n\ttrue\n", true},
+		{"a:V mem=2G:\n\ttrue\n", false},
+		{"a:V pool=link:\n\ttrue\npool link 1\n", true},
+		{"pool link 1\na:V pool=lnk:\n\ttrue\n", false},
+		{"resource mem 1G\na:V mem=2G:\n\ttrue\n", false},
+	}
+
+	for _, test := range tests {
+		checked := false
+		sandboxed(func() {
+			parse(test.mkfile, "mkfile", "/mkfile", make(map[string][]string)).checkResources()
+			checked = true
+		})
+		if checked != test.ok {
+			t.Errorf("%q: resources checked out %v, want %v", test.mkfile, checked, test.ok)
+		}
+	}
+}
+
+func TestWeightedJobs(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		jobs   int
+		want   int
+	}{
+		{"all:V: a b c\na b c:V:\n\ttrue\n", 3, 3},
+		{"all:V: a b c\na b c:V jobs=2:\n\ttrue\n", 3, 1},
+		{"all:V: a b c\na b c:V jobs=8:\n\ttrue\n", 3, 1},
+		{"resource mem 4G\nall:V: a b c\na b c:V mem=2G:\n\ttrue\n", 3, 2},
+		{"pool link 1\nall:V: a b c d\na b c:V pool=link:\n\ttrue\nd:V:\n\ttrue\n", 4, 2},
+	}
+
+	for _, test := range tests {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", test.mkfile)
+			opts := defaultBuildOptions()
+			opts.jobs = test.jobs
+			x := &concurrencyExecutor{}
+			opts.executor = x
+			runMk(t, []string{"all"}, opts)
+			if x.most != test.want {
+				t.Errorf("%q: ran %d recipes at once, want %d", test.mkfile, x.most, test.want)
+			}
+		})
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	tests := []struct {
+		name   string
+		mkfile string
+		jobs   int
+		want   int // recipes executed
+	}{
+		{"siblings", "all:V: a b x c d\na b c d:V:\n\techo $target\nx:VX:\n\techo exclusive\n", 4, 5},
+		{"nested", "all:V: x\nx:VX: a b\n\techo exclusive\na b:V: c\n\techo $target\nc:VX:\n\techo exclusive\n", 4, 4},
+		{"serial", "all:V: x y z\nx y z:VX:\n\techo exclusive\n", 1, 3},
+		{"weighted", "pool link 1\nall:V: a b x y\na b:V jobs=2:\n\techo $target\nx y:VX pool=link:\n\techo exclusive\n", 3, 4},
+	}
+
+	for _, test := range tests {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", test.mkfile)
+			opts := defaultBuildOptions()
+			opts.jobs = test.jobs
+			x := &concurrencyExecutor{}
+			opts.executor = x
+			runMkWithin(t, []string{"all"}, opts)
+			if x.overlaps > 0 {
+				t.Errorf("%s: exclusive recipes ran alongside others %d times", test.name, x.overlaps)
+			}
+			if x.executed != test.want {
+				t.Errorf("%s: executed %d recipes, want %d", test.name, x.executed, test.want)
+			}
+		})
+	}
+}
+
+func TestCancelAfterFailure(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "all:V: a b c d\na b c d:V:\n\techo $target\n")
+		opts := defaultBuildOptions()
+		x := &stubExecutor{fail: true}
+		opts.executor = x
+		runMkWithin(t, []string{"all"}, opts)
+		if len(x.inputs) != 1 {
+			t.Errorf("executed %q after the first failed, want just one", x.inputs)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// A restricted mode for untrusted mkfiles, such as those of a pull request
+// under review, in which nothing runs while parsing unless allowed, and
+// nothing outside the workspace is read or built.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// What an untrusted mkfile may do.
+type restrictions struct {
+	workspace string           // absolute path everything must lie within
+	allowed   []*regexp.Regexp // commands that may run while parsing
+}
+
+// The restrictions in force, or nil if mkfiles are trusted.
+var restricted *restrictions
+
+// Restrict mkfiles to the workspace. Commands matching the patterns in the
+// allowlist file, if given, may still run while parsing. A pattern's * matches
+// anything but shell metacharacters, so that nothing can be chained onto an
+// allowed command.
+func newRestrictions(workspace string, allowlist string) (*restrictions, error) {
+	abs, err := resolvePath(workspace)
+	if err != nil {
+		return nil, err
+	}
+	x := &restrictions{workspace: abs}
+	if allowlist == "" {
+		return x, nil
+	}
+
+	file, err := os.Open(allowlist)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := strings.Replace(regexp.QuoteMeta(line), `\*`, "[^;&|<>$`()\\\\\n'\"]*", -1)
+		x.allowed = append(x.allowed, regexp.MustCompile("^"+pattern+"$"))
+	}
+	return x, scanner.Err()
+}
+
+// The absolute path of a file, with symbolic links resolved. The part of the
+// path that doesn't exist yet is taken as it is.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, rest), nil
+		} else if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// True if the path, relative to the working directory, lies within the
+// workspace once symbolic links are resolved.
+func (x *restrictions) inWorkspace(path string) bool {
+	abs, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(x.workspace, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// True if the command may run while parsing.
+func (x *restrictions) allows(command string) bool {
+	command = strings.TrimSpace(command)
+	for _, pattern := range x.allowed {
+		if pattern.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// Why a target may not be built by its recipe or fetched, or nil if it may:
+// it, a prerequisite or the recipe's directory lies outside the workspace.
+// What the recipe itself does isn't checked.
+func (x *restrictions) checkRecipe(target string, e *edge, prereqs []*node) error {
+	if !x.inWorkspace(target) {
+		return fmt.Errorf("%s is outside the workspace", target)
+	}
+	for _, v := range prereqs {
+		if !x.inWorkspace(v.name) {
+			return fmt.Errorf("its prerequisite %s is outside the workspace", v.name)
+		}
+	}
+	if e.r.dir != "" && !x.inWorkspace(e.r.dir) {
+		return fmt.Errorf("its directory %s is outside the workspace", e.r.dir)
+	}
+	return nil
+}
+
+// Runs commands while parsing only if they're allowed.
+type restrictedExecutor struct {
+	x    *restrictions
+	next executor
+}
+
+// The program and its arguments come from the mkfile's $MKSHELL, so they're
+// ignored: the command checked is run by sh, as the only thing sh does.
+func (r restrictedExecutor) run(ctx context.Context, program string, args []string, dir string, input string, capture captureMode) (string, error) {
+	// without input, sh runs the argument after -c, later ones setting $0, $1
+	// and so on
+	command, shargs := input, []string{}
+	if input == "" {
+		for i := range args {
+			if args[i] == "-c" && i+1 < len(args) {
+				command, shargs = args[i+1], args[i:]
+				break
+			}
+		}
+	}
+	if command == "" || strings.HasPrefix(command, "-") || !r.x.allows(command) {
+		return "", fmt.Errorf("restricted: not allowed to run while parsing: %s", strings.TrimSpace(command))
+	}
+	return r.next.run(ctx, "sh", shargs, dir, input, capture)
+}
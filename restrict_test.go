@@ -0,0 +1,150 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestrictions(t *testing.T) {
+	dir := t.TempDir()
+	allowlist := filepath.Join(dir, "allow")
+	if err := ioutil.WriteFile(allowlist, []byte("# tools\ngit rev-parse *\nuname\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	x, err := newRestrictions(dir, allowlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("/", filepath.Join(dir, "root")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		filepath.Join(dir, "root/etc/passwd"): false, filepath.Join(dir, "root/new/file"): false,
+		dir: true, filepath.Join(dir, "a/b"): true, filepath.Join(dir, "..foo"): true,
+		filepath.Join(dir, ".."): false, filepath.Join(dir, "../x"): false, "/etc/passwd": false,
+	} {
+		if got := x.inWorkspace(path); got != want {
+			t.Errorf("%s in the workspace: %v, want %v", path, got, want)
+		}
+	}
+
+	for command, want := range map[string]bool{
+		"git rev-parse HEAD":     true,
+		"uname\n":                true,
+		"uname -a":               false,
+		"git rev-parse HEAD; id": false,
+		"git rev-parse $(id)":    false,
+		"id":                     false,
+	} {
+		if got := x.allows(command); got != want {
+			t.Errorf("allowed %q: %v, want %v", command, got, want)
+		}
+	}
+
+	next := &stubExecutor{output: "ok"}
+	executor := restrictedExecutor{x, next}
+	if _, err := executor.run(context.Background(), "sh", nil, "", "id", captureStdout); err == nil || len(next.inputs) > 0 {
+		t.Error("ran a command that isn't allowed")
+	}
+	if out, err := executor.run(context.Background(), "sh", []string{"-c", "uname"}, "", "", captureStdout); err != nil || out != "ok" {
+		t.Error("didn't run an allowed command")
+	}
+	if _, err := executor.run(context.Background(), "sh", []string{"-c", "id", "uname"}, "", "", captureStdout); err == nil {
+		t.Error("ran a command that isn't allowed, given an allowed $0")
+	}
+}
+
+func TestRestrictedRecipes(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		x, err := newRestrictions(".", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		restricted = x
+		defer func() { restricted = nil }()
+
+		writeFile(t, "mkfile", "all:V: a ../b\na:\n\ttouch a\n../b:\n\ttouch ../b\n")
+		executor := &stubExecutor{}
+		opts := defaultBuildOptions()
+		opts.executor = executor
+		opts.keepGoing = true
+		g := runMk(t, nil, opts)
+		if len(executor.inputs) != 1 || g.nodes["../b"].status != nodeStatusFailed {
+			t.Errorf("executed %q, want just a's recipe", executor.inputs)
+		}
+
+		// nothing may be fetched outside the workspace
+		parsed := false
+		sandboxed(func() {
+			parse("MKCACHE=../cache\nx: https://example.com/x.tar\n\ttar xf $prereq\n", "mkfile", "mkfile",
+				make(map[string][]string))
+			parsed = true
+		})
+		if parsed {
+			t.Errorf("parsed a mkfile fetching into ../cache")
+		}
+		rs := parse("all:V: ../c.tar\n", "mkfile", "mkfile", make(map[string][]string))
+		rs.add(rule{targets: []pattern{{spat: "../c.tar"}}, url: "https://example.com/c.tar"})
+		rs.addRoot([]string{"all"})
+		opts = defaultBuildOptions()
+		opts.dryRun = true
+		opts.keepGoing = true
+		g = buildgraph(rs, "", opts)
+		sandboxed(func() { mkRoot(g, opts) })
+		if g.nodes["../c.tar"].status != nodeStatusFailed {
+			t.Errorf("fetched ../c.tar outside the workspace")
+		}
+	})
+}
+
+func TestRestrictedShell(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "allow", "echo hi\necho Y=1\n")
+		x, err := newRestrictions(".", "allow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		restricted = x
+		defer func() { restricted = nil }()
+
+		// the mkfile's shell mustn't run anything beyond the allowed command
+		var rs *ruleSet
+		sandboxed(func() {
+			parseExecutor = restrictedExecutor{x, processExecutor{}}
+			rs = parse("MKSHELL=sh -c 'touch pwned'\nX=`echo hi`\n<|'echo Y=1'\n", "mkfile", dir+"/mkfile",
+				make(map[string][]string))
+		})
+		if _, err := os.Stat("pwned"); err == nil {
+			t.Error("ran $MKSHELL while parsing a restricted mkfile")
+		}
+		if rs == nil {
+			t.Fatal("didn't run the allowed commands")
+		}
+		if got, _ := lookupVar(rs.vars, "X"); len(got) != 1 || got[0] != "hi" {
+			t.Errorf("X = %q, want [hi]", got)
+		}
+	})
+}
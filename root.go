@@ -0,0 +1,101 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Finding the mkfile when -f isn't given, under one of several names, and
+// in a parent directory, so mk can run anywhere in a project, as git does.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The names the mkfile may have, in the order they're tried, which are those
+// listed in $MKFILES if it's set.
+func mkfileNames() []string {
+	if names := strings.Fields(os.Getenv("MKFILES")); len(names) > 0 {
+		return names
+	}
+	return []string{"mkfile", "Mkfile", "mk.build"}
+}
+
+// The first of names that's a file in dir.
+func findMkfile(dir string, names []string) (string, bool) {
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// The mkfile in the current directory, failing if there's none.
+func defaultMkfile() string {
+	names := mkfileNames()
+	name, ok := findMkfile(".", names)
+	if !ok {
+		dir, _ := os.Getwd()
+		mkError(fmt.Sprintf("no mkfile found in %s, tried %s", dir, strings.Join(names, ", ")))
+	}
+	return name
+}
+
+// Find the nearest directory above dir holding a mkfile under one of names.
+// The search stops at a directory holding .git, taken to be the top of the
+// project, and at any directory listed in $MKBOUNDARY.
+func findMkfileDir(dir string, names []string) (string, bool) {
+	boundaries := filepath.SplitList(os.Getenv("MKBOUNDARY"))
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", false
+		}
+		for _, b := range boundaries {
+			if b != "" && filepath.Clean(b) == dir {
+				return "", false
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+		if _, ok := findMkfile(dir, names); ok {
+			return dir, true
+		}
+	}
+}
+
+// Make the targets named relative to the subdirectory sub relative to the
+// directory of the mkfile instead. Those that are targets of the mkfile as
+// they are, such as 'all' or 'clean', and aren't within sub are left alone.
+func translateTargets(rs *ruleSet, sub string, targets []string) []string {
+	translated := make([]string, len(targets))
+	for i, t := range targets {
+		name := filepath.Join(sub, t)
+		_, asIs := rs.targetRules[t]
+		_, within := rs.targetRules[name]
+		if filepath.IsAbs(t) || (asIs && !within) {
+			name = t
+		}
+		translated[i] = name
+	}
+	return translated
+}
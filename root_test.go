@@ -0,0 +1,80 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindMkfileDir(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "proj", "src", "lib")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	inDir(t, filepath.Join(root, "proj"), func() { writeFile(t, "mkfile", "") })
+
+	if dir, ok := findMkfileDir(sub, mkfileNames()); !ok || dir != filepath.Join(root, "proj") {
+		t.Errorf("found %q, %v, want %q", dir, ok, filepath.Join(root, "proj"))
+	}
+	os.Setenv("MKBOUNDARY", filepath.Join(root, "proj", "src"))
+	defer os.Unsetenv("MKBOUNDARY")
+	if dir, ok := findMkfileDir(sub, mkfileNames()); ok {
+		t.Errorf("found %q beyond $MKBOUNDARY", dir)
+	}
+	os.Unsetenv("MKBOUNDARY")
+	if err := os.Mkdir(filepath.Join(root, "proj", "src", ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if dir, ok := findMkfileDir(sub, mkfileNames()); ok {
+		t.Errorf("found %q beyond .git", dir)
+	}
+}
+
+func TestFindMkfile(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir, func() {
+		writeFile(t, "mk.build", "")
+		if name, ok := findMkfile(".", mkfileNames()); !ok || name != "mk.build" {
+			t.Errorf("found %q, %v, want mk.build", name, ok)
+		}
+		writeFile(t, "Mkfile", "")
+		if name, ok := findMkfile(".", mkfileNames()); !ok || name != "Mkfile" {
+			t.Errorf("found %q, %v, want Mkfile", name, ok)
+		}
+
+		os.Setenv("MKFILES", "build.mk mk.build")
+		defer os.Unsetenv("MKFILES")
+		if name, ok := findMkfile(".", mkfileNames()); !ok || name != "mk.build" {
+			t.Errorf("with $MKFILES, found %q, %v, want mk.build", name, ok)
+		}
+	})
+}
+
+func TestTranslateTargets(t *testing.T) {
+	rs := parse("all:V: src/a.o\n\ttrue\nclean:V:\n\ttrue\nsrc/clean:V:\n\ttrue\n%.o: %.c\n\tcc -c $stem.c\n", "mkfile", "/mkfile", make(map[string][]string))
+	got := translateTargets(rs, "src", []string{"a.o", "all", "clean", "/abs/b.o", "../top.o"})
+	want := []string{filepath.Join("src", "a.o"), "all", filepath.Join("src", "clean"), "/abs/b.o", "top.o"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("translated to %q, want %q", got, want)
+	}
+}
@@ -50,7 +50,11 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -65,11 +69,17 @@ type attribSet struct {
 	update          bool // treat the targets as if they were updated
 	virtual         bool // rule is virtual (does not match files)
 	exclusive       bool // don't execute concurrently with any other rule
+	precious        bool // never removed by mk clean -generated
+	intermediate    bool // removed after the build, and only rebuilt if needed
+	lines           bool // execute each line of the recipe on its own
+	test            bool // a test, whose results are kept and reported
+	output          bool // the recipe's standard output is the target
 }
 
 // Error parsing an attribute
 type attribError struct {
 	found rune
+	what  string // what's wrong with an attribute that was found, if anything
 }
 
 // target and rereq patterns
@@ -93,17 +103,130 @@ func (p *pattern) match(target string) []string {
 	return nil
 }
 
+// How specific the pattern is about the targets it matches, for ordering
+// meta-rules: the length of the text around the % of a % pattern, 0 for a
+// regular expression, and more than either for a plain target.
+func (p *pattern) specificity() int {
+	if p.rpat == nil {
+		return math.MaxInt32
+	}
+	if !p.isSuffix {
+		return 0
+	}
+	return len(unescapeName(p.spat, false)) - 1
+}
+
 // A single rule.
 type rule struct {
-	targets    []pattern // non-empty array of targets
-	attributes attribSet // rule attributes
-	prereqs    []string  // possibly empty prerequesites
-	shell      []string  // command used to execute the recipe
-	recipe     string    // recipe source
-	command    []string  // command attribute
-	isMeta     bool      // is this a meta rule
-	file       string    // file where the rule is defined
-	line       int       // line number on which the rule is defined
+	targets    []pattern        // non-empty array of targets
+	attributes attribSet        // rule attributes
+	prereqs    []string         // possibly empty prerequesites
+	shell      []string         // command used to execute the recipe
+	recipe     string           // recipe source
+	command    []string         // command attribute
+	checksum   string           // expected SHA-256 of the targets, in hex
+	url        string           // URL the target is fetched from, instead of a recipe
+	weight     int              // job slots the recipe counts as, if not 1
+	resources  map[string]int64 // amounts of resource classes the recipe uses
+	inputs     string           // tool versions, flags and such the targets depend on
+	nice       int              // niceness to run the recipe at, if not that of -nice
+	cpus       string           // CPUs to run the recipe on, if not those of -cpus
+	limits     map[string]int64 // resource limits of the recipe, such as maxmem
+	ambiguity  ambiguityPolicy  // which recipe the targets get if their rules differ
+	chain      int              // times the rule may be applied in one chain, if not that of -chain
+	isMeta     bool             // is this a meta rule
+	dir        string           // subdirectory whose mkfile defines the rule
+	path       string           // full path of the mkfile defining the rule
+	file       string           // file where the rule is defined
+	line       int              // line number on which the rule is defined
+	doc        string           // '## ' comment lines just above the rule
+}
+
+// The targets of the rule as written.
+func (r *rule) targetNames() []string {
+	names := make([]string, len(r.targets))
+	for i := range r.targets {
+		names[i] = r.targets[i].spat
+	}
+	return names
+}
+
+// Where the rule is defined, as file:line.
+func (r *rule) location() string {
+	return fmt.Sprintf("%s:%d", r.file, r.line)
+}
+
+// The rule's attributes as they would be written in a mkfile.
+func (r *rule) attribString() string {
+	a := r.attributes
+	s := ""
+	for _, attr := range []struct {
+		set    bool
+		letter string
+	}{
+		{a.delFailed, "D"}, {a.nonstop, "E"}, {a.forcedTimestamp, "N"},
+		{a.nonVirtual, "n"}, {a.quiet, "Q"}, {a.regex, "R"}, {a.update, "U"},
+		{a.virtual, "V"}, {a.exclusive, "X"}, {a.precious, "K"}, {a.intermediate, "I"}, {a.lines, "L"},
+		{a.test, "T"}, {a.output, "O"},
+	} {
+		if attr.set {
+			s += attr.letter
+		}
+	}
+	if r.checksum != "" {
+		s += "H" + r.checksum
+	}
+	if settings := r.settings(); len(settings) > 0 {
+		if s != "" {
+			s += " "
+		}
+		s += strings.Join(settings, " ")
+		if len(r.command) > 0 || len(r.shell) > 0 {
+			s += " "
+		}
+	}
+	if len(r.command) > 0 {
+		s += "P" + strings.Join(r.command, " ")
+	} else if len(r.shell) > 0 {
+		s += "S" + strings.Join(r.shell, " ")
+	}
+	return s
+}
+
+// Let the rule be applied a number of times in one chain of inference.
+func (r *rule) setChain(name string, value string) *attribError {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > maxChain {
+		return &attribError{'c', fmt.Sprintf("expected a chain length from 1 to %d but found %q", maxChain, value)}
+	}
+	r.chain = n
+	return nil
+}
+
+// How many times the rule may be applied in one chain of inference, given that
+// of -chain.
+func (r *rule) chainLimit(chain int) int {
+	if r.chain > 0 {
+		return r.chain
+	}
+	return chain
+}
+
+// The name of a file relative to the directory the rule's recipe is executed
+// in.
+func (r *rule) relPath(name string) string {
+	if r.dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	if rel, err := filepath.Rel(r.dir, name); err == nil {
+		return rel
+	}
+	return name
+}
+
+// True if this is the dummy rule rooting the graph, added by addRoot.
+func (r *rule) isRoot() bool {
+	return len(r.targets) == 1 && r.targets[0].spat == ""
 }
 
 // Equivalent recipes.
@@ -131,12 +254,149 @@ type ruleSet struct {
 	rules []rule
 	// map a target to an array of indexes into rules
 	targetRules map[string][]int
+	// map the fingerprint of each rule to its index in rules
+	fingerprints map[string]int
+	// files included while parsing, in order
+	includes []include
+	// rule templates, by name
+	templates map[string]template
+	// how deeply template uses are nested
+	useDepth int
+	// subdirectory whose mkfile is being parsed
+	dir string
+	// where variables got their values, if not from the mkfile
+	origins map[string]varOrigin
+	// variables assigned in the namespaced include being parsed, if any
+	assigned map[string]bool
+	// let the environment override assignments in the mkfile
+	envOverrides bool
+	// capacities of the resource classes recipes may use
+	resources map[string]int64
+	// aliases for targets, by name
+	aliases map[string]alias
+	// documentation of variables, given in ## comments before assignments
+	varDocs map[string]string
+	// included files being read ahead of being parsed, by path
+	preloads map[string]*preload
+}
+
+// Where a variable got its value. Assignments in the mkfile override the
+// environment, unless -e is given, and are overridden by the command line.
+type varOrigin int
+
+const (
+	originMkfile varOrigin = iota
+	originEnvironment
+	originProfile
+	originCommandLine
+)
+
+func (o varOrigin) String() string {
+	switch o {
+	case originEnvironment:
+		return "environment"
+	case originProfile:
+		return "profile"
+	case originCommandLine:
+		return "command line"
+	}
+	return "mkfile"
+}
+
+// Make an empty rule set whose variables start out as those of env, which are
+// taken to come from the environment.
+func newRuleSet(env map[string][]string) *ruleSet {
+	rs := &ruleSet{
+		vars:         env,
+		rules:        make([]rule, 0),
+		targetRules:  make(map[string][]int),
+		fingerprints: make(map[string]int),
+		includes:     make([]include, 0),
+		templates:    make(map[string]template),
+		origins:      make(map[string]varOrigin),
+		resources:    make(map[string]int64),
+		aliases:      make(map[string]alias),
+		varDocs:      make(map[string]string),
+	}
+	for name := range env {
+		rs.origins[name] = originEnvironment
+	}
+	return rs
+}
+
+// Expand a word with the rule set's variables, running any backticks in the
+// directory whose mkfile is being parsed.
+func (rs *ruleSet) expand(input string, expandBackticks bool) ([]string, *expandError) {
+	return (&expander{vars: rs.vars, dir: rs.dir}).expand(input, expandBackticks)
+}
+
+// Assign a variable in the mkfile, unless it has a value taking precedence.
+func (rs *ruleSet) assign(name string, values []string) {
+	if rs.assigned != nil {
+		rs.assigned[name] = true
+	}
+	switch rs.origins[name] {
+	case originCommandLine, originProfile:
+		return
+	case originEnvironment:
+		if rs.envOverrides {
+			return
+		}
+	}
+	rs.vars[name] = values
+	delete(rs.origins, name)
+}
+
+// A block defined with 'define name param ...', which can be instantiated with
+// 'use name arg ...'.
+type template struct {
+	params []string // parameter names
+	body   string   // mkfile text
+	file   string   // file where the template is defined
+}
+
+// A file included with '<'.
+type include struct {
+	name string // file name as written in the include
+	path string // full path of the file that was included
+	from string // name of the file containing the include
+	line int    // line of the include
+}
+
+// The name=value attributes that are settings of a rule, rather than amounts
+// of resource classes its recipe uses, along with what applies each.
+var ruleSettings = map[string]func(r *rule, name string, value string) *attribError{
+	"ambiguous": (*rule).setAmbiguity,
+	"chain":     (*rule).setChain,
+	"cpus":      (*rule).setCPUs,
+	"inputs":    (*rule).setInputs,
+	"jobs":      (*rule).setJobs,
+	"maxcore":   (*rule).setLimit,
+	"maxfiles":  (*rule).setLimit,
+	"maxmem":    (*rule).setLimit,
+	"nice":      (*rule).setNice,
+	"pool":      (*rule).setPool,
+}
+
+// Apply a name=value attribute to the rule: one of the settings, or else the
+// amount of a resource class its recipe uses.
+func (r *rule) parseSetting(name string, value string) *attribError {
+	if set, ok := ruleSettings[name]; ok {
+		return set(r, name, value)
+	}
+	return r.setResource(name, value)
 }
 
 // Read attributes for an array of strings, updating the rule.
 func (r *rule) parseAttribs(inputs []string) *attribError {
 	for i := 0; i < len(inputs); i++ {
 		input := inputs[i]
+		if k := strings.IndexByte(input, '='); k > 0 && isSettingName(input[:k]) {
+			if err := r.parseSetting(input[:k], input[k+1:]); err != nil {
+				return err
+			}
+			continue
+		}
 		pos := 0
 		for pos < len(input) {
 			c, w := utf8.DecodeRuneInString(input[pos:])
@@ -159,6 +419,16 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 				r.attributes.virtual = true
 			case 'X':
 				r.attributes.exclusive = true
+			case 'K':
+				r.attributes.precious = true
+			case 'I':
+				r.attributes.intermediate = true
+			case 'L':
+				r.attributes.lines = true
+			case 'T':
+				r.attributes.test = true
+			case 'O':
+				r.attributes.output = true
 			case 'P':
 				if pos+w < len(input) {
 					r.command = append(r.command, input[pos+w:])
@@ -173,8 +443,16 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 				r.shell = append(r.shell, inputs[i+1:]...)
 				return nil
 
+			case 'H':
+				r.checksum = strings.ToLower(input[pos+w:])
+				if !isChecksum(r.checksum) {
+					return &attribError{c, fmt.Sprintf("expected a SHA-256 in hex after H but found %q", r.checksum)}
+				}
+				pos = len(input)
+				continue
+
 			default:
-				return &attribError{c}
+				return &attribError{c, ""}
 			}
 
 			pos += w
@@ -184,16 +462,55 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 	return nil
 }
 
-// Add a rule to the rule set.
-func (rs *ruleSet) add(r rule) {
+// What makes a rule the rule it is: two rules with the same fingerprint
+// are the same rule, wherever they're defined.
+func (r *rule) fingerprint() string {
+	return fmt.Sprintf("%q %q %q %q %q %q %q", r.targetNames(), r.attribString(),
+		r.prereqs, r.recipe, r.shell, r.url, r.dir)
+}
+
+// Add a rule to the rule set, unless it's the same as one already added, as
+// when a file is included twice. Returns false if it was a duplicate. Warns
+// about a target getting a recipe different from one it already has.
+func (rs *ruleSet) add(r rule) bool {
+	fp := r.fingerprint()
+	if _, ok := rs.fingerprints[fp]; ok {
+		return false
+	}
+
+	for i := range r.targets {
+		if r.targets[i].rpat != nil || r.recipe == "" {
+			continue
+		}
+		for _, k := range rs.targetRules[r.targets[i].spat] {
+			if prev := &rs.rules[k]; prev.recipe != "" && !prev.equivRecipe(&r) {
+				mkPrintError(fmt.Sprintf("warning: %s: recipe for %s conflicts with the one at %s",
+					r.location(), r.targets[i].spat, prev.location()))
+				break
+			}
+		}
+	}
+
 	rs.rules = append(rs.rules, r)
 	k := len(rs.rules) - 1
+	rs.fingerprints[fp] = k
 	for i := range r.targets {
 		if r.targets[i].rpat == nil {
 			rs.targetRules[r.targets[i].spat] =
 				append(rs.targetRules[r.targets[i].spat], k)
 		}
 	}
+	return true
+}
+
+// Add a dummy virtual rule that depends on every target. The graph is rooted
+// at its empty target.
+func (rs *ruleSet) addRoot(targets []string) {
+	root := rule{}
+	root.targets = []pattern{pattern{false, "", nil}}
+	root.attributes = attribSet{virtual: true}
+	root.prereqs = targets
+	rs.add(root)
 }
 
 func isValidVarName(v string) bool {
@@ -212,7 +529,9 @@ type assignmentError struct {
 	where token
 }
 
-// Parse and execute assignment operation.
+// Parse and execute assignment operation. An assignment of the form
+// 'var=D=value' is deferred: value is stored unexpanded, and expanded each
+// time var is used.
 func (rs *ruleSet) executeAssignment(ts []token) *assignmentError {
 	assignee := ts[0].val
 	if !isValidVarName(assignee) {
@@ -220,27 +539,75 @@ func (rs *ruleSet) executeAssignment(ts []token) *assignmentError {
 			fmt.Sprintf("target of assignment is not a valid variable name: \"%s\"", assignee),
 			ts[0]}
 	}
+	if ts[0].doc != "" {
+		rs.varDocs[assignee] = ts[0].doc
+	}
+
+	if len(ts) > 2 && ts[1].typ == tokenWord && ts[1].val == "D" &&
+		ts[2].typ == tokenAssign {
+		input, _ := assignmentWords(ts[3:])
+		rs.assign(assignee, append([]string{deferredMarker}, input...))
+		return nil
+	}
+
+	input, where := assignmentWords(ts[1:])
+
+	// expanded variables
+	vals := make([]string, 0)
+	for i := 0; i < len(input); i++ {
+		parts, err := rs.expand(input[i], true)
+		if err != nil {
+			return &assignmentError{err.what, where[i]}
+		}
+		vals = append(vals, parts...)
+	}
+
+	rs.assign(assignee, vals)
+	return nil
+}
 
-	// interpret tokens in assignment context
+// Interpret the tokens following '=' in assignment context, returning the
+// words assigned along with the tokens at which they begin.
+func assignmentWords(ts []token) ([]string, []token) {
 	input := make([]string, 0)
-	for i := 1; i < len(ts); i++ {
-		if ts[i].typ != tokenWord || (i > 1 && ts[i-1].typ != tokenWord) {
+	where := make([]token, 0)
+	for i := 0; i < len(ts); i++ {
+		if ts[i].typ != tokenWord || (i > 0 && ts[i-1].typ != tokenWord) {
 			if len(input) == 0 {
 				input = append(input, ts[i].val)
+				where = append(where, ts[i])
 			} else {
 				input[len(input)-1] += ts[i].val
 			}
 		} else {
 			input = append(input, ts[i].val)
+			where = append(where, ts[i])
 		}
 	}
+	return input, where
+}
 
-	// expanded variables
-	vals := make([]string, 0)
-	for i := 0; i < len(input); i++ {
-		vals = append(vals, expand(input[i], rs.vars, true)...)
+// Assign the body of a 'define name param ...' block to name, verbatim, and
+// record it as a template defined in the given file.
+func (rs *ruleSet) executeDefine(t token, file string) *assignmentError {
+	header, body := t.val, ""
+	if k := strings.IndexByte(t.val, '\n'); k >= 0 {
+		header, body = t.val[:k], t.val[k+1:]
+	}
+
+	fields := strings.Fields(header)[1:]
+	for _, name := range fields {
+		if !isValidVarName(name) {
+			return &assignmentError{
+				fmt.Sprintf("not a valid variable name in define: \"%s\"", name), t}
+		}
+	}
+	if len(fields) == 0 {
+		return &assignmentError{"expected a variable name after define", t}
 	}
 
-	rs.vars[assignee] = vals
+	body = strings.TrimSuffix(body, "\n")
+	rs.assign(fields[0], []string{body})
+	rs.templates[fields[0]] = template{fields[1:], body, file}
 	return nil
 }
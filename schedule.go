@@ -0,0 +1,103 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Running recipes at a lower priority or on some of the CPUs, so that builds
+// in the background leave the machine usable.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The niceness and CPUs a recipe runs with: those of its rule, or else those
+// given with -nice and -cpus.
+func recipeSchedule(r *rule, opts *buildOptions) (int, string) {
+	nice, cpus := opts.nice, opts.cpus
+	if r.nice > 0 {
+		nice = r.nice
+	}
+	if r.cpus != "" {
+		cpus = r.cpus
+	}
+	return nice, cpus
+}
+
+// Fail unless -nice and -cpus were given sensibly.
+func checkSchedule(opts *buildOptions) {
+	if opts.nice != 0 {
+		if _, err := parseNice(strconv.Itoa(opts.nice)); err != nil {
+			mkError(fmt.Sprintf("mk: -nice: %s", err))
+		}
+	}
+	if opts.cpus != "" {
+		if _, err := parseCPUList(opts.cpus); err != nil {
+			mkError(fmt.Sprintf("mk: -cpus: %s", err))
+		}
+	}
+}
+
+// Run the recipe at a niceness.
+func (r *rule) setNice(name string, value string) *attribError {
+	n, err := parseNice(value)
+	if err != nil {
+		return &attribError{'n', err.Error()}
+	}
+	r.nice = n
+	return nil
+}
+
+// Run the recipe on a list of CPUs.
+func (r *rule) setCPUs(name string, value string) *attribError {
+	if _, err := parseCPUList(value); err != nil {
+		return &attribError{'c', err.Error()}
+	}
+	r.cpus = value
+	return nil
+}
+
+// The CPUs in a list such as 0-3,8, as taskset takes it.
+func parseCPUList(list string) ([]int, error) {
+	cpus := make([]int, 0)
+	for _, part := range strings.Split(list, ",") {
+		first, last := part, part
+		if k := strings.IndexByte(part, '-'); k >= 0 {
+			first, last = part[:k], part[k+1:]
+		}
+		i, err := strconv.Atoi(first)
+		j, err2 := strconv.Atoi(last)
+		if err != nil || err2 != nil || i < 0 || j < i {
+			return nil, fmt.Errorf("expected a list of CPUs such as 0-3,8 but found %q", list)
+		}
+		for ; i <= j; i++ {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus, nil
+}
+
+// Parse a niceness from 1, the least, to 19.
+func parseNice(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 19 {
+		return 0, fmt.Errorf("expected a niceness from 1 to 19 but found %q", s)
+	}
+	return n, nil
+}
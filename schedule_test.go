@@ -0,0 +1,65 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	if got, err := parseCPUList("0-3,8"); err != nil || !reflect.DeepEqual(got, []int{0, 1, 2, 3, 8}) {
+		t.Errorf("parsed 0-3,8 as %v, %v", got, err)
+	}
+	for _, list := range []string{"", "a", "3-1", "1,", "-1"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Errorf("parsed %q", list)
+		}
+	}
+}
+
+func TestRecipeSchedule(t *testing.T) {
+	rs := parse("a:V nice=5 cpus=0-1:\n\ttrue\nb:V:\n\ttrue\n", "mkfile", "/mkfile", make(map[string][]string))
+	if got := rs.rules[0].attribString(); got != "V nice=5 cpus=0-1" {
+		t.Errorf("attributes are %q, want %q", got, "V nice=5 cpus=0-1")
+	}
+
+	opts := defaultBuildOptions()
+	opts.nice, opts.cpus = 10, "2"
+	if nice, cpus := recipeSchedule(&rs.rules[0], opts); nice != 5 || cpus != "0-1" {
+		t.Errorf("a runs at %d on %q, want 5 on 0-1", nice, cpus)
+	}
+	if nice, cpus := recipeSchedule(&rs.rules[1], opts); nice != 10 || cpus != "2" {
+		t.Errorf("b runs at %d on %q, want 10 on 2", nice, cpus)
+	}
+
+	program, args := scheduleCommand(0, "", "sh", []string{"-e"})
+	if program != "sh" || !reflect.DeepEqual(args, []string{"-e"}) {
+		t.Errorf("unscheduled, ran %s %q", program, args)
+	}
+	program, args = scheduleCommand(5, "", "sh", nil)
+	if program != "nice" || args[0] != "-n" || args[1] != "5" || args[len(args)-1] != "sh" {
+		t.Errorf("at niceness 5, ran %s %q", program, args)
+	}
+
+	sandboxed(func() {
+		parse("a:V nice=20:\n\ttrue\n", "mkfile", "/mkfile", make(map[string][]string))
+		t.Error("accepted nice=20")
+	})
+}
@@ -0,0 +1,156 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Writing mk's state files, which are kept from one build to the next.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Records kept in one of mk's state files, such as the hash of the inputs
+// each target was built with. Each line of the file gives a record's fields,
+// then the name it's kept under, which may hold spaces.
+type stateStore struct {
+	mutex   sync.Mutex
+	path    string              // file the records are kept in
+	fields  int                 // number of fields before each name
+	records map[string][]string // map names to their fields
+	changed bool                // records were set or deleted since loading
+}
+
+// Load the records kept in the given file, each with the given number of
+// fields. A missing file holds none, and malformed lines are passed over.
+func loadStateStore(path string, fields int) *stateStore {
+	s := &stateStore{path: path, fields: fields, records: make(map[string][]string)}
+	file, err := os.Open(path)
+	if err != nil {
+		return s
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", fields+1)
+		if len(parts) == fields+1 && parts[fields] != "" {
+			s.records[parts[fields]] = parts[:fields]
+		}
+	}
+	return s
+}
+
+// The fields recorded under the name, if any are.
+func (s *stateStore) get(name string) ([]string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fields, ok := s.records[name]
+	return fields, ok
+}
+
+// Record the fields under the name, replacing any recorded before.
+func (s *stateStore) set(name string, fields ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old, ok := s.records[name]; ok && strings.Join(old, " ") == strings.Join(fields, " ") {
+		return
+	}
+	s.records[name] = fields
+	s.changed = true
+}
+
+// Forget what's recorded under the name.
+func (s *stateStore) delete(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.records[name]; ok {
+		delete(s.records, name)
+		s.changed = true
+	}
+}
+
+// The names records are kept under, in sorted order.
+func (s *stateStore) names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortedNames()
+}
+
+func (s *stateStore) sortedNames() []string {
+	names := make([]string, 0, len(s.records))
+	for name := range s.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write the records back to their file, if any were set or deleted.
+func (s *stateStore) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.changed {
+		return nil
+	}
+
+	err := writeStateFile(s.path, func(w io.Writer) error {
+		for _, name := range s.sortedNames() {
+			line := append(append([]string{}, s.records[name]...), name)
+			if _, err := fmt.Fprintln(w, strings.Join(line, " ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.changed = false
+	}
+	return err
+}
+
+// Write one of mk's state files by way of a temporary file renamed over it,
+// so that a crash never leaves it truncated. It's readable only by its owner.
+func writeStateFile(path string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestStateStore(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, ".mkstate", "h1 a b\nmalformed\nh2 c\n")
+		s := loadStateStore(".mkstate", 1)
+		if fields, ok := s.get("a b"); !ok || !reflect.DeepEqual(fields, []string{"h1"}) {
+			t.Errorf("a b has %q, want [h1]", fields)
+		}
+
+		// nothing is written until a record changes
+		writeFile(t, ".mkstate", "")
+		s.set("c", "h2")
+		if err := s.save(); err != nil {
+			t.Fatal(err)
+		}
+		if words := readWords(t, ".mkstate"); len(words) != 0 {
+			t.Errorf(".mkstate rewritten with %q, though nothing changed", words)
+		}
+
+		s.set("c", "h3")
+		s.delete("a b")
+		s.set("d", "h4")
+		if err := s.save(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(".mkstate"); err != nil || string(got) != "h3 c\nh4 d\n" {
+			t.Errorf(".mkstate holds %q, want h3 c and h4 d", got)
+		}
+
+		// the file is replaced rather than written in place
+		if entries, err := ioutil.ReadDir("."); err != nil || len(entries) != 1 {
+			t.Errorf("the directory holds %d files, want only .mkstate", len(entries))
+		}
+	})
+}
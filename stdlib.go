@@ -0,0 +1,44 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// The standard library of mk fragments, which mkfiles can include as
+// '<mk:name' to get rules for common kinds of projects.
+
+package main
+
+import (
+	"embed"
+	"strings"
+)
+
+//go:embed lib/*.mk
+var stdlib embed.FS
+
+// Prefix of includes referring to the standard library.
+const stdlibPrefix = "mk:"
+
+// True if an included file name refers to the standard library.
+func isStdlibInclude(filename string) bool {
+	return strings.HasPrefix(filename, stdlibPrefix)
+}
+
+// Read a fragment of the standard library, e.g. "mk:cc".
+func readStdlib(filename string) ([]byte, error) {
+	name := strings.TrimPrefix(filename, stdlibPrefix)
+	return stdlib.ReadFile("lib/" + name + ".mk")
+}
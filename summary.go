@@ -0,0 +1,80 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Summarizing what a build did, for people and for tracking builds over time.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// What a build did.
+type buildSummary struct {
+	Examined    int     `json:"examined"`     // targets with rules that were considered
+	Rebuilt     int     `json:"rebuilt"`      // targets whose recipes were executed
+	UpToDate    int     `json:"up_to_date"`   // targets that needed nothing done
+	Failed      int     `json:"failed"`       // targets that failed to build
+	CacheHits   int     `json:"cache_hits"`   // fetched URLs that hadn't changed
+	WallTime    float64 `json:"wall_time"`    // seconds the build took
+	MaxParallel int64   `json:"max_parallel"` // most job slots in use at once
+}
+
+// Summarize the last build of the graph, which started at the given time.
+func (g *graph) summarize(start time.Time) buildSummary {
+	s := buildSummary{
+		WallTime:    time.Since(start).Seconds(),
+		MaxParallel: g.jobs.peak,
+	}
+	g.mutex.Lock()
+	s.CacheHits = g.cacheHits
+	g.mutex.Unlock()
+
+	for _, u := range g.nodes {
+		if u == g.root || len(u.prereqs) == 0 || u.status == nodeStatusReady {
+			continue
+		}
+		s.Examined++
+		switch u.status {
+		case nodeStatusDone:
+			s.Rebuilt++
+		case nodeStatusNop:
+			s.UpToDate++
+		case nodeStatusFailed:
+			s.Failed++
+		}
+	}
+	return s
+}
+
+func (s buildSummary) String() string {
+	return fmt.Sprintf("mk: %d targets examined, %d rebuilt, %d up to date, %d failed, %d cache hits in %.2fs, at most %d jobs at once",
+		s.Examined, s.Rebuilt, s.UpToDate, s.Failed, s.CacheHits, s.WallTime, s.MaxParallel)
+}
+
+// Write the summary to a file as JSON.
+func (s buildSummary) save(name string) error {
+	content, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(content, '\n'), 0644)
+}
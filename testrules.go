@@ -0,0 +1,154 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Rules with the T attribute are tests: mk keeps a history of their results,
+// doesn't run a test again while its inputs are the same as when it passed,
+// quarantines tests that are flaky, and reports on them apart from the build.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Results of tests in this and earlier builds.
+type testStore struct {
+	mutex       sync.Mutex
+	results     *stateStore     // each test with its last result
+	passed      map[string]bool // tests that passed in this build
+	cached      map[string]bool // tests skipped, having passed before
+	failed      map[string]bool // tests that failed in this build
+	quarantined map[string]bool // flaky tests that failed in this build
+}
+
+// Load the results kept in the given file. A missing file holds none.
+func loadTestStore(path string) *testStore {
+	// each result is: key pass|fail flaky|-, the key hashing the test's
+	// inputs when it ran
+	return &testStore{
+		results:     loadStateStore(path, 3),
+		passed:      make(map[string]bool),
+		cached:      make(map[string]bool),
+		failed:      make(map[string]bool),
+		quarantined: make(map[string]bool),
+	}
+}
+
+// Write the results back to their file.
+func (s *testStore) save() error {
+	return s.results.save()
+}
+
+// Hash what a test depends on: its recipe as it would be executed, the shell
+// and environment it's run with, and the names and content of its
+// prerequisites.
+func testKey(target string, u *node, e *edge, prereqs []*node) string {
+	h := sha256.New()
+	io.WriteString(h, expandRecipeSigils(e.r.recipe, recipeSigils(target, u, e), e.r.shell))
+	for _, arg := range e.r.shell {
+		fmt.Fprintf(h, "\x00%s", arg)
+	}
+	env := os.Environ()
+	sort.Strings(env)
+	for _, entry := range env {
+		fmt.Fprintf(h, "\x00%s", entry)
+	}
+	for _, v := range prereqs {
+		fmt.Fprintf(h, "\x00%s\x00%s", v.name, hashFile(v.name))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// True if the test passed when last run with the same inputs, in which case
+// it's counted as a cached pass. Flaky tests are always run.
+func (s *testStore) cachedPass(target string, key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res, ok := s.results.get(target)
+	if ok && res[0] == key && res[1] == "pass" && res[2] != "flaky" {
+		s.cached[target] = true
+		return true
+	}
+	return false
+}
+
+// Record whether a test passed. A test whose result differs from the last one
+// with the same inputs is flaky, and stays so until its inputs change. The
+// failure of a flaky test is quarantined: it's reported, but doesn't fail the
+// build. Returns true if the test's failure is quarantined.
+func (s *testStore) record(target string, key string, passed bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	last, ok := s.results.get(target)
+	flaky := ok && last[0] == key && (last[2] == "flaky" || (last[1] == "pass") != passed)
+	result, flakiness := "fail", "-"
+	if passed {
+		result = "pass"
+	}
+	if flaky {
+		flakiness = "flaky"
+	}
+	s.results.set(target, key, result, flakiness)
+
+	if passed {
+		s.passed[target] = true
+	} else if flaky {
+		s.quarantined[target] = true
+	} else {
+		s.failed[target] = true
+	}
+	return !passed && flaky
+}
+
+// True if any tests were run or skipped in this build.
+func (s *testStore) ran() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.passed)+len(s.cached)+len(s.failed)+len(s.quarantined) > 0
+}
+
+// Report on this build's tests, naming those that failed.
+func (s *testStore) report() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines := []string{fmt.Sprintf("mk: tests: %d passed, %d cached, %d failed, %d quarantined",
+		len(s.passed), len(s.cached), len(s.failed), len(s.quarantined))}
+	for _, target := range sortedKeys(s.failed) {
+		lines = append(lines, "mk: failed: "+target)
+	}
+	for _, target := range sortedKeys(s.quarantined) {
+		lines = append(lines, "mk: quarantined: "+target)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
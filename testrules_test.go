@@ -0,0 +1,98 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTestRules(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "prog", "1")
+		writeFile(t, "mkfile", "check:VT: prog\n\t./prog\n")
+		run := func(fail bool) (*graph, *testStore) {
+			opts := defaultBuildOptions()
+			opts.executor = &stubExecutor{fail: fail}
+			opts.tests = loadTestStore(".mktests")
+			g := runMk(t, nil, opts)
+			if err := opts.tests.save(); err != nil {
+				t.Fatal(err)
+			}
+			return g, opts.tests
+		}
+
+		_, s := run(false)
+		if !reflect.DeepEqual(s.passed, map[string]bool{"check": true}) {
+			t.Errorf("passed %v, want check", s.passed)
+		}
+		_, s = run(true)
+		if !reflect.DeepEqual(s.cached, map[string]bool{"check": true}) || len(s.failed) > 0 {
+			t.Errorf("cached %v and failed %v, want the pass cached", s.cached, s.failed)
+		}
+
+		// a test that fails with new inputs fails the build
+		writeFile(t, "prog", "2")
+		g, s := run(true)
+		if !reflect.DeepEqual(s.failed, map[string]bool{"check": true}) || g.root.status != nodeStatusFailed {
+			t.Errorf("failed %v with the build %s, want check to fail it", s.failed, g.root.status)
+		}
+
+		// then passes with the same inputs, so it's flaky, and run every time
+		_, s = run(false)
+		if !reflect.DeepEqual(s.passed, map[string]bool{"check": true}) {
+			t.Errorf("passed %v, want flaky check run again", s.passed)
+		}
+		g, s = run(true)
+		if !reflect.DeepEqual(s.quarantined, map[string]bool{"check": true}) || g.root.status == nodeStatusFailed {
+			t.Errorf("quarantined %v with the build %s, want check quarantined", s.quarantined, g.root.status)
+		}
+		want := "mk: tests: 0 passed, 0 cached, 0 failed, 1 quarantined\nmk: quarantined: check"
+		if got := s.report(); got != want {
+			t.Errorf("reported %q, want %q", got, want)
+		}
+	})
+}
+
+func TestTestKey(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "prog", "1")
+		key := func(mkfile string) string {
+			rs := parse(mkfile, "mkfile", "mkfile", make(map[string][]string))
+			rs.addRoot([]string{"check"})
+			g := buildgraph(rs, "", defaultBuildOptions())
+			u := g.nodes["check"]
+			return testKey(u.name, u, u.prereqs[0], []*node{g.nodes["prog"]})
+		}
+
+		mkfile := "check:VT: prog\n\t./$prereq $TESTFLAGS\n"
+		t.Setenv("TESTFLAGS", "-short")
+		short := key(mkfile)
+		if key(mkfile) != short {
+			t.Error("the key changed with the same inputs")
+		}
+		if key("FLAGS=-v\ncheck:VT: prog\n\t./$prereq $FLAGS\n") == key("FLAGS=-q\ncheck:VT: prog\n\t./$prereq $FLAGS\n") {
+			t.Error("the key didn't change with a variable of the recipe")
+		}
+		t.Setenv("TESTFLAGS", "-long")
+		if key(mkfile) == short {
+			t.Error("the key didn't change with the environment")
+		}
+	})
+}
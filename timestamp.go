@@ -0,0 +1,262 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Deciding whether a target is older than its prerequisites.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// How a target is treated when its timestamp equals a prerequisite's, which
+// happens on filesystems with coarse timestamps when both are written within
+// the same tick.
+type equalTimePolicy int
+
+const (
+	equalTimeUpToDate equalTimePolicy = iota // the target is up to date
+	equalTimeRebuild                         // the target is rebuilt
+	equalTimeHash                            // rebuilt if the prerequisite's content changed
+)
+
+func (p *equalTimePolicy) String() string {
+	switch *p {
+	case equalTimeRebuild:
+		return "rebuild"
+	case equalTimeHash:
+		return "hash"
+	}
+	return "uptodate"
+}
+
+func (p *equalTimePolicy) Set(value string) error {
+	switch value {
+	case "uptodate":
+		*p = equalTimeUpToDate
+	case "rebuild":
+		*p = equalTimeRebuild
+	case "hash":
+		*p = equalTimeHash
+	default:
+		return fmt.Errorf("unknown policy %q, expected uptodate, rebuild or hash", value)
+	}
+	return nil
+}
+
+// True if the target u must be rebuilt because of its prerequisite v's
+// timestamp. Timestamps closer together than the skew tolerated are taken to
+// be equal.
+func (opts *buildOptions) olderThan(u *node, v *node) bool {
+	// a missing intermediate is only out of date if what it's built from is
+	if v.isMissingIntermediate() {
+		return u.t.Add(opts.skew).Before(v.sourceTime())
+	}
+	// a prerequisite from the future may be taken to be as old as the target
+	if v.flags&nodeFlagFuture == 0 {
+		if u.t.Add(opts.skew).Before(v.t) {
+			return true
+		}
+		if v.t.Add(opts.skew).Before(u.t) {
+			return false
+		}
+	}
+
+	switch opts.equalTime {
+	case equalTimeRebuild:
+		return true
+	case equalTimeHash:
+		return opts.hashes.changed(u.name, v.name)
+	}
+	return false
+}
+
+// The skew between clocks tolerated by -nfs, as network filesystems date
+// files by the server's clock, and other clients' may differ.
+const nfsSkew = 2 * time.Second
+
+// The times a stat failing transiently is tried again with -nfs.
+const nfsStatRetries = 4
+
+// True if a stat failed in a way that may not happen if it's tried again, as
+// when a network filesystem's server is slow to answer or a file handle went
+// stale.
+func isTransientStatError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ESTALE, syscall.EIO, syscall.EINTR, syscall.EAGAIN, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// How a file modified in the future is treated, which, left as it is, makes
+// its dependents out of date on every build until that time has passed.
+type futurePolicy int
+
+const (
+	futureWarn  futurePolicy = iota // warn, comparing its time as it is
+	futureTouch                     // warn, and set its time to now
+	futureEqual                     // warn, and take it to be as old as its dependents
+	futureError                     // fail
+)
+
+func (p *futurePolicy) String() string {
+	switch *p {
+	case futureTouch:
+		return "touch"
+	case futureEqual:
+		return "equal"
+	case futureError:
+		return "error"
+	}
+	return "warn"
+}
+
+func (p *futurePolicy) Set(value string) error {
+	switch value {
+	case "warn":
+		*p = futureWarn
+	case "touch":
+		*p = futureTouch
+	case "equal":
+		*p = futureEqual
+	case "error":
+		*p = futureError
+	default:
+		return fmt.Errorf("unknown policy %q, expected warn, touch, equal or error", value)
+	}
+	return nil
+}
+
+// Treat each of the nodes that exists with a timestamp further in the future
+// than the skew tolerated as the -future policy says.
+func (g *graph) checkFuture(nodes []*node) {
+	now := time.Now()
+	for _, u := range nodes {
+		if !u.exists || !u.t.After(now.Add(g.opts.skew)) {
+			continue
+		}
+		ahead := u.t.Sub(now).Round(time.Second)
+		switch g.opts.future {
+		case futureTouch:
+			if err := os.Chtimes(u.name, now, now); err != nil {
+				mkPrintError(fmt.Sprintf("warning: %s was modified %s in the future, and its time can't be set: %s", u.name, ahead, err))
+				continue
+			}
+			mkPrintError(fmt.Sprintf("warning: %s was modified %s in the future; its time is set to now", u.name, ahead))
+			u.updateTimestamp(g.opts)
+		case futureEqual:
+			mkPrintError(fmt.Sprintf("warning: %s was modified %s in the future; it's taken to be as old as its dependents", u.name, ahead))
+			u.flags |= nodeFlagFuture
+		case futureError:
+			mkError(fmt.Sprintf("%s was modified %s in the future", u.name, ahead))
+		default:
+			mkPrintError(fmt.Sprintf("warning: %s was modified %s in the future", u.name, ahead))
+		}
+	}
+}
+
+// Content hashes of prerequisites, recorded when their targets are built.
+type hashStore struct {
+	state *stateStore // each target and prerequisite with the hash
+}
+
+// Key of the hash of a target's prerequisite.
+func hashKey(target string, prereq string) string {
+	return target + " " + prereq
+}
+
+// Load the hashes kept in the given file. A missing file holds no hashes.
+func loadHashStore(path string) *hashStore {
+	return &hashStore{loadStateStore(path, 1)}
+}
+
+// Write the hashes back to their file.
+func (s *hashStore) save() error {
+	return s.state.save()
+}
+
+// Hash a file's content, returning "" if it can't be read.
+func hashFile(name string) string {
+	file, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// True if s is a SHA-256 hash in lowercase hex.
+func isChecksum(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Check a target built by a rule with the H attribute against its expected
+// hash, removing it if it doesn't match so it isn't taken to be up to date.
+func verifyChecksum(target string, r *rule, opts *buildOptions) bool {
+	if r.checksum == "" || opts.dryRun {
+		return true
+	}
+	got := hashFile(target)
+	if got == r.checksum {
+		return true
+	}
+	if got == "" {
+		mkPrintError(fmt.Sprintf("mk: unable to verify the checksum of %s", target))
+	} else {
+		mkPrintError(fmt.Sprintf("mk: checksum mismatch for %s: expected %s, got %s", target, r.checksum, got))
+		os.Remove(target)
+	}
+	return false
+}
+
+// True if the prerequisite's content differs from when the target was last
+// built, or if that isn't known.
+func (s *hashStore) changed(target string, prereq string) bool {
+	hash := hashFile(prereq)
+	recorded, ok := s.state.get(hashKey(target, prereq))
+	return !ok || hash == "" || hash != recorded[0]
+}
+
+// Record the content of a target's prerequisites after building it.
+func (s *hashStore) record(target string, prereqs []*node) {
+	for _, v := range prereqs {
+		hash := hashFile(v.name)
+		if hash == "" {
+			continue
+		}
+		s.state.set(hashKey(target, v.name), hash)
+	}
+}
@@ -0,0 +1,317 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Give every named file the same modification time, as a filesystem with
+// coarse timestamps would when they're written within the same tick.
+func sameTime(t *testing.T, names ...string) {
+	tick := time.Now().Truncate(time.Second)
+	for _, name := range names {
+		if err := os.Chtimes(name, tick, tick); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEqualTimePolicy(t *testing.T) {
+	tests := []struct {
+		policy equalTimePolicy
+		want   []string
+	}{
+		{equalTimeUpToDate, []string{}},
+		{equalTimeRebuild, []string{"out"}},
+		{equalTimeHash, []string{"out"}},
+	}
+
+	for _, test := range tests {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", "out: in\n\tcp in out; echo $target >> log\n")
+			writeFile(t, "in", "a")
+			writeFile(t, "out", "a")
+			sameTime(t, "in", "out")
+
+			opts := defaultBuildOptions()
+			opts.equalTime = test.policy
+			opts.hashes = loadHashStore(".mkhashes")
+			runMk(t, nil, opts)
+
+			got := readWords(t, "log")
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("policy %s: executed %q, want %q", test.policy.String(), got, test.want)
+			}
+		})
+	}
+}
+
+func TestEqualTimeHash(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "out: in\n\tcp in out; echo $target >> log\n")
+		writeFile(t, "in", "a")
+
+		run := func() []string {
+			os.Remove("log")
+			opts := defaultBuildOptions()
+			opts.equalTime = equalTimeHash
+			opts.hashes = loadHashStore(".mkhashes")
+			runMk(t, nil, opts)
+			if err := opts.hashes.save(); err != nil {
+				t.Fatal(err)
+			}
+			return readWords(t, "log")
+		}
+
+		run()
+		sameTime(t, "in", "out")
+		if got := run(); len(got) != 0 {
+			t.Errorf("unchanged prerequisite: executed %q, want nothing", got)
+		}
+
+		writeFile(t, "in", "b")
+		sameTime(t, "in", "out")
+		if got := run(); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("changed prerequisite: executed %q, want [out]", got)
+		}
+	})
+}
+
+func TestDirNewest(t *testing.T) {
+	for _, dirNewest := range []bool{false, true} {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", "out: src\n\ttouch out; echo $target >> log\n")
+			if err := os.Mkdir("src", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, "src/a", "")
+			writeFile(t, "out", "")
+
+			// src/a changed after out was built, but src itself didn't
+			old := time.Now().Add(-time.Hour)
+			if err := os.Chtimes("src", old, old); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes("out", old.Add(time.Minute), old.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := defaultBuildOptions()
+			opts.dirNewest = dirNewest
+			runMk(t, nil, opts)
+
+			rebuilt := len(readWords(t, "log")) > 0
+			if rebuilt != dirNewest {
+				t.Errorf("dirNewest %v: rebuilt = %v", dirNewest, rebuilt)
+			}
+		})
+	}
+}
+
+func TestIntermediate(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "%.o: %.c\n\techo $target >> log; touch $target\n%.c: %.y\n\techo $target >> log; touch $target\n")
+		writeFile(t, "a.y", "")
+
+		run := func() []string {
+			os.Remove("log")
+			opts := defaultBuildOptions()
+			opts.intermediates = true
+			runMk(t, []string{"a.o"}, opts)
+			return readWords(t, "log")
+		}
+
+		// only inferred with -intermediates
+		runMk(t, []string{"a.o"}, defaultBuildOptions())
+		if _, err := os.Stat("a.c"); err != nil {
+			t.Errorf("a.c was removed without -intermediates")
+		}
+		os.Remove("a.c")
+		os.Remove("a.o")
+
+		run()
+		if _, err := os.Stat("a.c"); !os.IsNotExist(err) {
+			t.Errorf("intermediate a.c wasn't removed")
+		}
+
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes("a.y", later, later); err != nil {
+			t.Fatal(err)
+		}
+		if got := run(); !reflect.DeepEqual(got, []string{"a.c", "a.o"}) {
+			t.Errorf("changed source: executed %q, want [a.c a.o]", got)
+		}
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	const sum = "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb" // of "a"
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "out:QH"+sum+":\n\tprintf a > out; echo $target >> log\nbad:H"+sum+":\n\tprintf b > bad\n")
+
+		run := func(target string) []string {
+			os.Remove("log")
+			runMk(t, []string{target}, defaultBuildOptions())
+			return readWords(t, "log")
+		}
+
+		if got := run("out"); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("executed %q, want [out]", got)
+		}
+		if got := run("out"); len(got) != 0 {
+			t.Errorf("matching checksum: executed %q, want nothing", got)
+		}
+		writeFile(t, "out", "b")
+		if got := run("out"); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("mismatched checksum: executed %q, want [out]", got)
+		}
+
+		g := runMk(t, []string{"bad"}, defaultBuildOptions())
+		if g.nodes["bad"].status != nodeStatusFailed {
+			t.Errorf("bad has status %d, want failed", g.nodes["bad"].status)
+		}
+		if _, err := os.Stat("bad"); !os.IsNotExist(err) {
+			t.Errorf("bad wasn't removed")
+		}
+	})
+}
+
+func TestInputs(t *testing.T) {
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "in", "")
+		run := func(cflags string) []string {
+			writeFile(t, "mkfile", "CC=cc\nCFLAGS="+cflags+"\nout:Q inputs=$CC $CFLAGS: in\n\ttouch out; echo $target >> log\n")
+			os.Remove("log")
+			opts := defaultBuildOptions()
+			opts.inputs = loadInputStore(".mkinputs")
+			runMk(t, nil, opts)
+			if err := opts.inputs.save(); err != nil {
+				t.Fatal(err)
+			}
+			return readWords(t, "log")
+		}
+
+		if got := run("-O2 -g"); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("executed %q, want [out]", got)
+		}
+		if got := run("-O2 -g"); len(got) != 0 {
+			t.Errorf("same inputs: executed %q, want nothing", got)
+		}
+		if got := run("-O3"); !reflect.DeepEqual(got, []string{"out"}) {
+			t.Errorf("changed flags: executed %q, want [out]", got)
+		}
+
+		rs := parse("out:Q inputs=cc -O3: in\n\ttouch out\n", "mkfile", "/mkfile", make(map[string][]string))
+		if got := rs.rules[0].attribString(); got != "Q inputs=cc -O3" {
+			t.Errorf("attributes are %q, want %q", got, "Q inputs=cc -O3")
+		}
+	})
+}
+
+func TestSkew(t *testing.T) {
+	tests := []struct {
+		skew   time.Duration
+		policy equalTimePolicy
+		want   []string
+	}{
+		{0, equalTimeUpToDate, []string{"out"}},
+		{2 * time.Second, equalTimeUpToDate, []string{}},
+		{2 * time.Second, equalTimeRebuild, []string{"out"}},
+		{500 * time.Millisecond, equalTimeUpToDate, []string{"out"}},
+	}
+
+	for _, test := range tests {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", "out: in\n\tcp in out; echo $target >> log\n")
+			writeFile(t, "in", "a")
+			writeFile(t, "out", "a")
+			tick := time.Now().Truncate(time.Second)
+			os.Chtimes("out", tick, tick)
+			os.Chtimes("in", tick.Add(time.Second), tick.Add(time.Second))
+
+			opts := defaultBuildOptions()
+			opts.skew = test.skew
+			opts.equalTime = test.policy
+			runMk(t, nil, opts)
+
+			if got := readWords(t, "log"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("skew %s, policy %s: executed %q, want %q", test.skew, test.policy.String(), got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransientStatError(t *testing.T) {
+	stale := &os.PathError{Op: "stat", Path: "x", Err: syscall.ESTALE}
+	missing := &os.PathError{Op: "stat", Path: "x", Err: syscall.ENOENT}
+	if !isTransientStatError(stale) || isTransientStatError(missing) {
+		t.Errorf("ESTALE transient = %v, ENOENT transient = %v", isTransientStatError(stale), isTransientStatError(missing))
+	}
+}
+
+func TestFuturePolicy(t *testing.T) {
+	tests := []struct {
+		policy futurePolicy
+		want   []string
+	}{
+		{futureWarn, []string{"out", "out"}},
+		{futureEqual, []string{"out"}},
+		{futureTouch, []string{"out"}},
+	}
+
+	for _, test := range tests {
+		inDir(t, t.TempDir(), func() {
+			writeFile(t, "mkfile", "out: in\n\tcp in out; echo $target >> log\n")
+			writeFile(t, "in", "a")
+			future := time.Now().Add(time.Hour)
+			os.Chtimes("in", future, future)
+
+			for i := 0; i < 2; i++ {
+				opts := defaultBuildOptions()
+				opts.future = test.policy
+				runMk(t, nil, opts)
+			}
+			if got := readWords(t, "log"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("policy %s: executed %q, want %q", test.policy.String(), got, test.want)
+			}
+		})
+	}
+
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "out: in\n\tcp in out\n")
+		writeFile(t, "in", "a")
+		future := time.Now().Add(time.Hour)
+		os.Chtimes("in", future, future)
+		built := false
+		sandboxed(func() {
+			opts := defaultBuildOptions()
+			opts.future = futureError
+			runMk(t, nil, opts)
+			built = true
+		})
+		if built {
+			t.Errorf("policy error: built with a file from the future")
+		}
+	})
+}
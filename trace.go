@@ -0,0 +1,184 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Exporting builds as OpenTelemetry traces, over OTLP/HTTP in JSON: a span for
+// the build, with one for each recipe executed and URL fetched within it.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An OTLP attribute, with a string or integer value.
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{key, otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) otlpAttribute {
+	s := strconv.Itoa(value)
+	return otlpAttribute{key, otlpValue{IntValue: &s}}
+}
+
+type otlpStatus struct {
+	Code int `json:"code"` // 1 if ok, 2 if failed
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// Collects the spans of a build.
+type tracer struct {
+	mutex   sync.Mutex
+	traceID string
+	rootID  string
+	start   time.Time
+	spans   []otlpSpan
+}
+
+// A random hex ID of n bytes.
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func newTracer() *tracer {
+	return &tracer{traceID: randomID(16), rootID: randomID(8), start: time.Now()}
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func spanStatus(ok bool) otlpStatus {
+	if ok {
+		return otlpStatus{1}
+	}
+	return otlpStatus{2}
+}
+
+// Record a recipe executed, or URL fetched, for a target. The cache status is
+// "hit" for a fetched URL that hadn't changed, and "miss" otherwise.
+func (t *tracer) record(target string, r *rule, start time.Time, ok bool, cache string) {
+	if t == nil {
+		return
+	}
+	exitCode := 0
+	if !ok {
+		exitCode = 1
+	}
+	span := otlpSpan{
+		TraceID:      t.traceID,
+		SpanID:       randomID(8),
+		ParentSpanID: t.rootID,
+		Name:         target,
+		Kind:         1,
+		Start:        nanos(start),
+		End:          nanos(time.Now()),
+		Attributes: []otlpAttribute{
+			stringAttribute("mk.target", target),
+			stringAttribute("mk.rule", r.location()),
+			intAttribute("mk.exit_code", exitCode),
+			stringAttribute("mk.cache", cache),
+		},
+		Status: spanStatus(ok),
+	}
+	t.mutex.Lock()
+	t.spans = append(t.spans, span)
+	t.mutex.Unlock()
+}
+
+// The export request for the build, given whether it succeeded.
+func (t *tracer) request(targets []string, ok bool) map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	root := otlpSpan{
+		TraceID:    t.traceID,
+		SpanID:     t.rootID,
+		Name:       "mk " + strings.Join(targets, " "),
+		Kind:       1,
+		Start:      nanos(t.start),
+		End:        nanos(time.Now()),
+		Attributes: []otlpAttribute{stringAttribute("mk.targets", strings.Join(targets, " "))},
+		Status:     spanStatus(ok),
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{stringAttribute("service.name", "mk")},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "mk"},
+				"spans": append([]otlpSpan{root}, t.spans...),
+			}},
+		}},
+	}
+}
+
+// Send the build's spans to an OTLP/HTTP endpoint, such as
+// http://localhost:4318.
+func (t *tracer) export(endpoint string, targets []string, ok bool) error {
+	body, err := json.Marshal(t.request(targets, ok))
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
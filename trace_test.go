@@ -0,0 +1,87 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceExport(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	inDir(t, t.TempDir(), func() {
+		writeFile(t, "mkfile", "all:V: a\na:\n\ttouch a\n")
+		opts := defaultBuildOptions()
+		opts.executor = &stubExecutor{}
+		opts.tracer = newTracer()
+		runMk(t, nil, opts)
+		if err := opts.tracer.export(server.URL, []string{"all"}, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if path != "/v1/traces" {
+		t.Errorf("exported to %q, want /v1/traces", path)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("exported %+v, want a single scope", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	root, span := spans[0], spans[1]
+	if root.Name != "mk all" || root.ParentSpanID != "" {
+		t.Errorf("root span %+v", root)
+	}
+	if span.Name != "a" || span.ParentSpanID != root.SpanID || span.TraceID != root.TraceID {
+		t.Errorf("recipe span %+v isn't under the root span %+v", span, root)
+	}
+	attributes := make(map[string]string)
+	for _, a := range span.Attributes {
+		if a.Value.StringValue != nil {
+			attributes[a.Key] = *a.Value.StringValue
+		} else {
+			attributes[a.Key] = *a.Value.IntValue
+		}
+	}
+	want := map[string]string{"mk.target": "a", "mk.rule": "mkfile:2", "mk.exit_code": "0", "mk.cache": "miss"}
+	for k, v := range want {
+		if attributes[k] != v {
+			t.Errorf("attribute %s is %q, want %q", k, attributes[k], v)
+		}
+	}
+}
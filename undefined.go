@@ -0,0 +1,173 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Checks for references to variables that aren't set, which are usually
+// typos.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What to do about references to variables that aren't set.
+type undefinedPolicy int
+
+const (
+	undefinedIgnore undefinedPolicy = iota // leave them be
+	undefinedWarn                          // print a warning
+	undefinedError                         // fail
+)
+
+// How references to unset variables in rules and recipes are treated.
+var undefinedRefs = undefinedIgnore
+
+// How many references to unset variables have been warned about.
+var unsetRefs = 0
+
+// Variables set while executing recipes, which may be referred to before
+// they are.
+var recipeVars = map[string]bool{
+	"target":     true,
+	"prereq":     true,
+	"prereqfile": true,
+	"stem":       true,
+	"targetdir":  true,
+	"prereqdirs": true,
+	"mkfile":     true,
+	"pid":        true,
+}
+
+// Shell variables assigned within a recipe, by 'name=' or 'for name'.
+var shellAssignPattern = regexp.MustCompile(`(?:^|[^\w$])([A-Za-z_]\w*)=|\bfor\s+([A-Za-z_]\w*)\b`)
+
+// Shell builtins that assign the variables named among their arguments, up to
+// the end of the command, such as 'read name' and 'getopts ab: name', which
+// also assigns OPTARG and OPTIND.
+var shellBuiltinAssignPattern = regexp.MustCompile(`\b(read|local|export|readonly|declare|typeset|getopts|select)\b([^;&|\n]*)`)
+
+// Names of the variables referred to in input which aren't set in vars, in
+// the order they appear. If quotes is true, references in single quotes are
+// passed over, as they are when expanding words.
+func unsetVars(input string, vars map[string][]string, quotes bool) []string {
+	unset := make([]string, 0)
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+			continue
+		case '\'':
+			if quotes {
+				if j := strings.IndexByte(input[i+1:], '\''); j >= 0 {
+					i += j + 1
+				}
+			}
+			continue
+		case '$':
+		default:
+			continue
+		}
+
+		rest := input[i+1:]
+		var name string
+		if strings.HasPrefix(rest, "$") {
+			i++
+			continue
+		} else if strings.HasPrefix(rest, "{") {
+			j := strings.IndexAny(rest, ":}")
+			if j < 0 || strings.ContainsRune(rest[1:j], '$') {
+				continue
+			}
+			name = strings.TrimSpace(rest[1:j])
+		} else {
+			j := 0
+			for j < len(rest) {
+				c, w := utf8.DecodeRuneInString(rest[j:])
+				if !(unicode.IsLetter(c) || c == '_' || (j > 0 && unicode.IsDigit(c))) {
+					break
+				}
+				j += w
+			}
+			name = rest[:j]
+		}
+
+		if name == "" || !isValidVarName(name) {
+			continue
+		}
+		if _, ok := vars[name]; !ok {
+			unset = append(unset, name)
+		}
+	}
+	return unset
+}
+
+// True if name is one of the variables set while executing a recipe.
+func isRecipeVar(name string) bool {
+	if recipeVars[name] {
+		return true
+	}
+	digits := strings.TrimPrefix(name, "stem")
+	return digits != name && strings.Trim(digits, "0123456789") == ""
+}
+
+// Report references to unset variables in a rule's targets and
+// prerequisites, or if recipe is true, in its recipe, according to
+// undefinedRefs. The input begins on the given line.
+func (p *parser) checkUnset(input string, line int, recipe bool) {
+	if undefinedRefs == undefinedIgnore {
+		return
+	}
+
+	assigned := make(map[string]bool)
+	if recipe {
+		for _, m := range shellAssignPattern.FindAllStringSubmatch(input, -1) {
+			assigned[m[1]] = true
+			assigned[m[2]] = true
+		}
+		for _, m := range shellBuiltinAssignPattern.FindAllStringSubmatch(input, -1) {
+			if m[1] == "getopts" {
+				assigned["OPTARG"] = true
+				assigned["OPTIND"] = true
+			}
+			for _, word := range strings.Fields(m[2]) {
+				if k := strings.IndexByte(word, '='); k >= 0 {
+					word = word[:k]
+				}
+				assigned[word] = true
+			}
+		}
+	}
+
+	for k, text := range strings.Split(input, "\n") {
+		for _, name := range unsetVars(text, p.rules.vars, !recipe) {
+			if isRecipeVar(name) || assigned[name] {
+				continue
+			}
+			msg := fmt.Sprintf("%s:%d: $%s is not set", p.name, line+k, name)
+			if undefinedRefs == undefinedError {
+				mkError(msg)
+			}
+			mkPrintError("warning: " + msg)
+			unsetRefs++
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// The version of mk, and the builtin variables telling mkfiles which mk runs
+// them and on what.
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// The version of mk, set when building with -ldflags "-X main.mkVersion=...".
+// Otherwise it's taken from the module's build info, if there is any.
+var mkVersion = "devel"
+
+// The version of the running mk: the one set at link time, or the module's
+// version, or the revision it was built from.
+func version() string {
+	if mkVersion != "devel" {
+		return mkVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return mkVersion
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return mkVersion
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "+dirty"
+	}
+	return mkVersion + "-" + revision
+}
+
+// Set the variables describing the running mk and the host. Those of mk take
+// precedence over the environment, which may hold those of another mk running
+// this one, but not over assignments in the mkfile. The host's system and
+// architecture, like the home and temporary directories, are only set if the
+// environment doesn't set them, say to cross-compile, though Windows' own $OS
+// is replaced.
+func setBuiltinVars(env map[string][]string) {
+	env["MKVERSION"] = []string{version()}
+	env["MKOS"] = []string{runtime.GOOS}
+	env["MKARCH"] = []string{runtime.GOARCH}
+	if value, ok := env["OS"]; !ok || len(value) == 1 && value[0] == "Windows_NT" {
+		env["OS"] = []string{runtime.GOOS}
+	}
+	if _, ok := env["ARCH"]; !ok {
+		env["ARCH"] = []string{runtime.GOARCH}
+	}
+	env["NPROC"] = []string{strconv.Itoa(runtime.NumCPU())}
+	if _, ok := env["HOME"]; !ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			env["HOME"] = []string{home}
+		}
+	}
+	if _, ok := env["TMPDIR"]; !ok {
+		env["TMPDIR"] = []string{os.TempDir()}
+	}
+}
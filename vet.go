@@ -0,0 +1,138 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+// Checks of mkfiles for common mistakes, run by 'mk vet'.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Recipe variables whose values are lists, which quoting joins into a single
+// word.
+var listRecipeVars = []string{"prereq", "prereqdirs"}
+
+// Check a rule's recipe for common shell pitfalls, returning a message for
+// each found, prefixed with where it is.
+func lintRecipe(r *rule) []string {
+	found := make([]string, 0)
+	if r.recipe == "" || strings.HasPrefix(r.recipe, "#!") || !isShRecipe(r) {
+		return found
+	}
+	report := func(k int, what string) {
+		found = append(found, fmt.Sprintf("%s:%d: %s", r.file, r.line+1+k, what))
+	}
+
+	lines := strings.Split(strings.TrimRight(r.recipe, "\n"), "\n")
+	last := len(lines) - 1
+	for last > 0 && strings.TrimSpace(lines[last]) == "" {
+		last--
+	}
+	for k, line := range lines {
+		for _, name := range quotedListVars(line) {
+			report(k, fmt.Sprintf("\"$%s\" joins its words into one; unquoted, each is quoted for the shell on its own", name))
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "cd" {
+			continue
+		}
+		if r.attributes.lines {
+			if !strings.ContainsAny(line, ";&|") {
+				report(k, "cd has no effect on the lines after it, which each run in a shell of their own")
+			}
+		} else if k < last {
+			report(k, "cd changes the directory for the rest of the recipe; run it in a subshell, as in (cd dir && ...)")
+		}
+	}
+	return found
+}
+
+// True if the rule's recipe is run by sh or a shell like it.
+func isShRecipe(r *rule) bool {
+	if len(r.shell) == 0 {
+		return true
+	}
+	switch filepath.Base(r.shell[0]) {
+	case "sh", "bash", "dash", "ksh", "zsh", "mksh", "ash":
+		return true
+	}
+	return false
+}
+
+// Names of the list recipe variables referred to within double quotes on the
+// line.
+func quotedListVars(line string) []string {
+	names := make([]string, 0)
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && quote != '\'':
+			i++
+		case (c == '"' || c == '\'') && (quote == 0 || quote == c):
+			if quote == 0 {
+				quote = c
+			} else {
+				quote = 0
+			}
+		case c == '$' && quote == '"':
+			for _, name := range listRecipeVars {
+				rest := line[i+1:]
+				if strings.HasPrefix(rest, "{"+name+"}") ||
+					strings.HasPrefix(rest, name) && !isNameByte(rest, len(name)) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// True if s has a byte at i that may continue a variable name.
+func isNameByte(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	c := s[i]
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func vetCommand(args []string) bool {
+	flags := flag.NewFlagSet("mk vet", flag.ExitOnError)
+	mkfile := mkfileFlags(flags)
+	flags.Parse(args)
+
+	// references to unset variables are warned about while parsing
+	undefinedRefs = undefinedWarn
+	rs, _ := mkfile.read(flags.Args())
+	found := unsetRefs
+	for i := range rs.rules {
+		for _, msg := range lintRecipe(&rs.rules[i]) {
+			mkPrintError("warning: " + msg)
+			found++
+		}
+	}
+	if found > 0 {
+		mkExit(1)
+	}
+	return true
+}
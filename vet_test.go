@@ -0,0 +1,47 @@
+/*
+	Copyright (c) 2022 Tomas Glozar
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintRecipe(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"a: b\n\tcc -o $target $prereq\n", []string{}},
+		{"a: b\n\tcc -o \"$target\" \"$prereq\"\n", []string{`mkfile:2: "$prereq" joins its words into one; unquoted, each is quoted for the shell on its own`}},
+		{"a: b\n\techo '\"$prereq\"' \\\"$prereq\\\" \"${prereqdirs}\" \"$prereqx\"\n", []string{`mkfile:2: "$prereqdirs" joins its words into one; unquoted, each is quoted for the shell on its own`}},
+		{"a:\n\tcd sub\n\tmake\n", []string{"mkfile:2: cd changes the directory for the rest of the recipe; run it in a subshell, as in (cd dir && ...)"}},
+		{"a:\n\t(cd sub && make)\n\tcd sub\n\n", []string{}},
+		{"a:L:\n\tcd sub\n\tcd sub && make\n", []string{"mkfile:2: cd has no effect on the lines after it, which each run in a shell of their own"}},
+		{"a:Spython3:\n\tprint(\"$prereq\")\n", []string{}},
+		{"a:\n\t#!/bin/sh\n\tcd sub\n\tmake\n", []string{}},
+	}
+
+	for _, test := range tests {
+		rs := parse(test.input, "mkfile", "/mkfile", make(map[string][]string))
+		if got := lintRecipe(&rs.rules[0]); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lintRecipe(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}